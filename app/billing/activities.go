@@ -4,45 +4,84 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"math/rand"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/temporalio/reference-app-orders-go/app/fraud"
 	"go.temporal.io/sdk/activity"
+	"go.temporal.io/sdk/temporal"
 )
 
 // Activities implements the billing package's Activities.
 // Any state shared by the worker among the activities is stored here.
 type Activities struct {
+	BillingURL    string
 	FraudCheckURL string
 }
 
 var a Activities
 
+const (
+	// InvalidInputErrorType is the error type for activity input which fails validation.
+	// Errors of this type are not retried.
+	InvalidInputErrorType = "InvalidInput"
+
+	// FraudServiceUnavailableErrorType is the error type returned when the fraud service is
+	// temporarily unavailable, for instance due to maintenance. Errors of this type are retried.
+	FraudServiceUnavailableErrorType = "FraudServiceUnavailable"
+
+	// FraudCheckRejectedErrorType is the error type returned when the fraud service rejects
+	// a check request as invalid. Errors of this type are not retried.
+	FraudCheckRejectedErrorType = "FraudCheckRejected"
+
+	// PaymentMethodNotFoundErrorType is the error type returned when a Charge references
+	// a payment method the customer does not have. Errors of this type are not retried.
+	PaymentMethodNotFoundErrorType = "PaymentMethodNotFound"
+)
+
 // GenerateInvoice activity creates an invoice for a fulfillment.
 func (a *Activities) GenerateInvoice(ctx context.Context, input *GenerateInvoiceInput) (*GenerateInvoiceResult, error) {
 	var result GenerateInvoiceResult
 
 	if input.CustomerID == "" {
-		return nil, fmt.Errorf("CustomerID is required")
+		return nil, temporal.NewNonRetryableApplicationError("CustomerID is required", InvalidInputErrorType, nil)
 	}
 	if input.Reference == "" {
-		return nil, fmt.Errorf("OrderReference is required")
+		return nil, temporal.NewNonRetryableApplicationError("OrderReference is required", InvalidInputErrorType, nil)
 	}
 	if len(input.Items) == 0 {
-		return nil, fmt.Errorf("invoice must have items")
+		return nil, temporal.NewNonRetryableApplicationError("invoice must have items", InvalidInputErrorType, nil)
 	}
 
 	result.InvoiceReference = input.Reference
 
 	for _, item := range input.Items {
-		cost, tax := calculateCosts(item)
+		unitPrice, cost, tax := calculateCosts(item)
+		shipping := calculateShippingCost(item)
+
+		result.LineItems = append(result.LineItems, InvoiceLineItem{
+			SKU:       item.SKU,
+			Quantity:  item.Quantity,
+			UnitPrice: unitPrice,
+			SubTotal:  cost,
+			Tax:       tax,
+			Shipping:  shipping,
+			Total:     cost + tax + shipping,
+		})
+
 		result.SubTotal += cost
 		result.Tax += tax
-		result.Shipping += calculateShippingCost(item)
-		result.Total += result.SubTotal + result.Tax + result.Shipping
+		result.Shipping += shipping
+	}
+	result.Total = result.SubTotal + result.Tax + result.Shipping
+
+	result.TaxBreakdown = []TaxLine{
+		{Name: "VAT", Rate: taxRate, Amount: result.Tax},
 	}
 
 	activity.GetLogger(ctx).Info(
@@ -55,13 +94,16 @@ func (a *Activities) GenerateInvoice(ctx context.Context, input *GenerateInvoice
 	return &result, nil
 }
 
-// calculateCosts calculates the cost and tax for an item.
-func calculateCosts(item Item) (cost int32, tax int32) {
+// taxRate is the percentage of tax applied to item costs.
+const taxRate = 20
+
+// calculateCosts calculates the unit price, cost and tax for an item.
+func calculateCosts(item Item) (unitPrice int32, cost int32, tax int32) {
 	// This is just a simulation, so make up a cost
 	// Normally this would be looked up on the SKU
-	costPerUnit := 3500 + rand.Int31n(8500)
-	// Return tax at 20%
-	return costPerUnit * int32(item.Quantity), costPerUnit * int32(item.Quantity) / 5
+	unitPrice = 3500 + rand.Int31n(8500)
+	cost = unitPrice * int32(item.Quantity)
+	return unitPrice, cost, cost * taxRate / 100
 }
 
 // calculateShippingCost calculates the shipping cost for an item.
@@ -72,14 +114,52 @@ func calculateShippingCost(item Item) int32 {
 	return costPerUnit * int32(item.Quantity)
 }
 
-func (a *Activities) fraudCheck(ctx context.Context, input *ChargeCustomerInput) (*fraud.FraudCheckResult, error) {
+// RecordInvoice stores an Invoice via the Billing API.
+func (a *Activities) RecordInvoice(ctx context.Context, invoice *Invoice) error {
+	jsonInput, err := json.Marshal(invoice)
+	if err != nil {
+		return fmt.Errorf("unable to encode invoice: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.BillingURL+"/invoices", bytes.NewReader(jsonInput))
+	if err != nil {
+		return fmt.Errorf("unable to build request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		body, _ := io.ReadAll(res.Body)
+		return fmt.Errorf("%s: %s", http.StatusText(res.StatusCode), body)
+	}
+
+	return nil
+}
+
+// CheckFraud activity checks a charge with the fraud service.
+// If the charge is held for review the decision will be sent to the Charge's review URL.
+func (a *Activities) CheckFraud(ctx context.Context, input *CheckFraudInput) (*CheckFraudResult, error) {
 	if a.FraudCheckURL == "" {
-		return &fraud.FraudCheckResult{Declined: false}, nil
+		return &CheckFraudResult{Declined: false, Decision: fraud.DecisionApprove}, nil
 	}
 
 	checkInput := fraud.FraudCheckInput{
 		CustomerID: input.CustomerID,
 		Charge:     input.Charge,
+		ChargeID:   input.ChargeID,
+		Reference:  input.Reference,
+	}
+	if a.BillingURL != "" {
+		checkInput.CallbackURL = a.BillingURL + ReviewURL(input.ChargeID)
+	}
+	for _, item := range input.Items {
+		checkInput.Items = append(checkInput.Items, fraud.Item{SKU: item.SKU, Quantity: item.Quantity})
 	}
 	jsonInput, err := json.Marshal(checkInput)
 	if err != nil {
@@ -102,34 +182,227 @@ func (a *Activities) fraudCheck(ctx context.Context, input *ChargeCustomerInput)
 
 	if res.StatusCode < 200 || res.StatusCode >= 300 {
 		body, _ := io.ReadAll(res.Body)
-		return nil, fmt.Errorf("fraud check request failed: %s: %s", http.StatusText(res.StatusCode), body)
+		message := fmt.Sprintf("fraud check request failed: %s: %s", http.StatusText(res.StatusCode), body)
+
+		switch {
+		case res.StatusCode == http.StatusServiceUnavailable:
+			// The fraud service is in maintenance mode, retry with backoff or when it says it will be available.
+			return nil, temporal.NewApplicationErrorWithOptions(message, FraudServiceUnavailableErrorType, temporal.ApplicationErrorOptions{
+				NextRetryDelay: retryAfter(res.Header.Get("Retry-After"), time.Now()),
+			})
+		case res.StatusCode >= 400 && res.StatusCode < 500:
+			// The request will not succeed if repeated.
+			return nil, temporal.NewNonRetryableApplicationError(message, FraudCheckRejectedErrorType, nil)
+		default:
+			return nil, errors.New(message)
+		}
 	}
 
-	var checkResult fraud.FraudCheckResult
+	var checkResult CheckFraudResult
 
 	err = json.NewDecoder(res.Body).Decode(&checkResult)
-	return &checkResult, err
+	if err != nil {
+		return nil, err
+	}
+
+	activity.GetLogger(ctx).Info(
+		"Fraud check",
+		"Customer", input.CustomerID,
+		"Amount", input.Charge,
+		"Reference", input.Reference,
+		"Decision", checkResult.Decision,
+		"Rule", checkResult.Rule,
+		"RiskScore", checkResult.RiskScore,
+	)
+
+	return &checkResult, nil
+}
+
+// retryAfter parses a Retry-After header, given in either seconds or as an HTTP date.
+// It returns zero if the header is missing or invalid so that the retry policy's backoff is used.
+func retryAfter(header string, now time.Time) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(header); err == nil {
+		return max(0, time.Duration(seconds)*time.Second)
+	}
+	if t, err := http.ParseTime(header); err == nil {
+		return max(0, t.Sub(now))
+	}
+	return 0
+}
+
+// billingRequest sends a request to the Billing API, decoding the response into result if it is not nil.
+// Failed requests return the ErrorResponse sent by the API.
+func (a *Activities) billingRequest(ctx context.Context, method string, path string, body any, result any) error {
+	var reader io.Reader
+	if body != nil {
+		jsonInput, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("unable to encode request: %w", err)
+		}
+		reader = bytes.NewReader(jsonInput)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, a.BillingURL+path, reader)
+	if err != nil {
+		return fmt.Errorf("unable to build request: %w", err)
+	}
+
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		var e ErrorResponse
+		if err := json.NewDecoder(res.Body).Decode(&e); err != nil || e.Code == "" {
+			return fmt.Errorf("%s: %s", http.StatusText(res.StatusCode), e.Message)
+		}
+		return &e
+	}
+
+	if result == nil {
+		return nil
+	}
+
+	return json.NewDecoder(res.Body).Decode(result)
+}
+
+// paymentMethod returns the payment method to charge once store credit has been applied.
+// If the customer has no stored payment methods a card is assumed.
+func (a *Activities) paymentMethod(ctx context.Context, input *ChargeCustomerInput) (*PaymentMethod, error) {
+	if a.BillingURL == "" {
+		return &PaymentMethod{ID: input.PaymentMethodID, Type: PaymentMethodTypeCard}, nil
+	}
+
+	if input.PaymentMethodID != "" {
+		var method PaymentMethod
+
+		err := a.billingRequest(ctx, http.MethodGet, PaymentMethodURL(input.CustomerID, input.PaymentMethodID), nil, &method)
+		if err != nil {
+			var e *ErrorResponse
+			if errors.As(err, &e) && e.Code == ErrorCodeNotFound {
+				return nil, temporal.NewNonRetryableApplicationError(
+					fmt.Sprintf("payment method %s not found", input.PaymentMethodID), PaymentMethodNotFoundErrorType, nil,
+				)
+			}
+			return nil, err
+		}
+		if method.Type == PaymentMethodTypeCredit {
+			return nil, temporal.NewNonRetryableApplicationError(
+				"store credit is always applied first and cannot be selected as the payment method", InvalidInputErrorType, nil,
+			)
+		}
+
+		return &method, nil
+	}
+
+	var methods []PaymentMethod
+
+	err := a.billingRequest(ctx, http.MethodGet, PaymentMethodsURL(input.CustomerID), nil, &methods)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, m := range methods {
+		if m.IsDefault {
+			return &m, nil
+		}
+	}
+
+	return &PaymentMethod{Type: PaymentMethodTypeCard}, nil
+}
+
+// applyStoreCredit debits as much of the charge as possible from the customer's store credit.
+// The debit is keyed by the charge reference so retries do not debit the credit again.
+func (a *Activities) applyStoreCredit(ctx context.Context, input *ChargeCustomerInput) (int32, error) {
+	if a.BillingURL == "" || input.Charge <= 0 {
+		return 0, nil
+	}
+
+	var result CreditDebitResult
+
+	err := a.billingRequest(ctx, http.MethodPost, CreditDebitsURL(input.CustomerID),
+		CreditDebitInput{Reference: input.Reference, Amount: input.Charge},
+		&result,
+	)
+
+	return result.Amount, err
 }
 
-// ChargeCustomer activity charges a customer for a fulfillment.
+// ChargeCustomer activity charges a customer for a fulfillment which has passed the fraud check.
+// Store credit is used first, with any remainder charged to the customer's payment method.
 func (a *Activities) ChargeCustomer(ctx context.Context, input *ChargeCustomerInput) (*ChargeCustomerResult, error) {
 	var result ChargeCustomerResult
 
-	checkResult, err := a.fraudCheck(ctx, input)
+	method, err := a.paymentMethod(ctx, input)
 	if err != nil {
 		return nil, err
 	}
 
-	result.Success = !checkResult.Declined
+	result.Success = true
 	result.AuthCode = "1234"
 
+	credit, err := a.applyStoreCredit(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+	if credit > 0 {
+		result.Payments = append(result.Payments, Payment{Type: PaymentMethodTypeCredit, Amount: credit})
+	}
+
+	if remaining := input.Charge - credit; remaining > 0 {
+		result.Payments = append(result.Payments, Payment{
+			PaymentMethodID: method.ID,
+			Type:            method.Type,
+			Amount:          remaining,
+			AuthCode:        result.AuthCode,
+		})
+	}
+
 	activity.GetLogger(ctx).Info(
 		"Charge",
 		"Customer", input.CustomerID,
 		"Amount", input.Charge,
 		"Reference", input.Reference,
 		"Success", result.Success,
+		"Payments", result.Payments,
 	)
 
 	return &result, nil
 }
+
+// NotifyChargeCallback sends the status of a finished Charge to a callback URL.
+func (a *Activities) NotifyChargeCallback(ctx context.Context, input *ChargeCallbackInput) error {
+	jsonInput, err := json.Marshal(input.Status)
+	if err != nil {
+		return fmt.Errorf("unable to encode status: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, input.URL, bytes.NewReader(jsonInput))
+	if err != nil {
+		return fmt.Errorf("unable to build request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		body, _ := io.ReadAll(res.Body)
+		return fmt.Errorf("%s: %s", http.StatusText(res.StatusCode), body)
+	}
+
+	return nil
+}
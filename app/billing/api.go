@@ -3,18 +3,34 @@ package billing
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
+	"net/url"
+	"strings"
+	"time"
 
 	"github.com/google/uuid"
+	"github.com/temporalio/reference-app-orders-go/app/db"
+	"github.com/temporalio/reference-app-orders-go/app/fraud"
 	"go.temporal.io/api/enums/v1"
+	"go.temporal.io/api/serviceerror"
 	"go.temporal.io/sdk/client"
 )
 
 // TaskQueue is the default task queue for the Billing system.
 const TaskQueue = "billing"
 
+// StatusQuery is the name of the query to use to fetch a Charge's status.
+const StatusQuery = "status"
+
+// ReviewSignal is the name of the signal used to deliver a fraud review decision to a Charge.
+const ReviewSignal = "review"
+
+// ReviewDecision is the decision made by a fraud analyst on a Charge held for review.
+type ReviewDecision = fraud.ReviewDecision
+
 // Item represents an item being ordered.
 type Item struct {
 	SKU      string `json:"sku"`
@@ -27,8 +43,43 @@ type ChargeInput struct {
 	Reference      string `json:"orderReference"`
 	Items          []Item `json:"items"`
 	IdempotencyKey string `json:"idempotencyKey,omitempty"`
+
+	// PaymentMethodID is the customer's stored payment method to charge.
+	// If not set, the customer's default payment method is used.
+	PaymentMethodID string `json:"paymentMethodId,omitempty"`
+
+	// CallbackURL, if set, is sent the ChargeStatus once the charge has finished.
+	CallbackURL string `json:"callbackUrl,omitempty"`
+}
+
+// ChargeAccepted is the response for a Charge request accepted for processing.
+type ChargeAccepted struct {
+	ID string `json:"id"`
+}
+
+// ChargeStatus holds the status of a Charge workflow.
+type ChargeStatus struct {
+	ID     string        `json:"id"`
+	Status string        `json:"status"`
+	Result *ChargeResult `json:"result,omitempty"`
+	Error  string        `json:"error,omitempty"`
+
+	// ReviewID is set while the Charge is held for fraud review.
+	ReviewID string `json:"reviewId,omitempty"`
 }
 
+const (
+	// ChargeStatusPending is the status of a Charge which is still being processed.
+	ChargeStatusPending = "pending"
+
+	// ChargeStatusCompleted is the status of a Charge which has finished processing.
+	// The Result shows whether the payment was successful.
+	ChargeStatusCompleted = "completed"
+
+	// ChargeStatusFailed is the status of a Charge which could not be processed.
+	ChargeStatusFailed = "failed"
+)
+
 // ChargeResult is the result for the Charge workflow.
 type ChargeResult struct {
 	InvoiceReference string `json:"invoiceReference"`
@@ -39,6 +90,107 @@ type ChargeResult struct {
 
 	Success  bool   `json:"success"`
 	AuthCode string `json:"authCode"`
+
+	// Outcome distinguishes a declined payment from one which could not be processed.
+	Outcome      string `json:"outcome"`
+	PaymentError string `json:"paymentError,omitempty"`
+	FraudRule    string `json:"fraudRule,omitempty"`
+
+	// Review is set if the Charge was held for fraud review.
+	Review *ReviewResult `json:"review,omitempty"`
+
+	// InvoiceURL is the location of the invoice document, relative to the Billing API.
+	InvoiceURL string `json:"invoiceUrl,omitempty"`
+
+	// Payments lists how the total was paid, store credit first, then the payment method.
+	Payments []Payment `json:"payments,omitempty"`
+}
+
+// ReviewResult is the outcome of a fraud review.
+// If no decision was made in time the review's default decision is used and TimedOut is set.
+type ReviewResult struct {
+	ID       string `json:"id"`
+	Decision string `json:"decision"`
+	TimedOut bool   `json:"timedOut,omitempty"`
+}
+
+// Payment is an amount paid using a single payment method.
+// Store credit payments do not have a PaymentMethodID.
+type Payment struct {
+	PaymentMethodID string `json:"paymentMethodId,omitempty"`
+	Type            string `json:"type"`
+	Amount          int32  `json:"amount"`
+	AuthCode        string `json:"authCode,omitempty"`
+}
+
+const (
+	// ChargeOutcomeApproved is the outcome of a successful payment.
+	ChargeOutcomeApproved = "approved"
+
+	// ChargeOutcomeDeclined is the outcome of a payment declined by the fraud check or a fraud review.
+	ChargeOutcomeDeclined = "declined"
+
+	// ChargeOutcomeError is the outcome of a payment which could not be processed,
+	// for instance because the fraud service remained unavailable.
+	ChargeOutcomeError = "error"
+)
+
+// InvoiceLineItem is a line on an Invoice.
+type InvoiceLineItem struct {
+	SKU       string `json:"sku"`
+	Quantity  int32  `json:"quantity"`
+	UnitPrice int32  `json:"unitPrice"`
+	SubTotal  int32  `json:"subTotal"`
+	Tax       int32  `json:"tax"`
+	Shipping  int32  `json:"shipping"`
+	Total     int32  `json:"total"`
+}
+
+// TaxLine is an entry in the tax breakdown of an Invoice.
+// Rate is a percentage.
+type TaxLine struct {
+	Name   string `json:"name"`
+	Rate   int32  `json:"rate"`
+	Amount int32  `json:"amount"`
+}
+
+// Invoice is the invoice document for a fulfillment.
+type Invoice struct {
+	Reference  string `json:"reference"`
+	CustomerID string `json:"customerId"`
+
+	LineItems    []InvoiceLineItem `json:"lineItems"`
+	TaxBreakdown []TaxLine         `json:"taxBreakdown"`
+
+	SubTotal int32 `json:"subTotal"`
+	Shipping int32 `json:"shipping"`
+	Tax      int32 `json:"tax"`
+	Total    int32 `json:"total"`
+
+	PaymentStatus string    `json:"paymentStatus"`
+	AuthCode      string    `json:"authCode,omitempty"`
+	Payments      []Payment `json:"payments,omitempty"`
+
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+const (
+	// InvoiceStatusPending is the payment status of an Invoice which has not yet been charged.
+	InvoiceStatusPending = "pending"
+
+	// InvoiceStatusPaid is the payment status of an Invoice which has been charged successfully.
+	InvoiceStatusPaid = "paid"
+
+	// InvoiceStatusDeclined is the payment status of an Invoice whose charge was declined.
+	InvoiceStatusDeclined = "declined"
+
+	// InvoiceStatusError is the payment status of an Invoice whose charge could not be processed.
+	InvoiceStatusError = "error"
+)
+
+// InvoiceURL returns the location of an Invoice, relative to the Billing API.
+func InvoiceURL(reference string) string {
+	return "/invoices/" + url.PathEscape(reference)
 }
 
 // GenerateInvoiceInput is the input for the GenerateInvoice activity.
@@ -55,32 +207,96 @@ type GenerateInvoiceResult struct {
 	Shipping         int32  `json:"shipping"`
 	Tax              int32  `json:"tax"`
 	Total            int32  `json:"total"`
+
+	LineItems    []InvoiceLineItem `json:"lineItems"`
+	TaxBreakdown []TaxLine         `json:"taxBreakdown"`
 }
 
-// ChargeCustomerInput is the input for the ChargeCustomer activity.
-type ChargeCustomerInput struct {
+// CheckFraudInput is the input for the CheckFraud activity.
+type CheckFraudInput struct {
 	CustomerID string `json:"customerId"`
+	ChargeID   string `json:"chargeId"`
 	Reference  string `json:"reference"`
 	Charge     int32  `json:"charge"`
+	Items      []Item `json:"items,omitempty"`
+}
+
+// CheckFraudResult is the result for the CheckFraud activity.
+type CheckFraudResult = fraud.FraudCheckResult
+
+// ChargeCustomerInput is the input for the ChargeCustomer activity.
+type ChargeCustomerInput struct {
+	CustomerID      string `json:"customerId"`
+	PaymentMethodID string `json:"paymentMethodId,omitempty"`
+	Reference       string `json:"reference"`
+	Charge          int32  `json:"charge"`
+}
+
+// ChargeCallbackInput is the input for the NotifyChargeCallback activity.
+type ChargeCallbackInput struct {
+	URL    string       `json:"url"`
+	Status ChargeStatus `json:"status"`
 }
 
 // ChargeCustomerResult is the result for the GenerateInvoice activity.
 type ChargeCustomerResult struct {
-	Success  bool   `json:"success"`
-	AuthCode string `json:"authCode"`
+	Success  bool      `json:"success"`
+	AuthCode string    `json:"authCode"`
+	Payments []Payment `json:"payments,omitempty"`
 }
 
+// ErrorResponse is the body returned by the Billing API when a request fails.
+type ErrorResponse struct {
+	Code     string `json:"code"`
+	Message  string `json:"message"`
+	ChargeID string `json:"chargeId,omitempty"`
+}
+
+func (e *ErrorResponse) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+const (
+	// ErrorCodeInvalidInput indicates the request was malformed or incomplete.
+	ErrorCodeInvalidInput = "invalid_input"
+
+	// ErrorCodeNotFound indicates the requested resource does not exist.
+	ErrorCodeNotFound = "not_found"
+
+	// ErrorCodeConflict indicates the request conflicts with the current state of a resource.
+	ErrorCodeConflict = "conflict"
+
+	// ErrorCodeChargeFailed indicates the Charge workflow failed to process the charge.
+	ErrorCodeChargeFailed = "charge_failed"
+
+	// ErrorCodeInternal indicates an unexpected failure in the Billing system.
+	ErrorCodeInternal = "internal_error"
+)
+
 type handlers struct {
 	temporal client.Client
+	db       db.DB
 	logger   *slog.Logger
 }
 
 // Router implements the http.Handler interface for the Billing API
-func Router(c client.Client, logger *slog.Logger) http.Handler {
+func Router(c client.Client, db db.DB, logger *slog.Logger) http.Handler {
 	r := http.NewServeMux()
-	h := handlers{temporal: c, logger: logger}
+	h := handlers{temporal: c, db: db, logger: logger}
 
 	r.HandleFunc("POST /charge", h.handleCharge)
+	r.HandleFunc("GET /charges/{id}", h.handleGetCharge)
+	r.HandleFunc("POST /charges/{id}/review", h.handleReviewDecision)
+	r.HandleFunc("POST /invoices", h.handleSaveInvoice)
+	r.HandleFunc("GET /invoices/{reference}", h.handleGetInvoice)
+	r.HandleFunc("POST /invoices/{reference}/refunds", h.handleCreateRefund)
+	r.HandleFunc("GET /invoices/{reference}/refunds", h.handleListRefunds)
+	r.HandleFunc("GET /customers/{customerId}/payment-methods", h.handleListPaymentMethods)
+	r.HandleFunc("POST /customers/{customerId}/payment-methods", h.handleCreatePaymentMethod)
+	r.HandleFunc("GET /customers/{customerId}/payment-methods/{id}", h.handleGetPaymentMethod)
+	r.HandleFunc("PUT /customers/{customerId}/payment-methods/{id}", h.handleUpdatePaymentMethod)
+	r.HandleFunc("DELETE /customers/{customerId}/payment-methods/{id}", h.handleDeletePaymentMethod)
+	r.HandleFunc("POST /customers/{customerId}/credit/debits", h.handleDebitCredit)
 
 	return r
 }
@@ -96,7 +312,25 @@ func ChargeWorkflowID(input ChargeInput) string {
 		key = uuid.NewString()
 	}
 
-	return fmt.Sprintf("Charge:%s", key)
+	return chargeWorkflowIDFromChargeID(key)
+}
+
+func chargeWorkflowIDFromChargeID(id string) string {
+	return fmt.Sprintf("Charge:%s", id)
+}
+
+// ChargeIDFromWorkflowID returns the ID for a Charge from a WorkflowID.
+func ChargeIDFromWorkflowID(id string) string {
+	return strings.TrimPrefix(id, "Charge:")
+}
+
+func (h *handlers) writeError(w http.ResponseWriter, status int, e ErrorResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(e); err != nil {
+		h.logger.Error("Failed to encode error response", "error", err)
+	}
 }
 
 func (h *handlers) handleCharge(w http.ResponseWriter, r *http.Request) {
@@ -105,39 +339,220 @@ func (h *handlers) handleCharge(w http.ResponseWriter, r *http.Request) {
 	err := json.NewDecoder(r.Body).Decode(&input)
 	if err != nil {
 		h.logger.Error("Failed to decode charge input", "error", err)
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		h.writeError(w, http.StatusBadRequest, ErrorResponse{Code: ErrorCodeInvalidInput, Message: err.Error()})
 		return
 	}
 
+	workflowID := ChargeWorkflowID(input)
+	id := ChargeIDFromWorkflowID(workflowID)
+
 	// Start the Charge workflow.
-	// If the workflow is already running, or is finished but still within retention period, this will return the existing workflow.
+	// If the workflow is already running this will return the existing workflow.
 	// If an idempotency key was provided, this provides idempotency guarantees for the Charge operation.
-	wf, err := h.temporal.ExecuteWorkflow(context.Background(),
+	_, err = h.temporal.ExecuteWorkflow(context.Background(),
 		client.StartWorkflowOptions{
 			TaskQueue:             TaskQueue,
-			ID:                    ChargeWorkflowID(input),
+			ID:                    workflowID,
 			WorkflowIDReusePolicy: enums.WORKFLOW_ID_REUSE_POLICY_REJECT_DUPLICATE,
 		},
 		Charge,
 		&input,
 	)
 	if err != nil {
+		var alreadyStarted *serviceerror.WorkflowExecutionAlreadyStarted
+		if errors.As(err, &alreadyStarted) {
+			// The Charge has already been submitted. Attach to it and return its outcome,
+			// or accept it again if it is still pending.
+			w.Header().Set("Location", "/charges/"+url.PathEscape(id))
+			h.writeChargeStatus(w, r, id, http.StatusAccepted)
+			return
+		}
+
 		h.logger.Error("Failed to start charge workflow", "error", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		h.writeError(w, http.StatusInternalServerError, ErrorResponse{Code: ErrorCodeInternal, Message: err.Error()})
 		return
 	}
 
-	var result ChargeResult
-	err = wf.Get(r.Context(), &result)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/charges/"+url.PathEscape(id))
+	w.WriteHeader(http.StatusAccepted)
+
+	err = json.NewEncoder(w).Encode(ChargeAccepted{ID: id})
 	if err != nil {
-		h.logger.Error("Failed to get charge result", "error", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		h.logger.Error("Failed to encode charge response", "error", err)
+	}
+}
+
+func (h *handlers) handleGetCharge(w http.ResponseWriter, r *http.Request) {
+	h.writeChargeStatus(w, r, r.PathValue("id"), http.StatusOK)
+}
+
+// writeChargeStatus responds with the status of a Charge.
+// A Charge which failed is reported with a charge_failed error, and one which is still pending with pendingCode.
+func (h *handlers) writeChargeStatus(w http.ResponseWriter, r *http.Request, id string, pendingCode int) {
+	var status ChargeStatus
+
+	q, err := h.temporal.QueryWorkflow(r.Context(),
+		chargeWorkflowIDFromChargeID(id), "",
+		StatusQuery,
+	)
+	if err != nil {
+		if _, ok := err.(*serviceerror.NotFound); ok {
+			h.writeError(w, http.StatusNotFound, ErrorResponse{Code: ErrorCodeNotFound, Message: "Charge not found", ChargeID: id})
+		} else {
+			h.logger.Error("Failed to query charge workflow", "error", err)
+			h.writeError(w, http.StatusInternalServerError, ErrorResponse{Code: ErrorCodeInternal, Message: err.Error(), ChargeID: id})
+		}
+		return
+	}
+
+	if err := q.Get(&status); err != nil {
+		h.logger.Error("Failed to get charge query result", "error", err)
+		h.writeError(w, http.StatusInternalServerError, ErrorResponse{Code: ErrorCodeInternal, Message: err.Error(), ChargeID: id})
+		return
+	}
+
+	if status.Status == ChargeStatusFailed {
+		h.writeError(w, http.StatusUnprocessableEntity, ErrorResponse{Code: ErrorCodeChargeFailed, Message: status.Error, ChargeID: id})
+		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	err = json.NewEncoder(w).Encode(result)
+	if status.Status == ChargeStatusPending {
+		w.WriteHeader(pendingCode)
+	}
+
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		h.logger.Error("Failed to encode charge status", "error", err)
+	}
+}
+
+// ReviewURL returns the location a Charge's fraud review decision is sent to, relative to the Billing API.
+func ReviewURL(chargeID string) string {
+	return "/charges/" + url.PathEscape(chargeID) + "/review"
+}
+
+func (h *handlers) handleReviewDecision(w http.ResponseWriter, r *http.Request) {
+	var decision ReviewDecision
+
+	id := r.PathValue("id")
+
+	err := json.NewDecoder(r.Body).Decode(&decision)
+	if err != nil {
+		h.logger.Error("Failed to decode review decision", "error", err)
+		h.writeError(w, http.StatusBadRequest, ErrorResponse{Code: ErrorCodeInvalidInput, Message: err.Error(), ChargeID: id})
+		return
+	}
+
+	if decision.Decision != fraud.ReviewApprove && decision.Decision != fraud.ReviewReject {
+		h.writeError(w, http.StatusBadRequest, ErrorResponse{Code: ErrorCodeInvalidInput, Message: "decision must be approve or reject", ChargeID: id})
+		return
+	}
+
+	err = h.temporal.SignalWorkflow(r.Context(),
+		chargeWorkflowIDFromChargeID(id), "",
+		ReviewSignal,
+		decision,
+	)
+	if err != nil {
+		if _, ok := err.(*serviceerror.NotFound); ok {
+			h.writeError(w, http.StatusNotFound, ErrorResponse{Code: ErrorCodeNotFound, Message: "Charge not found", ChargeID: id})
+		} else {
+			h.logger.Error("Failed to signal charge workflow", "error", err)
+			h.writeError(w, http.StatusInternalServerError, ErrorResponse{Code: ErrorCodeInternal, Message: err.Error(), ChargeID: id})
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *handlers) handleSaveInvoice(w http.ResponseWriter, r *http.Request) {
+	var invoice Invoice
+
+	err := json.NewDecoder(r.Body).Decode(&invoice)
 	if err != nil {
-		h.logger.Error("Failed to encode charge result", "error", err)
+		h.logger.Error("Failed to decode invoice", "error", err)
+		h.writeError(w, http.StatusBadRequest, ErrorResponse{Code: ErrorCodeInvalidInput, Message: err.Error()})
+		return
+	}
+
+	document, err := json.Marshal(invoice)
+	if err != nil {
+		h.logger.Error("Failed to encode invoice", "error", err)
+		h.writeError(w, http.StatusInternalServerError, ErrorResponse{Code: ErrorCodeInternal, Message: err.Error()})
+		return
+	}
+
+	err = h.db.SaveInvoice(r.Context(), &db.Invoice{
+		Reference:  invoice.Reference,
+		CustomerID: invoice.CustomerID,
+		Status:     invoice.PaymentStatus,
+		Document:   string(document),
+		CreatedAt:  invoice.CreatedAt,
+	})
+	if err != nil {
+		h.logger.Error("Failed to save invoice", "error", err)
+		h.writeError(w, http.StatusInternalServerError, ErrorResponse{Code: ErrorCodeInternal, Message: err.Error()})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *handlers) handleGetInvoice(w http.ResponseWriter, r *http.Request) {
+	var record db.Invoice
+
+	err := h.db.GetInvoice(r.Context(), r.PathValue("reference"), &record)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			h.writeError(w, http.StatusNotFound, ErrorResponse{Code: ErrorCodeNotFound, Message: "Invoice not found"})
+		} else {
+			h.logger.Error("Failed to get invoice", "error", err)
+			h.writeError(w, http.StatusInternalServerError, ErrorResponse{Code: ErrorCodeInternal, Message: err.Error()})
+		}
+		return
+	}
+
+	var invoice Invoice
+	if err := json.Unmarshal([]byte(record.Document), &invoice); err != nil {
+		h.logger.Error("Failed to decode invoice", "error", err)
+		h.writeError(w, http.StatusInternalServerError, ErrorResponse{Code: ErrorCodeInternal, Message: err.Error()})
+		return
+	}
+
+	switch invoiceFormat(r) {
+	case "pdf":
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "invoice-"+invoice.Reference+".pdf"))
+		err = renderInvoicePDF(w, &invoice)
+	case "html":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		err = renderInvoiceHTML(w, &invoice)
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(invoice)
+	}
+	if err != nil {
+		h.logger.Error("Failed to render invoice", "error", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
+
+// invoiceFormat determines the format an invoice should be returned in.
+// An explicit format query parameter takes precedence over the Accept header.
+func invoiceFormat(r *http.Request) string {
+	if f := r.URL.Query().Get("format"); f != "" {
+		return f
+	}
+
+	accept := r.Header.Get("Accept")
+	switch {
+	case strings.Contains(accept, "application/pdf"):
+		return "pdf"
+	case strings.Contains(accept, "text/html"):
+		return "html"
+	default:
+		return "json"
+	}
+}
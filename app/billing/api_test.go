@@ -1,11 +1,22 @@
 package billing_test
 
 import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
 	"regexp"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
 	"github.com/temporalio/reference-app-orders-go/app/billing"
+	"github.com/temporalio/reference-app-orders-go/app/fraud"
+	"go.temporal.io/api/serviceerror"
+	"go.temporal.io/sdk/client"
+	"go.temporal.io/sdk/mocks"
 )
 
 func TestChargeWorkflowID(t *testing.T) {
@@ -21,3 +32,183 @@ func TestChargeWorkflowID(t *testing.T) {
 
 	assert.Regexp(t, regexp.MustCompile("Charge:[0-9a-f]+-[0-9a-f]+-[0-9a-f]+-[0-9a-f]+"), wfid)
 }
+
+func TestChargeIsAccepted(t *testing.T) {
+	c := mocks.NewClient(t)
+
+	c.On("ExecuteWorkflow", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(&mocks.WorkflowRun{}, nil)
+
+	r := billing.Router(c, nil, slog.Default())
+
+	req := httptest.NewRequest("POST", "/charge", strings.NewReader(`{"customerId":"1","orderReference":"1:1","idempotencyKey":"test"}`))
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+
+	require.Equal(t, http.StatusAccepted, rr.Code)
+	require.Equal(t, "/charges/test", rr.Header().Get("Location"))
+
+	var accepted billing.ChargeAccepted
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&accepted))
+	require.Equal(t, "test", accepted.ID)
+
+	c.AssertCalled(t, "ExecuteWorkflow",
+		mock.Anything,
+		mock.MatchedBy(func(o client.StartWorkflowOptions) bool { return o.ID == "Charge:test" }),
+		mock.Anything, mock.Anything,
+	)
+}
+
+func TestGetChargeStatus(t *testing.T) {
+	c := mocks.NewClient(t)
+	v := mocks.NewEncodedValue(t)
+
+	v.On("Get", mock.Anything).Return(func(ptr interface{}) error {
+		*(ptr.(*billing.ChargeStatus)) = billing.ChargeStatus{
+			ID:     "test",
+			Status: billing.ChargeStatusCompleted,
+			Result: &billing.ChargeResult{Success: true, Total: 100},
+		}
+		return nil
+	})
+	c.On("QueryWorkflow", mock.Anything, "Charge:test", "", billing.StatusQuery).Return(v, nil)
+
+	r := billing.Router(c, nil, slog.Default())
+
+	req := httptest.NewRequest("GET", "/charges/test", nil)
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	var status billing.ChargeStatus
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&status))
+	require.Equal(t, billing.ChargeStatusCompleted, status.Status)
+	require.True(t, status.Result.Success)
+}
+
+func TestChargeAttachesToFinishedCharge(t *testing.T) {
+	c := mocks.NewClient(t)
+	v := mocks.NewEncodedValue(t)
+
+	v.On("Get", mock.Anything).Return(func(ptr interface{}) error {
+		*(ptr.(*billing.ChargeStatus)) = billing.ChargeStatus{
+			ID:     "test",
+			Status: billing.ChargeStatusCompleted,
+			Result: &billing.ChargeResult{Success: true, Total: 100},
+		}
+		return nil
+	})
+	c.On("ExecuteWorkflow", mock.Anything, mock.Anything, mock.Anything, mock.Anything).
+		Return(nil, serviceerror.NewWorkflowExecutionAlreadyStarted("already started", "", ""))
+	c.On("QueryWorkflow", mock.Anything, "Charge:test", "", billing.StatusQuery).Return(v, nil)
+
+	r := billing.Router(c, nil, slog.Default())
+
+	req := httptest.NewRequest("POST", "/charge", strings.NewReader(`{"customerId":"1","orderReference":"1:1","idempotencyKey":"test"}`))
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	var status billing.ChargeStatus
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&status))
+	require.Equal(t, "test", status.ID)
+	require.Equal(t, int32(100), status.Result.Total)
+}
+
+func TestChargeResubmittedWhilePending(t *testing.T) {
+	c := mocks.NewClient(t)
+	v := mocks.NewEncodedValue(t)
+
+	v.On("Get", mock.Anything).Return(func(ptr interface{}) error {
+		*(ptr.(*billing.ChargeStatus)) = billing.ChargeStatus{ID: "test", Status: billing.ChargeStatusPending}
+		return nil
+	})
+	c.On("ExecuteWorkflow", mock.Anything, mock.Anything, mock.Anything, mock.Anything).
+		Return(nil, serviceerror.NewWorkflowExecutionAlreadyStarted("already started", "", ""))
+	c.On("QueryWorkflow", mock.Anything, "Charge:test", "", billing.StatusQuery).Return(v, nil)
+
+	r := billing.Router(c, nil, slog.Default())
+
+	req := httptest.NewRequest("POST", "/charge", strings.NewReader(`{"customerId":"1","orderReference":"1:1","idempotencyKey":"test"}`))
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+
+	require.Equal(t, http.StatusAccepted, rr.Code)
+	require.Equal(t, "/charges/test", rr.Header().Get("Location"))
+
+	var accepted billing.ChargeAccepted
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&accepted))
+	require.Equal(t, "test", accepted.ID)
+}
+
+func TestGetFailedCharge(t *testing.T) {
+	c := mocks.NewClient(t)
+	v := mocks.NewEncodedValue(t)
+
+	v.On("Get", mock.Anything).Return(func(ptr interface{}) error {
+		*(ptr.(*billing.ChargeStatus)) = billing.ChargeStatus{
+			ID:     "test",
+			Status: billing.ChargeStatusFailed,
+			Error:  "invoice must have items",
+		}
+		return nil
+	})
+	c.On("QueryWorkflow", mock.Anything, "Charge:test", "", billing.StatusQuery).Return(v, nil)
+
+	r := billing.Router(c, nil, slog.Default())
+
+	req := httptest.NewRequest("GET", "/charges/test", nil)
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+
+	require.Equal(t, http.StatusUnprocessableEntity, rr.Code)
+	require.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+
+	var e billing.ErrorResponse
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&e))
+	require.Equal(t, billing.ErrorResponse{
+		Code:     billing.ErrorCodeChargeFailed,
+		Message:  "invoice must have items",
+		ChargeID: "test",
+	}, e)
+}
+
+func TestChargeInvalidInput(t *testing.T) {
+	r := billing.Router(nil, nil, slog.Default())
+
+	req := httptest.NewRequest("POST", "/charge", strings.NewReader(`{`))
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+
+	require.Equal(t, http.StatusBadRequest, rr.Code)
+
+	var e billing.ErrorResponse
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&e))
+	require.Equal(t, billing.ErrorCodeInvalidInput, e.Code)
+}
+
+func TestReviewDecisionSignalsCharge(t *testing.T) {
+	c := mocks.NewClient(t)
+
+	decision := billing.ReviewDecision{ReviewID: "review1", Decision: fraud.ReviewApprove}
+	c.On("SignalWorkflow", mock.Anything, "Charge:test", "", billing.ReviewSignal, decision).Return(nil).Once()
+	c.On("SignalWorkflow", mock.Anything, "Charge:missing", "", billing.ReviewSignal, decision).Return(serviceerror.NewNotFound("not found")).Once()
+
+	r := billing.Router(c, nil, slog.Default())
+
+	req := httptest.NewRequest("POST", "/charges/test/review", strings.NewReader(`{"reviewId":"review1","decision":"approve"}`))
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	req = httptest.NewRequest("POST", "/charges/missing/review", strings.NewReader(`{"reviewId":"review1","decision":"approve"}`))
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusNotFound, rr.Code)
+
+	req = httptest.NewRequest("POST", "/charges/test/review", strings.NewReader(`{"reviewId":"review1","decision":"maybe"}`))
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusBadRequest, rr.Code)
+}
@@ -0,0 +1,158 @@
+package billing
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io"
+	"strings"
+)
+
+// formatAmount formats an amount in cents for display.
+func formatAmount(amount int32) string {
+	sign := ""
+	if amount < 0 {
+		sign = "-"
+		amount = -amount
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, amount/100, amount%100)
+}
+
+var invoiceTemplate = template.Must(template.New("invoice").Funcs(template.FuncMap{
+	"amount": formatAmount,
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Invoice {{.Reference}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; width: 100%; }
+th, td { border-bottom: 1px solid #ddd; padding: 0.4em; text-align: right; }
+th:first-child, td:first-child { text-align: left; }
+</style>
+</head>
+<body>
+<h1>Invoice {{.Reference}}</h1>
+<p>Customer: {{.CustomerID}}<br>
+Date: {{.CreatedAt.Format "2006-01-02"}}<br>
+Payment status: {{.PaymentStatus}}{{if .AuthCode}} (authorization {{.AuthCode}}){{end}}</p>
+<table>
+<tr><th>SKU</th><th>Quantity</th><th>Unit Price</th><th>Subtotal</th><th>Tax</th><th>Shipping</th><th>Total</th></tr>
+{{range .LineItems}}<tr><td>{{.SKU}}</td><td>{{.Quantity}}</td><td>{{amount .UnitPrice}}</td><td>{{amount .SubTotal}}</td><td>{{amount .Tax}}</td><td>{{amount .Shipping}}</td><td>{{amount .Total}}</td></tr>
+{{end}}</table>
+<h2>Summary</h2>
+<table>
+<tr><td>Subtotal</td><td>{{amount .SubTotal}}</td></tr>
+{{range .TaxBreakdown}}<tr><td>{{.Name}} ({{.Rate}}%)</td><td>{{amount .Amount}}</td></tr>
+{{end}}<tr><td>Shipping</td><td>{{amount .Shipping}}</td></tr>
+<tr><th>Total</th><th>{{amount .Total}}</th></tr>
+</table>
+{{if .Payments}}<h2>Payments</h2>
+<table>
+{{range .Payments}}<tr><td>{{.Type}}{{if .AuthCode}} (authorization {{.AuthCode}}){{end}}</td><td>{{amount .Amount}}</td></tr>
+{{end}}</table>
+{{end}}</body>
+</html>
+`))
+
+// renderInvoiceHTML writes an Invoice as an HTML document.
+func renderInvoiceHTML(w io.Writer, invoice *Invoice) error {
+	return invoiceTemplate.Execute(w, invoice)
+}
+
+// invoiceTextLines lays out an Invoice as lines of fixed width text.
+func invoiceTextLines(invoice *Invoice) []string {
+	lines := []string{
+		"INVOICE " + invoice.Reference,
+		"",
+		"Customer:       " + invoice.CustomerID,
+		"Date:           " + invoice.CreatedAt.Format("2006-01-02"),
+		"Payment status: " + invoice.PaymentStatus,
+	}
+	if invoice.AuthCode != "" {
+		lines = append(lines, "Authorization:  "+invoice.AuthCode)
+	}
+
+	row := "%-24s %5s %10s %10s %10s %10s"
+	lines = append(lines,
+		"",
+		fmt.Sprintf(row, "SKU", "Qty", "Unit", "Subtotal", "Tax", "Shipping"),
+		strings.Repeat("-", 74),
+	)
+	for _, item := range invoice.LineItems {
+		lines = append(lines, fmt.Sprintf(row,
+			item.SKU,
+			fmt.Sprint(item.Quantity),
+			formatAmount(item.UnitPrice),
+			formatAmount(item.SubTotal),
+			formatAmount(item.Tax),
+			formatAmount(item.Shipping),
+		))
+	}
+
+	summary := "%-62s %11s"
+	lines = append(lines,
+		strings.Repeat("-", 74),
+		fmt.Sprintf(summary, "Subtotal", formatAmount(invoice.SubTotal)),
+	)
+	for _, tax := range invoice.TaxBreakdown {
+		lines = append(lines, fmt.Sprintf(summary, fmt.Sprintf("%s (%d%%)", tax.Name, tax.Rate), formatAmount(tax.Amount)))
+	}
+	lines = append(lines,
+		fmt.Sprintf(summary, "Shipping", formatAmount(invoice.Shipping)),
+		fmt.Sprintf(summary, "Total", formatAmount(invoice.Total)),
+	)
+
+	if len(invoice.Payments) > 0 {
+		lines = append(lines, "", "Payments")
+		for _, p := range invoice.Payments {
+			lines = append(lines, fmt.Sprintf(summary, "  "+p.Type, formatAmount(p.Amount)))
+		}
+	}
+
+	return lines
+}
+
+// pdfEscape escapes a string for use in a PDF literal string.
+func pdfEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "(", `\(`, ")", `\)`).Replace(s)
+}
+
+// renderInvoicePDF writes an Invoice as a single page PDF document.
+// The document only uses a standard font so no font data needs embedding.
+func renderInvoicePDF(w io.Writer, invoice *Invoice) error {
+	var content bytes.Buffer
+	content.WriteString("BT\n/F1 9 Tf\n12 TL\n40 800 Td\n")
+	for _, line := range invoiceTextLines(invoice) {
+		fmt.Fprintf(&content, "(%s) '\n", pdfEscape(line))
+	}
+	content.WriteString("ET\n")
+
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		"<< /Type /Page /Parent 2 0 R /MediaBox [0 0 595 842] /Resources << /Font << /F1 4 0 R >> >> /Contents 5 0 R >>",
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Courier >>",
+		fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", content.Len(), content.String()),
+	}
+
+	var doc bytes.Buffer
+	doc.WriteString("%PDF-1.4\n")
+
+	offsets := make([]int, len(objects))
+	for i, obj := range objects {
+		offsets[i] = doc.Len()
+		fmt.Fprintf(&doc, "%d 0 obj\n%s\nendobj\n", i+1, obj)
+	}
+
+	xref := doc.Len()
+	fmt.Fprintf(&doc, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&doc, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&doc, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+
+	_, err := w.Write(doc.Bytes())
+	return err
+}
@@ -0,0 +1,123 @@
+package billing_test
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/temporalio/reference-app-orders-go/app/billing"
+	"github.com/temporalio/reference-app-orders-go/app/config"
+	"github.com/temporalio/reference-app-orders-go/app/db"
+	"go.temporal.io/sdk/testsuite"
+)
+
+func TestGenerateInvoiceLineItems(t *testing.T) {
+	testSuite := testsuite.WorkflowTestSuite{}
+
+	var a *billing.Activities
+
+	env := testSuite.NewTestActivityEnvironment()
+	env.RegisterActivity(a.GenerateInvoice)
+
+	future, err := env.ExecuteActivity(a.GenerateInvoice, &billing.GenerateInvoiceInput{
+		CustomerID: "customer1",
+		Reference:  "order1:1",
+		Items: []billing.Item{
+			{SKU: "Hiking Boots", Quantity: 2},
+			{SKU: "Tennis Shoes", Quantity: 1},
+		},
+	})
+	require.NoError(t, err)
+
+	var result billing.GenerateInvoiceResult
+	require.NoError(t, future.Get(&result))
+
+	require.Len(t, result.LineItems, 2)
+
+	var subTotal, tax, shipping int32
+	for _, item := range result.LineItems {
+		require.Equal(t, item.UnitPrice*item.Quantity, item.SubTotal)
+		require.Equal(t, item.SubTotal+item.Tax+item.Shipping, item.Total)
+		subTotal += item.SubTotal
+		tax += item.Tax
+		shipping += item.Shipping
+	}
+
+	require.Equal(t, subTotal, result.SubTotal)
+	require.Equal(t, tax, result.Tax)
+	require.Equal(t, shipping, result.Shipping)
+	require.Equal(t, subTotal+tax+shipping, result.Total)
+	require.Equal(t, []billing.TaxLine{{Name: "VAT", Rate: 20, Amount: tax}}, result.TaxBreakdown)
+}
+
+func TestInvoiceAPI(t *testing.T) {
+	ctx := context.Background()
+
+	store := db.CreateDB(config.AppConfig{SQLitePath: filepath.Join(t.TempDir(), "test.db")})
+	require.NoError(t, store.Connect(ctx))
+	require.NoError(t, store.Setup())
+	defer store.Close()
+
+	r := billing.Router(nil, store, slog.Default())
+
+	invoice := billing.Invoice{
+		Reference:  "order1:1",
+		CustomerID: "customer1",
+		LineItems: []billing.InvoiceLineItem{
+			{SKU: "Hiking Boots", Quantity: 2, UnitPrice: 5000, SubTotal: 10000, Tax: 2000, Shipping: 1000, Total: 13000},
+		},
+		TaxBreakdown:  []billing.TaxLine{{Name: "VAT", Rate: 20, Amount: 2000}},
+		SubTotal:      10000,
+		Tax:           2000,
+		Shipping:      1000,
+		Total:         13000,
+		PaymentStatus: billing.InvoiceStatusPaid,
+		AuthCode:      "1234",
+		CreatedAt:     time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC),
+	}
+	body, err := json.Marshal(invoice)
+	require.NoError(t, err)
+
+	req := httptest.NewRequest("POST", "/invoices", strings.NewReader(string(body)))
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	req = httptest.NewRequest("GET", "/invoices/order1:1", nil)
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+
+	var result billing.Invoice
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&result))
+	require.Equal(t, invoice, result)
+
+	req = httptest.NewRequest("GET", "/invoices/order1:1", nil)
+	req.Header.Set("Accept", "text/html")
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Contains(t, rr.Body.String(), "<td>Hiking Boots</td>")
+	require.Contains(t, rr.Body.String(), "130.00")
+
+	req = httptest.NewRequest("GET", "/invoices/order1:1?format=pdf", nil)
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Equal(t, "application/pdf", rr.Header().Get("Content-Type"))
+	require.True(t, strings.HasPrefix(rr.Body.String(), "%PDF-1.4"))
+	require.Contains(t, rr.Body.String(), "(INVOICE order1:1)")
+
+	req = httptest.NewRequest("GET", "/invoices/missing", nil)
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusNotFound, rr.Code)
+}
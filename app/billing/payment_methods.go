@@ -0,0 +1,451 @@
+package billing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/temporalio/reference-app-orders-go/app/db"
+)
+
+const (
+	// PaymentMethodTypeCard is the type of a tokenised payment card.
+	PaymentMethodTypeCard = "card"
+
+	// PaymentMethodTypeWallet is the type of a digital wallet, such as Apple Pay.
+	PaymentMethodTypeWallet = "wallet"
+
+	// PaymentMethodTypeCredit is the type of a customer's store credit balance.
+	// A customer has at most one store credit payment method.
+	PaymentMethodTypeCredit = db.PaymentMethodTypeCredit
+)
+
+// PaymentMethod is a customer's stored payment method.
+// Card numbers are tokenised when the payment method is created, only the brand
+// and last four digits are kept for display.
+type PaymentMethod struct {
+	ID         string `json:"id"`
+	CustomerID string `json:"customerId"`
+	Type       string `json:"type"`
+
+	// IsDefault is set on the payment method charged when a Charge does not specify one.
+	// Store credit is always applied first and is never the default.
+	IsDefault bool `json:"isDefault"`
+
+	Brand    string `json:"brand,omitempty"`
+	Last4    string `json:"last4,omitempty"`
+	ExpMonth int32  `json:"expMonth,omitempty"`
+	ExpYear  int32  `json:"expYear,omitempty"`
+
+	Provider string `json:"provider,omitempty"`
+
+	Balance int32 `json:"balance"`
+
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// PaymentMethodInput is the body used to create or update a PaymentMethod.
+// CardNumber, Provider and WalletToken can only be set when the payment method is created.
+type PaymentMethodInput struct {
+	Type      string `json:"type"`
+	IsDefault bool   `json:"isDefault"`
+
+	CardNumber string `json:"cardNumber,omitempty"`
+	ExpMonth   int32  `json:"expMonth,omitempty"`
+	ExpYear    int32  `json:"expYear,omitempty"`
+
+	Provider    string `json:"provider,omitempty"`
+	WalletToken string `json:"walletToken,omitempty"`
+
+	Balance int32 `json:"balance,omitempty"`
+}
+
+// CreditDebitInput is the body used to debit a customer's store credit.
+// Amount is the most that should be debited.
+type CreditDebitInput struct {
+	Reference string `json:"reference"`
+	Amount    int32  `json:"amount"`
+}
+
+// CreditDebitResult is the result of debiting a customer's store credit.
+// Amount is the amount actually debited, which is less than requested if the balance was insufficient.
+type CreditDebitResult struct {
+	Reference string `json:"reference"`
+	Amount    int32  `json:"amount"`
+}
+
+// PaymentMethodURL returns the location of a customer's PaymentMethod, relative to the Billing API.
+func PaymentMethodURL(customerID string, id string) string {
+	return PaymentMethodsURL(customerID) + "/" + url.PathEscape(id)
+}
+
+// PaymentMethodsURL returns the location of a customer's PaymentMethods, relative to the Billing API.
+func PaymentMethodsURL(customerID string) string {
+	return "/customers/" + url.PathEscape(customerID) + "/payment-methods"
+}
+
+// CreditDebitsURL returns the location used to debit a customer's store credit, relative to the Billing API.
+func CreditDebitsURL(customerID string) string {
+	return "/customers/" + url.PathEscape(customerID) + "/credit/debits"
+}
+
+func paymentMethodFromDB(m *db.PaymentMethod) PaymentMethod {
+	return PaymentMethod{
+		ID:         m.ID,
+		CustomerID: m.CustomerID,
+		Type:       m.Type,
+		IsDefault:  m.IsDefault,
+		Brand:      m.Brand,
+		Last4:      m.Last4,
+		ExpMonth:   m.ExpMonth,
+		ExpYear:    m.ExpYear,
+		Provider:   m.Provider,
+		Balance:    m.Balance,
+		CreatedAt:  m.CreatedAt,
+	}
+}
+
+// luhnValid reports whether a card number passes the Luhn checksum.
+func luhnValid(number string) bool {
+	if len(number) < 12 || len(number) > 19 {
+		return false
+	}
+
+	var sum int
+	double := false
+	for i := len(number) - 1; i >= 0; i-- {
+		c := number[i]
+		if c < '0' || c > '9' {
+			return false
+		}
+		d := int(c - '0')
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+
+	return sum%10 == 0
+}
+
+// cardBrand determines the brand of a card from its number.
+func cardBrand(number string) string {
+	switch {
+	case strings.HasPrefix(number, "4"):
+		return "visa"
+	case strings.HasPrefix(number, "34"), strings.HasPrefix(number, "37"):
+		return "amex"
+	case number[0] == '5' && number[1] >= '1' && number[1] <= '5', number[0] == '2' && number[1] >= '2' && number[1] <= '7':
+		return "mastercard"
+	default:
+		return "unknown"
+	}
+}
+
+// newPaymentMethod validates a PaymentMethodInput and builds the PaymentMethod to store.
+// Card numbers are replaced with a token.
+func newPaymentMethod(customerID string, input *PaymentMethodInput) (*db.PaymentMethod, error) {
+	m := db.PaymentMethod{
+		ID:         "pm_" + uuid.NewString(),
+		CustomerID: customerID,
+		Type:       input.Type,
+		IsDefault:  input.IsDefault,
+		CreatedAt:  time.Now().UTC(),
+	}
+
+	switch input.Type {
+	case PaymentMethodTypeCard:
+		number := strings.ReplaceAll(input.CardNumber, " ", "")
+		if !luhnValid(number) {
+			return nil, errors.New("cardNumber is not a valid card number")
+		}
+		if input.ExpMonth < 1 || input.ExpMonth > 12 || input.ExpYear < 1 {
+			return nil, errors.New("expMonth and expYear are required")
+		}
+		m.Token = "tok_" + uuid.NewString()
+		m.Brand = cardBrand(number)
+		m.Last4 = number[len(number)-4:]
+		m.ExpMonth = input.ExpMonth
+		m.ExpYear = input.ExpYear
+	case PaymentMethodTypeWallet:
+		if input.Provider == "" || input.WalletToken == "" {
+			return nil, errors.New("provider and walletToken are required")
+		}
+		m.Provider = input.Provider
+		m.Token = input.WalletToken
+	case PaymentMethodTypeCredit:
+		if input.IsDefault {
+			return nil, errors.New("store credit cannot be the default payment method")
+		}
+		if input.Balance < 0 {
+			return nil, errors.New("balance must not be negative")
+		}
+		m.Balance = input.Balance
+	default:
+		return nil, errors.New("type must be one of card, wallet or credit")
+	}
+
+	return &m, nil
+}
+
+// clearDefault unsets the default flag on a customer's payment methods other than the one given.
+func (h *handlers) clearDefault(ctx context.Context, customerID string, id string) error {
+	var methods []db.PaymentMethod
+
+	if err := h.db.GetPaymentMethods(ctx, customerID, &methods); err != nil {
+		return err
+	}
+
+	for _, m := range methods {
+		if m.ID == id || !m.IsDefault {
+			continue
+		}
+		m.IsDefault = false
+		if err := h.db.UpdatePaymentMethod(ctx, &m); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (h *handlers) writePaymentMethod(w http.ResponseWriter, status int, m *db.PaymentMethod) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(paymentMethodFromDB(m)); err != nil {
+		h.logger.Error("Failed to encode payment method", "error", err)
+	}
+}
+
+func (h *handlers) handleListPaymentMethods(w http.ResponseWriter, r *http.Request) {
+	var methods []db.PaymentMethod
+
+	err := h.db.GetPaymentMethods(r.Context(), r.PathValue("customerId"), &methods)
+	if err != nil {
+		h.logger.Error("Failed to list payment methods", "error", err)
+		h.writeError(w, http.StatusInternalServerError, ErrorResponse{Code: ErrorCodeInternal, Message: err.Error()})
+		return
+	}
+
+	result := make([]PaymentMethod, 0, len(methods))
+	for _, m := range methods {
+		result = append(result, paymentMethodFromDB(&m))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		h.logger.Error("Failed to encode payment methods", "error", err)
+	}
+}
+
+func (h *handlers) handleCreatePaymentMethod(w http.ResponseWriter, r *http.Request) {
+	var input PaymentMethodInput
+
+	customerID := r.PathValue("customerId")
+
+	err := json.NewDecoder(r.Body).Decode(&input)
+	if err != nil {
+		h.logger.Error("Failed to decode payment method input", "error", err)
+		h.writeError(w, http.StatusBadRequest, ErrorResponse{Code: ErrorCodeInvalidInput, Message: err.Error()})
+		return
+	}
+
+	m, err := newPaymentMethod(customerID, &input)
+	if err != nil {
+		h.writeError(w, http.StatusBadRequest, ErrorResponse{Code: ErrorCodeInvalidInput, Message: err.Error()})
+		return
+	}
+
+	var existing []db.PaymentMethod
+	if err := h.db.GetPaymentMethods(r.Context(), customerID, &existing); err != nil {
+		h.logger.Error("Failed to list payment methods", "error", err)
+		h.writeError(w, http.StatusInternalServerError, ErrorResponse{Code: ErrorCodeInternal, Message: err.Error()})
+		return
+	}
+
+	hasDefault := false
+	for _, e := range existing {
+		if m.Type == PaymentMethodTypeCredit && e.Type == PaymentMethodTypeCredit {
+			h.writeError(w, http.StatusConflict, ErrorResponse{Code: ErrorCodeConflict, Message: "Customer already has store credit"})
+			return
+		}
+		hasDefault = hasDefault || e.IsDefault
+	}
+
+	// The first card or wallet a customer adds becomes their default.
+	if m.Type != PaymentMethodTypeCredit && !hasDefault {
+		m.IsDefault = true
+	}
+
+	if err := h.db.InsertPaymentMethod(r.Context(), m); err != nil {
+		h.logger.Error("Failed to insert payment method", "error", err)
+		h.writeError(w, http.StatusInternalServerError, ErrorResponse{Code: ErrorCodeInternal, Message: err.Error()})
+		return
+	}
+
+	if m.IsDefault && hasDefault {
+		if err := h.clearDefault(r.Context(), customerID, m.ID); err != nil {
+			h.logger.Error("Failed to update default payment method", "error", err)
+			h.writeError(w, http.StatusInternalServerError, ErrorResponse{Code: ErrorCodeInternal, Message: err.Error()})
+			return
+		}
+	}
+
+	w.Header().Set("Location", PaymentMethodURL(customerID, m.ID))
+	h.writePaymentMethod(w, http.StatusCreated, m)
+}
+
+// getPaymentMethod fetches the payment method identified by the request path,
+// writing an error response if it cannot be found.
+func (h *handlers) getPaymentMethod(w http.ResponseWriter, r *http.Request) (*db.PaymentMethod, bool) {
+	var m db.PaymentMethod
+
+	err := h.db.GetPaymentMethod(r.Context(), r.PathValue("customerId"), r.PathValue("id"), &m)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			h.writeError(w, http.StatusNotFound, ErrorResponse{Code: ErrorCodeNotFound, Message: "Payment method not found"})
+		} else {
+			h.logger.Error("Failed to get payment method", "error", err)
+			h.writeError(w, http.StatusInternalServerError, ErrorResponse{Code: ErrorCodeInternal, Message: err.Error()})
+		}
+		return nil, false
+	}
+
+	return &m, true
+}
+
+func (h *handlers) handleGetPaymentMethod(w http.ResponseWriter, r *http.Request) {
+	m, ok := h.getPaymentMethod(w, r)
+	if !ok {
+		return
+	}
+
+	h.writePaymentMethod(w, http.StatusOK, m)
+}
+
+func (h *handlers) handleUpdatePaymentMethod(w http.ResponseWriter, r *http.Request) {
+	var input PaymentMethodInput
+
+	err := json.NewDecoder(r.Body).Decode(&input)
+	if err != nil {
+		h.logger.Error("Failed to decode payment method input", "error", err)
+		h.writeError(w, http.StatusBadRequest, ErrorResponse{Code: ErrorCodeInvalidInput, Message: err.Error()})
+		return
+	}
+
+	m, ok := h.getPaymentMethod(w, r)
+	if !ok {
+		return
+	}
+
+	if input.Type != "" && input.Type != m.Type {
+		h.writeError(w, http.StatusBadRequest, ErrorResponse{Code: ErrorCodeInvalidInput, Message: "type cannot be changed"})
+		return
+	}
+	if input.CardNumber != "" || input.Provider != "" || input.WalletToken != "" {
+		h.writeError(w, http.StatusBadRequest, ErrorResponse{Code: ErrorCodeInvalidInput, Message: "card and wallet details cannot be changed, add a new payment method instead"})
+		return
+	}
+
+	switch m.Type {
+	case PaymentMethodTypeCard:
+		if input.ExpMonth != 0 || input.ExpYear != 0 {
+			if input.ExpMonth < 1 || input.ExpMonth > 12 || input.ExpYear < 1 {
+				h.writeError(w, http.StatusBadRequest, ErrorResponse{Code: ErrorCodeInvalidInput, Message: "expMonth and expYear are required"})
+				return
+			}
+			m.ExpMonth = input.ExpMonth
+			m.ExpYear = input.ExpYear
+		}
+	case PaymentMethodTypeCredit:
+		if input.IsDefault {
+			h.writeError(w, http.StatusBadRequest, ErrorResponse{Code: ErrorCodeInvalidInput, Message: "store credit cannot be the default payment method"})
+			return
+		}
+		if input.Balance < 0 {
+			h.writeError(w, http.StatusBadRequest, ErrorResponse{Code: ErrorCodeInvalidInput, Message: "balance must not be negative"})
+			return
+		}
+		m.Balance = input.Balance
+	}
+
+	m.IsDefault = input.IsDefault
+
+	if err := h.db.UpdatePaymentMethod(r.Context(), m); err != nil {
+		h.logger.Error("Failed to update payment method", "error", err)
+		h.writeError(w, http.StatusInternalServerError, ErrorResponse{Code: ErrorCodeInternal, Message: err.Error()})
+		return
+	}
+
+	if m.IsDefault {
+		if err := h.clearDefault(r.Context(), m.CustomerID, m.ID); err != nil {
+			h.logger.Error("Failed to update default payment method", "error", err)
+			h.writeError(w, http.StatusInternalServerError, ErrorResponse{Code: ErrorCodeInternal, Message: err.Error()})
+			return
+		}
+	}
+
+	h.writePaymentMethod(w, http.StatusOK, m)
+}
+
+func (h *handlers) handleDeletePaymentMethod(w http.ResponseWriter, r *http.Request) {
+	err := h.db.DeletePaymentMethod(r.Context(), r.PathValue("customerId"), r.PathValue("id"))
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			h.writeError(w, http.StatusNotFound, ErrorResponse{Code: ErrorCodeNotFound, Message: "Payment method not found"})
+		} else {
+			h.logger.Error("Failed to delete payment method", "error", err)
+			h.writeError(w, http.StatusInternalServerError, ErrorResponse{Code: ErrorCodeInternal, Message: err.Error()})
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *handlers) handleDebitCredit(w http.ResponseWriter, r *http.Request) {
+	var input CreditDebitInput
+
+	err := json.NewDecoder(r.Body).Decode(&input)
+	if err != nil {
+		h.logger.Error("Failed to decode credit debit input", "error", err)
+		h.writeError(w, http.StatusBadRequest, ErrorResponse{Code: ErrorCodeInvalidInput, Message: err.Error()})
+		return
+	}
+
+	if input.Reference == "" || input.Amount <= 0 {
+		h.writeError(w, http.StatusBadRequest, ErrorResponse{Code: ErrorCodeInvalidInput, Message: "reference and a positive amount are required"})
+		return
+	}
+
+	debit := db.CreditDebit{
+		Reference:  input.Reference,
+		CustomerID: r.PathValue("customerId"),
+		Amount:     input.Amount,
+		CreatedAt:  time.Now().UTC(),
+	}
+
+	if err := h.db.DebitStoreCredit(r.Context(), &debit); err != nil {
+		h.logger.Error("Failed to debit store credit", "error", err)
+		h.writeError(w, http.StatusInternalServerError, ErrorResponse{Code: ErrorCodeInternal, Message: err.Error()})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	err = json.NewEncoder(w).Encode(CreditDebitResult{Reference: debit.Reference, Amount: debit.Amount})
+	if err != nil {
+		h.logger.Error("Failed to encode credit debit result", "error", err)
+	}
+}
@@ -0,0 +1,192 @@
+package billing_test
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/temporalio/reference-app-orders-go/app/billing"
+	"github.com/temporalio/reference-app-orders-go/app/config"
+	"github.com/temporalio/reference-app-orders-go/app/db"
+	"go.temporal.io/sdk/testsuite"
+)
+
+func testStore(t *testing.T) db.DB {
+	store := db.CreateDB(config.AppConfig{SQLitePath: filepath.Join(t.TempDir(), "test.db")})
+	require.NoError(t, store.Connect(context.Background()))
+	require.NoError(t, store.Setup())
+	t.Cleanup(func() { store.Close() })
+
+	return store
+}
+
+func testBillingAPI(t *testing.T) http.Handler {
+	return billing.Router(nil, testStore(t), slog.Default())
+}
+
+func doJSON(t *testing.T, r http.Handler, method string, path string, body any, result any) int {
+	var payload string
+	if body != nil {
+		b, err := json.Marshal(body)
+		require.NoError(t, err)
+		payload = string(b)
+	}
+
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest(method, path, strings.NewReader(payload)))
+
+	if result != nil && rr.Code < 300 {
+		require.NoError(t, json.NewDecoder(rr.Body).Decode(result))
+	}
+
+	return rr.Code
+}
+
+func TestPaymentMethodsAPI(t *testing.T) {
+	r := testBillingAPI(t)
+
+	var card billing.PaymentMethod
+	code := doJSON(t, r, "POST", "/customers/customer1/payment-methods", billing.PaymentMethodInput{
+		Type:       billing.PaymentMethodTypeCard,
+		CardNumber: "4242 4242 4242 4242",
+		ExpMonth:   12,
+		ExpYear:    2030,
+	}, &card)
+	require.Equal(t, http.StatusCreated, code)
+	require.Equal(t, "visa", card.Brand)
+	require.Equal(t, "4242", card.Last4)
+	require.True(t, card.IsDefault, "first card is the default")
+
+	code = doJSON(t, r, "POST", "/customers/customer1/payment-methods", billing.PaymentMethodInput{
+		Type:       billing.PaymentMethodTypeCard,
+		CardNumber: "4242 4242 4242 4241",
+		ExpMonth:   12,
+		ExpYear:    2030,
+	}, nil)
+	require.Equal(t, http.StatusBadRequest, code, "card number fails Luhn check")
+
+	var wallet billing.PaymentMethod
+	code = doJSON(t, r, "POST", "/customers/customer1/payment-methods", billing.PaymentMethodInput{
+		Type:        billing.PaymentMethodTypeWallet,
+		IsDefault:   true,
+		Provider:    "applepay",
+		WalletToken: "wallet-token",
+	}, &wallet)
+	require.Equal(t, http.StatusCreated, code)
+	require.True(t, wallet.IsDefault)
+
+	code = doJSON(t, r, "POST", "/customers/customer1/payment-methods", billing.PaymentMethodInput{
+		Type:    billing.PaymentMethodTypeCredit,
+		Balance: 1000,
+	}, nil)
+	require.Equal(t, http.StatusCreated, code)
+
+	code = doJSON(t, r, "POST", "/customers/customer1/payment-methods", billing.PaymentMethodInput{
+		Type:    billing.PaymentMethodTypeCredit,
+		Balance: 1000,
+	}, nil)
+	require.Equal(t, http.StatusConflict, code, "only one store credit balance per customer")
+
+	var methods []billing.PaymentMethod
+	require.Equal(t, http.StatusOK, doJSON(t, r, "GET", "/customers/customer1/payment-methods", nil, &methods))
+	require.Len(t, methods, 3)
+	require.False(t, methods[0].IsDefault, "adding a default wallet replaces the default card")
+
+	var updated billing.PaymentMethod
+	code = doJSON(t, r, "PUT", "/customers/customer1/payment-methods/"+card.ID, billing.PaymentMethodInput{
+		IsDefault: true,
+		ExpMonth:  1,
+		ExpYear:   2031,
+	}, &updated)
+	require.Equal(t, http.StatusOK, code)
+	require.True(t, updated.IsDefault)
+	require.Equal(t, int32(2031), updated.ExpYear)
+
+	require.Equal(t, http.StatusOK, doJSON(t, r, "GET", "/customers/customer1/payment-methods/"+wallet.ID, nil, &wallet))
+	require.False(t, wallet.IsDefault)
+
+	require.Equal(t, http.StatusNoContent, doJSON(t, r, "DELETE", "/customers/customer1/payment-methods/"+wallet.ID, nil, nil))
+	require.Equal(t, http.StatusNotFound, doJSON(t, r, "GET", "/customers/customer1/payment-methods/"+wallet.ID, nil, nil))
+	require.Equal(t, http.StatusNotFound, doJSON(t, r, "GET", "/customers/customer2/payment-methods/"+card.ID, nil, nil))
+}
+
+func TestDebitStoreCredit(t *testing.T) {
+	r := testBillingAPI(t)
+
+	var credit billing.PaymentMethod
+	code := doJSON(t, r, "POST", "/customers/customer1/payment-methods", billing.PaymentMethodInput{
+		Type:    billing.PaymentMethodTypeCredit,
+		Balance: 1000,
+	}, &credit)
+	require.Equal(t, http.StatusCreated, code)
+
+	var debit billing.CreditDebitResult
+	code = doJSON(t, r, "POST", "/customers/customer1/credit/debits", billing.CreditDebitInput{Reference: "order1:1", Amount: 600}, &debit)
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, int32(600), debit.Amount)
+
+	// Repeating a debit does not debit the balance again.
+	code = doJSON(t, r, "POST", "/customers/customer1/credit/debits", billing.CreditDebitInput{Reference: "order1:1", Amount: 600}, &debit)
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, int32(600), debit.Amount)
+
+	// Only the remaining balance is debited.
+	code = doJSON(t, r, "POST", "/customers/customer1/credit/debits", billing.CreditDebitInput{Reference: "order2:1", Amount: 600}, &debit)
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, int32(400), debit.Amount)
+
+	require.Equal(t, http.StatusOK, doJSON(t, r, "GET", "/customers/customer1/payment-methods/"+credit.ID, nil, &credit))
+	require.Equal(t, int32(0), credit.Balance)
+}
+
+func TestChargeCustomerSplitPayment(t *testing.T) {
+	srv := httptest.NewServer(testBillingAPI(t))
+	defer srv.Close()
+
+	var card billing.PaymentMethod
+	require.Equal(t, http.StatusCreated, doJSON(t, srv.Config.Handler, "POST", "/customers/customer1/payment-methods", billing.PaymentMethodInput{
+		Type:       billing.PaymentMethodTypeCard,
+		CardNumber: "5555555555554444",
+		ExpMonth:   12,
+		ExpYear:    2030,
+	}, &card))
+	require.Equal(t, http.StatusCreated, doJSON(t, srv.Config.Handler, "POST", "/customers/customer1/payment-methods", billing.PaymentMethodInput{
+		Type:    billing.PaymentMethodTypeCredit,
+		Balance: 1500,
+	}, nil))
+
+	testSuite := testsuite.WorkflowTestSuite{}
+	env := testSuite.NewTestActivityEnvironment()
+
+	a := &billing.Activities{BillingURL: srv.URL}
+	env.RegisterActivity(a)
+
+	future, err := env.ExecuteActivity(a.ChargeCustomer, &billing.ChargeCustomerInput{
+		CustomerID: "customer1",
+		Reference:  "order1:1",
+		Charge:     4000,
+	})
+	require.NoError(t, err)
+
+	var result billing.ChargeCustomerResult
+	require.NoError(t, future.Get(&result))
+	require.True(t, result.Success)
+	require.Equal(t, []billing.Payment{
+		{Type: billing.PaymentMethodTypeCredit, Amount: 1500},
+		{PaymentMethodID: card.ID, Type: billing.PaymentMethodTypeCard, Amount: 2500, AuthCode: "1234"},
+	}, result.Payments)
+
+	_, err = env.ExecuteActivity(a.ChargeCustomer, &billing.ChargeCustomerInput{
+		CustomerID:      "customer1",
+		PaymentMethodID: "pm_missing",
+		Reference:       "order2:1",
+		Charge:          4000,
+	})
+	require.ErrorContains(t, err, billing.PaymentMethodNotFoundErrorType)
+}
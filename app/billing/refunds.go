@@ -0,0 +1,322 @@
+package billing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/temporalio/reference-app-orders-go/app/db"
+)
+
+// RefundInput is the body used to refund items from a paid Invoice.
+// Reference identifies the refund: repeating a refund with the same Reference returns the original refund.
+type RefundInput struct {
+	Reference string `json:"reference"`
+	Items     []Item `json:"items"`
+}
+
+// RefundLineItem is a line on a Refund.
+type RefundLineItem struct {
+	SKU      string `json:"sku"`
+	Quantity int32  `json:"quantity"`
+	SubTotal int32  `json:"subTotal"`
+	Tax      int32  `json:"tax"`
+	Total    int32  `json:"total"`
+}
+
+// Refund is a refund of items from a paid Invoice. Shipping is not refunded.
+type Refund struct {
+	Reference        string `json:"reference"`
+	InvoiceReference string `json:"invoiceReference"`
+	CustomerID       string `json:"customerId"`
+
+	LineItems []RefundLineItem `json:"lineItems"`
+
+	SubTotal int32 `json:"subTotal"`
+	Tax      int32 `json:"tax"`
+	Total    int32 `json:"total"`
+
+	// Payments lists how the total was refunded, to the invoice's payment methods first,
+	// with any remainder returned as store credit.
+	Payments []Payment `json:"payments"`
+
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// RefundsURL returns the location of an Invoice's Refunds, relative to the Billing API.
+func RefundsURL(invoiceReference string) string {
+	return InvoiceURL(invoiceReference) + "/refunds"
+}
+
+// paymentKey identifies the payment method a Payment was made with.
+func paymentKey(p Payment) string {
+	return p.Type + ":" + p.PaymentMethodID
+}
+
+// prorate returns the part of amount due for quantity of total units, rounded down.
+func prorate(amount int32, quantity int32, total int32) int32 {
+	return int32(int64(amount) * int64(quantity) / int64(total))
+}
+
+// newRefund builds a Refund of items from an Invoice, taking into account the earlier refunds against it.
+func newRefund(invoice *Invoice, previous []Refund, input *RefundInput) (*Refund, error) {
+	refunded := make(map[string]int32)
+	paid := make(map[string]int32)
+	for _, r := range previous {
+		for _, l := range r.LineItems {
+			refunded[l.SKU] += l.Quantity
+		}
+		for _, p := range r.Payments {
+			paid[paymentKey(p)] += p.Amount
+		}
+	}
+
+	refund := Refund{
+		Reference:        input.Reference,
+		InvoiceReference: invoice.Reference,
+		CustomerID:       invoice.CustomerID,
+		CreatedAt:        time.Now().UTC(),
+	}
+
+	for _, item := range input.Items {
+		i := slices.IndexFunc(invoice.LineItems, func(l InvoiceLineItem) bool { return l.SKU == item.SKU })
+		if i < 0 {
+			return nil, fmt.Errorf("%s is not on invoice %s", item.SKU, invoice.Reference)
+		}
+		line := invoice.LineItems[i]
+
+		before := refunded[item.SKU]
+		after := before + item.Quantity
+		if after > line.Quantity {
+			return nil, fmt.Errorf("only %d of %s can be refunded", line.Quantity-before, item.SKU)
+		}
+		refunded[item.SKU] = after
+
+		// Prorating the running total carries rounding to the last unit refunded,
+		// so that refunding every unit refunds the whole line.
+		l := RefundLineItem{
+			SKU:      item.SKU,
+			Quantity: item.Quantity,
+			SubTotal: prorate(line.SubTotal, after, line.Quantity) - prorate(line.SubTotal, before, line.Quantity),
+			Tax:      prorate(line.Tax, after, line.Quantity) - prorate(line.Tax, before, line.Quantity),
+		}
+		l.Total = l.SubTotal + l.Tax
+
+		refund.LineItems = append(refund.LineItems, l)
+		refund.SubTotal += l.SubTotal
+		refund.Tax += l.Tax
+		refund.Total += l.Total
+	}
+
+	// Refund the payment method charged last first, store credit is always returned as credit.
+	remaining := refund.Total
+	var credit int32
+	for i := len(invoice.Payments) - 1; i >= 0; i-- {
+		p := invoice.Payments[i]
+		amount := min(remaining, p.Amount-paid[paymentKey(p)])
+		if amount <= 0 {
+			continue
+		}
+		remaining -= amount
+
+		if p.Type == PaymentMethodTypeCredit {
+			credit += amount
+			continue
+		}
+		refund.Payments = append(refund.Payments, Payment{PaymentMethodID: p.PaymentMethodID, Type: p.Type, Amount: amount})
+	}
+	if credit += remaining; credit > 0 {
+		refund.Payments = append(refund.Payments, Payment{Type: PaymentMethodTypeCredit, Amount: credit})
+	}
+
+	return &refund, nil
+}
+
+// refundCredit returns the part of a Refund returned as store credit.
+func refundCredit(refund *Refund) int32 {
+	var credit int32
+	for _, p := range refund.Payments {
+		if p.Type == PaymentMethodTypeCredit {
+			credit += p.Amount
+		}
+	}
+	return credit
+}
+
+// ensureStoreCredit creates a store credit balance for a customer who does not have one.
+func (h *handlers) ensureStoreCredit(ctx context.Context, customerID string) error {
+	var methods []db.PaymentMethod
+
+	if err := h.db.GetPaymentMethods(ctx, customerID, &methods); err != nil {
+		return err
+	}
+
+	for _, m := range methods {
+		if m.Type == PaymentMethodTypeCredit {
+			return nil
+		}
+	}
+
+	m, err := newPaymentMethod(customerID, &PaymentMethodInput{Type: PaymentMethodTypeCredit})
+	if err != nil {
+		return err
+	}
+
+	return h.db.InsertPaymentMethod(ctx, m)
+}
+
+// getRefunds returns the Refunds against an Invoice, oldest first.
+func (h *handlers) getRefunds(ctx context.Context, invoiceReference string) ([]Refund, error) {
+	var records []db.Refund
+
+	if err := h.db.GetRefunds(ctx, invoiceReference, &records); err != nil {
+		return nil, err
+	}
+
+	refunds := make([]Refund, len(records))
+	for i, r := range records {
+		if err := json.Unmarshal([]byte(r.Document), &refunds[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	return refunds, nil
+}
+
+func (h *handlers) writeRefund(w http.ResponseWriter, status int, refund *Refund) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(refund); err != nil {
+		h.logger.Error("Failed to encode refund", "error", err)
+	}
+}
+
+func (h *handlers) handleCreateRefund(w http.ResponseWriter, r *http.Request) {
+	var input RefundInput
+
+	err := json.NewDecoder(r.Body).Decode(&input)
+	if err != nil {
+		h.logger.Error("Failed to decode refund input", "error", err)
+		h.writeError(w, http.StatusBadRequest, ErrorResponse{Code: ErrorCodeInvalidInput, Message: err.Error()})
+		return
+	}
+
+	if input.Reference == "" || len(input.Items) == 0 {
+		h.writeError(w, http.StatusBadRequest, ErrorResponse{Code: ErrorCodeInvalidInput, Message: "reference and items are required"})
+		return
+	}
+	for _, item := range input.Items {
+		if item.SKU == "" || item.Quantity <= 0 {
+			h.writeError(w, http.StatusBadRequest, ErrorResponse{Code: ErrorCodeInvalidInput, Message: "items must have a SKU and a positive quantity"})
+			return
+		}
+	}
+
+	var record db.Invoice
+
+	err = h.db.GetInvoice(r.Context(), r.PathValue("reference"), &record)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			h.writeError(w, http.StatusNotFound, ErrorResponse{Code: ErrorCodeNotFound, Message: "Invoice not found"})
+		} else {
+			h.logger.Error("Failed to get invoice", "error", err)
+			h.writeError(w, http.StatusInternalServerError, ErrorResponse{Code: ErrorCodeInternal, Message: err.Error()})
+		}
+		return
+	}
+
+	var invoice Invoice
+	if err := json.Unmarshal([]byte(record.Document), &invoice); err != nil {
+		h.logger.Error("Failed to decode invoice", "error", err)
+		h.writeError(w, http.StatusInternalServerError, ErrorResponse{Code: ErrorCodeInternal, Message: err.Error()})
+		return
+	}
+
+	previous, err := h.getRefunds(r.Context(), invoice.Reference)
+	if err != nil {
+		h.logger.Error("Failed to list refunds", "error", err)
+		h.writeError(w, http.StatusInternalServerError, ErrorResponse{Code: ErrorCodeInternal, Message: err.Error()})
+		return
+	}
+
+	for _, p := range previous {
+		if p.Reference == input.Reference {
+			h.writeRefund(w, http.StatusOK, &p)
+			return
+		}
+	}
+
+	if invoice.PaymentStatus != InvoiceStatusPaid {
+		h.writeError(w, http.StatusConflict, ErrorResponse{Code: ErrorCodeConflict, Message: "Only paid invoices can be refunded"})
+		return
+	}
+
+	refund, err := newRefund(&invoice, previous, &input)
+	if err != nil {
+		h.writeError(w, http.StatusConflict, ErrorResponse{Code: ErrorCodeConflict, Message: err.Error()})
+		return
+	}
+
+	credit := refundCredit(refund)
+	if credit > 0 {
+		if err := h.ensureStoreCredit(r.Context(), refund.CustomerID); err != nil {
+			h.logger.Error("Failed to create store credit", "error", err)
+			h.writeError(w, http.StatusInternalServerError, ErrorResponse{Code: ErrorCodeInternal, Message: err.Error()})
+			return
+		}
+	}
+
+	document, err := json.Marshal(refund)
+	if err != nil {
+		h.logger.Error("Failed to encode refund", "error", err)
+		h.writeError(w, http.StatusInternalServerError, ErrorResponse{Code: ErrorCodeInternal, Message: err.Error()})
+		return
+	}
+
+	stored := db.Refund{
+		Reference:        refund.Reference,
+		InvoiceReference: refund.InvoiceReference,
+		CustomerID:       refund.CustomerID,
+		Amount:           refund.Total,
+		Credit:           credit,
+		Document:         string(document),
+		CreatedAt:        refund.CreatedAt,
+	}
+
+	if err := h.db.InsertRefund(r.Context(), &stored); err != nil {
+		h.logger.Error("Failed to record refund", "error", err)
+		h.writeError(w, http.StatusInternalServerError, ErrorResponse{Code: ErrorCodeInternal, Message: err.Error()})
+		return
+	}
+
+	// A concurrent request with the same reference may have recorded the refund first.
+	if err := json.Unmarshal([]byte(stored.Document), refund); err != nil {
+		h.logger.Error("Failed to decode refund", "error", err)
+		h.writeError(w, http.StatusInternalServerError, ErrorResponse{Code: ErrorCodeInternal, Message: err.Error()})
+		return
+	}
+
+	h.logger.Info("Refund", "Customer", refund.CustomerID, "Invoice", refund.InvoiceReference, "Reference", refund.Reference, "Total", refund.Total)
+
+	h.writeRefund(w, http.StatusCreated, refund)
+}
+
+func (h *handlers) handleListRefunds(w http.ResponseWriter, r *http.Request) {
+	refunds, err := h.getRefunds(r.Context(), r.PathValue("reference"))
+	if err != nil {
+		h.logger.Error("Failed to list refunds", "error", err)
+		h.writeError(w, http.StatusInternalServerError, ErrorResponse{Code: ErrorCodeInternal, Message: err.Error()})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(refunds); err != nil {
+		h.logger.Error("Failed to encode refunds", "error", err)
+	}
+}
@@ -0,0 +1,99 @@
+package billing_test
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/temporalio/reference-app-orders-go/app/billing"
+)
+
+func TestRefundAPI(t *testing.T) {
+	r := testBillingAPI(t)
+
+	invoice := billing.Invoice{
+		Reference:  "order1:1",
+		CustomerID: "customer1",
+		LineItems: []billing.InvoiceLineItem{
+			{SKU: "Hiking Boots", Quantity: 2, UnitPrice: 5000, SubTotal: 10000, Tax: 2000, Shipping: 1000, Total: 13000},
+			{SKU: "Socks", Quantity: 3, UnitPrice: 333, SubTotal: 1000, Tax: 200, Total: 1200},
+		},
+		SubTotal:      11000,
+		Tax:           2200,
+		Shipping:      1000,
+		Total:         14200,
+		PaymentStatus: billing.InvoiceStatusPaid,
+		Payments: []billing.Payment{
+			{Type: billing.PaymentMethodTypeCredit, Amount: 7000},
+			{PaymentMethodID: "pm_1", Type: billing.PaymentMethodTypeCard, Amount: 7200, AuthCode: "1234"},
+		},
+		CreatedAt: time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC),
+	}
+	require.Equal(t, http.StatusOK, doJSON(t, r, "POST", "/invoices", invoice, nil))
+
+	url := billing.RefundsURL(invoice.Reference)
+
+	var refund billing.Refund
+	code := doJSON(t, r, "POST", url, billing.RefundInput{
+		Reference: "return1",
+		Items:     []billing.Item{{SKU: "Hiking Boots", Quantity: 1}},
+	}, &refund)
+	require.Equal(t, http.StatusCreated, code)
+	require.Equal(t, int32(6000), refund.Total, "shipping is not refunded")
+	require.Equal(t, []billing.Payment{{PaymentMethodID: "pm_1", Type: billing.PaymentMethodTypeCard, Amount: 6000}}, refund.Payments)
+
+	// Repeating a refund does not refund the items again.
+	code = doJSON(t, r, "POST", url, billing.RefundInput{
+		Reference: "return1",
+		Items:     []billing.Item{{SKU: "Hiking Boots", Quantity: 1}},
+	}, &refund)
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, int32(6000), refund.Total)
+
+	code = doJSON(t, r, "POST", url, billing.RefundInput{
+		Reference: "return2",
+		Items:     []billing.Item{{SKU: "Socks", Quantity: 1}},
+	}, &refund)
+	require.Equal(t, http.StatusCreated, code)
+	require.Equal(t, int32(399), refund.Total)
+
+	// Once the card has been refunded in full the remainder is returned as store credit,
+	// and refunding the last of a line refunds any rounding.
+	code = doJSON(t, r, "POST", url, billing.RefundInput{
+		Reference: "return3",
+		Items:     []billing.Item{{SKU: "Hiking Boots", Quantity: 1}, {SKU: "Socks", Quantity: 2}},
+	}, &refund)
+	require.Equal(t, http.StatusCreated, code)
+	require.Equal(t, int32(6801), refund.Total)
+	require.Equal(t, []billing.Payment{
+		{PaymentMethodID: "pm_1", Type: billing.PaymentMethodTypeCard, Amount: 801},
+		{Type: billing.PaymentMethodTypeCredit, Amount: 6000},
+	}, refund.Payments)
+
+	var methods []billing.PaymentMethod
+	require.Equal(t, http.StatusOK, doJSON(t, r, "GET", "/customers/customer1/payment-methods", nil, &methods))
+	require.Len(t, methods, 1)
+	require.Equal(t, billing.PaymentMethodTypeCredit, methods[0].Type)
+	require.Equal(t, int32(6000), methods[0].Balance)
+
+	code = doJSON(t, r, "POST", url, billing.RefundInput{
+		Reference: "return4",
+		Items:     []billing.Item{{SKU: "Hiking Boots", Quantity: 1}},
+	}, nil)
+	require.Equal(t, http.StatusConflict, code, "items cannot be refunded more than once")
+
+	code = doJSON(t, r, "POST", url, billing.RefundInput{Reference: "return4"}, nil)
+	require.Equal(t, http.StatusBadRequest, code)
+
+	code = doJSON(t, r, "POST", billing.RefundsURL("missing"), billing.RefundInput{
+		Reference: "return4",
+		Items:     []billing.Item{{SKU: "Hiking Boots", Quantity: 1}},
+	}, nil)
+	require.Equal(t, http.StatusNotFound, code)
+
+	var refunds []billing.Refund
+	require.Equal(t, http.StatusOK, doJSON(t, r, "GET", url, nil, &refunds))
+	require.Len(t, refunds, 3)
+	require.Equal(t, "return1", refunds[0].Reference)
+}
@@ -14,7 +14,7 @@ func RunWorker(ctx context.Context, config config.AppConfig, client client.Clien
 	w := worker.New(client, TaskQueue, worker.Options{})
 
 	w.RegisterWorkflow(Charge)
-	w.RegisterActivity(&Activities{FraudCheckURL: config.FraudURL})
+	w.RegisterActivity(&Activities{BillingURL: config.BillingURL, FraudCheckURL: config.FraudURL})
 
 	return w.Run(temporalutil.WorkerInterruptFromContext(ctx))
 }
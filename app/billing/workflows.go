@@ -3,12 +3,102 @@ package billing
 import (
 	"time"
 
+	"github.com/temporalio/reference-app-orders-go/app/fraud"
+	"go.temporal.io/sdk/log"
+	"go.temporal.io/sdk/temporal"
 	"go.temporal.io/sdk/workflow"
 )
 
+type chargeImpl struct {
+	status ChargeStatus
+	logger log.Logger
+}
+
 // Charge Workflow invoices and processes payment for a fulfillment.
 func Charge(ctx workflow.Context, input *ChargeInput) (*ChargeResult, error) {
-	logger := workflow.GetLogger(ctx)
+	wf := new(chargeImpl)
+
+	if err := wf.setup(ctx, input); err != nil {
+		return nil, err
+	}
+
+	var result *ChargeResult
+	var err error
+
+	// Charges started before invoices were recorded and fraud checked as separate steps
+	// replay the original sequence of activities.
+	if workflow.GetVersion(ctx, recordInvoiceChangeID, workflow.DefaultVersion, 1) == workflow.DefaultVersion {
+		result, err = wf.runUnrecorded(ctx, input)
+	} else {
+		result, err = wf.run(ctx, input)
+	}
+	if err != nil {
+		wf.status.Status = ChargeStatusFailed
+		wf.status.Error = err.Error()
+	} else {
+		wf.status.Status = ChargeStatusCompleted
+		wf.status.Result = result
+	}
+
+	if input.CallbackURL != "" {
+		wf.notifyCallback(ctx, input.CallbackURL)
+	}
+
+	return result, err
+}
+
+func (wf *chargeImpl) setup(ctx workflow.Context, input *ChargeInput) error {
+	wf.status = ChargeStatus{
+		ID:     ChargeIDFromWorkflowID(workflow.GetInfo(ctx).WorkflowExecution.ID),
+		Status: ChargeStatusPending,
+	}
+
+	wf.logger = log.With(
+		workflow.GetLogger(ctx),
+		"chargeId", wf.status.ID,
+		"customerId", input.CustomerID,
+	)
+
+	return workflow.SetQueryHandler(ctx, StatusQuery, func() (*ChargeStatus, error) {
+		return &wf.status, nil
+	})
+}
+
+// invoiceActivityOptions are used for the GenerateInvoice activity.
+// Invalid input is never retried, other failures are retried a few times.
+var invoiceActivityOptions = workflow.ActivityOptions{
+	StartToCloseTimeout: 5 * time.Second,
+	RetryPolicy: &temporal.RetryPolicy{
+		InitialInterval:        time.Second,
+		BackoffCoefficient:     2,
+		MaximumInterval:        10 * time.Second,
+		MaximumAttempts:        5,
+		NonRetryableErrorTypes: []string{InvalidInputErrorType},
+	},
+}
+
+// chargeActivityOptions are used for the CheckFraud and ChargeCustomer activities.
+// Rejected fraud checks and invalid payment methods are not retried. The fraud
+// service may be unavailable for some time during maintenance, so other
+// failures are retried with backoff until the ScheduleToCloseTimeout is reached.
+var chargeActivityOptions = workflow.ActivityOptions{
+	StartToCloseTimeout:    10 * time.Second,
+	ScheduleToCloseTimeout: 10 * time.Minute,
+	RetryPolicy: &temporal.RetryPolicy{
+		InitialInterval:        2 * time.Second,
+		BackoffCoefficient:     2,
+		MaximumInterval:        time.Minute,
+		NonRetryableErrorTypes: []string{FraudCheckRejectedErrorType, PaymentMethodNotFoundErrorType, InvalidInputErrorType},
+	},
+}
+
+// recordInvoiceChangeID versions the Charge workflow from when it began recording invoices and
+// checking fraud with its own activities, rather than generating the invoice and charging only.
+const recordInvoiceChangeID = "RecordInvoice"
+
+// runUnrecorded is the Charge workflow as it was before invoices were recorded. It is kept for
+// charges started by an earlier version of the workflow, and may be removed once none are running.
+func (wf *chargeImpl) runUnrecorded(ctx workflow.Context, input *ChargeInput) (*ChargeResult, error) {
 	ctx = workflow.WithActivityOptions(ctx,
 		workflow.ActivityOptions{
 			ScheduleToCloseTimeout: 30 * time.Second,
@@ -17,35 +107,30 @@ func Charge(ctx workflow.Context, input *ChargeInput) (*ChargeResult, error) {
 
 	var invoice GenerateInvoiceResult
 
-	cwf := workflow.ExecuteActivity(ctx,
+	err := workflow.ExecuteActivity(ctx,
 		a.GenerateInvoice,
 		GenerateInvoiceInput{
 			CustomerID: input.CustomerID,
 			Reference:  input.Reference,
 			Items:      input.Items,
 		},
-	)
-	err := cwf.Get(ctx, &invoice)
+	).Get(ctx, &invoice)
 	if err != nil {
 		return nil, err
 	}
 
 	var charge ChargeCustomerResult
 
-	cwf = workflow.ExecuteActivity(ctx,
+	err = workflow.ExecuteActivity(ctx,
 		a.ChargeCustomer,
 		ChargeCustomerInput{
 			CustomerID: input.CustomerID,
 			Reference:  invoice.InvoiceReference,
 			Charge:     invoice.Total,
 		},
-	)
-	if err := cwf.Get(ctx, &charge); err != nil {
-		logger.Warn("Charge failed", "customer_id", input.CustomerID, "error", err)
-		charge.Success = false
-	}
+	).Get(ctx, &charge)
 
-	return &ChargeResult{
+	result := &ChargeResult{
 		InvoiceReference: invoice.InvoiceReference,
 		SubTotal:         invoice.SubTotal,
 		Tax:              invoice.Tax,
@@ -54,5 +139,233 @@ func Charge(ctx workflow.Context, input *ChargeInput) (*ChargeResult, error) {
 
 		Success:  charge.Success,
 		AuthCode: charge.AuthCode,
-	}, nil
+	}
+
+	// ChargeCustomer checked for fraud itself in this version, declining the charge by reporting failure.
+	switch {
+	case err != nil:
+		wf.logger.Warn("Charge failed", "error", err)
+
+		result.Success = false
+		result.Outcome = ChargeOutcomeError
+		result.PaymentError = err.Error()
+	case !charge.Success:
+		result.Outcome = ChargeOutcomeDeclined
+	default:
+		result.Outcome = ChargeOutcomeApproved
+	}
+
+	return result, nil
+}
+
+func (wf *chargeImpl) run(ctx workflow.Context, input *ChargeInput) (*ChargeResult, error) {
+	var invoice GenerateInvoiceResult
+
+	cwf := workflow.ExecuteActivity(workflow.WithActivityOptions(ctx, invoiceActivityOptions),
+		a.GenerateInvoice,
+		GenerateInvoiceInput{
+			CustomerID: input.CustomerID,
+			Reference:  input.Reference,
+			Items:      input.Items,
+		},
+	)
+	err := cwf.Get(ctx, &invoice)
+	if err != nil {
+		return nil, err
+	}
+
+	doc := &Invoice{
+		Reference:     invoice.InvoiceReference,
+		CustomerID:    input.CustomerID,
+		LineItems:     invoice.LineItems,
+		TaxBreakdown:  invoice.TaxBreakdown,
+		SubTotal:      invoice.SubTotal,
+		Shipping:      invoice.Shipping,
+		Tax:           invoice.Tax,
+		Total:         invoice.Total,
+		PaymentStatus: InvoiceStatusPending,
+		CreatedAt:     workflow.Now(ctx),
+	}
+	if err := recordInvoice(ctx, doc); err != nil {
+		return nil, err
+	}
+
+	result := &ChargeResult{
+		InvoiceReference: invoice.InvoiceReference,
+		SubTotal:         invoice.SubTotal,
+		Tax:              invoice.Tax,
+		Shipping:         invoice.Shipping,
+		Total:            invoice.Total,
+
+		InvoiceURL: InvoiceURL(invoice.InvoiceReference),
+	}
+
+	approved, err := wf.checkFraud(ctx, input, &invoice, result)
+	if err == nil && approved {
+		err = wf.chargeCustomer(ctx, input, &invoice, result, doc)
+	}
+
+	switch {
+	case err != nil:
+		// The payment could not be processed, which is distinct from the payment being declined.
+		wf.logger.Warn("Charge failed", "error", err)
+
+		result.Outcome = ChargeOutcomeError
+		result.PaymentError = err.Error()
+		doc.PaymentStatus = InvoiceStatusError
+	case !approved:
+		result.Outcome = ChargeOutcomeDeclined
+		doc.PaymentStatus = InvoiceStatusDeclined
+	}
+
+	if err := recordInvoice(ctx, doc); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// checkFraud checks the charge with the fraud service, waiting for a review decision if required.
+// It reports whether the charge may proceed.
+func (wf *chargeImpl) checkFraud(ctx workflow.Context, input *ChargeInput, invoice *GenerateInvoiceResult, result *ChargeResult) (bool, error) {
+	var check CheckFraudResult
+
+	err := workflow.ExecuteActivity(workflow.WithActivityOptions(ctx, chargeActivityOptions),
+		a.CheckFraud,
+		CheckFraudInput{
+			CustomerID: input.CustomerID,
+			ChargeID:   wf.status.ID,
+			Reference:  invoice.InvoiceReference,
+			Charge:     invoice.Total,
+			Items:      input.Items,
+		},
+	).Get(ctx, &check)
+	if err != nil {
+		return false, err
+	}
+
+	switch {
+	case check.Decision == fraud.DecisionReview:
+		result.Review = wf.awaitReview(ctx, &check)
+		if result.Review.Decision == fraud.ReviewApprove {
+			return true, nil
+		}
+	case check.Declined || check.Decision == fraud.DecisionDecline:
+	default:
+		return true, nil
+	}
+
+	result.FraudRule = check.Rule
+	return false, nil
+}
+
+// defaultReviewTimeout is used if the fraud service does not say when a review expires.
+const defaultReviewTimeout = time.Hour
+
+// awaitReview waits for the decision on a fraud review, which is delivered by signal.
+// If no decision arrives before the review expires its default decision is used.
+func (wf *chargeImpl) awaitReview(ctx workflow.Context, check *CheckFraudResult) *ReviewResult {
+	review := &ReviewResult{ID: check.ReviewID}
+
+	timeout := defaultReviewTimeout
+	if check.ReviewExpiresAt != nil {
+		timeout = check.ReviewExpiresAt.Sub(workflow.Now(ctx))
+	}
+
+	wf.logger.Info("Charge held for fraud review", "reviewId", review.ID, "timeout", timeout)
+
+	wf.status.ReviewID = review.ID
+	defer func() { wf.status.ReviewID = "" }()
+
+	timerCtx, cancelTimer := workflow.WithCancel(ctx)
+	defer cancelTimer()
+
+	s := workflow.NewSelector(ctx)
+	s.AddReceive(workflow.GetSignalChannel(ctx, ReviewSignal), func(c workflow.ReceiveChannel, _ bool) {
+		var decision ReviewDecision
+		c.Receive(ctx, &decision)
+
+		if decision.ReviewID != review.ID {
+			wf.logger.Warn("Ignoring decision for another review", "reviewId", decision.ReviewID)
+			return
+		}
+		review.Decision = decision.Decision
+	})
+	if timeout > 0 {
+		s.AddFuture(workflow.NewTimer(timerCtx, timeout), func(workflow.Future) {
+			review.TimedOut = true
+		})
+	} else {
+		review.TimedOut = true
+	}
+
+	for review.Decision == "" && !review.TimedOut {
+		s.Select(ctx)
+	}
+
+	if review.TimedOut {
+		review.Decision = check.ReviewDefault
+		if review.Decision == "" {
+			review.Decision = fraud.ReviewReject
+		}
+	}
+
+	wf.logger.Info("Fraud review decided", "reviewId", review.ID, "decision", review.Decision, "timedOut", review.TimedOut)
+
+	return review
+}
+
+// chargeCustomer takes payment for a charge which has passed the fraud check.
+func (wf *chargeImpl) chargeCustomer(ctx workflow.Context, input *ChargeInput, invoice *GenerateInvoiceResult, result *ChargeResult, doc *Invoice) error {
+	var charge ChargeCustomerResult
+
+	err := workflow.ExecuteActivity(workflow.WithActivityOptions(ctx, chargeActivityOptions),
+		a.ChargeCustomer,
+		ChargeCustomerInput{
+			CustomerID:      input.CustomerID,
+			PaymentMethodID: input.PaymentMethodID,
+			Reference:       invoice.InvoiceReference,
+			Charge:          invoice.Total,
+		},
+	).Get(ctx, &charge)
+	if err != nil {
+		return err
+	}
+
+	result.Success = true
+	result.AuthCode = charge.AuthCode
+	result.Outcome = ChargeOutcomeApproved
+	result.Payments = charge.Payments
+	doc.PaymentStatus = InvoiceStatusPaid
+	doc.AuthCode = charge.AuthCode
+	doc.Payments = charge.Payments
+
+	return nil
+}
+
+// notifyCallback sends the final status of the Charge to the requestor's callback URL.
+// Failure to deliver the callback does not affect the outcome of the Charge, the status
+// is still available via the status query.
+func (wf *chargeImpl) notifyCallback(ctx workflow.Context, url string) {
+	ctx = workflow.WithActivityOptions(ctx,
+		workflow.ActivityOptions{
+			StartToCloseTimeout:    10 * time.Second,
+			ScheduleToCloseTimeout: 5 * time.Minute,
+		},
+	)
+
+	err := workflow.ExecuteActivity(ctx,
+		a.NotifyChargeCallback,
+		ChargeCallbackInput{URL: url, Status: wf.status},
+	).Get(ctx, nil)
+	if err != nil {
+		wf.logger.Warn("Failed to deliver charge callback", "url", url, "error", err)
+	}
+}
+
+func recordInvoice(ctx workflow.Context, invoice *Invoice) error {
+	ctx = workflow.WithLocalActivityOptions(ctx, workflow.LocalActivityOptions{
+		ScheduleToCloseTimeout: 5 * time.Second,
+	})
+	return workflow.ExecuteLocalActivity(ctx, a.RecordInvoice, invoice).Get(ctx, nil)
 }
@@ -0,0 +1,329 @@
+package billing_test
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/temporalio/reference-app-orders-go/app/billing"
+	"github.com/temporalio/reference-app-orders-go/app/fraud"
+	"go.temporal.io/sdk/activity"
+	"go.temporal.io/sdk/client"
+	"go.temporal.io/sdk/converter"
+	"go.temporal.io/sdk/temporal"
+	"go.temporal.io/sdk/testsuite"
+	"go.temporal.io/sdk/workflow"
+)
+
+func TestChargeWorkflow(t *testing.T) {
+	s := testsuite.WorkflowTestSuite{}
+	env := s.NewTestWorkflowEnvironment()
+	var a *billing.Activities
+
+	env.SetStartWorkflowOptions(client.StartWorkflowOptions{ID: "Charge:test"})
+
+	env.RegisterActivity(a.GenerateInvoice)
+	env.OnActivity(a.RecordInvoice, mock.Anything, mock.Anything).Return(nil)
+	env.OnActivity(a.CheckFraud, mock.Anything, mock.Anything).Return(&billing.CheckFraudResult{Decision: fraud.DecisionApprove}, nil)
+	env.OnActivity(a.ChargeCustomer, mock.Anything, mock.Anything).Return(func(_ context.Context, _ *billing.ChargeCustomerInput) (*billing.ChargeCustomerResult, error) {
+		return &billing.ChargeCustomerResult{Success: true, AuthCode: "1234"}, nil
+	})
+	env.OnActivity(a.NotifyChargeCallback, mock.Anything, mock.MatchedBy(func(input *billing.ChargeCallbackInput) bool {
+		return input.URL == "http://callback" &&
+			input.Status.ID == "test" &&
+			input.Status.Status == billing.ChargeStatusCompleted &&
+			input.Status.Result.Success
+	})).Return(nil).Once()
+
+	env.ExecuteWorkflow(billing.Charge, &billing.ChargeInput{
+		CustomerID:  "customer1",
+		Reference:   "order1:1",
+		Items:       []billing.Item{{SKU: "test1", Quantity: 1}},
+		CallbackURL: "http://callback",
+	})
+
+	var result billing.ChargeResult
+	require.NoError(t, env.GetWorkflowResult(&result))
+	assert.True(t, result.Success)
+	assert.Equal(t, "/invoices/order1:1", result.InvoiceURL)
+
+	v, err := env.QueryWorkflow(billing.StatusQuery)
+	require.NoError(t, err)
+
+	var status billing.ChargeStatus
+	require.NoError(t, v.Get(&status))
+	assert.Equal(t, billing.ChargeStatusCompleted, status.Status)
+	assert.Equal(t, result, *status.Result)
+
+	env.AssertExpectations(t)
+}
+
+func TestChargeWorkflowUnrecordedVersion(t *testing.T) {
+	tests := []struct {
+		name     string
+		charge   *billing.ChargeCustomerResult
+		err      error
+		expected billing.ChargeResult
+	}{
+		{
+			name:     "approved",
+			charge:   &billing.ChargeCustomerResult{Success: true, AuthCode: "1234"},
+			expected: billing.ChargeResult{Success: true, AuthCode: "1234", Outcome: billing.ChargeOutcomeApproved},
+		},
+		{
+			// ChargeCustomer declined charges which failed its fraud check by reporting failure.
+			name:     "declined",
+			charge:   &billing.ChargeCustomerResult{Success: false, AuthCode: "1234"},
+			expected: billing.ChargeResult{AuthCode: "1234", Outcome: billing.ChargeOutcomeDeclined},
+		},
+		{
+			name:     "error",
+			err:      temporal.NewNonRetryableApplicationError("fraud check failed", "test", nil),
+			expected: billing.ChargeResult{Outcome: billing.ChargeOutcomeError},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s := testsuite.WorkflowTestSuite{}
+			env := s.NewTestWorkflowEnvironment()
+			var a *billing.Activities
+
+			env.SetStartWorkflowOptions(client.StartWorkflowOptions{ID: "Charge:test"})
+
+			// A charge started before invoices were recorded replays without the RecordInvoice and CheckFraud activities.
+			env.OnGetVersion("RecordInvoice", workflow.DefaultVersion, 1).Return(workflow.DefaultVersion)
+			env.RegisterActivity(a.GenerateInvoice)
+			env.OnActivity(a.ChargeCustomer, mock.Anything, mock.Anything).Return(tc.charge, tc.err)
+
+			env.ExecuteWorkflow(billing.Charge, &billing.ChargeInput{
+				CustomerID: "customer1",
+				Reference:  "order1:1",
+				Items:      []billing.Item{{SKU: "test1", Quantity: 1}},
+			})
+
+			var result billing.ChargeResult
+			require.NoError(t, env.GetWorkflowResult(&result))
+			assert.Equal(t, tc.expected.Success, result.Success)
+			assert.Equal(t, tc.expected.AuthCode, result.AuthCode)
+			assert.Equal(t, tc.expected.Outcome, result.Outcome)
+			assert.Equal(t, tc.err != nil, result.PaymentError != "")
+
+			env.AssertNotCalled(t, "RecordInvoice", mock.Anything, mock.Anything)
+			env.AssertNotCalled(t, "CheckFraud", mock.Anything, mock.Anything)
+		})
+	}
+}
+
+func TestChargeWorkflowFraudReview(t *testing.T) {
+	tests := []struct {
+		name     string
+		decision *billing.ReviewDecision
+		expected billing.ChargeResult
+	}{
+		{
+			name:     "approved",
+			decision: &billing.ReviewDecision{ReviewID: "review1", Decision: fraud.ReviewApprove},
+			expected: billing.ChargeResult{Success: true, Outcome: billing.ChargeOutcomeApproved, Review: &billing.ReviewResult{ID: "review1", Decision: fraud.ReviewApprove}},
+		},
+		{
+			name:     "rejected",
+			decision: &billing.ReviewDecision{ReviewID: "review1", Decision: fraud.ReviewReject},
+			expected: billing.ChargeResult{Outcome: billing.ChargeOutcomeDeclined, Review: &billing.ReviewResult{ID: "review1", Decision: fraud.ReviewReject}},
+		},
+		{
+			name:     "timed out",
+			expected: billing.ChargeResult{Success: true, Outcome: billing.ChargeOutcomeApproved, Review: &billing.ReviewResult{ID: "review1", Decision: fraud.ReviewApprove, TimedOut: true}},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s := testsuite.WorkflowTestSuite{}
+			env := s.NewTestWorkflowEnvironment()
+			var a *billing.Activities
+
+			env.SetStartWorkflowOptions(client.StartWorkflowOptions{ID: "Charge:test"})
+
+			env.RegisterActivity(a.GenerateInvoice)
+			env.OnActivity(a.RecordInvoice, mock.Anything, mock.Anything).Return(nil)
+			env.OnActivity(a.CheckFraud, mock.Anything, mock.MatchedBy(func(input *billing.CheckFraudInput) bool {
+				return input.ChargeID == "test"
+			})).Return(func(_ context.Context, _ *billing.CheckFraudInput) (*billing.CheckFraudResult, error) {
+				expires := env.Now().Add(time.Hour)
+				return &billing.CheckFraudResult{
+					Decision:        fraud.DecisionReview,
+					RiskScore:       80,
+					ReviewID:        "review1",
+					ReviewExpiresAt: &expires,
+					ReviewDefault:   fraud.ReviewApprove,
+				}, nil
+			})
+			env.OnActivity(a.ChargeCustomer, mock.Anything, mock.Anything).Return(&billing.ChargeCustomerResult{Success: true}, nil).Maybe()
+
+			env.RegisterDelayedCallback(func() {
+				v, err := env.QueryWorkflow(billing.StatusQuery)
+				require.NoError(t, err)
+
+				var status billing.ChargeStatus
+				require.NoError(t, v.Get(&status))
+				assert.Equal(t, billing.ChargeStatusPending, status.Status)
+				assert.Equal(t, "review1", status.ReviewID)
+
+				// Decisions for earlier reviews are ignored.
+				env.SignalWorkflow(billing.ReviewSignal, billing.ReviewDecision{ReviewID: "review0", Decision: fraud.ReviewReject})
+				if tc.decision != nil {
+					env.SignalWorkflow(billing.ReviewSignal, tc.decision)
+				}
+			}, 10*time.Minute)
+
+			env.ExecuteWorkflow(billing.Charge, &billing.ChargeInput{
+				CustomerID: "customer1",
+				Reference:  "order1:1",
+				Items:      []billing.Item{{SKU: "test1", Quantity: 1}},
+			})
+
+			var result billing.ChargeResult
+			require.NoError(t, env.GetWorkflowResult(&result))
+			assert.Equal(t, tc.expected.Success, result.Success)
+			assert.Equal(t, tc.expected.Outcome, result.Outcome)
+			assert.Equal(t, tc.expected.Review, result.Review)
+		})
+	}
+}
+
+// maintenanceFraudAPI returns a fraud API in maintenance mode which leaves
+// maintenance after the given number of check requests have been rejected.
+func maintenanceFraudAPI(t *testing.T, rejections int32) (*httptest.Server, *atomic.Int32) {
+	r := fraud.Router(testStore(t), slog.Default())
+
+	req := httptest.NewRequest("POST", "/maintenance", nil)
+	r.ServeHTTP(httptest.NewRecorder(), req)
+
+	var checks atomic.Int32
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/check" && checks.Add(1) == rejections+1 {
+			r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/maintenance", strings.NewReader(`{"enabled":false}`)))
+		}
+		r.ServeHTTP(w, req)
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv, &checks
+}
+
+func TestChargeWorkflowRetriesDuringFraudMaintenance(t *testing.T) {
+	s := testsuite.WorkflowTestSuite{}
+	env := s.NewTestWorkflowEnvironment()
+
+	fraudAPI, checks := maintenanceFraudAPI(t, 2)
+	a := &billing.Activities{FraudCheckURL: fraudAPI.URL}
+
+	env.RegisterActivity(a.GenerateInvoice)
+	env.RegisterActivity(a.CheckFraud)
+	env.RegisterActivity(a.ChargeCustomer)
+	env.OnActivity(a.RecordInvoice, mock.Anything, mock.Anything).Return(nil)
+
+	env.ExecuteWorkflow(billing.Charge, &billing.ChargeInput{
+		CustomerID: "customer1",
+		Reference:  "order1:1",
+		Items:      []billing.Item{{SKU: "test1", Quantity: 1}},
+	})
+
+	var result billing.ChargeResult
+	require.NoError(t, env.GetWorkflowResult(&result))
+	assert.True(t, result.Success)
+	assert.Equal(t, billing.ChargeOutcomeApproved, result.Outcome)
+	assert.Equal(t, int32(3), checks.Load())
+}
+
+func TestChargeWorkflowPaymentErrorWhenFraudUnavailable(t *testing.T) {
+	s := testsuite.WorkflowTestSuite{}
+	env := s.NewTestWorkflowEnvironment()
+
+	fraudAPI, checks := maintenanceFraudAPI(t, math.MaxInt32)
+	a := &billing.Activities{FraudCheckURL: fraudAPI.URL}
+
+	env.RegisterActivity(a.GenerateInvoice)
+	env.RegisterActivity(a.CheckFraud)
+	env.RegisterActivity(a.ChargeCustomer)
+	env.OnActivity(a.RecordInvoice, mock.Anything, mock.MatchedBy(func(invoice *billing.Invoice) bool {
+		return invoice.PaymentStatus == billing.InvoiceStatusPending
+	})).Return(nil).Once()
+	env.OnActivity(a.RecordInvoice, mock.Anything, mock.MatchedBy(func(invoice *billing.Invoice) bool {
+		return invoice.PaymentStatus == billing.InvoiceStatusError
+	})).Return(nil).Once()
+
+	env.ExecuteWorkflow(billing.Charge, &billing.ChargeInput{
+		CustomerID: "customer1",
+		Reference:  "order1:1",
+		Items:      []billing.Item{{SKU: "test1", Quantity: 1}},
+	})
+
+	var result billing.ChargeResult
+	require.NoError(t, env.GetWorkflowResult(&result))
+	assert.False(t, result.Success)
+	assert.Equal(t, billing.ChargeOutcomeError, result.Outcome)
+	assert.NotEmpty(t, result.PaymentError)
+	assert.Greater(t, checks.Load(), int32(1))
+
+	env.AssertExpectations(t)
+}
+
+func TestCheckFraudHonoursRetryAfter(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Retry-After", "120")
+		http.Error(w, "Fraud service is in maintenance mode", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	s := testsuite.WorkflowTestSuite{}
+	env := s.NewTestActivityEnvironment()
+
+	a := &billing.Activities{FraudCheckURL: srv.URL}
+	env.RegisterActivity(a.CheckFraud)
+
+	_, err := env.ExecuteActivity(a.CheckFraud, &billing.CheckFraudInput{CustomerID: "customer1", Charge: 100})
+
+	var appErr *temporal.ApplicationError
+	require.ErrorAs(t, err, &appErr)
+	assert.Equal(t, billing.FraudServiceUnavailableErrorType, appErr.Type())
+	assert.Equal(t, 120*time.Second, appErr.NextRetryDelay())
+}
+
+func TestChargeWorkflowDoesNotRetryInvalidInvoice(t *testing.T) {
+	s := testsuite.WorkflowTestSuite{}
+	env := s.NewTestWorkflowEnvironment()
+	var a *billing.Activities
+
+	env.RegisterActivity(a.GenerateInvoice)
+
+	attempts := 0
+	env.SetOnActivityStartedListener(func(_ *activity.Info, _ context.Context, _ converter.EncodedValues) {
+		attempts++
+	})
+
+	env.ExecuteWorkflow(billing.Charge, &billing.ChargeInput{
+		CustomerID: "customer1",
+		Reference:  "order1:1",
+	})
+
+	err := env.GetWorkflowError()
+
+	var appErr *temporal.ApplicationError
+	require.True(t, errors.As(err, &appErr))
+	assert.Equal(t, billing.InvalidInputErrorType, appErr.Type())
+
+	assert.Equal(t, 1, attempts)
+}
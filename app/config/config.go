@@ -4,20 +4,36 @@ import (
 	"fmt"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 )
 
-// AppConfig is a struct that holds the configuration for the Order/Shipment/Fraud/Billing system.
+// AppConfig is a struct that holds the configuration for the Order/Shipment/Fraud/Billing/Inventory system.
 type AppConfig struct {
-	BindOnIP     string
-	MongoURL     string
-	BillingPort  int32
-	BillingURL   string
-	OrderPort    int32
-	OrderURL     string
-	ShipmentPort int32
-	ShipmentURL  string
-	FraudPort    int32
-	FraudURL     string
+	BindOnIP      string
+	MongoURL      string
+	SQLitePath    string
+	BillingPort   int32
+	BillingURL    string
+	OrderPort     int32
+	OrderURL      string
+	ShipmentPort  int32
+	ShipmentURL   string
+	FraudPort     int32
+	FraudURL      string
+	InventoryPort int32
+	InventoryURL  string
+
+	// WarehouseCarriers maps a warehouse location to the names of the carriers which collect from it.
+	WarehouseCarriers map[string][]string
+
+	// CarrierWebhookSecrets maps a carrier name to the key it signs its webhook requests with.
+	// Webhooks are not accepted from carriers without a secret.
+	CarrierWebhookSecrets map[string]string
+
+	// ShipmentSLAs maps a shipment status to the longest a shipment may remain in it before
+	// being escalated. If not set the shipment system's defaults are used.
+	ShipmentSLAs map[string]time.Duration
 }
 
 // ServiceHostPort returns the host:port for a given service.
@@ -29,6 +45,8 @@ func (c *AppConfig) ServiceHostPort(service string) (string, error) {
 		port = c.BillingPort
 	case "fraud":
 		port = c.FraudPort
+	case "inventory":
+		port = c.InventoryPort
 	case "order":
 		port = c.OrderPort
 	case "shipment":
@@ -43,16 +61,18 @@ func (c *AppConfig) ServiceHostPort(service string) (string, error) {
 // AppConfigFromEnv creates an AppConfig from environment variables.
 func AppConfigFromEnv() (AppConfig, error) {
 	conf := AppConfig{
-		BindOnIP:     "127.0.0.1",
-		MongoURL:     "",
-		BillingPort:  8081,
-		BillingURL:   "http://127.0.0.1:8081",
-		OrderPort:    8082,
-		OrderURL:     "http://127.0.0.1:8082",
-		ShipmentPort: 8083,
-		ShipmentURL:  "http://127.0.0.1:8083",
-		FraudPort:    8084,
-		FraudURL:     "http://127.0.0.1:8084",
+		BindOnIP:      "127.0.0.1",
+		MongoURL:      "",
+		BillingPort:   8081,
+		BillingURL:    "http://127.0.0.1:8081",
+		OrderPort:     8082,
+		OrderURL:      "http://127.0.0.1:8082",
+		ShipmentPort:  8083,
+		ShipmentURL:   "http://127.0.0.1:8083",
+		FraudPort:     8084,
+		FraudURL:      "http://127.0.0.1:8084",
+		InventoryPort: 8085,
+		InventoryURL:  "http://127.0.0.1:8085",
 	}
 
 	if ip := os.Getenv("BIND_ON_IP"); ip != "" {
@@ -63,6 +83,10 @@ func AppConfigFromEnv() (AppConfig, error) {
 		conf.MongoURL = p
 	}
 
+	if p := os.Getenv("SQLITE_PATH"); p != "" {
+		conf.SQLitePath = p
+	}
+
 	if p := os.Getenv("BILLING_API_URL"); p != "" {
 		conf.BillingURL = p
 	}
@@ -111,5 +135,108 @@ func AppConfigFromEnv() (AppConfig, error) {
 		conf.FraudPort = int32(v)
 	}
 
+	if p := os.Getenv("INVENTORY_API_URL"); p != "" {
+		conf.InventoryURL = p
+	}
+
+	if p := os.Getenv("INVENTORY_API_PORT"); p != "" {
+		v, err := strconv.Atoi(p)
+		if err != nil {
+			return conf, err
+		}
+		conf.InventoryPort = int32(v)
+	}
+
+	if p := os.Getenv("WAREHOUSE_CARRIERS"); p != "" {
+		carriers, err := parseWarehouseCarriers(p)
+		if err != nil {
+			return conf, err
+		}
+		conf.WarehouseCarriers = carriers
+	}
+
+	if p := os.Getenv("CARRIER_WEBHOOK_SECRETS"); p != "" {
+		secrets, err := parseCarrierWebhookSecrets(p)
+		if err != nil {
+			return conf, err
+		}
+		conf.CarrierWebhookSecrets = secrets
+	}
+
+	if p := os.Getenv("SHIPMENT_SLAS"); p != "" {
+		slas, err := parseShipmentSLAs(p)
+		if err != nil {
+			return conf, err
+		}
+		conf.ShipmentSLAs = slas
+	}
+
 	return conf, nil
 }
+
+// parseWarehouseCarriers parses a list of warehouse=carriers pairs separated by commas,
+// where each warehouse's carriers are separated by "|", for example
+// "Warehouse A=simulator|acme,Warehouse B=simulator".
+func parseWarehouseCarriers(s string) (map[string][]string, error) {
+	carriers := make(map[string][]string)
+
+	for _, pair := range strings.Split(s, ",") {
+		warehouse, names, ok := strings.Cut(pair, "=")
+		warehouse = strings.TrimSpace(warehouse)
+		if !ok || warehouse == "" {
+			return nil, fmt.Errorf("invalid warehouse carriers %q, expected warehouse=carrier|carrier", pair)
+		}
+		for _, name := range strings.Split(names, "|") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				return nil, fmt.Errorf("invalid warehouse carriers %q, expected warehouse=carrier|carrier", pair)
+			}
+			carriers[warehouse] = append(carriers[warehouse], name)
+		}
+	}
+
+	return carriers, nil
+}
+
+// parseCarrierWebhookSecrets parses a list of carrier=secret pairs separated by commas,
+// for example "simulator=s3cret,acme=0p3n".
+func parseCarrierWebhookSecrets(s string) (map[string]string, error) {
+	secrets := make(map[string]string)
+
+	for _, pair := range strings.Split(s, ",") {
+		carrier, secret, ok := strings.Cut(pair, "=")
+		carrier = strings.TrimSpace(carrier)
+		if !ok || carrier == "" || secret == "" {
+			// The entry is reported as given, except for the secret.
+			entry := pair
+			if secret != "" {
+				entry = strings.TrimSuffix(pair, secret) + "***"
+			}
+			return nil, fmt.Errorf("invalid carrier webhook secret %q, expected carrier=secret", entry)
+		}
+		secrets[carrier] = secret
+	}
+
+	return secrets, nil
+}
+
+// parseShipmentSLAs parses a list of status=duration pairs separated by commas,
+// for example "booked=48h,dispatched=168h".
+func parseShipmentSLAs(s string) (map[string]time.Duration, error) {
+	slas := make(map[string]time.Duration)
+
+	for _, pair := range strings.Split(s, ",") {
+		status, value, ok := strings.Cut(pair, "=")
+		status = strings.TrimSpace(status)
+		if !ok || status == "" {
+			return nil, fmt.Errorf("invalid shipment SLA %q, expected status=duration", pair)
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(value))
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid shipment SLA for %q, expected a positive duration such as 48h", status)
+		}
+		slas[status] = d
+	}
+
+	return slas, nil
+}
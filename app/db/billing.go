@@ -0,0 +1,453 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// InvoicesCollection is the name of the MongoDB collection to use for Invoices.
+const InvoicesCollection = "invoices"
+
+// Invoice is a struct that represents a stored Invoice.
+// The full invoice is held in Document as JSON, owned by the Billing system.
+type Invoice struct {
+	Reference  string `db:"reference" bson:"reference"`
+	CustomerID string `db:"customer_id" bson:"customer_id"`
+	Status     string `db:"status" bson:"status"`
+	Document   string `db:"document" bson:"document"`
+
+	CreatedAt time.Time `db:"created_at" bson:"created_at"`
+}
+
+// PaymentMethodsCollection is the name of the MongoDB collection to use for Payment Methods.
+const PaymentMethodsCollection = "payment_methods"
+
+// CreditDebitsCollection is the name of the MongoDB collection to use for store credit debits.
+const CreditDebitsCollection = "credit_debits"
+
+// PaymentMethod is a struct that represents a customer's stored Payment Method.
+// Card numbers are never stored, only a token and the details required for display.
+type PaymentMethod struct {
+	ID         string `db:"id" bson:"id"`
+	CustomerID string `db:"customer_id" bson:"customer_id"`
+	Type       string `db:"type" bson:"type"`
+	IsDefault  bool   `db:"is_default" bson:"is_default"`
+
+	Token    string `db:"token" bson:"token"`
+	Brand    string `db:"brand" bson:"brand"`
+	Last4    string `db:"last4" bson:"last4"`
+	ExpMonth int32  `db:"exp_month" bson:"exp_month"`
+	ExpYear  int32  `db:"exp_year" bson:"exp_year"`
+	Provider string `db:"provider" bson:"provider"`
+	Balance  int32  `db:"balance" bson:"balance"`
+
+	CreatedAt time.Time `db:"created_at" bson:"created_at"`
+}
+
+// PaymentMethodTypeCredit is the Type of a store credit PaymentMethod.
+const PaymentMethodTypeCredit = "credit"
+
+// CreditDebit is a struct that represents store credit applied to a charge.
+// Amount is the maximum to debit; once applied it holds the amount actually debited.
+type CreditDebit struct {
+	Reference  string    `db:"reference" bson:"reference"`
+	CustomerID string    `db:"customer_id" bson:"customer_id"`
+	Amount     int32     `db:"amount" bson:"amount"`
+	CreatedAt  time.Time `db:"created_at" bson:"created_at"`
+}
+
+// RefundsCollection is the name of the MongoDB collection to use for Refunds.
+const RefundsCollection = "refunds"
+
+// Refund is a struct that represents a stored Refund against an Invoice.
+// The full refund is held in Document as JSON, owned by the Billing system.
+// Credit is the part of Amount returned to the customer's store credit.
+type Refund struct {
+	Reference        string `db:"reference" bson:"reference"`
+	InvoiceReference string `db:"invoice_reference" bson:"invoice_reference"`
+	CustomerID       string `db:"customer_id" bson:"customer_id"`
+	Amount           int32  `db:"amount" bson:"amount"`
+	Credit           int32  `db:"credit" bson:"credit"`
+	Document         string `db:"document" bson:"document"`
+
+	CreatedAt time.Time `db:"created_at" bson:"created_at"`
+}
+
+func (m *MongoDB) setupBilling() error {
+	invoices := m.db.Collection(InvoicesCollection)
+	_, err := invoices.Indexes().CreateOne(context.TODO(), mongo.IndexModel{
+		Keys:    map[string]interface{}{"reference": 1},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create invoice index: %w", err)
+	}
+
+	paymentMethods := m.db.Collection(PaymentMethodsCollection)
+	_, err = paymentMethods.Indexes().CreateOne(context.TODO(), mongo.IndexModel{
+		Keys: bson.D{{Key: "customer_id", Value: 1}, {Key: "id", Value: 1}},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create payment method index: %w", err)
+	}
+
+	debits := m.db.Collection(CreditDebitsCollection)
+	_, err = debits.Indexes().CreateOne(context.TODO(), mongo.IndexModel{
+		Keys:    map[string]interface{}{"reference": 1},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create credit debit index: %w", err)
+	}
+
+	refunds := m.db.Collection(RefundsCollection)
+	_, err = refunds.Indexes().CreateMany(context.TODO(), []mongo.IndexModel{
+		{
+			Keys:    map[string]interface{}{"reference": 1},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys: bson.D{{Key: "invoice_reference", Value: 1}, {Key: "created_at", Value: 1}},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create refund indexes: %w", err)
+	}
+
+	return nil
+}
+
+// SaveInvoice inserts or replaces an Invoice in the MongoDB instance
+func (m *MongoDB) SaveInvoice(ctx context.Context, invoice *Invoice) error {
+	_, err := m.db.Collection(InvoicesCollection).UpdateOne(
+		ctx,
+		bson.M{"reference": invoice.Reference},
+		bson.M{
+			"$set": bson.M{
+				"customer_id": invoice.CustomerID,
+				"status":      invoice.Status,
+				"document":    invoice.Document,
+			},
+			"$setOnInsert": bson.M{"created_at": invoice.CreatedAt},
+		},
+		options.Update().SetUpsert(true),
+	)
+	return err
+}
+
+// GetInvoice returns an Invoice from the MongoDB instance
+func (m *MongoDB) GetInvoice(ctx context.Context, reference string, result *Invoice) error {
+	err := m.db.Collection(InvoicesCollection).FindOne(ctx, bson.M{"reference": reference}).Decode(result)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// InsertPaymentMethod inserts a PaymentMethod into the MongoDB instance
+func (m *MongoDB) InsertPaymentMethod(ctx context.Context, method *PaymentMethod) error {
+	_, err := m.db.Collection(PaymentMethodsCollection).InsertOne(ctx, method)
+	return err
+}
+
+// UpdatePaymentMethod updates a PaymentMethod in the MongoDB instance
+func (m *MongoDB) UpdatePaymentMethod(ctx context.Context, method *PaymentMethod) error {
+	res, err := m.db.Collection(PaymentMethodsCollection).ReplaceOne(ctx, bson.M{"customer_id": method.CustomerID, "id": method.ID}, method)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// DeletePaymentMethod deletes a PaymentMethod from the MongoDB instance
+func (m *MongoDB) DeletePaymentMethod(ctx context.Context, customerID string, id string) error {
+	res, err := m.db.Collection(PaymentMethodsCollection).DeleteOne(ctx, bson.M{"customer_id": customerID, "id": id})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// GetPaymentMethod returns a customer's PaymentMethod from the MongoDB instance
+func (m *MongoDB) GetPaymentMethod(ctx context.Context, customerID string, id string, result *PaymentMethod) error {
+	err := m.db.Collection(PaymentMethodsCollection).FindOne(ctx, bson.M{"customer_id": customerID, "id": id}).Decode(result)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// GetPaymentMethods returns a customer's PaymentMethods from the MongoDB instance
+func (m *MongoDB) GetPaymentMethods(ctx context.Context, customerID string, result *[]PaymentMethod) error {
+	res, err := m.db.Collection(PaymentMethodsCollection).Find(ctx, bson.M{"customer_id": customerID}, &options.FindOptions{
+		Sort: bson.M{"created_at": 1},
+	})
+	if err != nil {
+		return err
+	}
+
+	return res.All(ctx, result)
+}
+
+// DebitStoreCredit applies up to debit.Amount of a customer's store credit in the MongoDB instance.
+// Debits are idempotent by Reference: repeating a debit returns the amount originally applied.
+func (m *MongoDB) DebitStoreCredit(ctx context.Context, debit *CreditDebit) error {
+	debits := m.db.Collection(CreditDebitsCollection)
+
+	var existing CreditDebit
+	err := debits.FindOne(ctx, bson.M{"reference": debit.Reference}).Decode(&existing)
+	if err == nil {
+		*debit = existing
+		return nil
+	}
+	if !errors.Is(err, mongo.ErrNoDocuments) {
+		return err
+	}
+
+	methods := m.db.Collection(PaymentMethodsCollection)
+	for {
+		var credit PaymentMethod
+		err := methods.FindOne(ctx, bson.M{"customer_id": debit.CustomerID, "type": PaymentMethodTypeCredit}).Decode(&credit)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			debit.Amount = 0
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		applied := min(credit.Balance, debit.Amount)
+		if applied <= 0 {
+			debit.Amount = 0
+			break
+		}
+
+		// Only apply the debit if the balance has not changed since it was read.
+		res, err := methods.UpdateOne(ctx,
+			bson.M{"customer_id": credit.CustomerID, "id": credit.ID, "balance": credit.Balance},
+			bson.M{"$inc": bson.M{"balance": -applied}},
+		)
+		if err != nil {
+			return err
+		}
+		if res.ModifiedCount == 1 {
+			debit.Amount = applied
+			break
+		}
+	}
+
+	_, err = debits.InsertOne(ctx, debit)
+	return err
+}
+
+// InsertRefund records a Refund and returns its Credit to the customer's store credit in the MongoDB instance.
+// Refunds are idempotent by Reference: repeating a refund returns the refund originally recorded.
+// ErrNotFound is returned if the refund has Credit but the customer has no store credit balance.
+func (m *MongoDB) InsertRefund(ctx context.Context, refund *Refund) error {
+	refunds := m.db.Collection(RefundsCollection)
+
+	var existing Refund
+	err := refunds.FindOne(ctx, bson.M{"reference": refund.Reference}).Decode(&existing)
+	if err == nil {
+		*refund = existing
+		return nil
+	}
+	if !errors.Is(err, mongo.ErrNoDocuments) {
+		return err
+	}
+
+	if _, err := refunds.InsertOne(ctx, refund); err != nil {
+		return err
+	}
+
+	if refund.Credit <= 0 {
+		return nil
+	}
+
+	res, err := m.db.Collection(PaymentMethodsCollection).UpdateOne(ctx,
+		bson.M{"customer_id": refund.CustomerID, "type": PaymentMethodTypeCredit},
+		bson.M{"$inc": bson.M{"balance": refund.Credit}},
+	)
+	if err == nil && res.MatchedCount == 0 {
+		err = ErrNotFound
+	}
+	if err != nil {
+		// Remove the refund so that it can be retried.
+		_, _ = refunds.DeleteOne(ctx, bson.M{"reference": refund.Reference})
+	}
+	return err
+}
+
+// GetRefunds returns the Refunds against an Invoice from the MongoDB instance, oldest first
+func (m *MongoDB) GetRefunds(ctx context.Context, invoiceReference string, result *[]Refund) error {
+	res, err := m.db.Collection(RefundsCollection).Find(ctx, bson.M{"invoice_reference": invoiceReference}, &options.FindOptions{
+		Sort: bson.M{"created_at": 1},
+	})
+	if err != nil {
+		return err
+	}
+
+	return res.All(ctx, result)
+}
+
+// SaveInvoice inserts or replaces an Invoice in the SQLite instance
+func (s *SQLiteDB) SaveInvoice(ctx context.Context, invoice *Invoice) error {
+	_, err := s.db.NamedExecContext(ctx, "INSERT INTO invoices (reference, customer_id, status, document, created_at) VALUES (:reference, :customer_id, :status, :document, :created_at) ON CONFLICT(reference) DO UPDATE SET customer_id = :customer_id, status = :status, document = :document", invoice)
+	return err
+}
+
+// GetInvoice returns an Invoice from the SQLite instance
+func (s *SQLiteDB) GetInvoice(ctx context.Context, reference string, result *Invoice) error {
+	err := s.db.GetContext(ctx, result, "SELECT reference, customer_id, status, document, created_at FROM invoices WHERE reference = ?", reference)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// InsertPaymentMethod inserts a PaymentMethod into the SQLite instance
+func (s *SQLiteDB) InsertPaymentMethod(ctx context.Context, method *PaymentMethod) error {
+	_, err := s.db.NamedExecContext(ctx, "INSERT INTO payment_methods (id, customer_id, type, is_default, token, brand, last4, exp_month, exp_year, provider, balance, created_at) VALUES (:id, :customer_id, :type, :is_default, :token, :brand, :last4, :exp_month, :exp_year, :provider, :balance, :created_at)", method)
+	return err
+}
+
+// UpdatePaymentMethod updates a PaymentMethod in the SQLite instance
+func (s *SQLiteDB) UpdatePaymentMethod(ctx context.Context, method *PaymentMethod) error {
+	res, err := s.db.NamedExecContext(ctx, "UPDATE payment_methods SET is_default = :is_default, token = :token, brand = :brand, last4 = :last4, exp_month = :exp_month, exp_year = :exp_year, provider = :provider, balance = :balance WHERE customer_id = :customer_id AND id = :id", method)
+	if err != nil {
+		return err
+	}
+	return expectRowsAffected(res)
+}
+
+// DeletePaymentMethod deletes a PaymentMethod from the SQLite instance
+func (s *SQLiteDB) DeletePaymentMethod(ctx context.Context, customerID string, id string) error {
+	res, err := s.db.ExecContext(ctx, "DELETE FROM payment_methods WHERE customer_id = ? AND id = ?", customerID, id)
+	if err != nil {
+		return err
+	}
+	return expectRowsAffected(res)
+}
+
+// GetPaymentMethod returns a customer's PaymentMethod from the SQLite instance
+func (s *SQLiteDB) GetPaymentMethod(ctx context.Context, customerID string, id string, result *PaymentMethod) error {
+	err := s.db.GetContext(ctx, result, "SELECT * FROM payment_methods WHERE customer_id = ? AND id = ?", customerID, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// GetPaymentMethods returns a customer's PaymentMethods from the SQLite instance
+func (s *SQLiteDB) GetPaymentMethods(ctx context.Context, customerID string, result *[]PaymentMethod) error {
+	return s.db.SelectContext(ctx, result, "SELECT * FROM payment_methods WHERE customer_id = ? ORDER BY created_at", customerID)
+}
+
+// DebitStoreCredit applies up to debit.Amount of a customer's store credit in the SQLite instance.
+// Debits are idempotent by Reference: repeating a debit returns the amount originally applied.
+func (s *SQLiteDB) DebitStoreCredit(ctx context.Context, debit *CreditDebit) error {
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var existing CreditDebit
+	err = tx.GetContext(ctx, &existing, "SELECT * FROM credit_debits WHERE reference = ?", debit.Reference)
+	if err == nil {
+		*debit = existing
+		return nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	var credit PaymentMethod
+	err = tx.GetContext(ctx, &credit, "SELECT * FROM payment_methods WHERE customer_id = ? AND type = ?", debit.CustomerID, PaymentMethodTypeCredit)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		debit.Amount = 0
+	case err != nil:
+		return err
+	default:
+		debit.Amount = max(0, min(credit.Balance, debit.Amount))
+		_, err = tx.ExecContext(ctx, "UPDATE payment_methods SET balance = balance - ? WHERE customer_id = ? AND id = ?", debit.Amount, credit.CustomerID, credit.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.NamedExecContext(ctx, "INSERT INTO credit_debits (reference, customer_id, amount, created_at) VALUES (:reference, :customer_id, :amount, :created_at)", debit)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// InsertRefund records a Refund and returns its Credit to the customer's store credit in the SQLite instance.
+// Refunds are idempotent by Reference: repeating a refund returns the refund originally recorded.
+// ErrNotFound is returned if the refund has Credit but the customer has no store credit balance.
+func (s *SQLiteDB) InsertRefund(ctx context.Context, refund *Refund) error {
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var existing Refund
+	err = tx.GetContext(ctx, &existing, "SELECT * FROM refunds WHERE reference = ?", refund.Reference)
+	if err == nil {
+		*refund = existing
+		return nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	if refund.Credit > 0 {
+		res, err := tx.ExecContext(ctx, "UPDATE payment_methods SET balance = balance + ? WHERE customer_id = ? AND type = ?", refund.Credit, refund.CustomerID, PaymentMethodTypeCredit)
+		if err != nil {
+			return err
+		}
+		if err := expectRowsAffected(res); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.NamedExecContext(ctx, "INSERT INTO refunds (reference, invoice_reference, customer_id, amount, credit, document, created_at) VALUES (:reference, :invoice_reference, :customer_id, :amount, :credit, :document, :created_at)", refund)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetRefunds returns the Refunds against an Invoice from the SQLite instance, oldest first
+func (s *SQLiteDB) GetRefunds(ctx context.Context, invoiceReference string, result *[]Refund) error {
+	return s.db.SelectContext(ctx, result, "SELECT * FROM refunds WHERE invoice_reference = ? ORDER BY created_at", invoiceReference)
+}
+
+func expectRowsAffected(res sql.Result) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
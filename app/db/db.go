@@ -3,6 +3,7 @@ package db
 import (
 	"context"
 	_ "embed"
+	"errors"
 	"fmt"
 	"time"
 
@@ -27,15 +28,48 @@ type OrderStatus struct {
 	ReceivedAt time.Time `db:"received_at" bson:"received_at"`
 }
 
+// ReturnsCollection is the name of the MongoDB collection to use for Returns.
+const ReturnsCollection = "returns"
+
+// ReturnVersionsCollection is the name of the MongoDB collection to use for the version of each
+// Order's Returns, used to detect concurrent inserts.
+const ReturnVersionsCollection = "return_versions"
+
+// Return is a struct that represents the status of a Return of items from an Order.
+// Items holds the returned items as JSON, owned by the Order system.
+type Return struct {
+	ID            string `db:"id" bson:"id"`
+	OrderID       string `db:"order_id" bson:"order_id"`
+	FulfillmentID string `db:"fulfillment_id" bson:"fulfillment_id"`
+	Status        string `db:"status" bson:"status"`
+	Items         string `db:"items" bson:"items"`
+
+	CreatedAt time.Time `db:"created_at" bson:"created_at"`
+}
+
+// ReturnCheck decides whether a Return may be added to an Order given the Order's existing Returns.
+type ReturnCheck func([]Return) (bool, error)
+
 // ShipmentStatus is a struct that represents the status of a Shipment
 type ShipmentStatus struct {
 	ID     string `db:"id" bson:"id"`
 	Status string `db:"status" bson:"status"`
+
+	// DueAt is when the Shipment breaches the SLA for its status, zero if the status has no SLA.
+	DueAt time.Time `db:"due_at" bson:"due_at"`
+	// EscalatedAt is when the Shipment was escalated for breaching the SLA, zero if it has not been.
+	EscalatedAt time.Time `db:"escalated_at" bson:"escalated_at"`
 }
 
 // ShipmentCollection is the name of the MongoDB collection to use for Shipment data.
 const ShipmentCollection = "shipments"
 
+// ErrNotFound is returned when a requested record does not exist.
+var ErrNotFound = errors.New("not found")
+
+// ErrAlreadyExists is returned when a record which may only be stored once has already been stored.
+var ErrAlreadyExists = errors.New("already exists")
+
 // DB is an interface that defines the methods that a database driver must implement
 type DB interface {
 	Connect(ctx context.Context) error
@@ -44,8 +78,52 @@ type DB interface {
 	InsertOrder(context.Context, *OrderStatus) error
 	UpdateOrderStatus(context.Context, string, string) error
 	GetOrders(context.Context, *[]OrderStatus) error
+	InsertReturn(context.Context, *Return, ReturnCheck) (bool, error)
+	UpdateReturnStatus(context.Context, string, string) error
+	GetReturns(context.Context, string, *[]Return) error
 	UpdateShipmentStatus(context.Context, string, string) error
 	GetShipments(context.Context, *[]ShipmentStatus) error
+	UpdateShipmentSLA(context.Context, string, time.Time, time.Time) error
+	GetShipmentsDueBy(context.Context, time.Time, *[]ShipmentStatus) error
+	SaveInvoice(context.Context, *Invoice) error
+	GetInvoice(context.Context, string, *Invoice) error
+	InsertPaymentMethod(context.Context, *PaymentMethod) error
+	UpdatePaymentMethod(context.Context, *PaymentMethod) error
+	DeletePaymentMethod(context.Context, string, string) error
+	GetPaymentMethod(context.Context, string, string, *PaymentMethod) error
+	GetPaymentMethods(context.Context, string, *[]PaymentMethod) error
+	DebitStoreCredit(context.Context, *CreditDebit) error
+	InsertRefund(context.Context, *Refund) error
+	GetRefunds(context.Context, string, *[]Refund) error
+	GetFraudSettings(context.Context, *FraudSettings) error
+	SetFraudRules(context.Context, string) error
+	SetFraudMaintenanceMode(context.Context, bool) error
+	SetFraudMaintenanceWindow(context.Context, time.Time, time.Time) error
+	ResetFraud(context.Context) error
+	RecordFraudCharge(context.Context, string, time.Time, FraudCharge, FraudCheck) (bool, error)
+	RemoveFraudCharge(context.Context, string, FraudCharge) error
+	InsertFraudCheck(context.Context, *FraudCheckRecord) error
+	GetFraudCheck(context.Context, string, *FraudCheckRecord) error
+	InsertFraudReview(context.Context, *FraudReview) error
+	GetFraudReview(context.Context, string, *FraudReview) error
+	GetFraudReviews(context.Context, string, *[]FraudReview) error
+	UpdateFraudReviewStatus(context.Context, string, string, string, time.Time) (bool, error)
+	InsertFraudDecision(context.Context, *FraudDecision) error
+	GetFraudDecisions(context.Context, FraudDecisionFilter, *[]FraudDecision) error
+	SetFraudListEntry(context.Context, *FraudListEntry) error
+	GetFraudListEntry(context.Context, string, *FraudListEntry) error
+	GetFraudListEntries(context.Context, string, *[]FraudListEntry) error
+	DeleteFraudListEntry(context.Context, string, string) error
+	GetStockLevels(context.Context, []string, *[]StockLevel) error
+	SetStockLevel(context.Context, *StockLevel) error
+	InitStockLevels(context.Context, []StockLevel) error
+	ApplyStockMovement(context.Context, *StockMovement, []StockLevel) (bool, error)
+	GetStockMovement(context.Context, string, *StockMovement) error
+	InsertBackorders(context.Context, []Backorder) error
+	GetBackorders(context.Context, []string, *[]Backorder) error
+	DeleteBackorders(context.Context, string) error
+	SetRelease(context.Context, *Release) error
+	GetReleases(context.Context, []string, *[]Release) error
 }
 
 // CreateDB creates a new DB instance based on the configuration
@@ -54,7 +132,12 @@ func CreateDB(config config.AppConfig) DB {
 		return &MongoDB{uri: config.MongoURL}
 	}
 
-	return &SQLiteDB{path: "./api-store.db"}
+	path := config.SQLitePath
+	if path == "" {
+		path = "./api-store.db"
+	}
+
+	return &SQLiteDB{path: path}
 }
 
 // MongoDB is a struct that implements the DB interface for MongoDB
@@ -85,6 +168,23 @@ func (m *MongoDB) Setup() error {
 		return fmt.Errorf("failed to create orders index: %w", err)
 	}
 
+	returns := m.db.Collection(ReturnsCollection)
+	_, err = returns.Indexes().CreateOne(context.TODO(), mongodb.IndexModel{
+		Keys: bson.D{{Key: "order_id", Value: 1}, {Key: "created_at", Value: 1}},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create returns index: %w", err)
+	}
+
+	returnVersions := m.db.Collection(ReturnVersionsCollection)
+	_, err = returnVersions.Indexes().CreateOne(context.TODO(), mongodb.IndexModel{
+		Keys:    map[string]interface{}{"order_id": 1},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create return versions index: %w", err)
+	}
+
 	shipments := m.db.Collection(ShipmentCollection)
 	_, err = shipments.Indexes().CreateOne(context.TODO(), mongodb.IndexModel{
 		Keys: map[string]interface{}{"booked_at": 1},
@@ -93,12 +193,25 @@ func (m *MongoDB) Setup() error {
 		return fmt.Errorf("failed to create shipment index: %w", err)
 	}
 
-	return nil
+	if err := m.setupBilling(); err != nil {
+		return err
+	}
+
+	if err := m.setupFraud(); err != nil {
+		return err
+	}
+
+	return m.setupInventory()
 }
 
 // InsertOrder inserts an Order into the MongoDB instance
 func (m *MongoDB) InsertOrder(ctx context.Context, order *OrderStatus) error {
-	_, err := m.db.Collection(OrdersCollection).InsertOne(ctx, order)
+	_, err := m.db.Collection(OrdersCollection).UpdateOne(
+		ctx,
+		bson.M{"id": order.ID},
+		bson.M{"$setOnInsert": order},
+		options.Update().SetUpsert(true),
+	)
 	return err
 }
 
@@ -120,6 +233,84 @@ func (m *MongoDB) GetOrders(ctx context.Context, result *[]OrderStatus) error {
 	return res.All(ctx, result)
 }
 
+// InsertReturn inserts a Return into the MongoDB instance if check accepts it.
+// Concurrent inserts for the same Order are detected by version, in which case the check is repeated.
+func (m *MongoDB) InsertReturn(ctx context.Context, ret *Return, check ReturnCheck) (bool, error) {
+	versions := m.db.Collection(ReturnVersionsCollection)
+
+	for {
+		var current struct {
+			Version int `bson:"version"`
+		}
+
+		err := versions.FindOne(ctx, bson.M{"order_id": ret.OrderID}).Decode(&current)
+		if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+			return false, err
+		}
+		exists := err == nil
+
+		var returns []Return
+		if err := m.GetReturns(ctx, ret.OrderID, &returns); err != nil {
+			return false, err
+		}
+
+		accepted, err := check(returns)
+		if err != nil || !accepted {
+			return false, err
+		}
+
+		// The version is claimed before the Return is inserted, so that a concurrent insert
+		// checked against the same Returns is repeated.
+		if !exists {
+			_, err := versions.InsertOne(ctx, bson.M{"order_id": ret.OrderID, "version": 1})
+			if mongo.IsDuplicateKeyError(err) {
+				continue
+			}
+			if err != nil {
+				return false, err
+			}
+		} else {
+			res, err := versions.UpdateOne(ctx,
+				bson.M{"order_id": ret.OrderID, "version": current.Version},
+				bson.M{"$inc": bson.M{"version": 1}},
+			)
+			if err != nil {
+				return false, err
+			}
+			if res.MatchedCount == 0 {
+				continue
+			}
+		}
+
+		_, err = m.db.Collection(ReturnsCollection).InsertOne(ctx, ret)
+		return err == nil, err
+	}
+}
+
+// UpdateReturnStatus updates a Return in the MongoDB instance
+func (m *MongoDB) UpdateReturnStatus(ctx context.Context, id string, status string) error {
+	res, err := m.db.Collection(ReturnsCollection).UpdateOne(ctx, bson.M{"id": id}, bson.M{"$set": bson.M{"status": status}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// GetReturns returns the Returns for an Order from the MongoDB instance, oldest first
+func (m *MongoDB) GetReturns(ctx context.Context, orderID string, result *[]Return) error {
+	res, err := m.db.Collection(ReturnsCollection).Find(ctx, bson.M{"order_id": orderID}, &options.FindOptions{
+		Sort: bson.M{"created_at": 1},
+	})
+	if err != nil {
+		return err
+	}
+
+	return res.All(ctx, result)
+}
+
 // UpdateShipmentStatus updates a Shipment in the MongoDB instance
 func (m *MongoDB) UpdateShipmentStatus(ctx context.Context, id string, status string) error {
 	_, err := m.db.Collection(ShipmentCollection).UpdateOne(
@@ -146,6 +337,30 @@ func (m *MongoDB) GetShipments(ctx context.Context, result *[]ShipmentStatus) er
 	return res.All(ctx, result)
 }
 
+// UpdateShipmentSLA sets when a Shipment breaches the SLA for its status, and when it was escalated, in the MongoDB instance
+func (m *MongoDB) UpdateShipmentSLA(ctx context.Context, id string, dueAt time.Time, escalatedAt time.Time) error {
+	_, err := m.db.Collection(ShipmentCollection).UpdateOne(
+		ctx,
+		bson.M{"id": id},
+		bson.M{"$set": bson.M{"due_at": dueAt.UTC(), "escalated_at": escalatedAt.UTC()}},
+	)
+	return err
+}
+
+// GetShipmentsDueBy returns the Shipments which breach the SLA for their status by a given time from the MongoDB instance,
+// soonest first
+func (m *MongoDB) GetShipmentsDueBy(ctx context.Context, before time.Time, result *[]ShipmentStatus) error {
+	res, err := m.db.Collection(ShipmentCollection).Find(ctx,
+		bson.M{"due_at": bson.M{"$gt": time.Time{}, "$lte": before.UTC()}},
+		options.Find().SetSort(bson.D{{Key: "due_at", Value: 1}, {Key: "id", Value: 1}}),
+	)
+	if err != nil {
+		return err
+	}
+
+	return res.All(ctx, result)
+}
+
 // Close closes the connection to the MongoDB instance
 func (m *MongoDB) Close() error {
 	return m.client.Disconnect(context.Background())
@@ -171,10 +386,49 @@ func (s *SQLiteDB) Connect(_ context.Context) error {
 	return nil
 }
 
+// sqliteColumns lists the columns added to tables since they were first created. The schema
+// creates new tables with them, and Setup adds them to tables created before they existed.
+var sqliteColumns = []struct {
+	table      string
+	column     string
+	definition string
+}{
+	{"shipments", "due_at", "TIMESTAMP NOT NULL DEFAULT '0001-01-01 00:00:00+00:00'"},
+	{"shipments", "escalated_at", "TIMESTAMP NOT NULL DEFAULT '0001-01-01 00:00:00+00:00'"},
+	{"fraud_charges", "charge_id", "TEXT NOT NULL DEFAULT ''"},
+}
+
+// sqliteIndexes lists the indexes on columns in sqliteColumns. Setup creates them once the columns exist.
+var sqliteIndexes = []string{
+	"CREATE UNIQUE INDEX IF NOT EXISTS fraud_charges_charge ON fraud_charges (charge_id) WHERE charge_id != ''",
+}
+
 // Setup sets up the SQLite instance
 func (s *SQLiteDB) Setup() error {
-	_, err := s.db.Exec(sqliteSchema)
-	return err
+	if _, err := s.db.Exec(sqliteSchema); err != nil {
+		return err
+	}
+
+	for _, c := range sqliteColumns {
+		var exists bool
+		if err := s.db.Get(&exists, "SELECT COUNT(*) > 0 FROM pragma_table_info(?) WHERE name = ?", c.table, c.column); err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		if _, err := s.db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", c.table, c.column, c.definition)); err != nil {
+			return err
+		}
+	}
+
+	for _, index := range sqliteIndexes {
+		if _, err := s.db.Exec(index); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
 // Close closes the connection to the SQLite instance
@@ -199,6 +453,46 @@ func (s *SQLiteDB) GetOrders(ctx context.Context, result *[]OrderStatus) error {
 	return s.db.SelectContext(ctx, result, "SELECT id, status, received_at FROM orders ORDER BY received_at DESC")
 }
 
+// InsertReturn inserts a Return into the SQLite instance if check accepts it.
+func (s *SQLiteDB) InsertReturn(ctx context.Context, ret *Return, check ReturnCheck) (bool, error) {
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var returns []Return
+	if err := tx.SelectContext(ctx, &returns, "SELECT * FROM returns WHERE order_id = ? ORDER BY created_at", ret.OrderID); err != nil {
+		return false, err
+	}
+
+	accepted, err := check(returns)
+	if err != nil || !accepted {
+		return false, err
+	}
+
+	_, err = tx.NamedExecContext(ctx, "INSERT INTO returns (id, order_id, fulfillment_id, status, items, created_at) VALUES (:id, :order_id, :fulfillment_id, :status, :items, :created_at)", ret)
+	if err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+// UpdateReturnStatus updates a Return in the SQLite instance
+func (s *SQLiteDB) UpdateReturnStatus(ctx context.Context, id string, status string) error {
+	res, err := s.db.ExecContext(ctx, "UPDATE returns SET status = ? WHERE id = ?", status, id)
+	if err != nil {
+		return err
+	}
+	return expectRowsAffected(res)
+}
+
+// GetReturns returns the Returns for an Order from the SQLite instance, oldest first
+func (s *SQLiteDB) GetReturns(ctx context.Context, orderID string, result *[]Return) error {
+	return s.db.SelectContext(ctx, result, "SELECT * FROM returns WHERE order_id = ? ORDER BY created_at", orderID)
+}
+
 // UpdateShipmentStatus updates a Shipment in the SQLite instance
 func (s *SQLiteDB) UpdateShipmentStatus(ctx context.Context, id string, status string) error {
 	_, err := s.db.ExecContext(ctx, "INSERT INTO shipments (id, booked_at, status) VALUES (?, ?, ?) ON CONFLICT(id) DO UPDATE SET status = ?", id, time.Now().UTC(), status, status)
@@ -209,3 +503,18 @@ func (s *SQLiteDB) UpdateShipmentStatus(ctx context.Context, id string, status s
 func (s *SQLiteDB) GetShipments(ctx context.Context, result *[]ShipmentStatus) error {
 	return s.db.SelectContext(ctx, result, "SELECT id, status FROM shipments ORDER BY booked_at DESC")
 }
+
+// UpdateShipmentSLA sets when a Shipment breaches the SLA for its status, and when it was escalated, in the SQLite instance
+func (s *SQLiteDB) UpdateShipmentSLA(ctx context.Context, id string, dueAt time.Time, escalatedAt time.Time) error {
+	_, err := s.db.ExecContext(ctx, "UPDATE shipments SET due_at = ?, escalated_at = ? WHERE id = ?", dueAt.UTC(), escalatedAt.UTC(), id)
+	return err
+}
+
+// GetShipmentsDueBy returns the Shipments which breach the SLA for their status by a given time from the SQLite instance,
+// soonest first
+func (s *SQLiteDB) GetShipmentsDueBy(ctx context.Context, before time.Time, result *[]ShipmentStatus) error {
+	return s.db.SelectContext(ctx, result,
+		"SELECT id, status, due_at, escalated_at FROM shipments WHERE due_at > ? AND due_at <= ? ORDER BY due_at, id",
+		time.Time{}, before.UTC(),
+	)
+}
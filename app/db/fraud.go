@@ -0,0 +1,724 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// FraudSettingsCollection is the name of the MongoDB collection to use for Fraud settings.
+const FraudSettingsCollection = "fraud_settings"
+
+// FraudCustomersCollection is the name of the MongoDB collection to use for customer charge history.
+const FraudCustomersCollection = "fraud_customers"
+
+// FraudReviewsCollection is the name of the MongoDB collection to use for Fraud reviews.
+const FraudReviewsCollection = "fraud_reviews"
+
+// FraudDecisionsCollection is the name of the MongoDB collection to use for the Fraud decision log.
+const FraudDecisionsCollection = "fraud_decisions"
+
+// FraudListsCollection is the name of the MongoDB collection to use for the Fraud allow and block lists.
+const FraudListsCollection = "fraud_lists"
+
+// FraudChecksCollection is the name of the MongoDB collection to use for the verdicts of identified charges.
+const FraudChecksCollection = "fraud_checks"
+
+// fraudSettingsID is the ID of the single Fraud settings document.
+const fraudSettingsID = "settings"
+
+// FraudSettings is a struct that represents the Fraud service's settings.
+// Rules is a JSON document owned by the Fraud service. MaintenanceStart and
+// MaintenanceEnd are zero unless a maintenance window is scheduled.
+type FraudSettings struct {
+	MaintenanceMode  bool      `db:"maintenance_mode" bson:"maintenance_mode"`
+	MaintenanceStart time.Time `db:"maintenance_start" bson:"maintenance_start"`
+	MaintenanceEnd   time.Time `db:"maintenance_end" bson:"maintenance_end"`
+	Rules            string    `db:"rules" bson:"rules"`
+}
+
+// FraudCharge is a struct that represents a charge accepted by the Fraud service.
+// ChargeID is empty if the charge was checked without one.
+type FraudCharge struct {
+	ChargeID  string    `db:"charge_id" bson:"charge_id,omitempty"`
+	Amount    int32     `db:"amount" bson:"amount"`
+	CreatedAt time.Time `db:"created_at" bson:"created_at"`
+}
+
+// FraudHistory is a struct that represents a customer's charge history.
+// Charges only holds recent charges, ChargeCount is the number of charges ever accepted.
+type FraudHistory struct {
+	CustomerID  string        `bson:"customer_id"`
+	ChargeCount int64         `bson:"charge_count"`
+	Charges     []FraudCharge `bson:"charges"`
+	Version     int64         `bson:"version"`
+}
+
+// FraudReview is a struct that represents a charge awaiting review by a fraud analyst.
+type FraudReview struct {
+	ID              string    `db:"id" bson:"id"`
+	CustomerID      string    `db:"customer_id" bson:"customer_id"`
+	Reference       string    `db:"reference" bson:"reference"`
+	Charge          int32     `db:"charge" bson:"charge"`
+	Rule            string    `db:"rule" bson:"rule"`
+	RiskScore       int32     `db:"risk_score" bson:"risk_score"`
+	CallbackURL     string    `db:"callback_url" bson:"callback_url"`
+	Status          string    `db:"status" bson:"status"`
+	DefaultDecision string    `db:"default_decision" bson:"default_decision"`
+	CreatedAt       time.Time `db:"created_at" bson:"created_at"`
+	ExpiresAt       time.Time `db:"expires_at" bson:"expires_at"`
+	DecidedAt       time.Time `db:"decided_at" bson:"decided_at"`
+}
+
+// FraudDecision is a struct that represents the outcome of a fraud check.
+type FraudDecision struct {
+	ID         string    `db:"id" bson:"id"`
+	CustomerID string    `db:"customer_id" bson:"customer_id"`
+	Reference  string    `db:"reference" bson:"reference"`
+	Amount     int32     `db:"amount" bson:"amount"`
+	Decision   string    `db:"decision" bson:"decision"`
+	Rule       string    `db:"rule" bson:"rule"`
+	RiskScore  int32     `db:"risk_score" bson:"risk_score"`
+	CreatedAt  time.Time `db:"created_at" bson:"created_at"`
+}
+
+// FraudDecisionFilter selects FraudDecisions. Empty fields match any decision.
+// Since is inclusive and Until is exclusive. A Limit of zero returns all matching decisions.
+type FraudDecisionFilter struct {
+	CustomerID string
+	Decision   string
+	Rule       string
+	Since      time.Time
+	Until      time.Time
+	Limit      int
+}
+
+// FraudListEntry is a struct that represents a customer on the Fraud allow or block list.
+// A customer is on at most one list. ExpiresAt is zero if the entry does not expire.
+type FraudListEntry struct {
+	CustomerID string    `db:"customer_id" bson:"customer_id"`
+	List       string    `db:"list" bson:"list"`
+	Reason     string    `db:"reason" bson:"reason"`
+	CreatedAt  time.Time `db:"created_at" bson:"created_at"`
+	ExpiresAt  time.Time `db:"expires_at" bson:"expires_at"`
+}
+
+// FraudCheckRecord is a struct that represents the verdict given for an identified charge.
+// Result is a JSON document owned by the Fraud service.
+type FraudCheckRecord struct {
+	ChargeID   string    `db:"charge_id" bson:"charge_id"`
+	CustomerID string    `db:"customer_id" bson:"customer_id"`
+	Result     string    `db:"result" bson:"result"`
+	CreatedAt  time.Time `db:"created_at" bson:"created_at"`
+}
+
+// FraudCheck decides whether a charge should be accepted given the customer's history.
+type FraudCheck func(*FraudHistory) (bool, error)
+
+func (m *MongoDB) setupFraud() error {
+	customers := m.db.Collection(FraudCustomersCollection)
+	_, err := customers.Indexes().CreateOne(context.TODO(), mongo.IndexModel{
+		Keys:    map[string]interface{}{"customer_id": 1},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create fraud customer index: %w", err)
+	}
+
+	reviews := m.db.Collection(FraudReviewsCollection)
+	_, err = reviews.Indexes().CreateOne(context.TODO(), mongo.IndexModel{
+		Keys:    map[string]interface{}{"id": 1},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create fraud review index: %w", err)
+	}
+
+	decisions := m.db.Collection(FraudDecisionsCollection)
+	_, err = decisions.Indexes().CreateOne(context.TODO(), mongo.IndexModel{
+		Keys: map[string]interface{}{"created_at": -1},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create fraud decision index: %w", err)
+	}
+
+	lists := m.db.Collection(FraudListsCollection)
+	_, err = lists.Indexes().CreateOne(context.TODO(), mongo.IndexModel{
+		Keys:    map[string]interface{}{"customer_id": 1},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create fraud list index: %w", err)
+	}
+
+	checks := m.db.Collection(FraudChecksCollection)
+	_, err = checks.Indexes().CreateOne(context.TODO(), mongo.IndexModel{
+		Keys:    map[string]interface{}{"charge_id": 1},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create fraud check index: %w", err)
+	}
+
+	return nil
+}
+
+// removeRecordedCharge removes the charge with the given ID from a history, reporting whether it was there.
+// The history then holds the charges as they were before it was recorded.
+func removeRecordedCharge(history *FraudHistory, chargeID string) bool {
+	if chargeID == "" {
+		return false
+	}
+	for i, c := range history.Charges {
+		if c.ChargeID == chargeID {
+			history.Charges = append(history.Charges[:i:i], history.Charges[i+1:]...)
+			history.ChargeCount--
+			return true
+		}
+	}
+	return false
+}
+
+// GetFraudSettings returns the Fraud settings from the MongoDB instance.
+// If no settings have been stored the defaults are returned.
+func (m *MongoDB) GetFraudSettings(ctx context.Context, result *FraudSettings) error {
+	err := m.db.Collection(FraudSettingsCollection).FindOne(ctx, bson.M{"_id": fraudSettingsID}).Decode(result)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		*result = FraudSettings{}
+		return nil
+	}
+	return err
+}
+
+func (m *MongoDB) setFraudSetting(ctx context.Context, field string, value interface{}) error {
+	_, err := m.db.Collection(FraudSettingsCollection).UpdateOne(ctx,
+		bson.M{"_id": fraudSettingsID},
+		bson.M{"$set": bson.M{field: value}},
+		options.Update().SetUpsert(true),
+	)
+	return err
+}
+
+// SetFraudRules sets the Fraud rules in the MongoDB instance
+func (m *MongoDB) SetFraudRules(ctx context.Context, rules string) error {
+	return m.setFraudSetting(ctx, "rules", rules)
+}
+
+// SetFraudMaintenanceMode sets the Fraud maintenance mode in the MongoDB instance
+func (m *MongoDB) SetFraudMaintenanceMode(ctx context.Context, enabled bool) error {
+	return m.setFraudSetting(ctx, "maintenance_mode", enabled)
+}
+
+// SetFraudMaintenanceWindow schedules a Fraud maintenance window in the MongoDB instance.
+// Zero times clear the window.
+func (m *MongoDB) SetFraudMaintenanceWindow(ctx context.Context, start time.Time, end time.Time) error {
+	_, err := m.db.Collection(FraudSettingsCollection).UpdateOne(ctx,
+		bson.M{"_id": fraudSettingsID},
+		bson.M{"$set": bson.M{"maintenance_start": start, "maintenance_end": end}},
+		options.Update().SetUpsert(true),
+	)
+	return err
+}
+
+// ResetFraud clears the Fraud settings, customer charge history, verdicts, reviews, decisions and lists in the MongoDB instance
+func (m *MongoDB) ResetFraud(ctx context.Context) error {
+	if _, err := m.db.Collection(FraudChecksCollection).DeleteMany(ctx, bson.M{}); err != nil {
+		return err
+	}
+	if _, err := m.db.Collection(FraudListsCollection).DeleteMany(ctx, bson.M{}); err != nil {
+		return err
+	}
+	if _, err := m.db.Collection(FraudSettingsCollection).DeleteMany(ctx, bson.M{}); err != nil {
+		return err
+	}
+	if _, err := m.db.Collection(FraudReviewsCollection).DeleteMany(ctx, bson.M{}); err != nil {
+		return err
+	}
+	if _, err := m.db.Collection(FraudDecisionsCollection).DeleteMany(ctx, bson.M{}); err != nil {
+		return err
+	}
+	_, err := m.db.Collection(FraudCustomersCollection).DeleteMany(ctx, bson.M{})
+	return err
+}
+
+// RecordFraudCharge records a charge in a customer's history in the MongoDB instance if check accepts it.
+// The history passed to check holds the charges made since the given time, older charges are discarded.
+// A charge whose ID is already in the history is not recorded again, and is checked against the history
+// as it was before it was recorded.
+// Concurrent updates to the same customer are detected by version, in which case the check is repeated.
+func (m *MongoDB) RecordFraudCharge(ctx context.Context, customerID string, since time.Time, charge FraudCharge, check FraudCheck) (bool, error) {
+	customers := m.db.Collection(FraudCustomersCollection)
+
+	for {
+		history := FraudHistory{CustomerID: customerID}
+
+		err := customers.FindOne(ctx, bson.M{"customer_id": customerID}).Decode(&history)
+		if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+			return false, err
+		}
+		exists := err == nil
+
+		var recent []FraudCharge
+		for _, c := range history.Charges {
+			if !c.CreatedAt.Before(since) {
+				recent = append(recent, c)
+			}
+		}
+		history.Charges = recent
+
+		recorded := removeRecordedCharge(&history, charge.ChargeID)
+
+		accepted, err := check(&history)
+		if err != nil || !accepted {
+			return false, err
+		}
+		if recorded {
+			return true, nil
+		}
+
+		history.Charges = append(history.Charges, charge)
+		history.ChargeCount++
+
+		if !exists {
+			history.Version = 1
+			_, err := customers.InsertOne(ctx, history)
+			if mongo.IsDuplicateKeyError(err) {
+				continue
+			}
+			return err == nil, err
+		}
+
+		res, err := customers.UpdateOne(ctx,
+			bson.M{"customer_id": customerID, "version": history.Version},
+			bson.M{
+				"$set": bson.M{"charges": history.Charges, "charge_count": history.ChargeCount},
+				"$inc": bson.M{"version": 1},
+			},
+		)
+		if err != nil {
+			return false, err
+		}
+		if res.MatchedCount == 1 {
+			return true, nil
+		}
+	}
+}
+
+// RemoveFraudCharge removes a charge from a customer's history in the MongoDB instance.
+func (m *MongoDB) RemoveFraudCharge(ctx context.Context, customerID string, charge FraudCharge) error {
+	match := bson.M{"amount": charge.Amount, "created_at": charge.CreatedAt}
+
+	_, err := m.db.Collection(FraudCustomersCollection).UpdateOne(ctx,
+		bson.M{"customer_id": customerID, "charges": bson.M{"$elemMatch": match}},
+		bson.M{
+			"$pull": bson.M{"charges": match},
+			"$inc":  bson.M{"charge_count": -1, "version": 1},
+		},
+	)
+	return err
+}
+
+// InsertFraudCheck records the verdict for an identified charge in the MongoDB instance.
+// ErrAlreadyExists is returned if a verdict has already been recorded for the charge.
+func (m *MongoDB) InsertFraudCheck(ctx context.Context, record *FraudCheckRecord) error {
+	_, err := m.db.Collection(FraudChecksCollection).InsertOne(ctx, record)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrAlreadyExists
+	}
+	return err
+}
+
+// GetFraudCheck returns the verdict recorded for an identified charge from the MongoDB instance
+func (m *MongoDB) GetFraudCheck(ctx context.Context, chargeID string, result *FraudCheckRecord) error {
+	err := m.db.Collection(FraudChecksCollection).FindOne(ctx, bson.M{"charge_id": chargeID}).Decode(result)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// InsertFraudReview inserts a FraudReview into the MongoDB instance
+func (m *MongoDB) InsertFraudReview(ctx context.Context, review *FraudReview) error {
+	_, err := m.db.Collection(FraudReviewsCollection).InsertOne(ctx, review)
+	return err
+}
+
+// GetFraudReview returns a FraudReview from the MongoDB instance
+func (m *MongoDB) GetFraudReview(ctx context.Context, id string, result *FraudReview) error {
+	err := m.db.Collection(FraudReviewsCollection).FindOne(ctx, bson.M{"id": id}).Decode(result)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// GetFraudReviews returns the FraudReviews with a status from the MongoDB instance, or all if status is empty
+func (m *MongoDB) GetFraudReviews(ctx context.Context, status string, result *[]FraudReview) error {
+	filter := bson.M{}
+	if status != "" {
+		filter["status"] = status
+	}
+
+	res, err := m.db.Collection(FraudReviewsCollection).Find(ctx, filter, &options.FindOptions{
+		Sort: bson.M{"created_at": 1},
+	})
+	if err != nil {
+		return err
+	}
+
+	return res.All(ctx, result)
+}
+
+// UpdateFraudReviewStatus changes the status of a FraudReview in the MongoDB instance,
+// provided it still has the expected status. It reports whether the status was changed.
+func (m *MongoDB) UpdateFraudReviewStatus(ctx context.Context, id string, from string, to string, at time.Time) (bool, error) {
+	res, err := m.db.Collection(FraudReviewsCollection).UpdateOne(ctx,
+		bson.M{"id": id, "status": from},
+		bson.M{"$set": bson.M{"status": to, "decided_at": at}},
+	)
+	if err != nil {
+		return false, err
+	}
+	return res.ModifiedCount == 1, nil
+}
+
+// InsertFraudDecision records a FraudDecision in the MongoDB instance.
+func (m *MongoDB) InsertFraudDecision(ctx context.Context, decision *FraudDecision) error {
+	_, err := m.db.Collection(FraudDecisionsCollection).InsertOne(ctx, decision)
+	return err
+}
+
+// GetFraudDecisions returns the FraudDecisions matching a filter from the MongoDB instance, newest first.
+func (m *MongoDB) GetFraudDecisions(ctx context.Context, filter FraudDecisionFilter, result *[]FraudDecision) error {
+	query := bson.M{}
+	if filter.CustomerID != "" {
+		query["customer_id"] = filter.CustomerID
+	}
+	if filter.Decision != "" {
+		query["decision"] = filter.Decision
+	}
+	if filter.Rule != "" {
+		query["rule"] = filter.Rule
+	}
+	createdAt := bson.M{}
+	if !filter.Since.IsZero() {
+		createdAt["$gte"] = filter.Since
+	}
+	if !filter.Until.IsZero() {
+		createdAt["$lt"] = filter.Until
+	}
+	if len(createdAt) > 0 {
+		query["created_at"] = createdAt
+	}
+
+	opts := options.Find().SetSort(bson.M{"created_at": -1})
+	if filter.Limit > 0 {
+		opts.SetLimit(int64(filter.Limit))
+	}
+
+	res, err := m.db.Collection(FraudDecisionsCollection).Find(ctx, query, opts)
+	if err != nil {
+		return err
+	}
+
+	return res.All(ctx, result)
+}
+
+// SetFraudListEntry adds a customer to a Fraud list in the MongoDB instance, replacing any existing entry.
+func (m *MongoDB) SetFraudListEntry(ctx context.Context, entry *FraudListEntry) error {
+	_, err := m.db.Collection(FraudListsCollection).ReplaceOne(ctx,
+		bson.M{"customer_id": entry.CustomerID},
+		entry,
+		options.Replace().SetUpsert(true),
+	)
+	return err
+}
+
+// GetFraudListEntry returns a customer's Fraud list entry from the MongoDB instance
+func (m *MongoDB) GetFraudListEntry(ctx context.Context, customerID string, result *FraudListEntry) error {
+	err := m.db.Collection(FraudListsCollection).FindOne(ctx, bson.M{"customer_id": customerID}).Decode(result)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// GetFraudListEntries returns the entries on a Fraud list from the MongoDB instance
+func (m *MongoDB) GetFraudListEntries(ctx context.Context, list string, result *[]FraudListEntry) error {
+	res, err := m.db.Collection(FraudListsCollection).Find(ctx, bson.M{"list": list}, &options.FindOptions{
+		Sort: bson.M{"created_at": 1},
+	})
+	if err != nil {
+		return err
+	}
+
+	return res.All(ctx, result)
+}
+
+// DeleteFraudListEntry removes a customer from a Fraud list in the MongoDB instance
+func (m *MongoDB) DeleteFraudListEntry(ctx context.Context, list string, customerID string) error {
+	res, err := m.db.Collection(FraudListsCollection).DeleteOne(ctx, bson.M{"list": list, "customer_id": customerID})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// GetFraudSettings returns the Fraud settings from the SQLite instance.
+// If no settings have been stored the defaults are returned.
+func (s *SQLiteDB) GetFraudSettings(ctx context.Context, result *FraudSettings) error {
+	err := s.db.GetContext(ctx, result, "SELECT maintenance_mode, maintenance_start, maintenance_end, rules FROM fraud_settings WHERE id = 1")
+	if errors.Is(err, sql.ErrNoRows) {
+		*result = FraudSettings{}
+		return nil
+	}
+	return err
+}
+
+// SetFraudRules sets the Fraud rules in the SQLite instance
+func (s *SQLiteDB) SetFraudRules(ctx context.Context, rules string) error {
+	_, err := s.db.ExecContext(ctx, "INSERT INTO fraud_settings (id, rules) VALUES (1, ?) ON CONFLICT(id) DO UPDATE SET rules = excluded.rules", rules)
+	return err
+}
+
+// SetFraudMaintenanceMode sets the Fraud maintenance mode in the SQLite instance
+func (s *SQLiteDB) SetFraudMaintenanceMode(ctx context.Context, enabled bool) error {
+	_, err := s.db.ExecContext(ctx, "INSERT INTO fraud_settings (id, maintenance_mode) VALUES (1, ?) ON CONFLICT(id) DO UPDATE SET maintenance_mode = excluded.maintenance_mode", enabled)
+	return err
+}
+
+// SetFraudMaintenanceWindow schedules a Fraud maintenance window in the SQLite instance.
+// Zero times clear the window.
+func (s *SQLiteDB) SetFraudMaintenanceWindow(ctx context.Context, start time.Time, end time.Time) error {
+	_, err := s.db.ExecContext(ctx, "INSERT INTO fraud_settings (id, maintenance_start, maintenance_end) VALUES (1, ?, ?) ON CONFLICT(id) DO UPDATE SET maintenance_start = excluded.maintenance_start, maintenance_end = excluded.maintenance_end", start, end)
+	return err
+}
+
+// ResetFraud clears the Fraud settings, customer charge history, verdicts, reviews, decisions and lists in the SQLite instance
+func (s *SQLiteDB) ResetFraud(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM fraud_settings; DELETE FROM fraud_customers; DELETE FROM fraud_charges; DELETE FROM fraud_checks; DELETE FROM fraud_reviews; DELETE FROM fraud_decisions; DELETE FROM fraud_lists")
+	return err
+}
+
+// RecordFraudCharge records a charge in a customer's history in the SQLite instance if check accepts it.
+// The history passed to check holds the charges made since the given time, older charges are discarded.
+// A charge whose ID is already in the history is not recorded again, and is checked against the history
+// as it was before it was recorded.
+func (s *SQLiteDB) RecordFraudCharge(ctx context.Context, customerID string, since time.Time, charge FraudCharge, check FraudCheck) (bool, error) {
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	history := FraudHistory{CustomerID: customerID}
+
+	err = tx.GetContext(ctx, &history.ChargeCount, "SELECT charge_count FROM fraud_customers WHERE customer_id = ?", customerID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return false, err
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM fraud_charges WHERE customer_id = ? AND created_at < ?", customerID, since)
+	if err != nil {
+		return false, err
+	}
+
+	err = tx.SelectContext(ctx, &history.Charges, "SELECT charge_id, amount, created_at FROM fraud_charges WHERE customer_id = ? ORDER BY created_at", customerID)
+	if err != nil {
+		return false, err
+	}
+
+	recorded := removeRecordedCharge(&history, charge.ChargeID)
+
+	accepted, err := check(&history)
+	if err != nil || !accepted {
+		return false, err
+	}
+	if recorded {
+		return true, tx.Commit()
+	}
+
+	_, err = tx.ExecContext(ctx, "INSERT INTO fraud_charges (customer_id, charge_id, amount, created_at) VALUES (?, ?, ?, ?)", customerID, charge.ChargeID, charge.Amount, charge.CreatedAt)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = tx.ExecContext(ctx, "INSERT INTO fraud_customers (customer_id, charge_count) VALUES (?, 1) ON CONFLICT(customer_id) DO UPDATE SET charge_count = charge_count + 1", customerID)
+	if err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+// RemoveFraudCharge removes a charge from a customer's history in the SQLite instance.
+func (s *SQLiteDB) RemoveFraudCharge(ctx context.Context, customerID string, charge FraudCharge) error {
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, "DELETE FROM fraud_charges WHERE rowid = (SELECT rowid FROM fraud_charges WHERE customer_id = ? AND amount = ? AND created_at = ? LIMIT 1)", customerID, charge.Amount, charge.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil || n == 0 {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE fraud_customers SET charge_count = charge_count - 1 WHERE customer_id = ?", customerID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// InsertFraudCheck records the verdict for an identified charge in the SQLite instance.
+// ErrAlreadyExists is returned if a verdict has already been recorded for the charge.
+func (s *SQLiteDB) InsertFraudCheck(ctx context.Context, record *FraudCheckRecord) error {
+	res, err := s.db.NamedExecContext(ctx, "INSERT INTO fraud_checks (charge_id, customer_id, result, created_at) VALUES (:charge_id, :customer_id, :result, :created_at) ON CONFLICT(charge_id) DO NOTHING", record)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrAlreadyExists
+	}
+
+	return nil
+}
+
+// GetFraudCheck returns the verdict recorded for an identified charge from the SQLite instance
+func (s *SQLiteDB) GetFraudCheck(ctx context.Context, chargeID string, result *FraudCheckRecord) error {
+	err := s.db.GetContext(ctx, result, "SELECT charge_id, customer_id, result, created_at FROM fraud_checks WHERE charge_id = ?", chargeID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// InsertFraudReview inserts a FraudReview into the SQLite instance
+func (s *SQLiteDB) InsertFraudReview(ctx context.Context, review *FraudReview) error {
+	_, err := s.db.NamedExecContext(ctx, "INSERT INTO fraud_reviews (id, customer_id, reference, charge, rule, risk_score, callback_url, status, default_decision, created_at, expires_at, decided_at) VALUES (:id, :customer_id, :reference, :charge, :rule, :risk_score, :callback_url, :status, :default_decision, :created_at, :expires_at, :decided_at)", review)
+	return err
+}
+
+// GetFraudReview returns a FraudReview from the SQLite instance
+func (s *SQLiteDB) GetFraudReview(ctx context.Context, id string, result *FraudReview) error {
+	err := s.db.GetContext(ctx, result, "SELECT * FROM fraud_reviews WHERE id = ?", id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// GetFraudReviews returns the FraudReviews with a status from the SQLite instance, or all if status is empty
+func (s *SQLiteDB) GetFraudReviews(ctx context.Context, status string, result *[]FraudReview) error {
+	if status == "" {
+		return s.db.SelectContext(ctx, result, "SELECT * FROM fraud_reviews ORDER BY created_at")
+	}
+	return s.db.SelectContext(ctx, result, "SELECT * FROM fraud_reviews WHERE status = ? ORDER BY created_at", status)
+}
+
+// UpdateFraudReviewStatus changes the status of a FraudReview in the SQLite instance,
+// provided it still has the expected status. It reports whether the status was changed.
+func (s *SQLiteDB) UpdateFraudReviewStatus(ctx context.Context, id string, from string, to string, at time.Time) (bool, error) {
+	res, err := s.db.ExecContext(ctx, "UPDATE fraud_reviews SET status = ?, decided_at = ? WHERE id = ? AND status = ?", to, at, id, from)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return n == 1, nil
+}
+
+// InsertFraudDecision records a FraudDecision in the SQLite instance.
+func (s *SQLiteDB) InsertFraudDecision(ctx context.Context, decision *FraudDecision) error {
+	_, err := s.db.NamedExecContext(ctx, "INSERT INTO fraud_decisions (id, customer_id, reference, amount, decision, rule, risk_score, created_at) VALUES (:id, :customer_id, :reference, :amount, :decision, :rule, :risk_score, :created_at)", decision)
+	return err
+}
+
+// GetFraudDecisions returns the FraudDecisions matching a filter from the SQLite instance, newest first.
+func (s *SQLiteDB) GetFraudDecisions(ctx context.Context, filter FraudDecisionFilter, result *[]FraudDecision) error {
+	query := "SELECT * FROM fraud_decisions WHERE 1 = 1"
+	var args []interface{}
+
+	if filter.CustomerID != "" {
+		query += " AND customer_id = ?"
+		args = append(args, filter.CustomerID)
+	}
+	if filter.Decision != "" {
+		query += " AND decision = ?"
+		args = append(args, filter.Decision)
+	}
+	if filter.Rule != "" {
+		query += " AND rule = ?"
+		args = append(args, filter.Rule)
+	}
+	if !filter.Since.IsZero() {
+		query += " AND created_at >= ?"
+		args = append(args, filter.Since.UTC())
+	}
+	if !filter.Until.IsZero() {
+		query += " AND created_at < ?"
+		args = append(args, filter.Until.UTC())
+	}
+
+	query += " ORDER BY created_at DESC"
+	if filter.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, filter.Limit)
+	}
+
+	return s.db.SelectContext(ctx, result, query, args...)
+}
+
+// SetFraudListEntry adds a customer to a Fraud list in the SQLite instance, replacing any existing entry.
+func (s *SQLiteDB) SetFraudListEntry(ctx context.Context, entry *FraudListEntry) error {
+	_, err := s.db.NamedExecContext(ctx, "INSERT OR REPLACE INTO fraud_lists (customer_id, list, reason, created_at, expires_at) VALUES (:customer_id, :list, :reason, :created_at, :expires_at)", entry)
+	return err
+}
+
+// GetFraudListEntry returns a customer's Fraud list entry from the SQLite instance
+func (s *SQLiteDB) GetFraudListEntry(ctx context.Context, customerID string, result *FraudListEntry) error {
+	err := s.db.GetContext(ctx, result, "SELECT * FROM fraud_lists WHERE customer_id = ?", customerID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// GetFraudListEntries returns the entries on a Fraud list from the SQLite instance
+func (s *SQLiteDB) GetFraudListEntries(ctx context.Context, list string, result *[]FraudListEntry) error {
+	return s.db.SelectContext(ctx, result, "SELECT * FROM fraud_lists WHERE list = ? ORDER BY created_at", list)
+}
+
+// DeleteFraudListEntry removes a customer from a Fraud list in the SQLite instance
+func (s *SQLiteDB) DeleteFraudListEntry(ctx context.Context, list string, customerID string) error {
+	res, err := s.db.ExecContext(ctx, "DELETE FROM fraud_lists WHERE list = ? AND customer_id = ?", list, customerID)
+	if err != nil {
+		return err
+	}
+	return expectRowsAffected(res)
+}
@@ -0,0 +1,431 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// StockCollection is the name of the MongoDB collection to use for stock levels.
+const StockCollection = "stock"
+
+// StockMovementsCollection is the name of the MongoDB collection to use for stock movements.
+const StockMovementsCollection = "stock_movements"
+
+// BackordersCollection is the name of the MongoDB collection to use for backorders.
+const BackordersCollection = "backorders"
+
+// ReleasesCollection is the name of the MongoDB collection to use for SKU release dates.
+const ReleasesCollection = "releases"
+
+// ErrInsufficientStock is returned when a stock movement would take a stock level below zero.
+var ErrInsufficientStock = errors.New("insufficient stock")
+
+// StockLevel is a struct that represents the quantity of a SKU held at a warehouse location.
+type StockLevel struct {
+	SKU      string `db:"sku" bson:"sku"`
+	Location string `db:"location" bson:"location"`
+	Quantity int32  `db:"quantity" bson:"quantity"`
+}
+
+// StockMovement is a struct that represents a change to stock levels, such as a reservation or restock.
+// The full movement is held in Document as JSON, owned by the Inventory system.
+type StockMovement struct {
+	Reference string `db:"reference" bson:"reference"`
+	Kind      string `db:"kind" bson:"kind"`
+	Document  string `db:"document" bson:"document"`
+
+	CreatedAt time.Time `db:"created_at" bson:"created_at"`
+}
+
+// Backorder is a struct that represents a SKU which a workflow is waiting to be restocked.
+// A backorder for several SKUs is held as one Backorder per SKU, sharing a Reference.
+type Backorder struct {
+	Reference  string    `db:"reference" bson:"reference"`
+	SKU        string    `db:"sku" bson:"sku"`
+	WorkflowID string    `db:"workflow_id" bson:"workflow_id"`
+	CreatedAt  time.Time `db:"created_at" bson:"created_at"`
+}
+
+// Release is a struct that represents the date a SKU is released, before which it can only be pre-ordered.
+type Release struct {
+	SKU        string    `db:"sku" bson:"sku"`
+	ReleasedAt time.Time `db:"released_at" bson:"released_at"`
+}
+
+func (m *MongoDB) setupInventory() error {
+	stock := m.db.Collection(StockCollection)
+	_, err := stock.Indexes().CreateOne(context.TODO(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "sku", Value: 1}, {Key: "location", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create stock index: %w", err)
+	}
+
+	movements := m.db.Collection(StockMovementsCollection)
+	_, err = movements.Indexes().CreateOne(context.TODO(), mongo.IndexModel{
+		Keys:    map[string]interface{}{"reference": 1},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create stock movement index: %w", err)
+	}
+
+	backorders := m.db.Collection(BackordersCollection)
+	_, err = backorders.Indexes().CreateMany(context.TODO(), []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "reference", Value: 1}, {Key: "sku", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys: bson.D{{Key: "sku", Value: 1}, {Key: "created_at", Value: 1}},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create backorder indexes: %w", err)
+	}
+
+	releases := m.db.Collection(ReleasesCollection)
+	_, err = releases.Indexes().CreateOne(context.TODO(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "sku", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create release index: %w", err)
+	}
+
+	return nil
+}
+
+// GetStockLevels returns the stock levels of the given SKUs, or of every SKU if none are given,
+// from the MongoDB instance
+func (m *MongoDB) GetStockLevels(ctx context.Context, skus []string, result *[]StockLevel) error {
+	filter := bson.M{}
+	if len(skus) > 0 {
+		filter["sku"] = bson.M{"$in": skus}
+	}
+
+	res, err := m.db.Collection(StockCollection).Find(ctx, filter,
+		options.Find().SetSort(bson.D{{Key: "sku", Value: 1}, {Key: "location", Value: 1}}),
+	)
+	if err != nil {
+		return err
+	}
+
+	return res.All(ctx, result)
+}
+
+// SetStockLevel inserts or replaces a stock level in the MongoDB instance
+func (m *MongoDB) SetStockLevel(ctx context.Context, level *StockLevel) error {
+	_, err := m.db.Collection(StockCollection).UpdateOne(
+		ctx,
+		bson.M{"sku": level.SKU, "location": level.Location},
+		bson.M{"$set": level},
+		options.Update().SetUpsert(true),
+	)
+	return err
+}
+
+// InitStockLevels inserts stock levels which are not already present in the MongoDB instance
+func (m *MongoDB) InitStockLevels(ctx context.Context, levels []StockLevel) error {
+	stock := m.db.Collection(StockCollection)
+	for _, level := range levels {
+		_, err := stock.UpdateOne(
+			ctx,
+			bson.M{"sku": level.SKU, "location": level.Location},
+			bson.M{"$setOnInsert": level},
+			options.Update().SetUpsert(true),
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ApplyStockMovement records a StockMovement and applies its changes to stock levels in the MongoDB instance.
+// Movements are idempotent by Reference: repeating a movement returns the movement originally recorded,
+// and false. ErrInsufficientStock is returned, and no changes applied, if any stock level would fall below zero.
+func (m *MongoDB) ApplyStockMovement(ctx context.Context, movement *StockMovement, changes []StockLevel) (bool, error) {
+	movements := m.db.Collection(StockMovementsCollection)
+
+	var existing StockMovement
+	err := movements.FindOne(ctx, bson.M{"reference": movement.Reference}).Decode(&existing)
+	if err == nil {
+		*movement = existing
+		return false, nil
+	}
+	if !errors.Is(err, mongo.ErrNoDocuments) {
+		return false, err
+	}
+
+	if _, err := movements.InsertOne(ctx, movement); err != nil {
+		return false, err
+	}
+
+	stock := m.db.Collection(StockCollection)
+
+	var applied []StockLevel
+	apply := func(change StockLevel) error {
+		if change.Quantity >= 0 {
+			_, err := stock.UpdateOne(ctx,
+				bson.M{"sku": change.SKU, "location": change.Location},
+				bson.M{"$inc": bson.M{"quantity": change.Quantity}},
+				options.Update().SetUpsert(true),
+			)
+			return err
+		}
+
+		// Only take stock which is there.
+		res, err := stock.UpdateOne(ctx,
+			bson.M{"sku": change.SKU, "location": change.Location, "quantity": bson.M{"$gte": -change.Quantity}},
+			bson.M{"$inc": bson.M{"quantity": change.Quantity}},
+		)
+		if err == nil && res.ModifiedCount == 0 {
+			err = ErrInsufficientStock
+		}
+		return err
+	}
+
+	for _, change := range changes {
+		if err := apply(change); err != nil {
+			// Undo the changes already applied, and remove the movement so that it can be retried.
+			for _, c := range applied {
+				_, _ = stock.UpdateOne(ctx,
+					bson.M{"sku": c.SKU, "location": c.Location},
+					bson.M{"$inc": bson.M{"quantity": -c.Quantity}},
+				)
+			}
+			_, _ = movements.DeleteOne(ctx, bson.M{"reference": movement.Reference})
+			return false, err
+		}
+		applied = append(applied, change)
+	}
+
+	return true, nil
+}
+
+// GetStockMovement returns a StockMovement from the MongoDB instance
+func (m *MongoDB) GetStockMovement(ctx context.Context, reference string, result *StockMovement) error {
+	err := m.db.Collection(StockMovementsCollection).FindOne(ctx, bson.M{"reference": reference}).Decode(result)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// InsertBackorders records Backorders which are not already present in the MongoDB instance
+func (m *MongoDB) InsertBackorders(ctx context.Context, backorders []Backorder) error {
+	collection := m.db.Collection(BackordersCollection)
+	for _, b := range backorders {
+		_, err := collection.UpdateOne(
+			ctx,
+			bson.M{"reference": b.Reference, "sku": b.SKU},
+			bson.M{"$setOnInsert": b},
+			options.Update().SetUpsert(true),
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetBackorders returns the Backorders for the given SKUs, or for every SKU if none are given,
+// from the MongoDB instance, oldest first
+func (m *MongoDB) GetBackorders(ctx context.Context, skus []string, result *[]Backorder) error {
+	filter := bson.M{}
+	if len(skus) > 0 {
+		filter["sku"] = bson.M{"$in": skus}
+	}
+
+	res, err := m.db.Collection(BackordersCollection).Find(ctx, filter,
+		options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}, {Key: "reference", Value: 1}, {Key: "sku", Value: 1}}),
+	)
+	if err != nil {
+		return err
+	}
+
+	return res.All(ctx, result)
+}
+
+// DeleteBackorders deletes the Backorders with a reference from the MongoDB instance
+func (m *MongoDB) DeleteBackorders(ctx context.Context, reference string) error {
+	_, err := m.db.Collection(BackordersCollection).DeleteMany(ctx, bson.M{"reference": reference})
+	return err
+}
+
+// SetRelease inserts or replaces the release date of a SKU in the MongoDB instance
+func (m *MongoDB) SetRelease(ctx context.Context, release *Release) error {
+	_, err := m.db.Collection(ReleasesCollection).UpdateOne(
+		ctx,
+		bson.M{"sku": release.SKU},
+		bson.M{"$set": release},
+		options.Update().SetUpsert(true),
+	)
+	return err
+}
+
+// GetReleases returns the release dates of the given SKUs, or of every SKU if none are given,
+// from the MongoDB instance. SKUs without a release date are omitted.
+func (m *MongoDB) GetReleases(ctx context.Context, skus []string, result *[]Release) error {
+	filter := bson.M{}
+	if len(skus) > 0 {
+		filter["sku"] = bson.M{"$in": skus}
+	}
+
+	res, err := m.db.Collection(ReleasesCollection).Find(ctx, filter,
+		options.Find().SetSort(bson.D{{Key: "sku", Value: 1}}),
+	)
+	if err != nil {
+		return err
+	}
+
+	return res.All(ctx, result)
+}
+
+// GetStockLevels returns the stock levels of the given SKUs, or of every SKU if none are given,
+// from the SQLite instance
+func (s *SQLiteDB) GetStockLevels(ctx context.Context, skus []string, result *[]StockLevel) error {
+	if len(skus) == 0 {
+		return s.db.SelectContext(ctx, result, "SELECT * FROM stock ORDER BY sku, location")
+	}
+
+	query, args, err := sqlx.In("SELECT * FROM stock WHERE sku IN (?) ORDER BY sku, location", skus)
+	if err != nil {
+		return err
+	}
+	return s.db.SelectContext(ctx, result, query, args...)
+}
+
+// SetStockLevel inserts or replaces a stock level in the SQLite instance
+func (s *SQLiteDB) SetStockLevel(ctx context.Context, level *StockLevel) error {
+	_, err := s.db.NamedExecContext(ctx, "INSERT INTO stock (sku, location, quantity) VALUES (:sku, :location, :quantity) ON CONFLICT(sku, location) DO UPDATE SET quantity = :quantity", level)
+	return err
+}
+
+// InitStockLevels inserts stock levels which are not already present in the SQLite instance
+func (s *SQLiteDB) InitStockLevels(ctx context.Context, levels []StockLevel) error {
+	if len(levels) == 0 {
+		return nil
+	}
+
+	_, err := s.db.NamedExecContext(ctx, "INSERT OR IGNORE INTO stock (sku, location, quantity) VALUES (:sku, :location, :quantity)", levels)
+	return err
+}
+
+// ApplyStockMovement records a StockMovement and applies its changes to stock levels in the SQLite instance.
+// Movements are idempotent by Reference: repeating a movement returns the movement originally recorded,
+// and false. ErrInsufficientStock is returned, and no changes applied, if any stock level would fall below zero.
+func (s *SQLiteDB) ApplyStockMovement(ctx context.Context, movement *StockMovement, changes []StockLevel) (bool, error) {
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var existing StockMovement
+	err = tx.GetContext(ctx, &existing, "SELECT * FROM stock_movements WHERE reference = ?", movement.Reference)
+	if err == nil {
+		*movement = existing
+		return false, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return false, err
+	}
+
+	for _, change := range changes {
+		if change.Quantity >= 0 {
+			_, err := tx.ExecContext(ctx, "INSERT INTO stock (sku, location, quantity) VALUES (?, ?, ?) ON CONFLICT(sku, location) DO UPDATE SET quantity = quantity + excluded.quantity", change.SKU, change.Location, change.Quantity)
+			if err != nil {
+				return false, err
+			}
+			continue
+		}
+
+		res, err := tx.ExecContext(ctx, "UPDATE stock SET quantity = quantity + ? WHERE sku = ? AND location = ? AND quantity >= ?", change.Quantity, change.SKU, change.Location, -change.Quantity)
+		if err != nil {
+			return false, err
+		}
+		if err := expectRowsAffected(res); err != nil {
+			if errors.Is(err, ErrNotFound) {
+				err = ErrInsufficientStock
+			}
+			return false, err
+		}
+	}
+
+	_, err = tx.NamedExecContext(ctx, "INSERT INTO stock_movements (reference, kind, document, created_at) VALUES (:reference, :kind, :document, :created_at)", movement)
+	if err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+// GetStockMovement returns a StockMovement from the SQLite instance
+func (s *SQLiteDB) GetStockMovement(ctx context.Context, reference string, result *StockMovement) error {
+	err := s.db.GetContext(ctx, result, "SELECT * FROM stock_movements WHERE reference = ?", reference)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// InsertBackorders records Backorders which are not already present in the SQLite instance
+func (s *SQLiteDB) InsertBackorders(ctx context.Context, backorders []Backorder) error {
+	if len(backorders) == 0 {
+		return nil
+	}
+
+	_, err := s.db.NamedExecContext(ctx, "INSERT OR IGNORE INTO backorders (reference, sku, workflow_id, created_at) VALUES (:reference, :sku, :workflow_id, :created_at)", backorders)
+	return err
+}
+
+// GetBackorders returns the Backorders for the given SKUs, or for every SKU if none are given,
+// from the SQLite instance, oldest first
+func (s *SQLiteDB) GetBackorders(ctx context.Context, skus []string, result *[]Backorder) error {
+	if len(skus) == 0 {
+		return s.db.SelectContext(ctx, result, "SELECT * FROM backorders ORDER BY created_at, reference, sku")
+	}
+
+	query, args, err := sqlx.In("SELECT * FROM backorders WHERE sku IN (?) ORDER BY created_at, reference, sku", skus)
+	if err != nil {
+		return err
+	}
+	return s.db.SelectContext(ctx, result, query, args...)
+}
+
+// DeleteBackorders deletes the Backorders with a reference from the SQLite instance
+func (s *SQLiteDB) DeleteBackorders(ctx context.Context, reference string) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM backorders WHERE reference = ?", reference)
+	return err
+}
+
+// SetRelease inserts or replaces the release date of a SKU in the SQLite instance
+func (s *SQLiteDB) SetRelease(ctx context.Context, release *Release) error {
+	_, err := s.db.NamedExecContext(ctx, "INSERT INTO releases (sku, released_at) VALUES (:sku, :released_at) ON CONFLICT(sku) DO UPDATE SET released_at = :released_at", release)
+	return err
+}
+
+// GetReleases returns the release dates of the given SKUs, or of every SKU if none are given,
+// from the SQLite instance. SKUs without a release date are omitted.
+func (s *SQLiteDB) GetReleases(ctx context.Context, skus []string, result *[]Release) error {
+	if len(skus) == 0 {
+		return s.db.SelectContext(ctx, result, "SELECT * FROM releases ORDER BY sku")
+	}
+
+	query, args, err := sqlx.In("SELECT * FROM releases WHERE sku IN (?) ORDER BY sku", skus)
+	if err != nil {
+		return err
+	}
+	return s.db.SelectContext(ctx, result, query, args...)
+}
@@ -10,7 +10,158 @@ CREATE INDEX IF NOT EXISTS orders_received_at ON orders(received_at DESC);
 CREATE TABLE IF NOT EXISTS shipments (
     id TEXT PRIMARY KEY,
     status TEXT NOT NULL,
-    booked_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+    booked_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    due_at TIMESTAMP NOT NULL DEFAULT '0001-01-01 00:00:00+00:00',
+    escalated_at TIMESTAMP NOT NULL DEFAULT '0001-01-01 00:00:00+00:00'
 );
 
 CREATE INDEX IF NOT EXISTS shipments_booked_at ON shipments (booked_at DESC);
+
+CREATE TABLE IF NOT EXISTS returns (
+    id TEXT PRIMARY KEY,
+    order_id TEXT NOT NULL,
+    fulfillment_id TEXT NOT NULL,
+    status TEXT NOT NULL,
+    items TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS returns_order ON returns (order_id, created_at);
+
+
+CREATE TABLE IF NOT EXISTS invoices (
+    reference TEXT PRIMARY KEY,
+    customer_id TEXT NOT NULL,
+    status TEXT NOT NULL,
+    document TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS payment_methods (
+    id TEXT NOT NULL,
+    customer_id TEXT NOT NULL,
+    type TEXT NOT NULL,
+    is_default BOOLEAN NOT NULL DEFAULT FALSE,
+    token TEXT NOT NULL DEFAULT '',
+    brand TEXT NOT NULL DEFAULT '',
+    last4 TEXT NOT NULL DEFAULT '',
+    exp_month INTEGER NOT NULL DEFAULT 0,
+    exp_year INTEGER NOT NULL DEFAULT 0,
+    provider TEXT NOT NULL DEFAULT '',
+    balance INTEGER NOT NULL DEFAULT 0,
+    created_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (customer_id, id)
+);
+
+CREATE TABLE IF NOT EXISTS credit_debits (
+    reference TEXT PRIMARY KEY,
+    customer_id TEXT NOT NULL,
+    amount INTEGER NOT NULL,
+    created_at TIMESTAMP NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS refunds (
+    reference TEXT PRIMARY KEY,
+    invoice_reference TEXT NOT NULL,
+    customer_id TEXT NOT NULL,
+    amount INTEGER NOT NULL,
+    credit INTEGER NOT NULL,
+    document TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS refunds_invoice ON refunds (invoice_reference, created_at);
+
+CREATE TABLE IF NOT EXISTS fraud_settings (
+    id INTEGER PRIMARY KEY CHECK (id = 1),
+    maintenance_mode BOOLEAN NOT NULL DEFAULT FALSE,
+    maintenance_start TIMESTAMP NOT NULL DEFAULT '0001-01-01 00:00:00+00:00',
+    maintenance_end TIMESTAMP NOT NULL DEFAULT '0001-01-01 00:00:00+00:00',
+    rules TEXT NOT NULL DEFAULT ''
+);
+
+CREATE TABLE IF NOT EXISTS fraud_customers (
+    customer_id TEXT PRIMARY KEY,
+    charge_count INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS fraud_charges (
+    customer_id TEXT NOT NULL,
+    charge_id TEXT NOT NULL DEFAULT '',
+    amount INTEGER NOT NULL,
+    created_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS fraud_charges_customer ON fraud_charges (customer_id, created_at);
+
+CREATE TABLE IF NOT EXISTS fraud_checks (
+    charge_id TEXT PRIMARY KEY,
+    customer_id TEXT NOT NULL,
+    result TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS fraud_reviews (
+    id TEXT PRIMARY KEY,
+    customer_id TEXT NOT NULL,
+    reference TEXT NOT NULL,
+    charge INTEGER NOT NULL,
+    rule TEXT NOT NULL,
+    risk_score INTEGER NOT NULL,
+    callback_url TEXT NOT NULL,
+    status TEXT NOT NULL,
+    default_decision TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    decided_at TIMESTAMP NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS fraud_decisions (
+    id TEXT PRIMARY KEY,
+    customer_id TEXT NOT NULL,
+    reference TEXT NOT NULL,
+    amount INTEGER NOT NULL,
+    decision TEXT NOT NULL,
+    rule TEXT NOT NULL,
+    risk_score INTEGER NOT NULL,
+    created_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS fraud_decisions_created ON fraud_decisions (created_at);
+
+CREATE TABLE IF NOT EXISTS fraud_lists (
+    customer_id TEXT PRIMARY KEY,
+    list TEXT NOT NULL,
+    reason TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS stock (
+    sku TEXT NOT NULL,
+    location TEXT NOT NULL,
+    quantity INTEGER NOT NULL,
+    PRIMARY KEY (sku, location)
+);
+
+CREATE TABLE IF NOT EXISTS stock_movements (
+    reference TEXT PRIMARY KEY,
+    kind TEXT NOT NULL,
+    document TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS backorders (
+    reference TEXT NOT NULL,
+    sku TEXT NOT NULL,
+    workflow_id TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (reference, sku)
+);
+
+CREATE INDEX IF NOT EXISTS backorders_sku ON backorders (sku, created_at);
+
+CREATE TABLE IF NOT EXISTS releases (
+    sku TEXT PRIMARY KEY,
+    released_at TIMESTAMP NOT NULL
+);
@@ -1,62 +1,178 @@
 package fraud
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"log/slog"
 	"net/http"
-	"sync"
+	"strconv"
+	"time"
+
+	"github.com/temporalio/reference-app-orders-go/app/db"
 )
 
 // FraudLimitInput is the input for the SetLimit API.
+// The limit is applied to each customer's spend within the spend window.
 type FraudLimitInput struct {
 	Limit int32 `json:"limit"`
 }
 
 // FraudSettingsResult is the result for the GetSettings API.
+// MaintenanceMode reports whether the service is currently in maintenance,
+// either because it was enabled or because a scheduled window is in progress.
 type FraudSettingsResult struct {
-	Limit           int32 `json:"limit"`
-	MaintenanceMode bool  `json:"maintenanceMode"`
+	Limit             int32              `json:"limit"`
+	MaintenanceMode   bool               `json:"maintenanceMode"`
+	MaintenanceWindow *MaintenanceWindow `json:"maintenanceWindow,omitempty"`
+	Rules             Rules              `json:"rules"`
+}
+
+// Item is an item included in a charge.
+type Item struct {
+	SKU      string `json:"sku"`
+	Quantity int32  `json:"quantity"`
 }
 
 // FraudCheckInput is the input for the check endpoint.
 type FraudCheckInput struct {
 	CustomerID string `json:"customerId"`
 	Charge     int32  `json:"charge"`
+	Items      []Item `json:"items,omitempty"`
+
+	// ChargeID identifies the charge, so that checking it again returns the verdict already given
+	// rather than counting the charge twice.
+	ChargeID string `json:"chargeId,omitempty"`
+	// Reference identifies the charge to fraud analysts.
+	Reference string `json:"reference,omitempty"`
+	// CallbackURL is sent the ReviewDecision if the charge is held for review.
+	CallbackURL string `json:"callbackUrl,omitempty"`
 }
 
 // FraudCheckResult is the result for the check endpoint.
+// Rule is the rule which caused the charge to be declined. RiskScore, from 0 to 100,
+// is how close the charge came to breaking any rule.
 type FraudCheckResult struct {
-	Declined bool `json:"declined"`
+	Declined  bool   `json:"declined"`
+	Decision  string `json:"decision"`
+	Rule      string `json:"rule,omitempty"`
+	RiskScore int32  `json:"riskScore"`
+
+	// List is set if the decision was made because the customer is on the allow or block list.
+	List string `json:"list,omitempty"`
+
+	// Set if the charge is held for review. If no decision is made by ReviewExpiresAt
+	// the ReviewDefault decision applies.
+	ReviewID        string     `json:"reviewId,omitempty"`
+	ReviewExpiresAt *time.Time `json:"reviewExpiresAt,omitempty"`
+	ReviewDefault   string     `json:"reviewDefault,omitempty"`
 }
 
+const (
+	// DecisionApprove is the Decision for a charge which may proceed.
+	DecisionApprove = "approve"
+
+	// DecisionDecline is the Decision for a charge which breaks a rule.
+	DecisionDecline = "decline"
+
+	// DecisionReview is the Decision for a charge which must be reviewed by a fraud analyst.
+	DecisionReview = "review"
+)
+
 type handlers struct {
-	limit               int32
-	maintenanceMode     bool
-	tallyLock           sync.Mutex
-	customerChargeTally map[string]int32
-	logger              *slog.Logger
+	db     db.DB
+	logger *slog.Logger
+	now    func() time.Time
 }
 
 // Router implements the http.Handler interface for the Billing API
-func Router(logger *slog.Logger) http.Handler {
+func Router(db db.DB, logger *slog.Logger) http.Handler {
+	return router(db, logger, time.Now)
+}
+
+func router(db db.DB, logger *slog.Logger, now func() time.Time) http.Handler {
 	r := http.NewServeMux()
-	h := handlers{customerChargeTally: make(map[string]int32), logger: logger}
+	h := handlers{db: db, logger: logger, now: now}
 
 	r.HandleFunc("GET /settings", h.handleGetSettings)
 	r.HandleFunc("POST /limit", h.handleSetLimit)
+	r.HandleFunc("GET /rules", h.handleGetRules)
+	r.HandleFunc("PUT /rules", h.handleSetRules)
 	r.HandleFunc("POST /maintenance", h.handleSetMaintenanceMode)
+	r.HandleFunc("PUT /maintenance/window", h.handleSetMaintenanceWindow)
+	r.HandleFunc("DELETE /maintenance/window", h.handleClearMaintenanceWindow)
 	r.HandleFunc("POST /reset", h.handleReset)
 	r.HandleFunc("POST /check", h.handleRunCheck)
+	r.HandleFunc("GET /decisions", h.handleListDecisions)
+	r.HandleFunc("GET /decisions/stats", h.handleDecisionStats)
+	r.HandleFunc("GET /allowlist", h.handleListEntries(ListAllow))
+	r.HandleFunc("PUT /allowlist/{customerId}", h.handleSetListEntry(ListAllow))
+	r.HandleFunc("DELETE /allowlist/{customerId}", h.handleDeleteListEntry(ListAllow))
+	r.HandleFunc("GET /blocklist", h.handleListEntries(ListBlock))
+	r.HandleFunc("PUT /blocklist/{customerId}", h.handleSetListEntry(ListBlock))
+	r.HandleFunc("DELETE /blocklist/{customerId}", h.handleDeleteListEntry(ListBlock))
+	r.HandleFunc("GET /reviews", h.handleListReviews)
+	r.HandleFunc("GET /reviews/{id}", h.handleGetReview)
+	r.HandleFunc("POST /reviews/{id}/approve", h.handleDecideReview(ReviewApprove))
+	r.HandleFunc("POST /reviews/{id}/reject", h.handleDecideReview(ReviewReject))
 
 	return r
 }
 
-func (h *handlers) handleGetSettings(w http.ResponseWriter, _ *http.Request) {
+// settings fetches the Fraud settings and rules, writing an error response if they cannot be read.
+func (h *handlers) settings(w http.ResponseWriter, r *http.Request) (*db.FraudSettings, *Rules, bool) {
+	var settings db.FraudSettings
+
+	if err := h.db.GetFraudSettings(r.Context(), &settings); err != nil {
+		h.logger.Error("Failed to get settings", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, nil, false
+	}
+
+	rules, err := rulesFromSettings(&settings)
+	if err != nil {
+		h.logger.Error("Failed to decode rules", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, nil, false
+	}
+
+	return &settings, &rules, true
+}
+
+func (h *handlers) saveRules(w http.ResponseWriter, r *http.Request, rules *Rules) {
+	if err := rules.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	doc, err := json.Marshal(rules)
+	if err != nil {
+		h.logger.Error("Failed to encode rules", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := h.db.SetFraudRules(r.Context(), string(doc)); err != nil {
+		h.logger.Error("Failed to set rules", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (h *handlers) handleGetSettings(w http.ResponseWriter, r *http.Request) {
+	settings, rules, ok := h.settings(w, r)
+	if !ok {
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 
+	active, _ := maintenanceStatus(settings, h.now())
+
 	err := json.NewEncoder(w).Encode(FraudSettingsResult{
-		Limit:           h.limit,
-		MaintenanceMode: h.maintenanceMode,
+		Limit:             rules.SpendLimit,
+		MaintenanceMode:   active,
+		MaintenanceWindow: maintenanceWindow(settings),
+		Rules:             *rules,
 	})
 	if err != nil {
 		h.logger.Error("Failed to encode limit result", "error", err)
@@ -74,28 +190,62 @@ func (h *handlers) handleSetLimit(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	h.limit = input.Limit
+	_, rules, ok := h.settings(w, r)
+	if !ok {
+		return
+	}
+
+	rules.SpendLimit = input.Limit
+
+	h.saveRules(w, r, rules)
 }
 
-func (h *handlers) handleReset(http.ResponseWriter, *http.Request) {
-	h.tallyLock.Lock()
-	h.customerChargeTally = make(map[string]int32)
-	h.tallyLock.Unlock()
+func (h *handlers) handleGetRules(w http.ResponseWriter, r *http.Request) {
+	_, rules, ok := h.settings(w, r)
+	if !ok {
+		return
+	}
 
-	h.limit = 0
-	h.maintenanceMode = false
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(rules); err != nil {
+		h.logger.Error("Failed to encode rules", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
 }
 
-func (h *handlers) handleSetMaintenanceMode(w http.ResponseWriter, _ *http.Request) {
-	h.maintenanceMode = true
+func (h *handlers) handleSetRules(w http.ResponseWriter, r *http.Request) {
+	rules := defaultRules()
+
+	err := json.NewDecoder(r.Body).Decode(&rules)
+	if err != nil {
+		h.logger.Error("Failed to decode rules", "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	h.saveRules(w, r, &rules)
+}
 
-	w.WriteHeader(http.StatusOK)
+func (h *handlers) handleReset(w http.ResponseWriter, r *http.Request) {
+	if err := h.db.ResetFraud(r.Context()); err != nil {
+		h.logger.Error("Failed to reset", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
 }
 
 func (h *handlers) handleRunCheck(w http.ResponseWriter, r *http.Request) {
 	var input FraudCheckInput
 
-	if h.maintenanceMode {
+	settings, rules, ok := h.settings(w, r)
+	if !ok {
+		return
+	}
+
+	if active, retryAfter := maintenanceStatus(settings, h.now()); active {
+		if retryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Round(time.Second).Seconds())))
+		}
 		http.Error(w, "Fraud service is in maintenance mode", http.StatusServiceUnavailable)
 		return
 	}
@@ -107,17 +257,153 @@ func (h *handlers) handleRunCheck(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	h.tallyLock.Lock()
-	declined := h.limit > 0 && input.Charge+h.customerChargeTally[input.CustomerID] > h.limit
-	if !declined {
-		h.customerChargeTally[input.CustomerID] += input.Charge
+	if input.ChargeID != "" {
+		stored, err := h.storedResult(r.Context(), input.ChargeID)
+		if err != nil {
+			h.logger.Error("Failed to get stored verdict", "chargeId", input.ChargeID, "error", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if stored != nil {
+			h.writeCheckResult(w, stored)
+			return
+		}
 	}
-	h.tallyLock.Unlock()
-	result := FraudCheckResult{Declined: declined}
 
-	w.Header().Set("Content-Type", "application/json")
-	err = json.NewEncoder(w).Encode(result)
+	now := h.now().UTC()
+
+	// The allow and block lists take precedence over the rules.
+	listed, err := h.listResult(r.Context(), input.CustomerID, now)
+	if err != nil {
+		h.logger.Error("Failed to check lists", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var result FraudCheckResult
+
+	// The charge is only added to the customer's history if it is accepted. A charge held for
+	// review is added only if it will be approved when no decision is made, and its review
+	// adjusts the history once it is decided.
+	// The store checks and records the charge atomically, so concurrent checks,
+	// including those handled by other instances, cannot break the rules. A charge
+	// recorded by an earlier check which failed before its verdict was stored is not recorded again.
+	_, err = h.db.RecordFraudCharge(r.Context(), input.CustomerID, now.Add(-rules.historyWindow()),
+		db.FraudCharge{ChargeID: input.ChargeID, Amount: input.Charge, CreatedAt: now},
+		func(history *db.FraudHistory) (bool, error) {
+			if listed != nil {
+				result = *listed
+			} else {
+				result = rules.evaluate(&input, history, now)
+			}
+			if result.Decision == DecisionReview {
+				return rules.ReviewDefault == ReviewApprove, nil
+			}
+			return !result.Declined, nil
+		},
+	)
+	if err != nil {
+		h.logger.Error("Failed to record charge", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	switch result.Decision {
+	case DecisionDecline:
+		h.logger.Info("Charge declined", "customerId", input.CustomerID, "charge", input.Charge, "rule", result.Rule, "riskScore", result.RiskScore)
+	case DecisionReview:
+		review, err := h.createReview(r.Context(), &input, &result, rules, now)
+		if err != nil {
+			h.logger.Error("Failed to create review", "error", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		result.ReviewID = review.ID
+		result.ReviewExpiresAt = &review.ExpiresAt
+		result.ReviewDefault = review.DefaultDecision
+	}
+
+	// The verdict for an identified charge is stored before it is given, so a repeated check returns it.
+	if input.ChargeID != "" {
+		stored, err := h.storeResult(r.Context(), &input, &result, now)
+		if err != nil {
+			h.logger.Error("Failed to store verdict", "chargeId", input.ChargeID, "error", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !stored {
+			// A concurrent check of the same charge stored its verdict first.
+			h.writeStoredResult(w, r, input.ChargeID)
+			return
+		}
+	}
+
+	// The verdict stands even if it cannot be logged, as the charge has already been recorded.
+	if err := h.recordDecision(r.Context(), &input, &result, now); err != nil {
+		h.logger.Error("Failed to record decision", "customerId", input.CustomerID, "error", err)
+	}
+
+	h.writeCheckResult(w, &result)
+}
+
+// storedResult returns the verdict already given for a charge, or nil if it has not been checked.
+func (h *handlers) storedResult(ctx context.Context, chargeID string) (*FraudCheckResult, error) {
+	var record db.FraudCheckRecord
+
+	err := h.db.GetFraudCheck(ctx, chargeID, &record)
+	if errors.Is(err, db.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var result FraudCheckResult
+	if err := json.Unmarshal([]byte(record.Result), &result); err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+// storeResult stores the verdict given for a charge. It reports false if a verdict was already stored.
+func (h *handlers) storeResult(ctx context.Context, input *FraudCheckInput, result *FraudCheckResult, now time.Time) (bool, error) {
+	encoded, err := json.Marshal(result)
 	if err != nil {
+		return false, err
+	}
+
+	err = h.db.InsertFraudCheck(ctx, &db.FraudCheckRecord{
+		ChargeID:   input.ChargeID,
+		CustomerID: input.CustomerID,
+		Result:     string(encoded),
+		CreatedAt:  now,
+	})
+	if errors.Is(err, db.ErrAlreadyExists) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+func (h *handlers) writeStoredResult(w http.ResponseWriter, r *http.Request, chargeID string) {
+	stored, err := h.storedResult(r.Context(), chargeID)
+	if err == nil && stored == nil {
+		err = db.ErrNotFound
+	}
+	if err != nil {
+		h.logger.Error("Failed to get stored verdict", "chargeId", chargeID, "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	h.writeCheckResult(w, stored)
+}
+
+func (h *handlers) writeCheckResult(w http.ResponseWriter, result *FraudCheckResult) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(result); err != nil {
 		h.logger.Error("Failed to encode charge result", "error", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
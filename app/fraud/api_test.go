@@ -1,21 +1,38 @@
 package fraud_test
 
 import (
+	"context"
+	"encoding/json"
 	"log/slog"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/temporalio/reference-app-orders-go/app/config"
+	"github.com/temporalio/reference-app-orders-go/app/db"
 	"github.com/temporalio/reference-app-orders-go/app/fraud"
 )
 
+func testStore(t *testing.T) db.DB {
+	store := db.CreateDB(config.AppConfig{SQLitePath: filepath.Join(t.TempDir(), "test.db")})
+	require.NoError(t, store.Connect(context.Background()))
+	require.NoError(t, store.Setup())
+	t.Cleanup(func() { store.Close() })
+
+	return store
+}
+
 func TestMaintenanceMode(t *testing.T) {
 
 	logger := slog.Default()
 
-	r := fraud.Router(logger)
+	r := fraud.Router(testStore(t), logger)
 
 	req, err := http.NewRequest("POST", "/check", strings.NewReader(`{"customer_id":"1","charge":100}`))
 	require.NoError(t, err)
@@ -52,3 +69,495 @@ func TestMaintenanceMode(t *testing.T) {
 	r.ServeHTTP(rr, req)
 	require.Equal(t, rr.Code, http.StatusOK)
 }
+
+func TestMaintenanceModeToggle(t *testing.T) {
+	r := fraud.Router(testStore(t), slog.Default())
+
+	require.Equal(t, http.StatusOK, setRules(t, r, `{"spendLimit":1000}`))
+
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest("POST", "/maintenance", strings.NewReader(`{"enabled":true}`)))
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest("POST", "/check", strings.NewReader(`{"customerId":"1","charge":100}`)))
+	require.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	require.Empty(t, rr.Header().Get("Retry-After"))
+
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest("POST", "/maintenance", strings.NewReader(`{"enabled":false}`)))
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	// Leaving maintenance mode keeps the configured rules.
+	result := check(t, r, fraud.FraudCheckInput{CustomerID: "1", Charge: 1100})
+	require.Equal(t, fraud.RuleSpendLimit, result.Rule)
+}
+
+func TestMaintenanceWindow(t *testing.T) {
+	clock := &testClock{now: time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)}
+	r := fraud.RouterWithClock(testStore(t), slog.Default(), clock.Now)
+
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest("PUT", "/maintenance/window", strings.NewReader(`{"start":"2024-06-01T14:00:00Z","end":"2024-06-01T13:00:00Z"}`)))
+	require.Equal(t, http.StatusBadRequest, rr.Code)
+
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest("PUT", "/maintenance/window", strings.NewReader(`{"start":"2024-06-01T13:00:00Z","end":"2024-06-01T14:00:00Z"}`)))
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	settings := func() fraud.FraudSettingsResult {
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, httptest.NewRequest("GET", "/settings", nil))
+		require.Equal(t, http.StatusOK, rr.Code)
+
+		var result fraud.FraudSettingsResult
+		require.NoError(t, json.NewDecoder(rr.Body).Decode(&result))
+		return result
+	}
+
+	window := &fraud.MaintenanceWindow{
+		Start: time.Date(2024, 6, 1, 13, 0, 0, 0, time.UTC),
+		End:   time.Date(2024, 6, 1, 14, 0, 0, 0, time.UTC),
+	}
+
+	result := settings()
+	require.False(t, result.MaintenanceMode, "window has not started")
+	require.Equal(t, window, result.MaintenanceWindow)
+	check(t, r, fraud.FraudCheckInput{CustomerID: "1", Charge: 100})
+
+	clock.now = clock.now.Add(90 * time.Minute)
+	require.True(t, settings().MaintenanceMode)
+
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest("POST", "/check", strings.NewReader(`{"customerId":"1","charge":100}`)))
+	require.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	require.Equal(t, "1800", rr.Header().Get("Retry-After"))
+
+	clock.now = clock.now.Add(30 * time.Minute)
+	require.False(t, settings().MaintenanceMode)
+	check(t, r, fraud.FraudCheckInput{CustomerID: "1", Charge: 100})
+
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest("DELETE", "/maintenance/window", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Nil(t, settings().MaintenanceWindow)
+}
+
+func TestConcurrentChecks(t *testing.T) {
+	store := testStore(t)
+
+	// Two instances of the service sharing a store.
+	instances := []http.Handler{
+		fraud.Router(store, slog.Default()),
+		fraud.Router(store, slog.Default()),
+	}
+
+	req := httptest.NewRequest("POST", "/limit", strings.NewReader(`{"limit":1000}`))
+	rr := httptest.NewRecorder()
+	instances[0].ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	accepted := 0
+
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(r http.Handler) {
+			defer wg.Done()
+
+			req := httptest.NewRequest("POST", "/check", strings.NewReader(`{"customerId":"1","charge":100}`))
+			rr := httptest.NewRecorder()
+			r.ServeHTTP(rr, req)
+			if !assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String()) {
+				return
+			}
+
+			var result fraud.FraudCheckResult
+			if !assert.NoError(t, json.NewDecoder(rr.Body).Decode(&result)) {
+				return
+			}
+			if !result.Declined {
+				lock.Lock()
+				accepted++
+				lock.Unlock()
+			}
+		}(instances[i%len(instances)])
+	}
+	wg.Wait()
+
+	require.Equal(t, 10, accepted)
+
+	// Settings and tallies survive a restart.
+	r := fraud.Router(store, slog.Default())
+
+	req = httptest.NewRequest("GET", "/settings", nil)
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+	var settings fraud.FraudSettingsResult
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&settings))
+	require.Equal(t, int32(1000), settings.Limit)
+	require.False(t, settings.MaintenanceMode)
+
+	req = httptest.NewRequest("POST", "/check", strings.NewReader(`{"customerId":"1","charge":100}`))
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.JSONEq(t, `{"declined":true,"decision":"decline","rule":"spendLimit","riskScore":100}`, rr.Body.String())
+}
+
+type testClock struct {
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	return c.now
+}
+
+func check(t *testing.T, r http.Handler, input fraud.FraudCheckInput) fraud.FraudCheckResult {
+	body, err := json.Marshal(input)
+	require.NoError(t, err)
+
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest("POST", "/check", strings.NewReader(string(body))))
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	var result fraud.FraudCheckResult
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&result))
+
+	return result
+}
+
+func setRules(t *testing.T, r http.Handler, rules string) int {
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest("PUT", "/rules", strings.NewReader(rules)))
+	return rr.Code
+}
+
+func TestSpendLimitWindow(t *testing.T) {
+	clock := &testClock{now: time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)}
+	r := fraud.RouterWithClock(testStore(t), slog.Default(), clock.Now)
+
+	require.Equal(t, http.StatusOK, setRules(t, r, `{"spendLimit":1000,"spendWindow":"24h"}`))
+
+	result := check(t, r, fraud.FraudCheckInput{CustomerID: "1", Charge: 800})
+	require.False(t, result.Declined)
+	require.Equal(t, int32(80), result.RiskScore)
+
+	clock.now = clock.now.Add(12 * time.Hour)
+	result = check(t, r, fraud.FraudCheckInput{CustomerID: "1", Charge: 800})
+	require.Equal(t, fraud.FraudCheckResult{Declined: true, Decision: fraud.DecisionDecline, Rule: fraud.RuleSpendLimit, RiskScore: 100}, result)
+
+	// Once the first charge is outside the window the customer may spend again.
+	clock.now = clock.now.Add(13 * time.Hour)
+	result = check(t, r, fraud.FraudCheckInput{CustomerID: "1", Charge: 800})
+	require.False(t, result.Declined)
+}
+
+func TestRules(t *testing.T) {
+	clock := &testClock{now: time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)}
+	r := fraud.RouterWithClock(testStore(t), slog.Default(), clock.Now)
+
+	require.Equal(t, http.StatusBadRequest, setRules(t, r, `{"spendWindow":"tomorrow"}`))
+	require.Equal(t, http.StatusBadRequest, setRules(t, r, `{"skuRisk":{"Rifle":150}}`))
+	require.Equal(t, http.StatusOK, setRules(t, r, `{"maxChargesPerHour":2,"firstOrderLimit":5000,"skuRisk":{"Gift Card":60},"riskThreshold":100}`))
+
+	result := check(t, r, fraud.FraudCheckInput{CustomerID: "1", Charge: 6000})
+	require.Equal(t, fraud.FraudCheckResult{Declined: true, Decision: fraud.DecisionDecline, Rule: fraud.RuleFirstOrderLimit, RiskScore: 100}, result)
+
+	result = check(t, r, fraud.FraudCheckInput{CustomerID: "1", Charge: 4000})
+	require.False(t, result.Declined)
+
+	// The first order limit no longer applies.
+	result = check(t, r, fraud.FraudCheckInput{CustomerID: "1", Charge: 6000})
+	require.Equal(t, fraud.FraudCheckResult{Declined: false, Decision: fraud.DecisionApprove, RiskScore: 100}, result)
+
+	result = check(t, r, fraud.FraudCheckInput{CustomerID: "1", Charge: 100})
+	require.Equal(t, fraud.RuleChargeVelocity, result.Rule)
+
+	clock.now = clock.now.Add(time.Hour)
+
+	result = check(t, r, fraud.FraudCheckInput{CustomerID: "1", Charge: 100, Items: []fraud.Item{{SKU: "Gift Card", Quantity: 1}}})
+	require.Equal(t, fraud.FraudCheckResult{Declined: false, Decision: fraud.DecisionApprove, RiskScore: 60}, result)
+
+	result = check(t, r, fraud.FraudCheckInput{CustomerID: "2", Charge: 100, Items: []fraud.Item{{SKU: "Gift Card", Quantity: 1}, {SKU: "Gift Card", Quantity: 2}}})
+	require.Equal(t, fraud.FraudCheckResult{Declined: true, Decision: fraud.DecisionDecline, Rule: fraud.RuleSKURisk, RiskScore: 100}, result)
+}
+
+func TestReviews(t *testing.T) {
+	clock := &testClock{now: time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)}
+	r := fraud.RouterWithClock(testStore(t), slog.Default(), clock.Now)
+
+	var delivered []fraud.ReviewDecision
+	callback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var decision fraud.ReviewDecision
+		require.NoError(t, json.NewDecoder(req.Body).Decode(&decision))
+		delivered = append(delivered, decision)
+	}))
+	defer callback.Close()
+
+	require.Equal(t, http.StatusOK, setRules(t, r, `{"skuRisk":{"Gift Card":60},"reviewThreshold":50,"reviewTimeout":"30m","reviewDefault":"approve"}`))
+
+	result := check(t, r, fraud.FraudCheckInput{CustomerID: "1", Charge: 100})
+	require.Equal(t, fraud.DecisionApprove, result.Decision)
+
+	giftCard := []fraud.Item{{SKU: "Gift Card", Quantity: 1}}
+
+	first := check(t, r, fraud.FraudCheckInput{CustomerID: "1", Charge: 100, Items: giftCard, Reference: "order1:1", CallbackURL: callback.URL})
+	require.Equal(t, fraud.DecisionReview, first.Decision)
+	require.False(t, first.Declined)
+	require.NotEmpty(t, first.ReviewID)
+	require.Equal(t, clock.now.Add(30*time.Minute), *first.ReviewExpiresAt)
+	require.Equal(t, fraud.ReviewApprove, first.ReviewDefault)
+
+	clock.now = clock.now.Add(20 * time.Minute)
+	second := check(t, r, fraud.FraudCheckInput{CustomerID: "2", Charge: 100, Items: giftCard, Reference: "order2:1", CallbackURL: callback.URL})
+	require.Equal(t, fraud.DecisionReview, second.Decision)
+
+	var reviews []fraud.Review
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest("GET", "/reviews?status=pending", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&reviews))
+	require.Len(t, reviews, 2)
+	require.Equal(t, "order1:1", reviews[0].Reference)
+	require.Equal(t, int32(60), reviews[0].RiskScore)
+
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest("POST", "/reviews/"+second.ReviewID+"/reject", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Equal(t, []fraud.ReviewDecision{{ReviewID: second.ReviewID, Decision: fraud.ReviewReject}}, delivered)
+
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest("POST", "/reviews/"+second.ReviewID+"/approve", nil))
+	require.Equal(t, http.StatusConflict, rr.Code, "review has already been decided")
+
+	// The first review expires, and can no longer be decided.
+	clock.now = clock.now.Add(20 * time.Minute)
+
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest("POST", "/reviews/"+first.ReviewID+"/approve", nil))
+	require.Equal(t, http.StatusConflict, rr.Code)
+
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest("GET", "/reviews?status=expired", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&reviews))
+	require.Len(t, reviews, 1)
+	require.Equal(t, first.ReviewID, reviews[0].ID)
+
+	require.Len(t, delivered, 1)
+}
+
+func TestReviewedChargeHistory(t *testing.T) {
+	clock := &testClock{now: time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)}
+	r := fraud.RouterWithClock(testStore(t), slog.Default(), clock.Now)
+
+	giftCard := []fraud.Item{{SKU: "Gift Card", Quantity: 1}}
+	decide := func(id string, decision string) {
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, httptest.NewRequest("POST", "/reviews/"+id+"/"+decision, nil))
+		require.Equal(t, http.StatusOK, rr.Code)
+	}
+
+	// A rejected review no longer counts towards the customer's spend.
+	require.Equal(t, http.StatusOK, setRules(t, r, `{"spendLimit":150,"skuRisk":{"Gift Card":80},"reviewThreshold":70,"reviewDefault":"approve"}`))
+
+	held := check(t, r, fraud.FraudCheckInput{CustomerID: "1", Charge: 100, Items: giftCard})
+	require.Equal(t, fraud.DecisionReview, held.Decision)
+	decide(held.ReviewID, "reject")
+
+	result := check(t, r, fraud.FraudCheckInput{CustomerID: "1", Charge: 100})
+	require.Equal(t, fraud.DecisionApprove, result.Decision)
+
+	// A review which defaults to reject only counts once it is approved.
+	require.Equal(t, http.StatusOK, setRules(t, r, `{"spendLimit":150,"skuRisk":{"Gift Card":80},"reviewThreshold":70,"reviewDefault":"reject"}`))
+
+	held = check(t, r, fraud.FraudCheckInput{CustomerID: "2", Charge: 100, Items: giftCard})
+	require.Equal(t, fraud.DecisionReview, held.Decision)
+
+	result = check(t, r, fraud.FraudCheckInput{CustomerID: "3", Charge: 100, Items: giftCard})
+	require.Equal(t, fraud.DecisionReview, result.Decision)
+	decide(result.ReviewID, "reject")
+
+	decide(held.ReviewID, "approve")
+
+	result = check(t, r, fraud.FraudCheckInput{CustomerID: "2", Charge: 100})
+	require.Equal(t, fraud.DecisionDecline, result.Decision)
+	require.Equal(t, fraud.RuleSpendLimit, result.Rule)
+
+	result = check(t, r, fraud.FraudCheckInput{CustomerID: "3", Charge: 100})
+	require.Equal(t, fraud.DecisionApprove, result.Decision)
+}
+
+func TestRepeatedChecks(t *testing.T) {
+	clock := &testClock{now: time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)}
+	store := testStore(t)
+	r := fraud.RouterWithClock(store, slog.Default(), clock.Now)
+
+	require.Equal(t, http.StatusOK, setRules(t, r, `{"spendLimit":1000}`))
+
+	// A repeated check returns the verdict already given, and the charge is only counted once.
+	first := check(t, r, fraud.FraudCheckInput{CustomerID: "1", Charge: 800, ChargeID: "charge1"})
+	require.Equal(t, fraud.FraudCheckResult{Declined: false, Decision: fraud.DecisionApprove, RiskScore: 80}, first)
+
+	clock.now = clock.now.Add(time.Minute)
+	require.Equal(t, first, check(t, r, fraud.FraudCheckInput{CustomerID: "1", Charge: 800, ChargeID: "charge1"}))
+
+	result := check(t, r, fraud.FraudCheckInput{CustomerID: "1", Charge: 150, ChargeID: "charge2"})
+	require.False(t, result.Declined)
+
+	result = check(t, r, fraud.FraudCheckInput{CustomerID: "1", Charge: 100, ChargeID: "charge3"})
+	require.Equal(t, fraud.RuleSpendLimit, result.Rule)
+
+	// A declined charge is still declined when checked again.
+	require.Equal(t, result, check(t, r, fraud.FraudCheckInput{CustomerID: "1", Charge: 100, ChargeID: "charge3"}))
+
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest("GET", "/decisions?customerId=1", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	var decisions []fraud.Decision
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&decisions))
+	require.Len(t, decisions, 3)
+
+	// A charge recorded by a check which failed before giving its verdict is not recorded again.
+	_, err := store.RecordFraudCharge(context.Background(), "2", clock.now.Add(-time.Hour),
+		db.FraudCharge{ChargeID: "charge4", Amount: 800, CreatedAt: clock.now},
+		func(*db.FraudHistory) (bool, error) { return true, nil },
+	)
+	require.NoError(t, err)
+
+	result = check(t, r, fraud.FraudCheckInput{CustomerID: "2", Charge: 800, ChargeID: "charge4"})
+	require.Equal(t, fraud.FraudCheckResult{Declined: false, Decision: fraud.DecisionApprove, RiskScore: 80}, result)
+
+	result = check(t, r, fraud.FraudCheckInput{CustomerID: "2", Charge: 150, ChargeID: "charge5"})
+	require.False(t, result.Declined)
+
+	// A charge held for review is only held once.
+	require.Equal(t, http.StatusOK, setRules(t, r, `{"skuRisk":{"Gift Card":60},"reviewThreshold":50}`))
+
+	giftCard := []fraud.Item{{SKU: "Gift Card", Quantity: 1}}
+	held := check(t, r, fraud.FraudCheckInput{CustomerID: "3", Charge: 100, Items: giftCard, ChargeID: "charge6"})
+	require.Equal(t, fraud.DecisionReview, held.Decision)
+	require.Equal(t, held, check(t, r, fraud.FraudCheckInput{CustomerID: "3", Charge: 100, Items: giftCard, ChargeID: "charge6"}))
+
+	var reviews []fraud.Review
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest("GET", "/reviews", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&reviews))
+	require.Len(t, reviews, 1)
+	require.Equal(t, held.ReviewID, reviews[0].ID)
+}
+
+func TestDecisions(t *testing.T) {
+	clock := &testClock{now: time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)}
+	r := fraud.RouterWithClock(testStore(t), slog.Default(), clock.Now)
+
+	require.Equal(t, http.StatusOK, setRules(t, r, `{"spendLimit":1000}`))
+
+	check(t, r, fraud.FraudCheckInput{CustomerID: "1", Charge: 800, Reference: "order1:1"})
+	check(t, r, fraud.FraudCheckInput{CustomerID: "1", Charge: 800, Reference: "order2:1"})
+	check(t, r, fraud.FraudCheckInput{CustomerID: "2", Charge: 1200, Reference: "order3:1"})
+
+	clock.now = clock.now.Add(time.Hour)
+	check(t, r, fraud.FraudCheckInput{CustomerID: "2", Charge: 1500, Reference: "order4:1"})
+	check(t, r, fraud.FraudCheckInput{CustomerID: "3", Charge: 100, Reference: "order5:1"})
+
+	decisions := func(query string) []fraud.Decision {
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, httptest.NewRequest("GET", "/decisions"+query, nil))
+		require.Equal(t, http.StatusOK, rr.Code)
+
+		var result []fraud.Decision
+		require.NoError(t, json.NewDecoder(rr.Body).Decode(&result))
+		return result
+	}
+
+	all := decisions("")
+	require.Len(t, all, 5)
+	require.Equal(t, "order5:1", all[0].Reference, "newest first")
+
+	declined := decisions("?decision=decline")
+	require.Len(t, declined, 3)
+	for _, d := range declined {
+		require.Equal(t, fraud.RuleSpendLimit, d.Rule)
+	}
+
+	require.Len(t, decisions("?customerId=2"), 2)
+	require.Len(t, decisions("?since=2024-06-01T13:00:00Z"), 2)
+	require.Len(t, decisions("?limit=1"), 1)
+
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest("GET", "/decisions?since=yesterday", nil))
+	require.Equal(t, http.StatusBadRequest, rr.Code)
+
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest("GET", "/decisions/stats?top=1", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	var stats fraud.DecisionStats
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&stats))
+
+	require.Equal(t, 5, stats.Total)
+	require.Equal(t, 3, stats.Declined)
+	require.InDelta(t, 0.6, stats.DeclineRate, 0.001)
+	require.Equal(t, []fraud.HourlyDecisionStats{
+		{Hour: time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC), Total: 3, Declined: 2, DeclineRate: 2.0 / 3},
+		{Hour: time.Date(2024, 6, 1, 13, 0, 0, 0, time.UTC), Total: 2, Declined: 1, DeclineRate: 0.5},
+	}, stats.Hourly)
+	require.Equal(t, []fraud.CustomerDeclineStats{{CustomerID: "2", Declined: 2, Amount: 2700}}, stats.TopDeclinedCustomers)
+}
+
+func TestLists(t *testing.T) {
+	clock := &testClock{now: time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)}
+	r := fraud.RouterWithClock(testStore(t), slog.Default(), clock.Now)
+
+	require.Equal(t, http.StatusOK, setRules(t, r, `{"spendLimit":1000}`))
+
+	setEntry := func(list string, customerID string, body string) int {
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, httptest.NewRequest("PUT", "/"+list+"/"+customerID, strings.NewReader(body)))
+		return rr.Code
+	}
+
+	require.Equal(t, http.StatusBadRequest, setEntry("allowlist", "wholesale", `{}`))
+	require.Equal(t, http.StatusBadRequest, setEntry("blocklist", "fraudster", `{"reason":"chargebacks","expiresAt":"2024-06-01T11:00:00Z"}`))
+	require.Equal(t, http.StatusOK, setEntry("allowlist", "wholesale", `{"reason":"wholesale account"}`))
+	require.Equal(t, http.StatusOK, setEntry("blocklist", "fraudster", `{"reason":"chargebacks","expiresAt":"2024-06-02T12:00:00Z"}`))
+
+	result := check(t, r, fraud.FraudCheckInput{CustomerID: "wholesale", Charge: 50000})
+	require.Equal(t, fraud.FraudCheckResult{Decision: fraud.DecisionApprove, List: fraud.ListAllow}, result)
+
+	result = check(t, r, fraud.FraudCheckInput{CustomerID: "fraudster", Charge: 100})
+	require.Equal(t, fraud.FraudCheckResult{Declined: true, Decision: fraud.DecisionDecline, Rule: fraud.RuleBlocklist, RiskScore: 100, List: fraud.ListBlock}, result)
+
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest("GET", "/blocklist", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	var entries []fraud.ListEntry
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&entries))
+	require.Len(t, entries, 1)
+	require.Equal(t, "chargebacks", entries[0].Reason)
+
+	// Once the entry expires the rules apply again.
+	clock.now = clock.now.Add(25 * time.Hour)
+	result = check(t, r, fraud.FraudCheckInput{CustomerID: "fraudster", Charge: 100})
+	require.Equal(t, fraud.DecisionApprove, result.Decision)
+	require.Empty(t, result.List)
+
+	// Moving a customer to the block list removes them from the allow list.
+	require.Equal(t, http.StatusOK, setEntry("blocklist", "wholesale", `{"reason":"account compromised"}`))
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest("DELETE", "/allowlist/wholesale", nil))
+	require.Equal(t, http.StatusNotFound, rr.Code)
+
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest("DELETE", "/blocklist/wholesale", nil))
+	require.Equal(t, http.StatusNoContent, rr.Code)
+
+	result = check(t, r, fraud.FraudCheckInput{CustomerID: "wholesale", Charge: 1100})
+	require.Equal(t, fraud.RuleSpendLimit, result.Rule)
+}
@@ -0,0 +1,302 @@
+package fraud
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/temporalio/reference-app-orders-go/app/db"
+)
+
+// Decision is the recorded outcome of a fraud check.
+type Decision struct {
+	ID         string    `json:"id"`
+	CustomerID string    `json:"customerId"`
+	Reference  string    `json:"reference,omitempty"`
+	Amount     int32     `json:"amount"`
+	Decision   string    `json:"decision"`
+	Rule       string    `json:"rule,omitempty"`
+	RiskScore  int32     `json:"riskScore"`
+	CreatedAt  time.Time `json:"createdAt"`
+}
+
+// DecisionStats summarises the fraud checks made within a period.
+type DecisionStats struct {
+	Since       time.Time `json:"since"`
+	Until       time.Time `json:"until"`
+	Total       int       `json:"total"`
+	Declined    int       `json:"declined"`
+	DeclineRate float64   `json:"declineRate"`
+
+	// Hourly holds the checks made in each hour of the period which had any checks, oldest first.
+	Hourly []HourlyDecisionStats `json:"hourly"`
+
+	// TopDeclinedCustomers holds the customers with the most declined charges, most declined first.
+	TopDeclinedCustomers []CustomerDeclineStats `json:"topDeclinedCustomers"`
+}
+
+// HourlyDecisionStats summarises the fraud checks made within an hour.
+type HourlyDecisionStats struct {
+	Hour        time.Time `json:"hour"`
+	Total       int       `json:"total"`
+	Declined    int       `json:"declined"`
+	DeclineRate float64   `json:"declineRate"`
+}
+
+// CustomerDeclineStats summarises a customer's declined charges.
+type CustomerDeclineStats struct {
+	CustomerID string `json:"customerId"`
+	Declined   int    `json:"declined"`
+	Amount     int64  `json:"amount"`
+}
+
+const (
+	// defaultDecisionLimit is the number of decisions listed if no limit is given.
+	defaultDecisionLimit = 100
+
+	// defaultStatsPeriod is the period summarised if no start time is given.
+	defaultStatsPeriod = 24 * time.Hour
+
+	// defaultTopCustomers is the number of top declined customers reported if no number is given.
+	defaultTopCustomers = 10
+)
+
+func decisionFromDB(d *db.FraudDecision) Decision {
+	return Decision{
+		ID:         d.ID,
+		CustomerID: d.CustomerID,
+		Reference:  d.Reference,
+		Amount:     d.Amount,
+		Decision:   d.Decision,
+		Rule:       d.Rule,
+		RiskScore:  d.RiskScore,
+		CreatedAt:  d.CreatedAt,
+	}
+}
+
+// recordDecision adds the outcome of a fraud check to the decision log.
+func (h *handlers) recordDecision(ctx context.Context, input *FraudCheckInput, result *FraudCheckResult, now time.Time) error {
+	return h.db.InsertFraudDecision(ctx, &db.FraudDecision{
+		ID:         uuid.NewString(),
+		CustomerID: input.CustomerID,
+		Reference:  input.Reference,
+		Amount:     input.Charge,
+		Decision:   result.Decision,
+		Rule:       result.Rule,
+		RiskScore:  result.RiskScore,
+		CreatedAt:  now,
+	})
+}
+
+// parseTime parses an optional RFC 3339 query parameter.
+func parseTime(q url.Values, name string) (time.Time, error) {
+	value := q.Get(name)
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s must be an RFC 3339 time", name)
+	}
+
+	return t.UTC(), nil
+}
+
+// parsePeriod parses the optional since and until query parameters.
+func parsePeriod(q url.Values) (time.Time, time.Time, error) {
+	since, err := parseTime(q, "since")
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+
+	until, err := parseTime(q, "until")
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+
+	if !since.IsZero() && !until.IsZero() && !until.After(since) {
+		return time.Time{}, time.Time{}, fmt.Errorf("until must be after since")
+	}
+
+	return since, until, nil
+}
+
+// parseLimit parses an optional positive integer query parameter.
+func parseLimit(q url.Values, name string, fallback int) (int, error) {
+	value := q.Get(name)
+	if value == "" {
+		return fallback, nil
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("%s must be a positive integer", name)
+	}
+
+	return n, nil
+}
+
+func (h *handlers) handleListDecisions(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	filter := db.FraudDecisionFilter{
+		CustomerID: q.Get("customerId"),
+		Decision:   q.Get("decision"),
+		Rule:       q.Get("rule"),
+	}
+
+	since, until, err := parsePeriod(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter.Since, filter.Until = since, until
+
+	filter.Limit, err = parseLimit(q, "limit", defaultDecisionLimit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var decisions []db.FraudDecision
+
+	if err := h.db.GetFraudDecisions(r.Context(), filter, &decisions); err != nil {
+		h.logger.Error("Failed to list decisions", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	result := make([]Decision, len(decisions))
+	for i, d := range decisions {
+		result[i] = decisionFromDB(&d)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		h.logger.Error("Failed to encode decisions", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (h *handlers) handleDecisionStats(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	since, until, err := parsePeriod(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	top, err := parseLimit(q, "top", defaultTopCustomers)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Without an end time the period includes decisions made up to now.
+	filter := db.FraudDecisionFilter{Since: since, Until: until}
+	if until.IsZero() {
+		until = h.now().UTC()
+	}
+	if since.IsZero() {
+		since = until.Add(-defaultStatsPeriod)
+		filter.Since = since
+	}
+
+	var decisions []db.FraudDecision
+
+	err = h.db.GetFraudDecisions(r.Context(), filter, &decisions)
+	if err != nil {
+		h.logger.Error("Failed to list decisions", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(decisionStats(decisions, since, until, top)); err != nil {
+		h.logger.Error("Failed to encode decision stats", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// decisionStats summarises decisions by hour and by declined customer.
+func decisionStats(decisions []db.FraudDecision, since time.Time, until time.Time, top int) DecisionStats {
+	stats := DecisionStats{
+		Since:                since,
+		Until:                until,
+		Hourly:               []HourlyDecisionStats{},
+		TopDeclinedCustomers: []CustomerDeclineStats{},
+	}
+
+	hours := map[time.Time]*HourlyDecisionStats{}
+	customers := map[string]*CustomerDeclineStats{}
+
+	for _, d := range decisions {
+		hour := d.CreatedAt.UTC().Truncate(time.Hour)
+		h, ok := hours[hour]
+		if !ok {
+			h = &HourlyDecisionStats{Hour: hour}
+			hours[hour] = h
+		}
+
+		stats.Total++
+		h.Total++
+
+		if d.Decision != DecisionDecline {
+			continue
+		}
+
+		stats.Declined++
+		h.Declined++
+
+		c, ok := customers[d.CustomerID]
+		if !ok {
+			c = &CustomerDeclineStats{CustomerID: d.CustomerID}
+			customers[d.CustomerID] = c
+		}
+		c.Declined++
+		c.Amount += int64(d.Amount)
+	}
+
+	stats.DeclineRate = declineRate(stats.Declined, stats.Total)
+
+	for _, h := range hours {
+		h.DeclineRate = declineRate(h.Declined, h.Total)
+		stats.Hourly = append(stats.Hourly, *h)
+	}
+	sort.Slice(stats.Hourly, func(i, j int) bool {
+		return stats.Hourly[i].Hour.Before(stats.Hourly[j].Hour)
+	})
+
+	for _, c := range customers {
+		stats.TopDeclinedCustomers = append(stats.TopDeclinedCustomers, *c)
+	}
+	sort.Slice(stats.TopDeclinedCustomers, func(i, j int) bool {
+		a, b := stats.TopDeclinedCustomers[i], stats.TopDeclinedCustomers[j]
+		if a.Declined != b.Declined {
+			return a.Declined > b.Declined
+		}
+		return a.CustomerID < b.CustomerID
+	})
+	if len(stats.TopDeclinedCustomers) > top {
+		stats.TopDeclinedCustomers = stats.TopDeclinedCustomers[:top]
+	}
+
+	return stats
+}
+
+func declineRate(declined int, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(declined) / float64(total)
+}
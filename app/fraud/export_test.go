@@ -0,0 +1,4 @@
+package fraud
+
+// RouterWithClock is Router using the given function to tell the time.
+var RouterWithClock = router
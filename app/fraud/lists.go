@@ -0,0 +1,178 @@
+package fraud
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/temporalio/reference-app-orders-go/app/db"
+)
+
+const (
+	// ListAllow is the list of customers whose charges are always approved.
+	ListAllow = "allow"
+
+	// ListBlock is the list of customers whose charges are always declined.
+	ListBlock = "block"
+)
+
+// RuleBlocklist is reported when a charge is declined because the customer is on the block list.
+const RuleBlocklist = "blocklist"
+
+// ListEntry is a customer on the allow or block list.
+type ListEntry struct {
+	CustomerID string     `json:"customerId"`
+	List       string     `json:"list"`
+	Reason     string     `json:"reason"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	ExpiresAt  *time.Time `json:"expiresAt,omitempty"`
+}
+
+// ListEntryInput is the input for adding a customer to the allow or block list.
+// If ExpiresAt is not set the entry does not expire.
+type ListEntryInput struct {
+	Reason    string     `json:"reason"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+// listEntryActive reports whether a stored list entry applies at the given time.
+func listEntryActive(e *db.FraudListEntry, now time.Time) bool {
+	return e.ExpiresAt.IsZero() || now.Before(e.ExpiresAt)
+}
+
+func listEntryFromDB(e *db.FraudListEntry) ListEntry {
+	entry := ListEntry{
+		CustomerID: e.CustomerID,
+		List:       e.List,
+		Reason:     e.Reason,
+		CreatedAt:  e.CreatedAt,
+	}
+	if !e.ExpiresAt.IsZero() {
+		entry.ExpiresAt = &e.ExpiresAt
+	}
+	return entry
+}
+
+// listResult returns the check result for a customer on the allow or block list.
+// It returns nil if the customer is on neither list.
+func (h *handlers) listResult(ctx context.Context, customerID string, now time.Time) (*FraudCheckResult, error) {
+	var entry db.FraudListEntry
+
+	err := h.db.GetFraudListEntry(ctx, customerID, &entry)
+	if errors.Is(err, db.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if !listEntryActive(&entry, now) {
+		return nil, nil
+	}
+
+	switch entry.List {
+	case ListAllow:
+		return &FraudCheckResult{Decision: DecisionApprove, List: ListAllow}, nil
+	case ListBlock:
+		return &FraudCheckResult{Declined: true, Decision: DecisionDecline, Rule: RuleBlocklist, RiskScore: 100, List: ListBlock}, nil
+	}
+
+	return nil, nil
+}
+
+func (h *handlers) handleListEntries(list string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var entries []db.FraudListEntry
+
+		if err := h.db.GetFraudListEntries(r.Context(), list, &entries); err != nil {
+			h.logger.Error("Failed to get list", "list", list, "error", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		now := h.now().UTC()
+
+		result := []ListEntry{}
+		for _, entry := range entries {
+			if listEntryActive(&entry, now) {
+				result = append(result, listEntryFromDB(&entry))
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+
+		if err := json.NewEncoder(w).Encode(result); err != nil {
+			h.logger.Error("Failed to encode list", "list", list, "error", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+// handleSetListEntry adds a customer to a list. As a customer may only be on one list,
+// this removes them from the other list.
+func (h *handlers) handleSetListEntry(list string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var input ListEntryInput
+
+		err := json.NewDecoder(r.Body).Decode(&input)
+		if err != nil {
+			h.logger.Error("Failed to decode list entry", "error", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if input.Reason == "" {
+			http.Error(w, "reason is required", http.StatusBadRequest)
+			return
+		}
+
+		now := h.now().UTC()
+
+		entry := db.FraudListEntry{
+			CustomerID: r.PathValue("customerId"),
+			List:       list,
+			Reason:     input.Reason,
+			CreatedAt:  now,
+		}
+		if input.ExpiresAt != nil {
+			if !input.ExpiresAt.After(now) {
+				http.Error(w, "expiresAt must be in the future", http.StatusBadRequest)
+				return
+			}
+			entry.ExpiresAt = input.ExpiresAt.UTC()
+		}
+
+		if err := h.db.SetFraudListEntry(r.Context(), &entry); err != nil {
+			h.logger.Error("Failed to set list entry", "list", list, "error", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		h.logger.Info("Customer added to list", "customerId", entry.CustomerID, "list", list, "reason", entry.Reason)
+
+		w.Header().Set("Content-Type", "application/json")
+
+		if err := json.NewEncoder(w).Encode(listEntryFromDB(&entry)); err != nil {
+			h.logger.Error("Failed to encode list entry", "error", err)
+		}
+	}
+}
+
+func (h *handlers) handleDeleteListEntry(list string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := h.db.DeleteFraudListEntry(r.Context(), list, r.PathValue("customerId"))
+		if err != nil {
+			if errors.Is(err, db.ErrNotFound) {
+				http.Error(w, "Customer is not on the list", http.StatusNotFound)
+			} else {
+				h.logger.Error("Failed to delete list entry", "list", list, "error", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
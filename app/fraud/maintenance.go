@@ -0,0 +1,98 @@
+package fraud
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/temporalio/reference-app-orders-go/app/db"
+)
+
+// MaintenanceInput is the input for the SetMaintenanceMode API.
+// If no body is sent maintenance mode is enabled.
+type MaintenanceInput struct {
+	Enabled bool `json:"enabled"`
+}
+
+// MaintenanceWindow is a scheduled period during which the service is in maintenance.
+type MaintenanceWindow struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// maintenanceWindow returns the scheduled maintenance window, if any.
+func maintenanceWindow(settings *db.FraudSettings) *MaintenanceWindow {
+	if settings.MaintenanceEnd.IsZero() {
+		return nil
+	}
+	return &MaintenanceWindow{Start: settings.MaintenanceStart, End: settings.MaintenanceEnd}
+}
+
+// maintenanceStatus reports whether the service is in maintenance and, if the
+// maintenance is due to a scheduled window, how long remains until it ends.
+func maintenanceStatus(settings *db.FraudSettings, now time.Time) (bool, time.Duration) {
+	if window := maintenanceWindow(settings); window != nil {
+		if !now.Before(window.Start) && now.Before(window.End) {
+			return true, window.End.Sub(now)
+		}
+	}
+
+	return settings.MaintenanceMode, 0
+}
+
+func (h *handlers) handleSetMaintenanceMode(w http.ResponseWriter, r *http.Request) {
+	input := MaintenanceInput{Enabled: true}
+
+	if r.Body != nil {
+		err := json.NewDecoder(r.Body).Decode(&input)
+		if err != nil && !errors.Is(err, io.EOF) {
+			h.logger.Error("Failed to decode maintenance input", "error", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := h.db.SetFraudMaintenanceMode(r.Context(), input.Enabled); err != nil {
+		h.logger.Error("Failed to set maintenance mode", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *handlers) handleSetMaintenanceWindow(w http.ResponseWriter, r *http.Request) {
+	var window MaintenanceWindow
+
+	err := json.NewDecoder(r.Body).Decode(&window)
+	if err != nil {
+		h.logger.Error("Failed to decode maintenance window", "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if window.Start.IsZero() || !window.End.After(window.Start) {
+		http.Error(w, "start and an end after start are required", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.db.SetFraudMaintenanceWindow(r.Context(), window.Start.UTC(), window.End.UTC()); err != nil {
+		h.logger.Error("Failed to set maintenance window", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *handlers) handleClearMaintenanceWindow(w http.ResponseWriter, r *http.Request) {
+	if err := h.db.SetFraudMaintenanceWindow(r.Context(), time.Time{}, time.Time{}); err != nil {
+		h.logger.Error("Failed to clear maintenance window", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
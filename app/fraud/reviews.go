@@ -0,0 +1,313 @@
+package fraud
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/temporalio/reference-app-orders-go/app/db"
+)
+
+// Review is a charge held for review by a fraud analyst.
+type Review struct {
+	ID         string `json:"id"`
+	CustomerID string `json:"customerId"`
+	Reference  string `json:"reference"`
+	Charge     int32  `json:"charge"`
+	Rule       string `json:"rule,omitempty"`
+	RiskScore  int32  `json:"riskScore"`
+
+	Status          string `json:"status"`
+	DefaultDecision string `json:"defaultDecision"`
+
+	CreatedAt time.Time  `json:"createdAt"`
+	ExpiresAt time.Time  `json:"expiresAt"`
+	DecidedAt *time.Time `json:"decidedAt,omitempty"`
+}
+
+// ReviewDecision is sent to a charge's callback URL when its review is decided.
+type ReviewDecision struct {
+	ReviewID string `json:"reviewId"`
+	Decision string `json:"decision"`
+}
+
+const (
+	// ReviewApprove is the decision to allow a reviewed charge.
+	ReviewApprove = "approve"
+
+	// ReviewReject is the decision to decline a reviewed charge.
+	ReviewReject = "reject"
+)
+
+const (
+	// ReviewStatusPending is the status of a Review awaiting a decision.
+	ReviewStatusPending = "pending"
+
+	// ReviewStatusApproved is the status of a Review which was approved.
+	ReviewStatusApproved = "approved"
+
+	// ReviewStatusRejected is the status of a Review which was rejected.
+	ReviewStatusRejected = "rejected"
+
+	// ReviewStatusExpired is the status of a Review which was not decided in time.
+	// The charge proceeds with the Review's default decision.
+	ReviewStatusExpired = "expired"
+)
+
+// reviewStatus returns the status of a stored review, taking account of its expiry.
+func reviewStatus(r *db.FraudReview, now time.Time) string {
+	if r.Status == ReviewStatusPending && !now.Before(r.ExpiresAt) {
+		return ReviewStatusExpired
+	}
+	return r.Status
+}
+
+func reviewFromDB(r *db.FraudReview, now time.Time) Review {
+	review := Review{
+		ID:              r.ID,
+		CustomerID:      r.CustomerID,
+		Reference:       r.Reference,
+		Charge:          r.Charge,
+		Rule:            r.Rule,
+		RiskScore:       r.RiskScore,
+		Status:          reviewStatus(r, now),
+		DefaultDecision: r.DefaultDecision,
+		CreatedAt:       r.CreatedAt,
+		ExpiresAt:       r.ExpiresAt,
+	}
+	if !r.DecidedAt.IsZero() {
+		review.DecidedAt = &r.DecidedAt
+	}
+	return review
+}
+
+// reviewIDNamespace is the namespace of the review IDs derived from charge IDs.
+var reviewIDNamespace = uuid.MustParse("3d1f8a52-6c4e-4b9a-8f27-91e5c0b7d468")
+
+// createReview holds a charge for review. The review for an identified charge has an ID derived
+// from the charge's, so checking the charge again finds the review already held for it.
+func (h *handlers) createReview(ctx context.Context, input *FraudCheckInput, result *FraudCheckResult, rules *Rules, now time.Time) (*db.FraudReview, error) {
+	id := uuid.NewString()
+	if input.ChargeID != "" {
+		id = uuid.NewSHA1(reviewIDNamespace, []byte(input.ChargeID)).String()
+
+		var existing db.FraudReview
+		err := h.db.GetFraudReview(ctx, id, &existing)
+		if err == nil {
+			return &existing, nil
+		}
+		if !errors.Is(err, db.ErrNotFound) {
+			return nil, err
+		}
+	}
+
+	review := db.FraudReview{
+		ID:              id,
+		CustomerID:      input.CustomerID,
+		Reference:       input.Reference,
+		Charge:          input.Charge,
+		Rule:            result.Rule,
+		RiskScore:       result.RiskScore,
+		CallbackURL:     input.CallbackURL,
+		Status:          ReviewStatusPending,
+		DefaultDecision: rules.ReviewDefault,
+		CreatedAt:       now,
+		ExpiresAt:       now.Add(rules.reviewTimeout()),
+	}
+
+	if err := h.db.InsertFraudReview(ctx, &review); err != nil {
+		return nil, err
+	}
+
+	h.logger.Info("Charge held for review", "customerId", input.CustomerID, "charge", input.Charge, "reviewId", review.ID, "riskScore", result.RiskScore)
+
+	return &review, nil
+}
+
+func (h *handlers) handleListReviews(w http.ResponseWriter, r *http.Request) {
+	var reviews []db.FraudReview
+
+	// Expired reviews are stored as pending, so are filtered here.
+	status := r.URL.Query().Get("status")
+	stored := status
+	if status == ReviewStatusExpired {
+		stored = ReviewStatusPending
+	}
+
+	if err := h.db.GetFraudReviews(r.Context(), stored, &reviews); err != nil {
+		h.logger.Error("Failed to list reviews", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	now := h.now().UTC()
+
+	result := []Review{}
+	for _, review := range reviews {
+		rv := reviewFromDB(&review, now)
+		if status == "" || rv.Status == status {
+			result = append(result, rv)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		h.logger.Error("Failed to encode reviews", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (h *handlers) handleGetReview(w http.ResponseWriter, r *http.Request) {
+	var review db.FraudReview
+
+	err := h.db.GetFraudReview(r.Context(), r.PathValue("id"), &review)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			http.Error(w, "Review not found", http.StatusNotFound)
+		} else {
+			h.logger.Error("Failed to get review", "error", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(reviewFromDB(&review, h.now().UTC())); err != nil {
+		h.logger.Error("Failed to encode review", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// handleDecideReview records an analyst's decision on a pending review and delivers it to the charge.
+// If the decision cannot be delivered the review is returned to pending so the decision can be retried.
+func (h *handlers) handleDecideReview(decision string) http.HandlerFunc {
+	status := ReviewStatusApproved
+	if decision == ReviewReject {
+		status = ReviewStatusRejected
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		var review db.FraudReview
+
+		err := h.db.GetFraudReview(r.Context(), r.PathValue("id"), &review)
+		if err != nil {
+			if errors.Is(err, db.ErrNotFound) {
+				http.Error(w, "Review not found", http.StatusNotFound)
+			} else {
+				h.logger.Error("Failed to get review", "error", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+
+		now := h.now().UTC()
+
+		if current := reviewStatus(&review, now); current != ReviewStatusPending {
+			http.Error(w, fmt.Sprintf("Review is %s", current), http.StatusConflict)
+			return
+		}
+
+		updated, err := h.db.UpdateFraudReviewStatus(r.Context(), review.ID, ReviewStatusPending, status, now)
+		if err != nil {
+			h.logger.Error("Failed to update review", "error", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !updated {
+			http.Error(w, "Review has already been decided", http.StatusConflict)
+			return
+		}
+
+		if review.CallbackURL != "" {
+			err := deliverDecision(r.Context(), review.CallbackURL, ReviewDecision{ReviewID: review.ID, Decision: decision})
+			if err != nil {
+				h.logger.Error("Failed to deliver review decision", "reviewId", review.ID, "error", err)
+
+				if _, err := h.db.UpdateFraudReviewStatus(r.Context(), review.ID, status, ReviewStatusPending, time.Time{}); err != nil {
+					h.logger.Error("Failed to restore review", "reviewId", review.ID, "error", err)
+				}
+
+				http.Error(w, err.Error(), http.StatusBadGateway)
+				return
+			}
+		}
+
+		// The decision stands even if the history cannot be updated, as it has been delivered.
+		if err := h.settleReview(r.Context(), &review, decision, now); err != nil {
+			h.logger.Error("Failed to update charge history for review", "reviewId", review.ID, "error", err)
+		}
+
+		review.Status = status
+		review.DecidedAt = now
+
+		w.Header().Set("Content-Type", "application/json")
+
+		if err := json.NewEncoder(w).Encode(reviewFromDB(&review, now)); err != nil {
+			h.logger.Error("Failed to encode review", "error", err)
+		}
+	}
+}
+
+// settleReview updates the customer's charge history once a review is decided. A charge held for review
+// is only in the history if its review defaults to approve, so it is added if the analyst approves it,
+// and removed if the analyst rejects it.
+func (h *handlers) settleReview(ctx context.Context, review *db.FraudReview, decision string, now time.Time) error {
+	recorded := review.DefaultDecision == ReviewApprove
+	charge := db.FraudCharge{Amount: review.Charge, CreatedAt: review.CreatedAt}
+
+	switch {
+	case decision == ReviewApprove && !recorded:
+		var settings db.FraudSettings
+		if err := h.db.GetFraudSettings(ctx, &settings); err != nil {
+			return err
+		}
+		rules, err := rulesFromSettings(&settings)
+		if err != nil {
+			return err
+		}
+
+		_, err = h.db.RecordFraudCharge(ctx, review.CustomerID, now.Add(-rules.historyWindow()), charge,
+			func(*db.FraudHistory) (bool, error) { return true, nil },
+		)
+		return err
+	case decision == ReviewReject && recorded:
+		return h.db.RemoveFraudCharge(ctx, review.CustomerID, charge)
+	}
+
+	return nil
+}
+
+func deliverDecision(ctx context.Context, url string, decision ReviewDecision) error {
+	body, err := json.Marshal(decision)
+	if err != nil {
+		return fmt.Errorf("unable to encode decision: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("unable to build request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		body, _ := io.ReadAll(res.Body)
+		return fmt.Errorf("%s: %s", http.StatusText(res.StatusCode), body)
+	}
+
+	return nil
+}
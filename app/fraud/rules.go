@@ -0,0 +1,184 @@
+package fraud
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/temporalio/reference-app-orders-go/app/db"
+)
+
+// Rules configures the checks made by the fraud service.
+// A rule with a zero limit is disabled.
+type Rules struct {
+	// SpendLimit is the most a customer may be charged within SpendWindow.
+	SpendLimit int32 `json:"spendLimit"`
+	// SpendWindow is the rolling window for SpendLimit, as a Go duration such as "24h".
+	SpendWindow string `json:"spendWindow"`
+
+	// MaxChargesPerHour is the most charges a customer may make within an hour.
+	MaxChargesPerHour int32 `json:"maxChargesPerHour"`
+
+	// FirstOrderLimit is the most a customer may be charged for their first order.
+	FirstOrderLimit int32 `json:"firstOrderLimit"`
+
+	// SKURisk is the risk score, from 0 to 100, of ordering each SKU.
+	// The risk scores of the SKUs in a charge are added together.
+	SKURisk map[string]int32 `json:"skuRisk,omitempty"`
+	// RiskThreshold is the SKU risk score at which a charge is declined.
+	RiskThreshold int32 `json:"riskThreshold"`
+
+	// ReviewThreshold is the risk score at which a charge which breaks no rules is held for review.
+	ReviewThreshold int32 `json:"reviewThreshold"`
+	// ReviewTimeout is how long a review may take, as a Go duration such as "1h".
+	ReviewTimeout string `json:"reviewTimeout"`
+	// ReviewDefault is the decision, approve or reject, used for reviews which time out.
+	ReviewDefault string `json:"reviewDefault"`
+}
+
+const (
+	// RuleSpendLimit is reported when a charge would exceed the customer's spend limit.
+	RuleSpendLimit = "spendLimit"
+
+	// RuleChargeVelocity is reported when a customer has made too many charges in the last hour.
+	RuleChargeVelocity = "chargeVelocity"
+
+	// RuleFirstOrderLimit is reported when a customer's first charge is over the first order limit.
+	RuleFirstOrderLimit = "firstOrderLimit"
+
+	// RuleSKURisk is reported when the SKUs in a charge reach the risk threshold.
+	RuleSKURisk = "skuRisk"
+)
+
+// defaultRules returns the rules used before any have been configured.
+func defaultRules() Rules {
+	return Rules{
+		SpendWindow:   "24h",
+		RiskThreshold: 100,
+		ReviewTimeout: "1h",
+		ReviewDefault: ReviewReject,
+	}
+}
+
+// spendWindow returns the parsed SpendWindow.
+func (r *Rules) spendWindow() time.Duration {
+	d, err := time.ParseDuration(r.SpendWindow)
+	if err != nil {
+		return 24 * time.Hour
+	}
+	return d
+}
+
+// reviewTimeout returns the parsed ReviewTimeout.
+func (r *Rules) reviewTimeout() time.Duration {
+	d, err := time.ParseDuration(r.ReviewTimeout)
+	if err != nil {
+		return time.Hour
+	}
+	return d
+}
+
+// historyWindow is how far back charges are needed to evaluate the rules.
+func (r *Rules) historyWindow() time.Duration {
+	return max(r.spendWindow(), time.Hour)
+}
+
+func (r *Rules) validate() error {
+	d, err := time.ParseDuration(r.SpendWindow)
+	if err != nil || d <= 0 {
+		return fmt.Errorf("spendWindow must be a positive duration, such as 24h")
+	}
+	d, err = time.ParseDuration(r.ReviewTimeout)
+	if err != nil || d <= 0 {
+		return fmt.Errorf("reviewTimeout must be a positive duration, such as 1h")
+	}
+	if r.ReviewDefault != ReviewApprove && r.ReviewDefault != ReviewReject {
+		return fmt.Errorf("reviewDefault must be %s or %s", ReviewApprove, ReviewReject)
+	}
+	if r.SpendLimit < 0 || r.MaxChargesPerHour < 0 || r.FirstOrderLimit < 0 || r.RiskThreshold < 0 || r.ReviewThreshold < 0 {
+		return errors.New("limits must not be negative")
+	}
+	for sku, risk := range r.SKURisk {
+		if risk < 0 || risk > 100 {
+			return fmt.Errorf("risk for SKU %s must be between 0 and 100", sku)
+		}
+	}
+	return nil
+}
+
+// rulesFromSettings decodes the rules stored in the Fraud settings.
+func rulesFromSettings(settings *db.FraudSettings) (Rules, error) {
+	rules := defaultRules()
+	if settings.Rules == "" {
+		return rules, nil
+	}
+
+	err := json.Unmarshal([]byte(settings.Rules), &rules)
+	return rules, err
+}
+
+// riskScore returns a charge's score for a rule, as the percentage of the rule's limit used.
+func riskScore(value int64, limit int32) int32 {
+	return int32(min(100, value*100/int64(limit)))
+}
+
+// evaluate checks a charge against the rules given the customer's recent history.
+// The most severe rule determines the risk score, a charge is declined if any rule is broken.
+// A charge which breaks no rules but reaches the review threshold is held for review.
+func (r *Rules) evaluate(input *FraudCheckInput, history *db.FraudHistory, now time.Time) FraudCheckResult {
+	var result FraudCheckResult
+
+	apply := func(rule string, broken bool, score int32) {
+		if broken && !result.Declined {
+			result.Declined = true
+			result.Rule = rule
+		}
+		result.RiskScore = max(result.RiskScore, score)
+	}
+
+	if r.FirstOrderLimit > 0 && history.ChargeCount == 0 {
+		apply(RuleFirstOrderLimit, input.Charge > r.FirstOrderLimit, riskScore(int64(input.Charge), r.FirstOrderLimit))
+	}
+
+	if r.SpendLimit > 0 {
+		spend := int64(input.Charge)
+		since := now.Add(-r.spendWindow())
+		for _, c := range history.Charges {
+			if c.CreatedAt.After(since) {
+				spend += int64(c.Amount)
+			}
+		}
+		apply(RuleSpendLimit, spend > int64(r.SpendLimit), riskScore(spend, r.SpendLimit))
+	}
+
+	if r.MaxChargesPerHour > 0 {
+		count := int64(1)
+		since := now.Add(-time.Hour)
+		for _, c := range history.Charges {
+			if c.CreatedAt.After(since) {
+				count++
+			}
+		}
+		apply(RuleChargeVelocity, count > int64(r.MaxChargesPerHour), riskScore(count, r.MaxChargesPerHour))
+	}
+
+	var risk int32
+	for _, item := range input.Items {
+		risk += r.SKURisk[item.SKU]
+	}
+	if risk > 0 {
+		apply(RuleSKURisk, r.RiskThreshold > 0 && risk >= r.RiskThreshold, min(100, risk))
+	}
+
+	switch {
+	case result.Declined:
+		result.Decision = DecisionDecline
+	case r.ReviewThreshold > 0 && result.RiskScore >= r.ReviewThreshold:
+		result.Decision = DecisionReview
+	default:
+		result.Decision = DecisionApprove
+	}
+
+	return result
+}
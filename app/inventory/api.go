@@ -0,0 +1,413 @@
+package inventory
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/temporalio/reference-app-orders-go/app/db"
+	"go.temporal.io/sdk/client"
+)
+
+// Item is a quantity of a SKU.
+type Item struct {
+	SKU      string `json:"sku"`
+	Quantity int32  `json:"quantity"`
+}
+
+// StockLevel is the quantity of a SKU held at a warehouse location.
+type StockLevel struct {
+	SKU      string `json:"sku"`
+	Location string `json:"location"`
+	Quantity int32  `json:"quantity"`
+}
+
+// StockLevelInput is the input for the SetStockLevel API.
+type StockLevelInput struct {
+	Quantity int32 `json:"quantity"`
+}
+
+// ReservationInput is the input for the Reserve API.
+// Reference identifies the reservation, so that repeating a request does not reserve the items again.
+type ReservationInput struct {
+	Reference string `json:"reference"`
+	Items     []Item `json:"items"`
+
+	// Policy is how the items are planned into shipments, either "fewestShipments" or "fastest".
+	// Defaults to fewestShipments.
+	Policy string `json:"policy,omitempty"`
+	// ShipComplete plans the items into a single shipment, rather than shipping them partially.
+	// If no warehouse stocks every item, none of them are planned.
+	ShipComplete bool `json:"shipComplete,omitempty"`
+}
+
+// Reservation is stock taken to ship an order's items.
+// Items the plan reports as unavailable or as pre-orders are not reserved.
+type Reservation struct {
+	Reference string    `json:"reference"`
+	Plan      Plan      `json:"plan"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// RestockInput is the input for the Restock API.
+// Reference identifies the restock, so that repeating a request does not restock the items again.
+type RestockInput struct {
+	Reference string `json:"reference"`
+	Location  string `json:"location"`
+	Items     []Item `json:"items"`
+}
+
+// Restock is stock returned to a warehouse, such as items which were reserved and not shipped, or returned items.
+type Restock struct {
+	Reference string    `json:"reference"`
+	Location  string    `json:"location"`
+	Items     []Item    `json:"items"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+const (
+	// movementReservation is the Kind of a StockMovement which records a Reservation.
+	movementReservation = "reservation"
+
+	// movementRestock is the Kind of a StockMovement which records a Restock.
+	movementRestock = "restock"
+)
+
+// maxReservationAttempts is how many times a reservation is planned before giving up, if stock is taken by other
+// reservations while it is being planned.
+const maxReservationAttempts = 3
+
+type handlers struct {
+	temporal   client.Client
+	db         db.DB
+	logger     *slog.Logger
+	warehouses []Warehouse
+}
+
+// Router implements the http.Handler interface for the Inventory API
+func Router(c client.Client, db db.DB, logger *slog.Logger) http.Handler {
+	r := http.NewServeMux()
+	h := handlers{temporal: c, db: db, logger: logger, warehouses: DefaultWarehouses}
+
+	r.HandleFunc("GET /stock", h.handleGetStock)
+	r.HandleFunc("PUT /stock/{sku}/{location}", h.handleSetStockLevel)
+	r.HandleFunc("POST /reservations", h.handleReserve)
+	r.HandleFunc("GET /reservations/{reference}", h.handleGetReservation)
+	r.HandleFunc("POST /restocks", h.handleRestock)
+	r.HandleFunc("GET /releases", h.handleListReleases)
+	r.HandleFunc("PUT /releases/{sku}", h.handleSetRelease)
+	r.HandleFunc("POST /backorders", h.handleBackorder)
+	r.HandleFunc("GET /backorders", h.handleListBackorders)
+	r.HandleFunc("DELETE /backorders/{reference}", h.handleDeleteBackorder)
+
+	return r
+}
+
+// stockLevels returns the stock levels of the given SKUs. SKUs with no stock recorded are given simulated stock levels.
+func (h *handlers) stockLevels(ctx context.Context, skus []string) ([]db.StockLevel, error) {
+	var levels []db.StockLevel
+	if err := h.db.GetStockLevels(ctx, skus, &levels); err != nil {
+		return nil, err
+	}
+
+	recorded := make(map[string]bool)
+	for _, l := range levels {
+		recorded[l.SKU] = true
+	}
+
+	var initial []db.StockLevel
+	for _, sku := range skus {
+		if !recorded[sku] {
+			recorded[sku] = true
+			initial = append(initial, simulatedStock(sku, h.warehouses)...)
+		}
+	}
+	if len(initial) == 0 {
+		return levels, nil
+	}
+
+	if err := h.db.InitStockLevels(ctx, initial); err != nil {
+		return nil, err
+	}
+
+	levels = nil
+	if err := h.db.GetStockLevels(ctx, skus, &levels); err != nil {
+		return nil, err
+	}
+
+	return levels, nil
+}
+
+func (h *handlers) handleGetStock(w http.ResponseWriter, r *http.Request) {
+	skus := r.URL.Query()["sku"]
+
+	var levels []db.StockLevel
+	var err error
+	if len(skus) > 0 {
+		levels, err = h.stockLevels(r.Context(), skus)
+	} else {
+		err = h.db.GetStockLevels(r.Context(), nil, &levels)
+	}
+	if err != nil {
+		h.logger.Error("Failed to get stock levels", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	result := make([]StockLevel, len(levels))
+	for i, l := range levels {
+		result[i] = StockLevel{SKU: l.SKU, Location: l.Location, Quantity: l.Quantity}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		h.logger.Error("Failed to encode stock levels", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (h *handlers) handleSetStockLevel(w http.ResponseWriter, r *http.Request) {
+	var input StockLevelInput
+
+	err := json.NewDecoder(r.Body).Decode(&input)
+	if err != nil {
+		h.logger.Error("Failed to decode stock level input", "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if input.Quantity < 0 {
+		http.Error(w, "quantity must not be negative", http.StatusBadRequest)
+		return
+	}
+
+	level := db.StockLevel{SKU: r.PathValue("sku"), Location: r.PathValue("location"), Quantity: input.Quantity}
+
+	if err := h.db.SetStockLevel(r.Context(), &level); err != nil {
+		h.logger.Error("Failed to set stock level", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if level.Quantity > 0 {
+		h.notifyRestock(r.Context(), []string{level.SKU})
+	}
+}
+
+// validateItems checks that items each have a SKU and a positive quantity.
+func validateItems(items []Item) error {
+	if len(items) == 0 {
+		return errors.New("items are required")
+	}
+
+	for _, item := range items {
+		if item.SKU == "" {
+			return errors.New("item SKU is required")
+		}
+		if item.Quantity <= 0 {
+			return fmt.Errorf("quantity of %s must be positive", item.SKU)
+		}
+	}
+
+	return nil
+}
+
+// writeMovement writes a recorded stock movement as the response, with 201 Created if it was
+// recorded by this request or 200 OK if it had been recorded before.
+func (h *handlers) writeMovement(w http.ResponseWriter, movement *db.StockMovement, created bool) {
+	w.Header().Set("Content-Type", "application/json")
+	if created {
+		w.WriteHeader(http.StatusCreated)
+	}
+
+	if _, err := w.Write([]byte(movement.Document)); err != nil {
+		h.logger.Error("Failed to write stock movement", "error", err)
+	}
+}
+
+func (h *handlers) handleReserve(w http.ResponseWriter, r *http.Request) {
+	var input ReservationInput
+
+	err := json.NewDecoder(r.Body).Decode(&input)
+	if err != nil {
+		h.logger.Error("Failed to decode reservation input", "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if input.Reference == "" {
+		http.Error(w, "reference is required", http.StatusBadRequest)
+		return
+	}
+	if err := validateItems(input.Items); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !validPolicy(input.Policy) {
+		http.Error(w, fmt.Sprintf("invalid policy %q", input.Policy), http.StatusBadRequest)
+		return
+	}
+
+	var skus []string
+	for _, item := range input.Items {
+		skus = append(skus, item.SKU)
+	}
+
+	unreleased, err := h.unreleased(r.Context(), skus, time.Now())
+	if err != nil {
+		h.logger.Error("Failed to get releases", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// The plan is made from the stock levels when they are read, so is made again if another
+	// reservation takes the stock before this one is recorded.
+	for attempt := 1; ; attempt++ {
+		levels, err := h.stockLevels(r.Context(), skus)
+		if err != nil {
+			h.logger.Error("Failed to get stock levels", "error", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		reservation := Reservation{
+			Reference: input.Reference,
+			Plan:      planFulfillment(input.Policy, input.ShipComplete, h.warehouses, levels, input.Items, unreleased),
+			CreatedAt: time.Now().UTC(),
+		}
+
+		var changes []db.StockLevel
+		for _, s := range reservation.Plan.Shipments {
+			for _, item := range s.Items {
+				changes = append(changes, db.StockLevel{SKU: item.SKU, Location: s.Location, Quantity: -item.Quantity})
+			}
+		}
+
+		doc, err := json.Marshal(reservation)
+		if err != nil {
+			h.logger.Error("Failed to encode reservation", "error", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		movement := db.StockMovement{
+			Reference: input.Reference,
+			Kind:      movementReservation,
+			Document:  string(doc),
+			CreatedAt: reservation.CreatedAt,
+		}
+
+		created, err := h.db.ApplyStockMovement(r.Context(), &movement, changes)
+		if errors.Is(err, db.ErrInsufficientStock) && attempt < maxReservationAttempts {
+			h.logger.Info("Stock changed while planning reservation, planning again", "reference", input.Reference)
+			continue
+		}
+		if err != nil {
+			h.logger.Error("Failed to reserve stock", "error", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if !created && movement.Kind != movementReservation {
+			http.Error(w, "reference is in use by a "+movement.Kind, http.StatusConflict)
+			return
+		}
+
+		h.writeMovement(w, &movement, created)
+		return
+	}
+}
+
+func (h *handlers) handleGetReservation(w http.ResponseWriter, r *http.Request) {
+	var movement db.StockMovement
+
+	err := h.db.GetStockMovement(r.Context(), r.PathValue("reference"), &movement)
+	if errors.Is(err, db.ErrNotFound) || (err == nil && movement.Kind != movementReservation) {
+		http.Error(w, "Reservation not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		h.logger.Error("Failed to get reservation", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	h.writeMovement(w, &movement, false)
+}
+
+func (h *handlers) handleRestock(w http.ResponseWriter, r *http.Request) {
+	var input RestockInput
+
+	err := json.NewDecoder(r.Body).Decode(&input)
+	if err != nil {
+		h.logger.Error("Failed to decode restock input", "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch {
+	case input.Reference == "":
+		http.Error(w, "reference is required", http.StatusBadRequest)
+		return
+	case input.Location == "":
+		http.Error(w, "location is required", http.StatusBadRequest)
+		return
+	}
+	if err := validateItems(input.Items); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	restock := Restock{
+		Reference: input.Reference,
+		Location:  input.Location,
+		Items:     input.Items,
+		CreatedAt: time.Now().UTC(),
+	}
+
+	var changes []db.StockLevel
+	for _, item := range input.Items {
+		changes = append(changes, db.StockLevel{SKU: item.SKU, Location: input.Location, Quantity: item.Quantity})
+	}
+
+	doc, err := json.Marshal(restock)
+	if err != nil {
+		h.logger.Error("Failed to encode restock", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	movement := db.StockMovement{
+		Reference: input.Reference,
+		Kind:      movementRestock,
+		Document:  string(doc),
+		CreatedAt: restock.CreatedAt,
+	}
+
+	created, err := h.db.ApplyStockMovement(r.Context(), &movement, changes)
+	if err != nil {
+		h.logger.Error("Failed to restock", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if !created && movement.Kind != movementRestock {
+		http.Error(w, "reference is in use by a "+movement.Kind, http.StatusConflict)
+		return
+	}
+
+	if created {
+		var skus []string
+		for _, item := range input.Items {
+			skus = append(skus, item.SKU)
+		}
+		h.notifyRestock(r.Context(), skus)
+	}
+
+	h.writeMovement(w, &movement, created)
+}
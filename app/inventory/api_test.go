@@ -0,0 +1,340 @@
+package inventory_test
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/temporalio/reference-app-orders-go/app/config"
+	"github.com/temporalio/reference-app-orders-go/app/db"
+	"github.com/temporalio/reference-app-orders-go/app/inventory"
+	"go.temporal.io/api/serviceerror"
+	"go.temporal.io/sdk/mocks"
+)
+
+func testStore(t *testing.T) db.DB {
+	store := db.CreateDB(config.AppConfig{SQLitePath: filepath.Join(t.TempDir(), "test.db")})
+	require.NoError(t, store.Connect(context.Background()))
+	require.NoError(t, store.Setup())
+	t.Cleanup(func() { store.Close() })
+
+	return store
+}
+
+func doJSON(t *testing.T, r http.Handler, method string, path string, body any, result any) int {
+	var payload string
+	if body != nil {
+		b, err := json.Marshal(body)
+		require.NoError(t, err)
+		payload = string(b)
+	}
+
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest(method, path, strings.NewReader(payload)))
+
+	if result != nil && rr.Code < 300 {
+		require.NoError(t, json.NewDecoder(rr.Body).Decode(result))
+	}
+
+	return rr.Code
+}
+
+// setStock sets the quantity of each SKU at Warehouse A and Warehouse B.
+func setStock(t *testing.T, r http.Handler, stock map[string][2]int32) {
+	for sku, quantities := range stock {
+		for i, location := range []string{"Warehouse A", "Warehouse B"} {
+			path := "/stock/" + url.PathEscape(sku) + "/" + url.PathEscape(location)
+			code := doJSON(t, r, "PUT", path, inventory.StockLevelInput{Quantity: quantities[i]}, nil)
+			require.Equal(t, http.StatusOK, code)
+		}
+	}
+}
+
+func reserve(t *testing.T, r http.Handler, input inventory.ReservationInput) inventory.Plan {
+	var reservation inventory.Reservation
+	require.Equal(t, http.StatusCreated, doJSON(t, r, "POST", "/reservations", input, &reservation))
+	return reservation.Plan
+}
+
+func locations(plan inventory.Plan) []string {
+	var result []string
+	for _, s := range plan.Shipments {
+		result = append(result, s.Location)
+	}
+	return result
+}
+
+func TestReservePlans(t *testing.T) {
+	items := []inventory.Item{
+		{SKU: "boots", Quantity: 1},
+		{SKU: "socks", Quantity: 2},
+		{SKU: "laces", Quantity: 1},
+	}
+
+	tests := []struct {
+		name         string
+		policy       string
+		shipComplete bool
+		stock        map[string][2]int32
+		locations    []string
+		lines        [][]int
+		unavailable  []int
+		summary      string
+	}{
+		{
+			name:      "fewest shipments consolidates in the warehouse stocking most items",
+			stock:     map[string][2]int32{"boots": {1, 1}, "socks": {0, 5}, "laces": {0, 5}},
+			locations: []string{"Warehouse B"},
+			lines:     [][]int{{0, 1, 2}},
+			summary:   "3 items planned as 1 shipment from Warehouse B to use as few shipments as possible.",
+		},
+		{
+			name:      "fastest ships from the quickest warehouse with stock",
+			policy:    inventory.PolicyFastest,
+			stock:     map[string][2]int32{"boots": {1, 1}, "socks": {0, 5}, "laces": {0, 5}},
+			locations: []string{"Warehouse A", "Warehouse B"},
+			lines:     [][]int{{0}, {1, 2}},
+			summary:   "3 items planned as 2 shipments from Warehouse A and Warehouse B to deliver as soon as possible.",
+		},
+		{
+			name:      "fewest shipments splits when no warehouse stocks everything",
+			stock:     map[string][2]int32{"boots": {1, 0}, "socks": {5, 0}, "laces": {0, 5}},
+			locations: []string{"Warehouse A", "Warehouse B"},
+			lines:     [][]int{{0, 1}, {2}},
+		},
+		{
+			name:        "items are not split across warehouses",
+			stock:       map[string][2]int32{"boots": {1, 0}, "socks": {1, 1}, "laces": {1, 0}},
+			locations:   []string{"Warehouse A"},
+			lines:       [][]int{{0, 2}},
+			unavailable: []int{1},
+			summary:     "3 items planned as 1 shipment from Warehouse A to use as few shipments as possible; 1 item is unavailable.",
+		},
+		{
+			name:         "ship complete uses a single warehouse",
+			shipComplete: true,
+			stock:        map[string][2]int32{"boots": {1, 1}, "socks": {5, 5}, "laces": {0, 5}},
+			locations:    []string{"Warehouse B"},
+			lines:        [][]int{{0, 1, 2}},
+			summary:      "3 items planned as 1 shipment from Warehouse B to ship the order complete.",
+		},
+		{
+			name:         "ship complete holds the order when no warehouse stocks everything",
+			shipComplete: true,
+			stock:        map[string][2]int32{"boots": {1, 0}, "socks": {5, 0}, "laces": {0, 5}},
+			unavailable:  []int{0, 1, 2},
+			summary:      "No warehouse has the stock to ship the 3 items complete.",
+		},
+		{
+			name:        "nothing in stock",
+			stock:       map[string][2]int32{"boots": {0, 0}, "socks": {0, 0}, "laces": {0, 0}},
+			unavailable: []int{0, 1, 2},
+			summary:     "No warehouse has the stock to ship any of the 3 items.",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r := inventory.Router(nil, testStore(t), slog.Default())
+			setStock(t, r, tc.stock)
+
+			plan := reserve(t, r, inventory.ReservationInput{
+				Reference:    "order1",
+				Items:        items,
+				Policy:       tc.policy,
+				ShipComplete: tc.shipComplete,
+			})
+
+			assert.Equal(t, tc.locations, locations(plan))
+			for i, s := range plan.Shipments {
+				assert.Equal(t, tc.lines[i], s.Lines)
+				assert.NotEmpty(t, s.Reason)
+			}
+
+			if tc.unavailable == nil {
+				assert.Nil(t, plan.Unavailable)
+			} else {
+				require.NotNil(t, plan.Unavailable)
+				assert.Equal(t, tc.unavailable, plan.Unavailable.Lines)
+			}
+
+			if tc.summary != "" {
+				assert.Equal(t, tc.summary, plan.Summary)
+			}
+		})
+	}
+}
+
+func TestReserveTakesStock(t *testing.T) {
+	r := inventory.Router(nil, testStore(t), slog.Default())
+	setStock(t, r, map[string][2]int32{"boots": {3, 0}})
+
+	input := inventory.ReservationInput{Reference: "order1", Items: []inventory.Item{{SKU: "boots", Quantity: 2}}}
+
+	plan := reserve(t, r, input)
+	assert.Equal(t, []string{"Warehouse A"}, locations(plan))
+
+	// Repeating the reservation returns it without taking more stock.
+	var again inventory.Reservation
+	require.Equal(t, http.StatusOK, doJSON(t, r, "POST", "/reservations", input, &again))
+	assert.Equal(t, plan, again.Plan)
+
+	var fetched inventory.Reservation
+	require.Equal(t, http.StatusOK, doJSON(t, r, "GET", "/reservations/order1", nil, &fetched))
+	assert.Equal(t, plan, fetched.Plan)
+
+	var levels []inventory.StockLevel
+	require.Equal(t, http.StatusOK, doJSON(t, r, "GET", "/stock?sku=boots", nil, &levels))
+	assert.Equal(t, []inventory.StockLevel{
+		{SKU: "boots", Location: "Warehouse A", Quantity: 1},
+		{SKU: "boots", Location: "Warehouse B", Quantity: 0},
+	}, levels)
+
+	// Only one boot is left.
+	plan = reserve(t, r, inventory.ReservationInput{Reference: "order2", Items: input.Items})
+	assert.Empty(t, plan.Shipments)
+	require.NotNil(t, plan.Unavailable)
+
+	// Restocking the reserved boots makes them available again.
+	restock := inventory.RestockInput{Reference: "order1:released", Location: "Warehouse A", Items: input.Items}
+	require.Equal(t, http.StatusCreated, doJSON(t, r, "POST", "/restocks", restock, nil))
+	require.Equal(t, http.StatusOK, doJSON(t, r, "POST", "/restocks", restock, nil))
+
+	plan = reserve(t, r, inventory.ReservationInput{Reference: "order3", Items: input.Items})
+	assert.Equal(t, []string{"Warehouse A"}, locations(plan))
+
+	require.Equal(t, http.StatusConflict, doJSON(t, r, "POST", "/reservations", inventory.ReservationInput{Reference: "order1:released", Items: input.Items}, nil))
+	require.Equal(t, http.StatusNotFound, doJSON(t, r, "GET", "/reservations/order1:released", nil, nil))
+}
+
+func TestReserveSimulatedStock(t *testing.T) {
+	r := inventory.Router(nil, testStore(t), slog.Default())
+
+	plan := reserve(t, r, inventory.ReservationInput{
+		Reference: "order1",
+		Items: []inventory.Item{
+			{SKU: "Hiking Boots", Quantity: 1},
+			{SKU: "Adidas Classic", Quantity: 1},
+		},
+	})
+
+	require.Len(t, plan.Shipments, 1)
+	assert.Equal(t, []int{0}, plan.Shipments[0].Lines)
+	require.NotNil(t, plan.Unavailable)
+	assert.Equal(t, []int{1}, plan.Unavailable.Lines)
+	assert.Equal(t, "not in stock at any warehouse", plan.Unavailable.Reason)
+}
+
+func TestReserveInvalidInput(t *testing.T) {
+	r := inventory.Router(nil, testStore(t), slog.Default())
+
+	for _, input := range []inventory.ReservationInput{
+		{Items: []inventory.Item{{SKU: "boots", Quantity: 1}}},
+		{Reference: "order1"},
+		{Reference: "order1", Items: []inventory.Item{{SKU: "boots", Quantity: 0}}},
+		{Reference: "order1", Items: []inventory.Item{{SKU: "boots", Quantity: 1}}, Policy: "cheapest"},
+	} {
+		assert.Equal(t, http.StatusBadRequest, doJSON(t, r, "POST", "/reservations", input, nil))
+	}
+}
+
+func TestRestockSignalsBackorders(t *testing.T) {
+	c := mocks.NewClient(t)
+	r := inventory.Router(c, testStore(t), slog.Default())
+	setStock(t, r, map[string][2]int32{"boots": {0, 0}, "socks": {0, 0}})
+
+	for _, input := range []inventory.BackorderInput{
+		{Reference: "order1:1", WorkflowID: "order1", Items: []inventory.Item{{SKU: "boots", Quantity: 1}, {SKU: "socks", Quantity: 1}}},
+		{Reference: "order2:1", WorkflowID: "order2", Items: []inventory.Item{{SKU: "socks", Quantity: 2}}},
+	} {
+		require.Equal(t, http.StatusCreated, doJSON(t, r, "POST", "/backorders", input, nil))
+		require.Equal(t, http.StatusCreated, doJSON(t, r, "POST", "/backorders", input, nil))
+	}
+
+	var listed []inventory.Backorder
+	require.Equal(t, http.StatusOK, doJSON(t, r, "GET", "/backorders?sku=boots", nil, &listed))
+	require.Len(t, listed, 1)
+	assert.Equal(t, "order1:1", listed[0].Reference)
+	assert.Equal(t, []string{"boots"}, listed[0].SKUs)
+
+	c.On("SignalWorkflow", mock.Anything, "order1", "", inventory.RestockSignalName,
+		inventory.RestockSignal{Reference: "order1:1", SKUs: []string{"socks"}}).Return(nil).Once()
+	c.On("SignalWorkflow", mock.Anything, "order2", "", inventory.RestockSignalName,
+		inventory.RestockSignal{Reference: "order2:1", SKUs: []string{"socks"}}).Return(serviceerror.NewNotFound("workflow not found")).Once()
+
+	restock := inventory.RestockInput{Reference: "delivery1", Location: "Warehouse B", Items: []inventory.Item{{SKU: "socks", Quantity: 10}}}
+	require.Equal(t, http.StatusCreated, doJSON(t, r, "POST", "/restocks", restock, nil))
+
+	// Repeating the restock does not signal again.
+	require.Equal(t, http.StatusOK, doJSON(t, r, "POST", "/restocks", restock, nil))
+
+	// The backorder of the finished workflow is removed.
+	require.Equal(t, http.StatusOK, doJSON(t, r, "GET", "/backorders", nil, &listed))
+	require.Len(t, listed, 1)
+	assert.Equal(t, "order1:1", listed[0].Reference)
+
+	c.On("SignalWorkflow", mock.Anything, "order1", "", inventory.RestockSignalName,
+		inventory.RestockSignal{Reference: "order1:1", SKUs: []string{"boots"}}).Return(nil).Once()
+
+	setStock(t, r, map[string][2]int32{"boots": {1, 0}})
+
+	require.Equal(t, http.StatusNoContent, doJSON(t, r, "DELETE", "/backorders/order1:1", nil, nil))
+	require.Equal(t, http.StatusOK, doJSON(t, r, "GET", "/backorders", nil, &listed))
+	assert.Empty(t, listed)
+}
+
+func TestReservePreorders(t *testing.T) {
+	r := inventory.Router(nil, testStore(t), slog.Default())
+	setStock(t, r, map[string][2]int32{"boots": {1, 0}, "console": {5, 0}, "game": {5, 0}})
+
+	released := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+	consoleDay := time.Now().Add(48 * time.Hour).UTC().Truncate(time.Second)
+	gameDay := time.Now().Add(24 * time.Hour).UTC().Truncate(time.Second)
+
+	for sku, at := range map[string]time.Time{"boots": released, "console": consoleDay, "game": gameDay} {
+		require.Equal(t, http.StatusOK, doJSON(t, r, "PUT", "/releases/"+sku, inventory.ReleaseInput{ReleasedAt: at}, nil))
+	}
+
+	var releases []inventory.Release
+	require.Equal(t, http.StatusOK, doJSON(t, r, "GET", "/releases?sku=console&sku=game", nil, &releases))
+	assert.Equal(t, []inventory.Release{{SKU: "console", ReleasedAt: consoleDay}, {SKU: "game", ReleasedAt: gameDay}}, releases)
+
+	plan := reserve(t, r, inventory.ReservationInput{
+		Reference: "order1",
+		Items: []inventory.Item{
+			{SKU: "console", Quantity: 1},
+			{SKU: "boots", Quantity: 1},
+			{SKU: "game", Quantity: 2},
+		},
+	})
+
+	assert.Equal(t, []string{"Warehouse A"}, locations(plan))
+	assert.Equal(t, []int{1}, plan.Shipments[0].Lines)
+	assert.Nil(t, plan.Unavailable)
+	assert.Equal(t, []inventory.PreorderItems{
+		{ReleasedAt: gameDay, Lines: []int{2}, Items: []inventory.Item{{SKU: "game", Quantity: 2}}},
+		{ReleasedAt: consoleDay, Lines: []int{0}, Items: []inventory.Item{{SKU: "console", Quantity: 1}}},
+	}, plan.Preorders)
+	assert.Equal(t, "1 item planned as 1 shipment from Warehouse A to use as few shipments as possible; 2 items are pre-ordered.", plan.Summary)
+
+	// Pre-ordered items are not reserved.
+	var levels []inventory.StockLevel
+	require.Equal(t, http.StatusOK, doJSON(t, r, "GET", "/stock?sku=console", nil, &levels))
+	assert.Equal(t, int32(5), levels[0].Quantity)
+
+	plan = reserve(t, r, inventory.ReservationInput{Reference: "order2", Items: []inventory.Item{{SKU: "console", Quantity: 1}}})
+	assert.Empty(t, plan.Shipments)
+	assert.Equal(t, "1 item is pre-ordered, to ship once released.", plan.Summary)
+
+	require.Equal(t, http.StatusBadRequest, doJSON(t, r, "PUT", "/releases/console", inventory.ReleaseInput{}, nil))
+}
@@ -0,0 +1,157 @@
+package inventory
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/temporalio/reference-app-orders-go/app/db"
+	"go.temporal.io/api/serviceerror"
+)
+
+// RestockSignalName is the name of the signal sent to a workflow waiting on a backorder
+// when any of its SKUs are restocked.
+const RestockSignalName = "Restock"
+
+// RestockSignal tells a workflow that some of the SKUs it backordered have been restocked.
+// The stock is not held for the workflow, so it must reserve the items to find out whether enough has arrived.
+type RestockSignal struct {
+	Reference string   `json:"reference"`
+	SKUs      []string `json:"skus"`
+}
+
+// BackorderInput is the input for the Backorder API.
+// WorkflowID is the workflow which is signalled when any of the items are restocked.
+type BackorderInput struct {
+	Reference  string `json:"reference"`
+	WorkflowID string `json:"workflowId"`
+	Items      []Item `json:"items"`
+}
+
+// Backorder is a set of SKUs which a workflow is waiting to be restocked.
+type Backorder struct {
+	Reference  string    `json:"reference"`
+	WorkflowID string    `json:"workflowId"`
+	SKUs       []string  `json:"skus"`
+	CreatedAt  time.Time `json:"createdAt"`
+}
+
+// backorders groups per-SKU backorder records by reference, keeping their order.
+func backorders(records []db.Backorder) []Backorder {
+	var result []Backorder
+	index := make(map[string]int)
+
+	for _, b := range records {
+		i, ok := index[b.Reference]
+		if !ok {
+			i = len(result)
+			index[b.Reference] = i
+			result = append(result, Backorder{Reference: b.Reference, WorkflowID: b.WorkflowID, CreatedAt: b.CreatedAt})
+		}
+		result[i].SKUs = append(result[i].SKUs, b.SKU)
+	}
+
+	return result
+}
+
+func (h *handlers) handleBackorder(w http.ResponseWriter, r *http.Request) {
+	var input BackorderInput
+
+	err := json.NewDecoder(r.Body).Decode(&input)
+	if err != nil {
+		h.logger.Error("Failed to decode backorder input", "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch {
+	case input.Reference == "":
+		http.Error(w, "reference is required", http.StatusBadRequest)
+		return
+	case input.WorkflowID == "":
+		http.Error(w, "workflowId is required", http.StatusBadRequest)
+		return
+	}
+	if err := validateItems(input.Items); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now().UTC()
+
+	var records []db.Backorder
+	for _, item := range input.Items {
+		records = append(records, db.Backorder{Reference: input.Reference, SKU: item.SKU, WorkflowID: input.WorkflowID, CreatedAt: now})
+	}
+
+	if err := h.db.InsertBackorders(r.Context(), records); err != nil {
+		h.logger.Error("Failed to insert backorders", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (h *handlers) handleListBackorders(w http.ResponseWriter, r *http.Request) {
+	var records []db.Backorder
+
+	if err := h.db.GetBackorders(r.Context(), r.URL.Query()["sku"], &records); err != nil {
+		h.logger.Error("Failed to get backorders", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	result := backorders(records)
+	if result == nil {
+		result = []Backorder{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		h.logger.Error("Failed to encode backorders", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (h *handlers) handleDeleteBackorder(w http.ResponseWriter, r *http.Request) {
+	if err := h.db.DeleteBackorders(r.Context(), r.PathValue("reference")); err != nil {
+		h.logger.Error("Failed to delete backorders", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// notifyRestock signals the workflows waiting on backorders for any of the SKUs, oldest backorder first.
+// Backorders whose workflow no longer exists are removed. Other failures are logged rather than
+// failing the restock, which has already been recorded.
+func (h *handlers) notifyRestock(ctx context.Context, skus []string) {
+	var records []db.Backorder
+	if err := h.db.GetBackorders(ctx, skus, &records); err != nil {
+		h.logger.Error("Failed to get backorders", "error", err)
+		return
+	}
+
+	for _, b := range backorders(records) {
+		err := h.temporal.SignalWorkflow(ctx,
+			b.WorkflowID, "",
+			RestockSignalName,
+			RestockSignal{Reference: b.Reference, SKUs: b.SKUs},
+		)
+		if errors.As(err, new(*serviceerror.NotFound)) {
+			h.logger.Warn("Removing backorder for unknown workflow", "reference", b.Reference, "workflowId", b.WorkflowID)
+			if err := h.db.DeleteBackorders(ctx, b.Reference); err != nil {
+				h.logger.Error("Failed to delete backorders", "reference", b.Reference, "error", err)
+			}
+			continue
+		}
+		if err != nil {
+			h.logger.Error("Failed to signal backordering workflow", "reference", b.Reference, "workflowId", b.WorkflowID, "error", err)
+		}
+	}
+}
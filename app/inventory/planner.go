@@ -0,0 +1,395 @@
+package inventory
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/temporalio/reference-app-orders-go/app/db"
+)
+
+const (
+	// PolicyFewestShipments plans an order into as few shipments as possible. This is the default.
+	PolicyFewestShipments = "fewestShipments"
+
+	// PolicyFastest plans each item from the warehouse which can dispatch it soonest.
+	PolicyFastest = "fastest"
+)
+
+// Warehouse is a location items are stocked at and shipped from.
+type Warehouse struct {
+	Name string `json:"name"`
+	// DispatchDays is how many days the warehouse takes to dispatch an order.
+	DispatchDays int32 `json:"dispatchDays"`
+}
+
+// DefaultWarehouses are the warehouses stock is held at.
+var DefaultWarehouses = []Warehouse{
+	{Name: "Warehouse A", DispatchDays: 1},
+	{Name: "Warehouse B", DispatchDays: 2},
+}
+
+// defaultDispatchDays is the dispatch time assumed for stock locations which are not a known warehouse.
+const defaultDispatchDays = 3
+
+// Plan describes how an order's items are split into shipments, and why.
+type Plan struct {
+	Policy       string `json:"policy"`
+	ShipComplete bool   `json:"shipComplete,omitempty"`
+
+	Shipments []PlannedShipment `json:"shipments"`
+	// Unavailable holds the items which could not be planned, if any.
+	Unavailable *UnavailableItems `json:"unavailable,omitempty"`
+	// Preorders holds the items which have not been released yet, by release date.
+	Preorders []PreorderItems `json:"preorders,omitempty"`
+
+	// Summary explains the plan as a whole.
+	Summary string `json:"summary"`
+}
+
+// PlannedShipment is a set of items shipped together from one warehouse.
+// Lines are the indexes of the items in the order they were requested in.
+type PlannedShipment struct {
+	Location     string `json:"location"`
+	DispatchDays int32  `json:"dispatchDays"`
+	Lines        []int  `json:"lines"`
+	Items        []Item `json:"items"`
+
+	// Reason explains why the items are shipped from this warehouse.
+	Reason string `json:"reason"`
+}
+
+// UnavailableItems are items which no warehouse has the stock to ship.
+type UnavailableItems struct {
+	Lines  []int  `json:"lines"`
+	Items  []Item `json:"items"`
+	Reason string `json:"reason"`
+}
+
+// PreorderItems are items which are not planned as they are not released until ReleasedAt.
+type PreorderItems struct {
+	ReleasedAt time.Time `json:"releasedAt"`
+	Lines      []int     `json:"lines"`
+	Items      []Item    `json:"items"`
+}
+
+// validPolicy reports whether policy is a known fulfillment policy, or empty for the default.
+func validPolicy(policy string) bool {
+	switch policy {
+	case "", PolicyFewestShipments, PolicyFastest:
+		return true
+	default:
+		return false
+	}
+}
+
+// stockKey identifies a SKU at a location.
+type stockKey struct {
+	sku      string
+	location string
+}
+
+// planner plans items against the stock available at a set of warehouses.
+// Items are never split across shipments, so a warehouse can only ship an item it holds the full quantity of.
+type planner struct {
+	warehouses []Warehouse
+	stock      map[stockKey]int32
+	items      []Item
+}
+
+func newPlanner(warehouses []Warehouse, levels []db.StockLevel, items []Item) *planner {
+	p := &planner{stock: make(map[stockKey]int32), items: items}
+
+	known := make(map[string]bool)
+	for _, w := range warehouses {
+		known[w.Name] = true
+		p.warehouses = append(p.warehouses, w)
+	}
+
+	for _, l := range levels {
+		p.stock[stockKey{l.SKU, l.Location}] += l.Quantity
+		if !known[l.Location] {
+			known[l.Location] = true
+			p.warehouses = append(p.warehouses, Warehouse{Name: l.Location, DispatchDays: defaultDispatchDays})
+		}
+	}
+
+	// Warehouses are considered fastest first, so ties go to the faster warehouse.
+	sort.SliceStable(p.warehouses, func(i, j int) bool {
+		if p.warehouses[i].DispatchDays != p.warehouses[j].DispatchDays {
+			return p.warehouses[i].DispatchDays < p.warehouses[j].DispatchDays
+		}
+		return p.warehouses[i].Name < p.warehouses[j].Name
+	})
+
+	return p
+}
+
+// stocks returns the lines which a warehouse has the stock to ship, taking earlier lines first.
+func (p *planner) stocks(w Warehouse, lines []int) []int {
+	taken := make(map[string]int32)
+
+	var result []int
+	for _, line := range lines {
+		item := p.items[line]
+		if p.stock[stockKey{item.SKU, w.Name}]-taken[item.SKU] >= item.Quantity {
+			taken[item.SKU] += item.Quantity
+			result = append(result, line)
+		}
+	}
+
+	return result
+}
+
+// mostStocked returns the warehouse which has the stock to ship the most lines, and those lines.
+func (p *planner) mostStocked(lines []int) (Warehouse, []int) {
+	var best Warehouse
+	var stocked []int
+
+	for _, w := range p.warehouses {
+		if s := p.stocks(w, lines); len(s) > len(stocked) {
+			best, stocked = w, s
+		}
+	}
+
+	return best, stocked
+}
+
+// take plans lines to ship from a warehouse, removing their items from its stock.
+func (p *planner) take(w Warehouse, lines []int, reason string) PlannedShipment {
+	s := PlannedShipment{Location: w.Name, DispatchDays: w.DispatchDays, Lines: lines, Reason: reason}
+
+	for _, line := range lines {
+		item := p.items[line]
+		p.stock[stockKey{item.SKU, w.Name}] -= item.Quantity
+		s.Items = append(s.Items, item)
+	}
+
+	return s
+}
+
+// fewestShipments repeatedly ships from the warehouse which can ship the most of the remaining lines.
+func (p *planner) fewestShipments(lines []int) ([]PlannedShipment, []int) {
+	var shipments []PlannedShipment
+
+	for len(lines) > 0 {
+		w, stocked := p.mostStocked(lines)
+		if len(stocked) == 0 {
+			break
+		}
+
+		reason := fmt.Sprintf("%s stocks %s", w.Name, countItems(len(stocked)))
+		if len(stocked) < len(lines) {
+			reason = fmt.Sprintf("%s stocks the most items, %d of %d", w.Name, len(stocked), len(lines))
+		}
+		if len(shipments) > 0 {
+			reason += " still to be planned"
+		}
+
+		shipments = append(shipments, p.take(w, stocked, reason))
+		lines = without(lines, stocked)
+	}
+
+	return shipments, lines
+}
+
+// fastest ships each line from the fastest warehouse which stocks it.
+func (p *planner) fastest(lines []int) ([]PlannedShipment, []int) {
+	var shipments []PlannedShipment
+	var unavailable []int
+
+	assigned := make(map[string][]int)
+	for _, line := range lines {
+		found := false
+		for _, w := range p.warehouses {
+			if len(p.stocks(w, append(assigned[w.Name], line))) == len(assigned[w.Name])+1 {
+				assigned[w.Name] = append(assigned[w.Name], line)
+				found = true
+				break
+			}
+		}
+		if !found {
+			unavailable = append(unavailable, line)
+		}
+	}
+
+	for i, w := range p.warehouses {
+		if len(assigned[w.Name]) == 0 {
+			continue
+		}
+
+		reason := fmt.Sprintf("%s is the fastest warehouse, dispatching in %s", w.Name, countDays(w.DispatchDays))
+		if i > 0 {
+			reason = fmt.Sprintf("%s is the fastest warehouse stocking these items, dispatching in %s", w.Name, countDays(w.DispatchDays))
+		}
+
+		shipments = append(shipments, p.take(w, assigned[w.Name], reason))
+	}
+
+	return shipments, unavailable
+}
+
+// complete ships every line from a single warehouse. If no warehouse stocks them all nothing is
+// planned, so that the order is not shipped in part.
+func (p *planner) complete(lines []int) ([]PlannedShipment, []int) {
+	w, stocked := p.mostStocked(lines)
+	if len(stocked) == 0 || len(stocked) < len(lines) {
+		return nil, lines
+	}
+
+	return []PlannedShipment{p.take(w, stocked, fmt.Sprintf("%s stocks the whole order", w.Name))}, nil
+}
+
+// planFulfillment plans items into shipments from warehouses according to a policy, given the stock levels
+// of the items. Items which cannot be shipped under the plan are reported as unavailable. Items whose SKU
+// has a release date in unreleased are reported as pre-orders, and not planned.
+func planFulfillment(policy string, shipComplete bool, warehouses []Warehouse, levels []db.StockLevel, items []Item, unreleased map[string]time.Time) Plan {
+	if policy == "" {
+		policy = PolicyFewestShipments
+	}
+
+	p := newPlanner(warehouses, levels, items)
+
+	var lines []int
+	var preorders []PreorderItems
+	for i, item := range items {
+		releasedAt, ok := unreleased[item.SKU]
+		if !ok {
+			lines = append(lines, i)
+			continue
+		}
+
+		j := slices.IndexFunc(preorders, func(p PreorderItems) bool { return p.ReleasedAt.Equal(releasedAt) })
+		if j < 0 {
+			j = len(preorders)
+			preorders = append(preorders, PreorderItems{ReleasedAt: releasedAt})
+		}
+		preorders[j].Lines = append(preorders[j].Lines, i)
+		preorders[j].Items = append(preorders[j].Items, item)
+	}
+	sort.SliceStable(preorders, func(i, j int) bool { return preorders[i].ReleasedAt.Before(preorders[j].ReleasedAt) })
+
+	var shipments []PlannedShipment
+	var unavailable []int
+
+	switch {
+	case shipComplete:
+		shipments, unavailable = p.complete(lines)
+	case policy == PolicyFastest:
+		shipments, unavailable = p.fastest(lines)
+	default:
+		shipments, unavailable = p.fewestShipments(lines)
+	}
+
+	plan := Plan{Policy: policy, ShipComplete: shipComplete, Shipments: shipments, Preorders: preorders}
+
+	if len(unavailable) > 0 {
+		u := &UnavailableItems{Lines: unavailable, Reason: "not in stock at any warehouse"}
+		if shipComplete {
+			u.Reason = "no warehouse stocks the whole order, which ships complete"
+		}
+		for _, line := range unavailable {
+			u.Items = append(u.Items, items[line])
+		}
+		plan.Unavailable = u
+	}
+
+	plan.Summary = summarise(plan, len(items))
+
+	return plan
+}
+
+// summarise explains a plan in a sentence.
+func summarise(plan Plan, items int) string {
+	preorders := 0
+	for _, p := range plan.Preorders {
+		preorders += len(p.Lines)
+	}
+	items -= preorders
+
+	switch {
+	case items == 0:
+		return fmt.Sprintf("%s %s pre-ordered, to ship once released.", countItems(preorders), isAre(preorders))
+	case len(plan.Shipments) == 0 && plan.ShipComplete:
+		return fmt.Sprintf("No warehouse has the stock to ship the %s complete%s.", countItems(items), preordered(preorders))
+	case len(plan.Shipments) == 0:
+		return fmt.Sprintf("No warehouse has the stock to ship any of the %s%s.", countItems(items), preordered(preorders))
+	}
+
+	var goal string
+	switch {
+	case plan.ShipComplete:
+		goal = "to ship the order complete"
+	case plan.Policy == PolicyFastest:
+		goal = "to deliver as soon as possible"
+	default:
+		goal = "to use as few shipments as possible"
+	}
+
+	shipments := "1 shipment"
+	if len(plan.Shipments) != 1 {
+		shipments = fmt.Sprintf("%d shipments", len(plan.Shipments))
+	}
+
+	var locations []string
+	for _, s := range plan.Shipments {
+		locations = append(locations, s.Location)
+	}
+
+	summary := fmt.Sprintf("%s planned as %s from %s %s", countItems(items), shipments, strings.Join(locations, " and "), goal)
+
+	if plan.Unavailable != nil {
+		n := len(plan.Unavailable.Lines)
+		summary += fmt.Sprintf("; %s %s unavailable", countItems(n), isAre(n))
+	}
+
+	return summary + preordered(preorders) + "."
+}
+
+// preordered is the clause added to a summary for pre-ordered items, if there are any.
+func preordered(n int) string {
+	if n == 0 {
+		return ""
+	}
+	return fmt.Sprintf("; %s %s pre-ordered", countItems(n), isAre(n))
+}
+
+func isAre(n int) string {
+	if n == 1 {
+		return "is"
+	}
+	return "are"
+}
+
+func countItems(n int) string {
+	if n == 1 {
+		return "1 item"
+	}
+	return fmt.Sprintf("%d items", n)
+}
+
+func countDays(n int32) string {
+	if n == 1 {
+		return "1 day"
+	}
+	return fmt.Sprintf("%d days", n)
+}
+
+// without returns the lines which are not in remove, keeping their order.
+func without(lines []int, remove []int) []int {
+	removed := make(map[int]bool, len(remove))
+	for _, line := range remove {
+		removed[line] = true
+	}
+
+	var result []int
+	for _, line := range lines {
+		if !removed[line] {
+			result = append(result, line)
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,83 @@
+package inventory
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/temporalio/reference-app-orders-go/app/db"
+)
+
+// Release is the date a SKU is released. Until then it can be pre-ordered, but is not reserved or shipped.
+type Release struct {
+	SKU        string    `json:"sku"`
+	ReleasedAt time.Time `json:"releasedAt"`
+}
+
+// ReleaseInput is the input for the SetRelease API.
+type ReleaseInput struct {
+	ReleasedAt time.Time `json:"releasedAt"`
+}
+
+// unreleased returns the release dates of the SKUs which are not released at a time.
+func (h *handlers) unreleased(ctx context.Context, skus []string, at time.Time) (map[string]time.Time, error) {
+	var releases []db.Release
+	if err := h.db.GetReleases(ctx, skus, &releases); err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]time.Time)
+	for _, r := range releases {
+		if r.ReleasedAt.After(at) {
+			result[r.SKU] = r.ReleasedAt.UTC()
+		}
+	}
+
+	return result, nil
+}
+
+func (h *handlers) handleListReleases(w http.ResponseWriter, r *http.Request) {
+	var releases []db.Release
+
+	if err := h.db.GetReleases(r.Context(), r.URL.Query()["sku"], &releases); err != nil {
+		h.logger.Error("Failed to get releases", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	result := make([]Release, len(releases))
+	for i, r := range releases {
+		result[i] = Release{SKU: r.SKU, ReleasedAt: r.ReleasedAt.UTC()}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		h.logger.Error("Failed to encode releases", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (h *handlers) handleSetRelease(w http.ResponseWriter, r *http.Request) {
+	var input ReleaseInput
+
+	err := json.NewDecoder(r.Body).Decode(&input)
+	if err != nil {
+		h.logger.Error("Failed to decode release input", "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if input.ReleasedAt.IsZero() {
+		http.Error(w, "releasedAt is required", http.StatusBadRequest)
+		return
+	}
+
+	release := db.Release{SKU: r.PathValue("sku"), ReleasedAt: input.ReleasedAt.UTC()}
+
+	if err := h.db.SetRelease(r.Context(), &release); err != nil {
+		h.logger.Error("Failed to set release", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
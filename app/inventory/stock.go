@@ -0,0 +1,34 @@
+package inventory
+
+import (
+	"hash/crc32"
+	"strings"
+
+	"github.com/temporalio/reference-app-orders-go/app/db"
+)
+
+// simulatedQuantity is the quantity of a SKU held at each warehouse which simulates stocking it.
+const simulatedQuantity = 100
+
+// simulatedStock returns the stock levels a SKU starts with, for SKUs which have not had stock recorded.
+// There is no real stock feed, so Adidas items are out of stock and other SKUs are held at one warehouse
+// or at all of them, chosen by a hash of the SKU so that the same SKU is always stocked in the same way.
+func simulatedStock(sku string, warehouses []Warehouse) []db.StockLevel {
+	levels := make([]db.StockLevel, len(warehouses))
+	for i, w := range warehouses {
+		levels[i] = db.StockLevel{SKU: sku, Location: w.Name}
+	}
+
+	if strings.Contains(sku, "Adidas") || len(warehouses) == 0 {
+		return levels
+	}
+
+	n := int(crc32.ChecksumIEEE([]byte(sku)) % uint32(len(warehouses)+1))
+	for i := range levels {
+		if n == len(warehouses) || n == i {
+			levels[i].Quantity = simulatedQuantity
+		}
+	}
+
+	return levels
+}
@@ -4,19 +4,27 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
-	"strings"
+	"net/url"
+	"time"
 
 	"github.com/temporalio/reference-app-orders-go/app/billing"
+	"github.com/temporalio/reference-app-orders-go/app/inventory"
+	"go.temporal.io/sdk/temporal"
 )
 
 // Activities implements the order package's Activities.
 // Any state shared by the worker among the activities is stored here.
 type Activities struct {
-	BillingURL string
-	OrderURL   string
+	BillingURL   string
+	OrderURL     string
+	InventoryURL string
+
+	// AddressValidator validates shipping addresses. If not set RulesAddressValidator is used.
+	AddressValidator AddressValidator
 }
 
 var a Activities
@@ -49,90 +57,185 @@ func (a *Activities) UpdateOrderStatus(ctx context.Context, status *OrderStatusU
 	return nil
 }
 
+// ValidateAddress validates a shipping address, returning it in a normalised form if it is valid.
+func (a *Activities) ValidateAddress(ctx context.Context, address *Address) (*AddressValidation, error) {
+	validator := a.AddressValidator
+	if validator == nil {
+		validator = RulesAddressValidator{}
+	}
+
+	return validator.ValidateAddress(ctx, address)
+}
+
 // ReserveItemsInput is the input to the ReserveItems activity.
 type ReserveItemsInput struct {
 	OrderID string
 	Items   []*Item
+
+	// Reference identifies the reservation, if the order reserves stock more than once. Defaults to OrderID.
+	Reference string
+
+	// Policy and ShipComplete are how the items are planned into shipments.
+	Policy       string
+	ShipComplete bool
 }
 
 // Reservation is a reservation of items for an order.
+// ReleasedAt is set for pre-ordered items, which are not reserved until they are released.
 type Reservation struct {
-	Available bool
-	Location  string
-	Items     []*Item
+	Available  bool
+	Location   string
+	Items      []*Item
+	ReleasedAt *time.Time
 }
 
 // ReserveItemsResult is the result from the ReserveItems activity.
+// Plan explains how the items were split into reservations.
 type ReserveItemsResult struct {
 	Reservations []*Reservation
+	Plan         *FulfillmentPlan
+}
+
+// inventoryRequest sends a request to the Inventory API, decoding the response into result if it is not nil.
+func (a *Activities) inventoryRequest(ctx context.Context, method string, path string, input any, result any) error {
+	var body io.Reader
+	if input != nil {
+		jsonInput, err := json.Marshal(input)
+		if err != nil {
+			return fmt.Errorf("unable to encode input: %w", err)
+		}
+		body = bytes.NewReader(jsonInput)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, a.InventoryURL+path, body)
+	if err != nil {
+		return fmt.Errorf("unable to build request: %w", err)
+	}
+
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		body, _ := io.ReadAll(res.Body)
+		return fmt.Errorf("%s: %s", http.StatusText(res.StatusCode), body)
+	}
+
+	if result == nil {
+		return nil
+	}
+
+	return json.NewDecoder(res.Body).Decode(result)
 }
 
-// ReserveItems reserves items to satisfy an order. It returns a list of reservations for the items.
-// Any unavailable items will be returned in a Reservation with Available set to false.
-// In a real system this would involve an inventory database of some kind.
-// For our purposes we just split orders arbitrarily.
-func (a *Activities) ReserveItems(_ context.Context, input *ReserveItemsInput) (*ReserveItemsResult, error) {
+// ReserveItems reserves stock for an order's items via the Inventory API, which plans them into shipments from
+// its warehouses. It returns a reservation for each planned shipment. Any unavailable items will be returned in a
+// Reservation with Available set to false.
+func (a *Activities) ReserveItems(ctx context.Context, input *ReserveItemsInput) (*ReserveItemsResult, error) {
 	if len(input.Items) < 1 {
 		return &ReserveItemsResult{}, nil
 	}
 
-	var reservations []*Reservation
-	var unavailableItems []*Item
-	var availableItems []*Item
-
+	request := inventory.ReservationInput{
+		Reference:    input.Reference,
+		Policy:       input.Policy,
+		ShipComplete: input.ShipComplete,
+	}
+	if request.Reference == "" {
+		request.Reference = input.OrderID
+	}
 	for _, item := range input.Items {
-		if strings.Contains(item.SKU, "Adidas") {
-			unavailableItems = append(unavailableItems, item)
-		} else {
-			availableItems = append(availableItems, item)
+		request.Items = append(request.Items, inventory.Item{SKU: item.SKU, Quantity: item.Quantity})
+	}
+
+	var reservation inventory.Reservation
+	if err := a.inventoryRequest(ctx, http.MethodPost, "/reservations", request, &reservation); err != nil {
+		return nil, err
+	}
+
+	lines := func(lines []int) []*Item {
+		items := make([]*Item, len(lines))
+		for i, line := range lines {
+			items[i] = input.Items[line]
 		}
+		return items
 	}
 
-	if len(unavailableItems) > 0 {
-		reservations = append(
-			reservations,
-			&Reservation{
-				Available: false,
-				Items:     unavailableItems,
-			},
-		)
+	plan := reservation.Plan
+	result := ReserveItemsResult{Plan: &plan}
+
+	if plan.Unavailable != nil {
+		result.Reservations = append(result.Reservations, &Reservation{
+			Available: false,
+			Items:     lines(plan.Unavailable.Lines),
+		})
 	}
 
-	// First item from one warehouse
-	reservations = append(
-		reservations,
-		&Reservation{
+	for _, s := range plan.Shipments {
+		result.Reservations = append(result.Reservations, &Reservation{
 			Available: true,
-			Location:  "Warehouse A",
-			Items:     availableItems[0:1],
-		},
-	)
+			Location:  s.Location,
+			Items:     lines(s.Lines),
+		})
+	}
 
-	if len(availableItems) > 1 {
-		// Second fulfillment with all other items
-		reservations = append(
-			reservations,
-			&Reservation{
-				Available: true,
-				Location:  "Warehouse B",
-				Items:     availableItems[1:],
-			},
-		)
+	for _, p := range plan.Preorders {
+		result.Reservations = append(result.Reservations, &Reservation{
+			Available:  false,
+			Items:      lines(p.Lines),
+			ReleasedAt: &p.ReleasedAt,
+		})
 	}
 
-	return &ReserveItemsResult{
-		Reservations: reservations,
-	}, nil
+	return &result, nil
 }
 
-// ChargeInput is the input to the Charge activity.
+// ChargeInput is the input to the StartCharge activity.
 type ChargeInput = billing.ChargeInput
 
-// ChargeResult is the result of the Charge activity.
+// ChargeResult is the result of the GetCharge activity.
 type ChargeResult = billing.ChargeResult
 
-// Charge charges a customer for a fulfillment via the Billing API
-func (a *Activities) Charge(ctx context.Context, input *ChargeInput) (*ChargeResult, error) {
+// StartChargeResult is the result of the StartCharge activity.
+// If the charge had already been processed the Billing API returns its ChargeStatus,
+// which shares the ID field.
+type StartChargeResult = billing.ChargeAccepted
+
+// GetChargeInput is the input to the GetCharge activity.
+type GetChargeInput struct {
+	ChargeID string
+}
+
+// ChargePendingErrorType is the error type returned by GetCharge while the charge is still being processed.
+const ChargePendingErrorType = "ChargePending"
+
+// billingError converts a failed Billing API response into an ApplicationError whose type is the
+// Billing API's error code. Errors which will not be resolved by retrying are marked as non-retryable.
+func billingError(res *http.Response) error {
+	body, _ := io.ReadAll(res.Body)
+
+	var e billing.ErrorResponse
+	if err := json.Unmarshal(body, &e); err != nil || e.Code == "" {
+		return fmt.Errorf("%s: %s", http.StatusText(res.StatusCode), body)
+	}
+
+	switch e.Code {
+	case billing.ErrorCodeInvalidInput, billing.ErrorCodeNotFound, billing.ErrorCodeChargeFailed:
+		return temporal.NewNonRetryableApplicationError(e.Message, e.Code, nil, e)
+	default:
+		return temporal.NewApplicationError(e.Message, e.Code, e)
+	}
+}
+
+// StartCharge requests a charge for a fulfillment via the Billing API.
+// The Billing API processes the charge asynchronously; use GetCharge to fetch the result.
+func (a *Activities) StartCharge(ctx context.Context, input *ChargeInput) (*StartChargeResult, error) {
 	jsonInput, err := json.Marshal(input)
 	if err != nil {
 		return nil, fmt.Errorf("unable to encode input: %w", err)
@@ -151,12 +254,211 @@ func (a *Activities) Charge(ctx context.Context, input *ChargeInput) (*ChargeRes
 	}
 	defer res.Body.Close()
 
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return nil, billingError(res)
+	}
+
+	var result StartChargeResult
+
+	err = json.NewDecoder(res.Body).Decode(&result)
+	if err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+// Charge requests a charge via the Billing API and waits for its result.
+// It is kept for orders which scheduled it before charges were processed asynchronously;
+// other orders use StartCharge and GetCharge.
+func (a *Activities) Charge(ctx context.Context, input *ChargeInput) (*ChargeResult, error) {
+	started, err := a.StartCharge(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		result, err := a.GetCharge(ctx, &GetChargeInput{ChargeID: started.ID})
+
+		var appErr *temporal.ApplicationError
+		if !errors.As(err, &appErr) || appErr.Type() != ChargePendingErrorType {
+			return result, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// GetCharge fetches the result of a charge from the Billing API.
+// While the charge is still being processed it returns a retryable ChargePending error,
+// so the activity's retry policy determines how often the Billing API is polled.
+func (a *Activities) GetCharge(ctx context.Context, input *GetChargeInput) (*ChargeResult, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, a.BillingURL+"/charges/"+url.PathEscape(input.ChargeID), nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to build request: %w", err)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return nil, billingError(res)
+	}
+
+	var status billing.ChargeStatus
+
+	err = json.NewDecoder(res.Body).Decode(&status)
+	if err != nil {
+		return nil, err
+	}
+
+	if status.Status == billing.ChargeStatusPending {
+		return nil, temporal.NewApplicationError("charge is pending", ChargePendingErrorType)
+	}
+
+	result := status.Result
+	if result == nil {
+		return nil, fmt.Errorf("charge %s has no result", input.ChargeID)
+	}
+
+	if result.InvoiceURL != "" {
+		result.InvoiceURL = a.BillingURL + result.InvoiceURL
+	}
+
+	return result, nil
+}
+
+// UpdateReturnStatus stores the Return status to the database.
+func (a *Activities) UpdateReturnStatus(ctx context.Context, status *ReturnStatusUpdate) error {
+	jsonInput, err := json.Marshal(status)
+	if err != nil {
+		return fmt.Errorf("unable to encode status: %w", err)
+	}
+
+	u := a.OrderURL + "/orders/" + url.PathEscape(status.OrderID) + "/returns/" + url.PathEscape(status.ID) + "/status"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(jsonInput))
+	if err != nil {
+		return fmt.Errorf("unable to build request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
 	if res.StatusCode < 200 || res.StatusCode >= 300 {
 		body, _ := io.ReadAll(res.Body)
-		return nil, fmt.Errorf("%s: %s", http.StatusText(res.StatusCode), body)
+		return fmt.Errorf("%s: %s", http.StatusText(res.StatusCode), body)
+	}
+
+	return nil
+}
+
+// RestockItemsInput is the input to the RestockItems activity.
+type RestockItemsInput struct {
+	Reference string
+	Location  string
+	Items     []*Item
+}
+
+// RestockItems returns items to stock at a warehouse via the Inventory API.
+func (a *Activities) RestockItems(ctx context.Context, input *RestockItemsInput) error {
+	request := inventory.RestockInput{
+		Reference: input.Reference,
+		Location:  input.Location,
+	}
+	for _, item := range input.Items {
+		request.Items = append(request.Items, inventory.Item{SKU: item.SKU, Quantity: item.Quantity})
+	}
+
+	return a.inventoryRequest(ctx, http.MethodPost, "/restocks", request, nil)
+}
+
+// BackorderItemsInput is the input to the BackorderItems activity.
+// WorkflowID is the workflow which is signalled when any of the items are restocked.
+type BackorderItemsInput struct {
+	Reference  string
+	WorkflowID string
+	Items      []*Item
+}
+
+// BackorderItems registers unavailable items with the Inventory API, so that the workflow waiting for them
+// is signalled when they are restocked.
+func (a *Activities) BackorderItems(ctx context.Context, input *BackorderItemsInput) error {
+	request := inventory.BackorderInput{
+		Reference:  input.Reference,
+		WorkflowID: input.WorkflowID,
+	}
+	for _, item := range input.Items {
+		request.Items = append(request.Items, inventory.Item{SKU: item.SKU, Quantity: item.Quantity})
+	}
+
+	return a.inventoryRequest(ctx, http.MethodPost, "/backorders", request, nil)
+}
+
+// RemoveBackorder removes a backorder from the Inventory API once the workflow is no longer waiting for its items.
+func (a *Activities) RemoveBackorder(ctx context.Context, reference string) error {
+	return a.inventoryRequest(ctx, http.MethodDelete, "/backorders/"+url.PathEscape(reference), nil, nil)
+}
+
+// RefundItemsInput is the input to the RefundItems activity.
+// Reference identifies the refund, so that retrying the activity does not refund the items again.
+type RefundItemsInput struct {
+	InvoiceReference string
+	Reference        string
+	Items            []*Item
+}
+
+// RefundResult is the result of the RefundItems activity.
+type RefundResult = billing.Refund
+
+// RefundItems refunds items from a fulfillment's invoice via the Billing API.
+func (a *Activities) RefundItems(ctx context.Context, input *RefundItemsInput) (*RefundResult, error) {
+	refund := billing.RefundInput{Reference: input.Reference}
+	for _, i := range input.Items {
+		refund.Items = append(refund.Items, billing.Item{SKU: i.SKU, Quantity: i.Quantity})
+	}
+
+	jsonInput, err := json.Marshal(refund)
+	if err != nil {
+		return nil, fmt.Errorf("unable to encode input: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.BillingURL+billing.RefundsURL(input.InvoiceReference), bytes.NewReader(jsonInput))
+	if err != nil {
+		return nil, fmt.Errorf("unable to build request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		err := billingError(res)
+
+		// A conflicting refund, such as one for more items than remain on the invoice, will not succeed on retry.
+		var appErr *temporal.ApplicationError
+		if errors.As(err, &appErr) && appErr.Type() == billing.ErrorCodeConflict {
+			return nil, temporal.NewNonRetryableApplicationError(appErr.Message(), appErr.Type(), err)
+		}
+		return nil, err
 	}
 
-	var result ChargeResult
+	var result RefundResult
 
 	err = json.NewDecoder(res.Body).Decode(&result)
 	if err != nil {
@@ -1,10 +1,25 @@
 package order_test
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
+	"github.com/temporalio/reference-app-orders-go/app/billing"
+	"github.com/temporalio/reference-app-orders-go/app/config"
+	"github.com/temporalio/reference-app-orders-go/app/db"
+	"github.com/temporalio/reference-app-orders-go/app/inventory"
 	"github.com/temporalio/reference-app-orders-go/app/order"
+	"go.temporal.io/sdk/temporal"
 	"go.temporal.io/sdk/testsuite"
 )
 
@@ -31,10 +46,31 @@ func TestFulfillOrderZeroItems(t *testing.T) {
 	require.Equal(t, expected, result)
 }
 
+// testInventoryAPI starts an Inventory API with the given stock levels.
+func testInventoryAPI(t *testing.T, stock []inventory.StockLevel) *httptest.Server {
+	store := db.CreateDB(config.AppConfig{SQLitePath: filepath.Join(t.TempDir(), "test.db")})
+	require.NoError(t, store.Connect(context.Background()))
+	require.NoError(t, store.Setup())
+	t.Cleanup(func() { store.Close() })
+
+	for _, l := range stock {
+		require.NoError(t, store.SetStockLevel(context.Background(), &db.StockLevel{SKU: l.SKU, Location: l.Location, Quantity: l.Quantity}))
+	}
+
+	api := httptest.NewServer(inventory.Router(nil, store, slog.Default()))
+	t.Cleanup(api.Close)
+
+	return api
+}
+
 func TestFulfillOrderOneItem(t *testing.T) {
 	testSuite := testsuite.WorkflowTestSuite{}
 
-	var a *order.Activities
+	inventoryAPI := testInventoryAPI(t, []inventory.StockLevel{
+		{SKU: "Hiking Boots", Location: "Warehouse B", Quantity: 5},
+	})
+
+	a := &order.Activities{InventoryURL: inventoryAPI.URL}
 
 	env := testSuite.NewTestActivityEnvironment()
 	env.RegisterActivity(a.ReserveItems)
@@ -52,25 +88,97 @@ func TestFulfillOrderOneItem(t *testing.T) {
 	var result order.ReserveItemsResult
 	require.NoError(t, future.Get(&result))
 
-	expected := order.ReserveItemsResult{
-		Reservations: []*order.Reservation{
-			{
-				Available: true,
-				Location:  "Warehouse A",
-				Items: []*order.Item{
-					{SKU: "Hiking Boots", Quantity: 2},
-				},
+	expected := []*order.Reservation{
+		{
+			Available: true,
+			Location:  "Warehouse B",
+			Items: []*order.Item{
+				{SKU: "Hiking Boots", Quantity: 2},
 			},
 		},
 	}
 
-	require.Equal(t, expected, result)
+	require.Equal(t, expected, result.Reservations)
+	require.NotNil(t, result.Plan)
+	require.Equal(t, inventory.PolicyFewestShipments, result.Plan.Policy)
 }
 
 func TestFulfillOrderTwoItems(t *testing.T) {
 	testSuite := testsuite.WorkflowTestSuite{}
 
-	var a *order.Activities
+	inventoryAPI := testInventoryAPI(t, []inventory.StockLevel{
+		{SKU: "Hiking Boots", Location: "Warehouse A", Quantity: 5},
+		{SKU: "Tennis Shoes", Location: "Warehouse A", Quantity: 5},
+		{SKU: "Tennis Shoes", Location: "Warehouse B", Quantity: 5},
+		{SKU: "Adidas", Location: "Warehouse A", Quantity: 0},
+	})
+
+	a := &order.Activities{InventoryURL: inventoryAPI.URL}
+
+	env := testSuite.NewTestActivityEnvironment()
+	env.RegisterActivity(a.ReserveItems)
+
+	items := []*order.Item{
+		{SKU: "Hiking Boots", Quantity: 2},
+		{SKU: "Adidas", Quantity: 1},
+		{SKU: "Tennis Shoes", Quantity: 1},
+	}
+
+	reserve := func(policy string) order.ReserveItemsResult {
+		future, err := env.ExecuteActivity(a.ReserveItems, &order.ReserveItemsInput{
+			OrderID: "test-" + policy,
+			Items:   items,
+			Policy:  policy,
+		})
+		require.NoError(t, err)
+
+		var result order.ReserveItemsResult
+		require.NoError(t, future.Get(&result))
+		return result
+	}
+
+	// Both items are stocked at Warehouse A, so are reserved together.
+	expected := []*order.Reservation{
+		{
+			Available: false,
+			Items:     []*order.Item{items[1]},
+		},
+		{
+			Available: true,
+			Location:  "Warehouse A",
+			Items:     []*order.Item{items[0], items[2]},
+		},
+	}
+
+	result := reserve(inventory.PolicyFewestShipments)
+	require.Equal(t, expected, result.Reservations)
+	require.Equal(t, "3 items planned as 1 shipment from Warehouse A to use as few shipments as possible; 1 item is unavailable.", result.Plan.Summary)
+
+	result = reserve(inventory.PolicyFastest)
+	require.Equal(t, expected, result.Reservations)
+	require.Equal(t, inventory.PolicyFastest, result.Plan.Policy)
+}
+
+func TestFulfillOrderPreorder(t *testing.T) {
+	testSuite := testsuite.WorkflowTestSuite{}
+
+	inventoryAPI := testInventoryAPI(t, []inventory.StockLevel{
+		{SKU: "Hiking Boots", Location: "Warehouse A", Quantity: 5},
+		{SKU: "Trail Console", Location: "Warehouse A", Quantity: 5},
+	})
+
+	releasedAt := time.Now().Add(24 * time.Hour).UTC().Truncate(time.Second)
+
+	body, err := json.Marshal(inventory.ReleaseInput{ReleasedAt: releasedAt})
+	require.NoError(t, err)
+	req, err := http.NewRequest(http.MethodPut, inventoryAPI.URL+"/releases/Trail%20Console", bytes.NewReader(body))
+	require.NoError(t, err)
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+
+	a := &order.Activities{InventoryURL: inventoryAPI.URL}
 
 	env := testSuite.NewTestActivityEnvironment()
 	env.RegisterActivity(a.ReserveItems)
@@ -78,8 +186,8 @@ func TestFulfillOrderTwoItems(t *testing.T) {
 	input := order.ReserveItemsInput{
 		OrderID: "test",
 		Items: []*order.Item{
-			{SKU: "Hiking Boots", Quantity: 2},
-			{SKU: "Tennis Shoes", Quantity: 1},
+			{SKU: "Trail Console", Quantity: 1},
+			{SKU: "Hiking Boots", Quantity: 1},
 		},
 	}
 
@@ -89,24 +197,198 @@ func TestFulfillOrderTwoItems(t *testing.T) {
 	var result order.ReserveItemsResult
 	require.NoError(t, future.Get(&result))
 
-	expected := order.ReserveItemsResult{
-		Reservations: []*order.Reservation{
-			{
-				Available: true,
-				Location:  "Warehouse A",
-				Items: []*order.Item{
-					{SKU: "Hiking Boots", Quantity: 2},
-				},
-			},
-			{
-				Available: true,
-				Location:  "Warehouse B",
-				Items: []*order.Item{
-					{SKU: "Tennis Shoes", Quantity: 1},
-				},
-			},
+	expected := []*order.Reservation{
+		{
+			Available: true,
+			Location:  "Warehouse A",
+			Items:     []*order.Item{{SKU: "Hiking Boots", Quantity: 1}},
+		},
+		{
+			Available:  false,
+			Items:      []*order.Item{{SKU: "Trail Console", Quantity: 1}},
+			ReleasedAt: &releasedAt,
 		},
 	}
 
-	require.Equal(t, expected, result)
+	require.Equal(t, expected, result.Reservations)
+}
+
+func TestRestockItems(t *testing.T) {
+	testSuite := testsuite.WorkflowTestSuite{}
+
+	inventoryAPI := testInventoryAPI(t, []inventory.StockLevel{
+		{SKU: "Hiking Boots", Location: "Warehouse A", Quantity: 1},
+		{SKU: "Hiking Boots", Location: "Warehouse B", Quantity: 0},
+	})
+
+	a := &order.Activities{InventoryURL: inventoryAPI.URL}
+
+	env := testSuite.NewTestActivityEnvironment()
+	env.RegisterActivity(a.RestockItems)
+
+	input := order.RestockItemsInput{
+		Reference: "test",
+		Location:  "Warehouse A",
+		Items:     []*order.Item{{SKU: "Hiking Boots", Quantity: 2}},
+	}
+
+	// Repeating the restock does not add the items again.
+	for range 2 {
+		_, err := env.ExecuteActivity(a.RestockItems, &input)
+		require.NoError(t, err)
+	}
+
+	res, err := http.Get(inventoryAPI.URL + "/stock?sku=Hiking+Boots")
+	require.NoError(t, err)
+	defer res.Body.Close()
+
+	var levels []inventory.StockLevel
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&levels))
+	require.Equal(t, int32(3), levels[0].Quantity)
+}
+
+func TestBackorderItems(t *testing.T) {
+	testSuite := testsuite.WorkflowTestSuite{}
+
+	inventoryAPI := testInventoryAPI(t, nil)
+
+	a := &order.Activities{InventoryURL: inventoryAPI.URL}
+
+	env := testSuite.NewTestActivityEnvironment()
+	env.RegisterActivity(a.BackorderItems)
+	env.RegisterActivity(a.RemoveBackorder)
+
+	listBackorders := func() []inventory.Backorder {
+		res, err := http.Get(inventoryAPI.URL + "/backorders")
+		require.NoError(t, err)
+		defer res.Body.Close()
+
+		var backorders []inventory.Backorder
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&backorders))
+		return backorders
+	}
+
+	_, err := env.ExecuteActivity(a.BackorderItems, &order.BackorderItemsInput{
+		Reference:  "1234:1",
+		WorkflowID: "1234",
+		Items:      []*order.Item{{SKU: "Adidas Classic", Quantity: 1}},
+	})
+	require.NoError(t, err)
+
+	backorders := listBackorders()
+	require.Len(t, backorders, 1)
+	require.Equal(t, "1234", backorders[0].WorkflowID)
+	require.Equal(t, []string{"Adidas Classic"}, backorders[0].SKUs)
+
+	_, err = env.ExecuteActivity(a.RemoveBackorder, "1234:1")
+	require.NoError(t, err)
+
+	require.Empty(t, listBackorders())
+}
+
+func TestGetCharge(t *testing.T) {
+	status := billing.ChargeStatus{ID: "test", Status: billing.ChargeStatusPending}
+
+	billingAPI := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/charges/test", r.URL.Path)
+		require.NoError(t, json.NewEncoder(w).Encode(status))
+	}))
+	defer billingAPI.Close()
+
+	testSuite := testsuite.WorkflowTestSuite{}
+
+	a := &order.Activities{BillingURL: billingAPI.URL}
+
+	env := testSuite.NewTestActivityEnvironment()
+	env.RegisterActivity(a.GetCharge)
+
+	_, err := env.ExecuteActivity(a.GetCharge, &order.GetChargeInput{ChargeID: "test"})
+
+	var appErr *temporal.ApplicationError
+	require.True(t, errors.As(err, &appErr))
+	require.Equal(t, order.ChargePendingErrorType, appErr.Type())
+	require.False(t, appErr.NonRetryable())
+
+	status.Status = billing.ChargeStatusCompleted
+	status.Result = &billing.ChargeResult{
+		InvoiceReference: "1:1",
+		InvoiceURL:       billing.InvoiceURL("1:1"),
+		Success:          true,
+	}
+
+	future, err := env.ExecuteActivity(a.GetCharge, &order.GetChargeInput{ChargeID: "test"})
+	require.NoError(t, err)
+
+	var result order.ChargeResult
+	require.NoError(t, future.Get(&result))
+	require.True(t, result.Success)
+	require.Equal(t, billingAPI.URL+"/invoices/1:1", result.InvoiceURL)
+}
+
+func TestChargeWaitsForResult(t *testing.T) {
+	var polls atomic.Int32
+
+	billingAPI := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/charge":
+			w.WriteHeader(http.StatusAccepted)
+			require.NoError(t, json.NewEncoder(w).Encode(billing.ChargeAccepted{ID: "test"}))
+		case "/charges/test":
+			status := billing.ChargeStatus{ID: "test", Status: billing.ChargeStatusPending}
+			if polls.Add(1) > 1 {
+				status.Status = billing.ChargeStatusCompleted
+				status.Result = &billing.ChargeResult{Success: true, Total: 100}
+			}
+			require.NoError(t, json.NewEncoder(w).Encode(status))
+		default:
+			t.Errorf("unexpected request to %s", r.URL.Path)
+		}
+	}))
+	defer billingAPI.Close()
+
+	testSuite := testsuite.WorkflowTestSuite{}
+
+	a := &order.Activities{BillingURL: billingAPI.URL}
+
+	env := testSuite.NewTestActivityEnvironment()
+	env.RegisterActivity(a.Charge)
+
+	future, err := env.ExecuteActivity(a.Charge, &order.ChargeInput{CustomerID: "1", Reference: "1:1", IdempotencyKey: "test"})
+	require.NoError(t, err)
+
+	var result order.ChargeResult
+	require.NoError(t, future.Get(&result))
+	require.True(t, result.Success)
+	require.Equal(t, int32(2), polls.Load())
+}
+
+func TestGetChargeFailed(t *testing.T) {
+	billingAPI := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		require.NoError(t, json.NewEncoder(w).Encode(billing.ErrorResponse{
+			Code:     billing.ErrorCodeChargeFailed,
+			Message:  "invoice must have items",
+			ChargeID: "test",
+		}))
+	}))
+	defer billingAPI.Close()
+
+	testSuite := testsuite.WorkflowTestSuite{}
+
+	a := &order.Activities{BillingURL: billingAPI.URL}
+
+	env := testSuite.NewTestActivityEnvironment()
+	env.RegisterActivity(a.GetCharge)
+
+	_, err := env.ExecuteActivity(a.GetCharge, &order.GetChargeInput{ChargeID: "test"})
+
+	var appErr *temporal.ApplicationError
+	require.True(t, errors.As(err, &appErr))
+	require.Equal(t, billing.ErrorCodeChargeFailed, appErr.Type())
+	require.True(t, appErr.NonRetryable())
+
+	var details billing.ErrorResponse
+	require.NoError(t, appErr.Details(&details))
+	require.Equal(t, "test", details.ChargeID)
 }
@@ -0,0 +1,232 @@
+package order
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/temporalio/reference-app-orders-go/app/shipment"
+	"go.temporal.io/sdk/workflow"
+)
+
+// Address is a postal address an order's items are shipped to.
+type Address = shipment.Address
+
+// AddressValidation is the result of validating an Address.
+// Address is the normalised form of a valid address. Reason explains why an invalid address was rejected.
+type AddressValidation struct {
+	Valid   bool     `json:"valid"`
+	Address *Address `json:"address,omitempty"`
+	Reason  string   `json:"reason,omitempty"`
+}
+
+// AddressValidator validates and normalises shipping addresses.
+type AddressValidator interface {
+	// ValidateAddress checks that an address can be delivered to, returning it in a normalised form.
+	// Invalid addresses are reported in the result rather than as an error.
+	ValidateAddress(ctx context.Context, address *Address) (*AddressValidation, error)
+}
+
+// RulesAddressValidator is an AddressValidator which checks addresses against local formatting rules,
+// without consulting an address database.
+type RulesAddressValidator struct{}
+
+var (
+	whitespace = regexp.MustCompile(`\s+`)
+
+	// postalCodeFormats are the postal code formats of countries with a known format.
+	postalCodeFormats = map[string]*regexp.Regexp{
+		"US": regexp.MustCompile(`^\d{5}(-\d{4})?$`),
+		"CA": regexp.MustCompile(`^[A-Z]\d[A-Z] \d[A-Z]\d$`),
+		"GB": regexp.MustCompile(`^[A-Z]{1,2}\d[A-Z\d]? \d[A-Z]{2}$`),
+		"DE": regexp.MustCompile(`^\d{5}$`),
+		"FR": regexp.MustCompile(`^\d{5}$`),
+		"AU": regexp.MustCompile(`^\d{4}$`),
+	}
+
+	// otherPostalCodeFormat is used for countries without a known format.
+	otherPostalCodeFormat = regexp.MustCompile(`^[A-Z\d][A-Z\d -]{1,8}[A-Z\d]$`)
+
+	// regionFormats are the region formats of countries which require a region.
+	regionFormats = map[string]*regexp.Regexp{
+		"US": regexp.MustCompile(`^[A-Z]{2}$`),
+		"CA": regexp.MustCompile(`^[A-Z]{2}$`),
+		"AU": regexp.MustCompile(`^[A-Z]{2,3}$`),
+	}
+
+	countryCode = regexp.MustCompile(`^[A-Z]{2}$`)
+)
+
+// normaliseField trims a field and collapses the whitespace within it.
+func normaliseField(s string) string {
+	return whitespace.ReplaceAllString(strings.TrimSpace(s), " ")
+}
+
+// normalisePostalCode formats a postal code as it is written in its country.
+func normalisePostalCode(country string, code string) string {
+	code = strings.ToUpper(normaliseField(code))
+
+	switch country {
+	case "CA", "GB":
+		// The inward code is the last three characters, separated by a space.
+		code = strings.ReplaceAll(code, " ", "")
+		if len(code) > 3 {
+			code = code[:len(code)-3] + " " + code[len(code)-3:]
+		}
+	}
+
+	return code
+}
+
+// ValidateAddress implements AddressValidator.
+func (RulesAddressValidator) ValidateAddress(_ context.Context, address *Address) (*AddressValidation, error) {
+	n := Address{
+		Name:    normaliseField(address.Name),
+		Line1:   normaliseField(address.Line1),
+		Line2:   normaliseField(address.Line2),
+		City:    normaliseField(address.City),
+		Region:  strings.ToUpper(normaliseField(address.Region)),
+		Country: strings.ToUpper(normaliseField(address.Country)),
+	}
+	n.PostalCode = normalisePostalCode(n.Country, address.PostalCode)
+
+	invalid := func(format string, args ...any) (*AddressValidation, error) {
+		return &AddressValidation{Reason: fmt.Sprintf(format, args...)}, nil
+	}
+
+	switch {
+	case n.Line1 == "":
+		return invalid("street address is required")
+	case n.City == "":
+		return invalid("city is required")
+	case n.Country == "":
+		return invalid("country is required")
+	case !countryCode.MatchString(n.Country):
+		return invalid("country %q must be a two letter country code", n.Country)
+	case n.PostalCode == "":
+		return invalid("postal code is required")
+	}
+
+	format, ok := postalCodeFormats[n.Country]
+	if !ok {
+		format = otherPostalCodeFormat
+	}
+	if !format.MatchString(n.PostalCode) {
+		return invalid("postal code %q is not valid for %s", n.PostalCode, n.Country)
+	}
+
+	if format, ok := regionFormats[n.Country]; ok && !format.MatchString(n.Region) {
+		if n.Region == "" {
+			return invalid("region is required for %s", n.Country)
+		}
+		return invalid("region %q is not valid for %s", n.Region, n.Country)
+	}
+
+	return &AddressValidation{Valid: true, Address: &n}, nil
+}
+
+// splitByAddress groups items by the address they are shipped to, in the order the addresses first appear.
+func splitByAddress(items []*Item) [][]*Item {
+	var groups [][]*Item
+	index := make(map[Address]int)
+
+	for _, item := range items {
+		var key Address
+		if item.ShippingAddress != nil {
+			key = *item.ShippingAddress
+		}
+
+		i, ok := index[key]
+		if !ok {
+			i = len(groups)
+			index[key] = i
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], item)
+	}
+
+	return groups
+}
+
+// validateAddresses validates the items' shipping addresses, replacing each valid address with its
+// normalised form. It returns the items with an invalid address and the reason the first was rejected.
+func (wf *orderImpl) validateAddresses(ctx workflow.Context, items []*Item) ([]*Item, string, error) {
+	ctx = workflow.WithActivityOptions(ctx,
+		workflow.ActivityOptions{
+			StartToCloseTimeout: 10 * time.Second,
+		},
+	)
+
+	validations := make(map[Address]*AddressValidation)
+
+	var invalid []*Item
+	var reason string
+
+	for _, item := range items {
+		if item.ShippingAddress == nil {
+			continue
+		}
+
+		v, ok := validations[*item.ShippingAddress]
+		if !ok {
+			err := workflow.ExecuteActivity(ctx, a.ValidateAddress, item.ShippingAddress).Get(ctx, &v)
+			if err != nil {
+				return nil, "", err
+			}
+			validations[*item.ShippingAddress] = v
+		}
+
+		if v.Valid {
+			item.ShippingAddress = v.Address
+			continue
+		}
+
+		if reason == "" {
+			reason = fmt.Sprintf("shipping address for %s is invalid: %s", item.SKU, v.Reason)
+		}
+		invalid = append(invalid, item)
+	}
+
+	return invalid, reason, nil
+}
+
+// confirmAddresses validates the order's shipping addresses, waiting for the customer to correct any
+// which are invalid. It returns the customer's action if they cancel the order or do not respond in time,
+// or an empty action once every address is valid.
+func (wf *orderImpl) confirmAddresses(ctx workflow.Context) (string, error) {
+	for {
+		invalid, reason, err := wf.validateAddresses(ctx, wf.items)
+		if err != nil {
+			return "", err
+		}
+
+		wf.reason = reason
+		if len(invalid) == 0 {
+			return "", nil
+		}
+
+		wf.logger.Info("Invalid shipping address", "reason", reason)
+
+		if err := wf.updateStatus(ctx, OrderStatusCustomerActionRequired); err != nil {
+			return "", err
+		}
+
+		signal, err := wf.waitForCustomer(ctx, CustomerActionUpdateAddress, CustomerActionCancel)
+		if err != nil {
+			return "", err
+		}
+
+		if signal.Action != CustomerActionUpdateAddress {
+			return signal.Action, nil
+		}
+		if signal.ShippingAddress == nil {
+			wf.logger.Warn("Address update has no address")
+			continue
+		}
+		for _, item := range invalid {
+			item.ShippingAddress = signal.ShippingAddress
+		}
+	}
+}
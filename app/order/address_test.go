@@ -0,0 +1,230 @@
+package order_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/temporalio/reference-app-orders-go/app/order"
+	"github.com/temporalio/reference-app-orders-go/app/shipment"
+	"go.temporal.io/sdk/testsuite"
+	"go.temporal.io/sdk/workflow"
+)
+
+func TestRulesAddressValidator(t *testing.T) {
+	tests := []struct {
+		name    string
+		address order.Address
+		want    *order.Address
+		reason  string
+	}{
+		{
+			name:    "normalises US address",
+			address: order.Address{Name: " Jane  Doe", Line1: "1 Main   St ", City: "Springfield", Region: "il", PostalCode: "62701", Country: "us"},
+			want:    &order.Address{Name: "Jane Doe", Line1: "1 Main St", City: "Springfield", Region: "IL", PostalCode: "62701", Country: "US"},
+		},
+		{
+			name:    "formats GB postcode",
+			address: order.Address{Line1: "10 Downing Street", City: "London", PostalCode: "sw1a2aa", Country: "GB"},
+			want:    &order.Address{Line1: "10 Downing Street", City: "London", PostalCode: "SW1A 2AA", Country: "GB"},
+		},
+		{
+			name:    "accepts other countries",
+			address: order.Address{Line1: "Calle Mayor 1", City: "Madrid", PostalCode: "28013", Country: "ES"},
+			want:    &order.Address{Line1: "Calle Mayor 1", City: "Madrid", PostalCode: "28013", Country: "ES"},
+		},
+		{
+			name:    "requires street",
+			address: order.Address{City: "Springfield", Region: "IL", PostalCode: "62701", Country: "US"},
+			reason:  "street address is required",
+		},
+		{
+			name:    "rejects country name",
+			address: order.Address{Line1: "1 Main St", City: "Springfield", Region: "IL", PostalCode: "62701", Country: "USA"},
+			reason:  `country "USA" must be a two letter country code`,
+		},
+		{
+			name:    "rejects postal code",
+			address: order.Address{Line1: "1 Main St", City: "Springfield", Region: "IL", PostalCode: "6270", Country: "US"},
+			reason:  `postal code "6270" is not valid for US`,
+		},
+		{
+			name:    "requires region",
+			address: order.Address{Line1: "1 Main St", City: "Springfield", PostalCode: "62701", Country: "US"},
+			reason:  "region is required for US",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			result, err := order.RulesAddressValidator{}.ValidateAddress(context.Background(), &tc.address)
+			require.NoError(t, err)
+			assert.Equal(t, tc.want != nil, result.Valid)
+			assert.Equal(t, tc.want, result.Address)
+			assert.Equal(t, tc.reason, result.Reason)
+		})
+	}
+}
+
+func TestOrderInvalidShippingAddress(t *testing.T) {
+	s := testsuite.WorkflowTestSuite{}
+	env := s.NewTestWorkflowEnvironment()
+	a := &order.Activities{}
+
+	env.RegisterActivity(a.ValidateAddress)
+	env.OnActivity(a.ReserveItems, mock.Anything, mock.Anything).Return(reserveItems)
+	env.OnActivity(a.StartCharge, mock.Anything, mock.Anything).Return(func(ctx context.Context, input *order.ChargeInput) (*order.StartChargeResult, error) {
+		return &order.StartChargeResult{ID: input.IdempotencyKey}, nil
+	})
+	env.OnActivity(a.GetCharge, mock.Anything, mock.Anything).Return(&order.ChargeResult{Success: true}, nil)
+
+	var statuses []string
+	env.OnActivity(a.UpdateOrderStatus, mock.Anything, mock.Anything).Return(func(ctx context.Context, input *order.OrderStatusUpdate) error {
+		statuses = append(statuses, input.Status)
+		return nil
+	})
+
+	destinations := make(map[string]*shipment.Address)
+	env.OnWorkflow(shipment.Shipment, mock.Anything, mock.Anything).Return(func(ctx workflow.Context, input *shipment.ShipmentInput) (*shipment.ShipmentResult, error) {
+		destinations[input.Items[0].SKU] = input.Destination
+		return &shipment.ShipmentResult{CourierReference: "test"}, nil
+	})
+
+	home := &order.Address{Line1: "1 Main St", City: "Springfield", Region: "IL", PostalCode: "62701", Country: "US"}
+	office := &order.Address{Line1: "2 High St", City: "London", PostalCode: "EC1A 1BB"}
+
+	var waiting order.OrderStatus
+	env.RegisterDelayedCallback(func() {
+		v, err := env.QueryWorkflow(order.StatusQuery)
+		require.NoError(t, err)
+		require.NoError(t, v.Get(&waiting))
+
+		env.SignalWorkflow(order.CustomerActionSignalName, order.CustomerActionSignal{
+			Action:          order.CustomerActionUpdateAddress,
+			ShippingAddress: &order.Address{Line1: "2 High St", City: "London", PostalCode: "ec1a1bb", Country: "GB"},
+		})
+	}, time.Second)
+
+	env.ExecuteWorkflow(order.Order, &order.OrderInput{
+		ID:              "1234",
+		CustomerID:      "1234",
+		ShippingAddress: home,
+		Items: []*order.Item{
+			{SKU: "test1", Quantity: 1},
+			{SKU: "test2", Quantity: 1},
+			{SKU: "test3", Quantity: 1, ShippingAddress: office},
+		},
+	})
+
+	var result order.OrderResult
+	require.NoError(t, env.GetWorkflowResult(&result))
+	assert.Equal(t, order.OrderStatusCompleted, result.Status)
+
+	assert.Equal(t, order.OrderStatusCustomerActionRequired, waiting.Status)
+	assert.Equal(t, "shipping address for test3 is invalid: country is required", waiting.Reason)
+	assert.Equal(t, []string{order.OrderStatusCustomerActionRequired, order.OrderStatusProcessing, order.OrderStatusCompleted}, statuses)
+
+	v, err := env.QueryWorkflow(order.StatusQuery)
+	require.NoError(t, err)
+
+	var status order.OrderStatus
+	require.NoError(t, v.Get(&status))
+	assert.Empty(t, status.Reason)
+
+	// The second warehouse's items are going to different addresses, so are shipped separately.
+	require.Len(t, status.Fulfillments, 3)
+	assert.Equal(t, "EC1A 1BB", status.Fulfillments[2].ShippingAddress.PostalCode)
+
+	assert.Equal(t, home, destinations["test1"])
+	assert.Equal(t, home, destinations["test2"])
+	assert.Equal(t, "EC1A 1BB", destinations["test3"].PostalCode)
+}
+
+func TestOrderAddressUpdateWhileItemsUnavailable(t *testing.T) {
+	s := testsuite.WorkflowTestSuite{}
+	env := s.NewTestWorkflowEnvironment()
+	a := &order.Activities{}
+
+	env.RegisterActivity(a.ValidateAddress)
+	env.OnActivity(a.ReserveItems, mock.Anything, mock.Anything).Return(reserveItems)
+	env.OnActivity(a.StartCharge, mock.Anything, mock.Anything).Return(func(ctx context.Context, input *order.ChargeInput) (*order.StartChargeResult, error) {
+		return &order.StartChargeResult{ID: input.IdempotencyKey}, nil
+	})
+	env.OnActivity(a.GetCharge, mock.Anything, mock.Anything).Return(&order.ChargeResult{Success: true}, nil)
+	env.OnActivity(a.UpdateOrderStatus, mock.Anything, mock.Anything).Return(nil)
+
+	var destination *shipment.Address
+	env.OnWorkflow(shipment.Shipment, mock.Anything, mock.Anything).Return(func(ctx workflow.Context, input *shipment.ShipmentInput) (*shipment.ShipmentResult, error) {
+		destination = input.Destination
+		return &shipment.ShipmentResult{CourierReference: "test"}, nil
+	})
+
+	home := &order.Address{Line1: "1 Main St", City: "Springfield", Region: "IL", PostalCode: "62701", Country: "US"}
+
+	var waiting order.OrderStatus
+	env.RegisterDelayedCallback(func() {
+		// The addresses have been confirmed, so an address update does not apply to the unavailable items.
+		env.SignalWorkflow(order.CustomerActionSignalName, order.CustomerActionSignal{
+			Action:          order.CustomerActionUpdateAddress,
+			ShippingAddress: &order.Address{Line1: "2 High St", City: "London", PostalCode: "EC1A 1BB", Country: "GB"},
+		})
+	}, time.Second)
+	env.RegisterDelayedCallback(func() {
+		v, err := env.QueryWorkflow(order.StatusQuery)
+		require.NoError(t, err)
+		require.NoError(t, v.Get(&waiting))
+
+		env.SignalWorkflow(order.CustomerActionSignalName, order.CustomerActionSignal{Action: order.CustomerActionAmend})
+	}, 2*time.Second)
+
+	env.ExecuteWorkflow(order.Order, &order.OrderInput{
+		ID:              "1234",
+		CustomerID:      "1234",
+		ShippingAddress: home,
+		Items: []*order.Item{
+			{SKU: "Adidas", Quantity: 1},
+			{SKU: "test2", Quantity: 1},
+		},
+	})
+
+	require.NoError(t, env.GetWorkflowError())
+
+	var result order.OrderResult
+	require.NoError(t, env.GetWorkflowResult(&result))
+	assert.Equal(t, order.OrderStatusCompleted, result.Status)
+
+	assert.Equal(t, order.OrderStatusCustomerActionRequired, waiting.Status)
+	assert.Equal(t, home, destination)
+}
+
+func TestOrderAddressConfirmationVersion(t *testing.T) {
+	s := testsuite.WorkflowTestSuite{}
+	env := s.NewTestWorkflowEnvironment()
+	var a *order.Activities
+
+	// An order started before shipping addresses were validated does not validate them on replay.
+	env.OnGetVersion("ConfirmAddresses", workflow.DefaultVersion, 1).Return(workflow.DefaultVersion)
+	env.OnActivity(a.ReserveItems, mock.Anything, mock.Anything).Return(reserveItems)
+	env.OnActivity(a.StartCharge, mock.Anything, mock.Anything).Return(func(ctx context.Context, input *order.ChargeInput) (*order.StartChargeResult, error) {
+		return &order.StartChargeResult{ID: input.IdempotencyKey}, nil
+	})
+	env.OnActivity(a.GetCharge, mock.Anything, mock.Anything).Return(&order.ChargeResult{Success: true}, nil)
+	env.OnActivity(a.UpdateOrderStatus, mock.Anything, mock.Anything).Return(nil)
+	env.OnWorkflow(shipment.Shipment, mock.Anything, mock.Anything).Return(&shipment.ShipmentResult{CourierReference: "test"}, nil)
+
+	env.ExecuteWorkflow(order.Order, &order.OrderInput{
+		ID:              "1234",
+		CustomerID:      "1234",
+		ShippingAddress: &order.Address{Line1: "2 High St", City: "London", PostalCode: "EC1A 1BB"},
+		Items:           []*order.Item{{SKU: "test1", Quantity: 1}},
+	})
+
+	var result order.OrderResult
+	require.NoError(t, env.GetWorkflowResult(&result))
+	assert.Equal(t, order.OrderStatusCompleted, result.Status)
+
+	env.AssertNotCalled(t, "ValidateAddress", mock.Anything, mock.Anything)
+}
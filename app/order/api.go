@@ -3,12 +3,15 @@ package order
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"log/slog"
 	"net/http"
 	"strings"
 	"time"
 
 	"github.com/temporalio/reference-app-orders-go/app/db"
+	"github.com/temporalio/reference-app-orders-go/app/inventory"
+	"github.com/temporalio/reference-app-orders-go/app/shipment"
 	"go.temporal.io/api/enums/v1"
 	"go.temporal.io/api/serviceerror"
 	"go.temporal.io/sdk/client"
@@ -32,10 +35,13 @@ func OrderIDFromWorkflowID(id string) string {
 }
 
 // Item represents an item being ordered.
-// All fields are required.
+// All fields except ShippingAddress are required.
 type Item struct {
 	SKU      string `json:"sku"`
 	Quantity int32  `json:"quantity"`
+
+	// ShippingAddress is where the item is delivered, if not to the order's shipping address.
+	ShippingAddress *Address `json:"shippingAddress,omitempty"`
 }
 
 // OrderInput is the input for an Order workflow.
@@ -43,8 +49,35 @@ type OrderInput struct {
 	ID         string  `json:"id"`
 	CustomerID string  `json:"customerId"`
 	Items      []*Item `json:"items"`
+
+	// PaymentMethodID is the customer's stored payment method to charge.
+	// If not set, the customer's default payment method is used.
+	PaymentMethodID string `json:"paymentMethodId,omitempty"`
+
+	// ShippingPolicy is how carriers are chosen for the order's shipments, either
+	// "economy" for the cheapest or "express" for the fastest. Defaults to economy.
+	ShippingPolicy string `json:"shippingPolicy,omitempty"`
+
+	// ShippingAddress is where the order's items are delivered. Items may be sent
+	// elsewhere by giving them their own ShippingAddress.
+	ShippingAddress *Address `json:"shippingAddress,omitempty"`
+
+	// FulfillmentPolicy is how the order's items are split into shipments, either "fewestShipments"
+	// to use as few shipments as possible or "fastest" to deliver soonest. Defaults to fewestShipments.
+	FulfillmentPolicy string `json:"fulfillmentPolicy,omitempty"`
+
+	// ShipComplete ships the order as a single shipment rather than in parts. If no warehouse can ship
+	// every item, the whole order is backordered until one can.
+	ShipComplete bool `json:"shipComplete,omitempty"`
+
+	// NotBefore schedules the order, so that its items are not reserved or charged until then.
+	// The customer may cancel the order while it is scheduled.
+	NotBefore *time.Time `json:"notBefore,omitempty"`
 }
 
+// FulfillmentPlan explains how an order's items were split into fulfillments.
+type FulfillmentPlan = inventory.Plan
+
 // OrderStatus holds the status of an Order workflow.
 type OrderStatus struct {
 	ID         string    `json:"id"`
@@ -52,8 +85,18 @@ type OrderStatus struct {
 	ReceivedAt time.Time `json:"receivedAt"`
 
 	Status string `json:"status"`
+	// Reason explains why customer action is required, where the order's status does not.
+	Reason string `json:"reason,omitempty"`
+	// ScheduledFor is when a scheduled order's items are reserved and charged.
+	ScheduledFor *time.Time `json:"scheduledFor,omitempty"`
 
 	Fulfillments []*Fulfillment `json:"fulfillments"`
+
+	// Plan explains how the order's items were split into fulfillments, once they have been reserved.
+	Plan *FulfillmentPlan `json:"plan,omitempty"`
+
+	// Returns lists the returns requested for the order's fulfillments.
+	Returns []ReturnSummary `json:"returns,omitempty"`
 }
 
 // OrderStatusUpdate is used to update an Order's status.
@@ -66,6 +109,9 @@ const (
 	// OrderStatusPending is the status of a pending Order.
 	OrderStatusPending = "pending"
 
+	// OrderStatusScheduled is the status of an Order which is waiting for the time it is scheduled for.
+	OrderStatusScheduled = "scheduled"
+
 	// OrderStatusProcessing is the status of a processing Order.
 	OrderStatusProcessing = "processing"
 
@@ -98,6 +144,37 @@ type ShipmentStatus struct {
 
 	Status    string    `json:"status"`
 	UpdatedAt time.Time `json:"updatedAt"`
+
+	Carrier          string `json:"carrier,omitempty"`
+	CourierReference string `json:"courierReference,omitempty"`
+	TrackingURL      string `json:"trackingUrl,omitempty"`
+
+	// LatestEvent is the most recent event in the shipment's tracking timeline.
+	LatestEvent *shipment.TrackingEvent `json:"latestEvent,omitempty"`
+	// Escalations lists the shipment SLAs which have been breached.
+	Escalations []shipment.Escalation `json:"escalations,omitempty"`
+	// Cancellation is the outcome of a request to cancel the shipment, if one was made.
+	Cancellation *shipment.Cancellation `json:"cancellation,omitempty"`
+}
+
+// update applies a status update sent by the Shipment workflow.
+func (s *ShipmentStatus) update(signal shipment.ShipmentStatusUpdatedSignal) {
+	s.Status = signal.Status
+	s.UpdatedAt = signal.UpdatedAt
+	if signal.CourierReference != "" {
+		s.Carrier = signal.Carrier
+		s.CourierReference = signal.CourierReference
+		s.TrackingURL = signal.TrackingURL
+	}
+	if signal.Event != nil {
+		s.LatestEvent = signal.Event
+	}
+	if signal.Escalation != nil {
+		s.Escalations = append(s.Escalations, *signal.Escalation)
+	}
+	if signal.Cancellation != nil {
+		s.Cancellation = signal.Cancellation
+	}
 }
 
 // PaymentStatus holds the status of a Payment.
@@ -108,6 +185,19 @@ type PaymentStatus struct {
 	Total    int32 `json:"total"`
 
 	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+
+	InvoiceReference string `json:"invoiceReference,omitempty"`
+	InvoiceURL       string `json:"invoiceUrl,omitempty"`
+}
+
+// BackorderStatus holds the status of a fulfillment which is waiting for its items to be restocked.
+type BackorderStatus struct {
+	// ExpiresAt is when the fulfillment is cancelled if its items have not been restocked.
+	ExpiresAt time.Time `json:"expiresAt"`
+
+	// Attempts is how many times stock has been reserved for the items since they were backordered.
+	Attempts int `json:"attempts"`
 }
 
 const (
@@ -117,7 +207,10 @@ const (
 	// PaymentStatusSuccess is the status of a successful payment.
 	PaymentStatusSuccess = "success"
 
-	// PaymentStatusFailed is the status of a failed payment.
+	// PaymentStatusDeclined is the status of a declined payment.
+	PaymentStatusDeclined = "declined"
+
+	// PaymentStatusFailed is the status of a payment which could not be processed.
 	PaymentStatusFailed = "failed"
 )
 
@@ -129,6 +222,12 @@ type Fulfillment struct {
 	// CustomerID is the ID of the customer that this fulfillment is for.
 	customerID string
 
+	// paymentMethodID is the customer's payment method to charge for this fulfillment.
+	paymentMethodID string
+
+	// shippingPolicy is how the carrier is chosen for this fulfillment's shipment.
+	shippingPolicy string
+
 	// ID is an identifier for the fulfillment
 	ID string `json:"id"`
 
@@ -138,15 +237,33 @@ type Fulfillment struct {
 	// Location is the address for carrier pickup.
 	Location string `json:"location,omitempty"`
 
-	// Status is the status of the fulfillment, one of "unavailable", "pending", "processing", "dispatched", "delivered", "failed".
+	// ShippingAddress is where the fulfillment is delivered.
+	ShippingAddress *Address `json:"shippingAddress,omitempty"`
+
+	// Status is the status of the fulfillment, one of "unavailable", "preordered", "backordered", "pending", "processing", "dispatched", "delivered", "failed".
 	Status string `json:"status"`
 
+	// ReleasedAt is when a pre-ordered fulfillment's items are released, after which they are reserved and charged.
+	ReleasedAt *time.Time `json:"releasedAt,omitempty"`
+
+	// Backorder is set if the customer chose to wait for the fulfillment's unavailable items to be restocked.
+	Backorder *BackorderStatus `json:"backorder,omitempty"`
+
 	// PaymentStatus is the status of the payment for this fulfillment.
 	Payment *PaymentStatus `json:"payment,omitempty"`
 
 	// ShipmentStatus is the status of the shipment for this fulfillment.
 	Shipment *ShipmentStatus `json:"shipment,omitempty"`
 
+	// Refund is set if the fulfillment was cancelled after payment.
+	Refund *RefundResult `json:"refund,omitempty"`
+
+	// releasesStock is set if the fulfillment's reserved stock is returned when it is not shipped.
+	releasesStock bool
+
+	// restocked is set when the Inventory system signals that some of a backordered fulfillment's items were restocked.
+	restocked bool
+
 	logger log.Logger
 }
 
@@ -154,6 +271,12 @@ const (
 	// FulfillmentStatusUnavailable is the status of an unavailable Fulfillment.
 	FulfillmentStatusUnavailable = "unavailable"
 
+	// FulfillmentStatusPreordered is the status of a Fulfillment whose items have not been released yet.
+	FulfillmentStatusPreordered = "preordered"
+
+	// FulfillmentStatusBackordered is the status of an unavailable Fulfillment which is waiting for its items to be restocked.
+	FulfillmentStatusBackordered = "backordered"
+
 	// FulfillmentStatusPending is the status of a pending Fulfillment.
 	FulfillmentStatusPending = "pending"
 
@@ -176,6 +299,9 @@ const CustomerActionSignalName = "CustomerAction"
 // CustomerActionSignal is the signal sent to the Fulfillment workflow to indicate a customer action.
 type CustomerActionSignal struct {
 	Action string `json:"action"`
+
+	// ShippingAddress is the corrected address for the updateAddress action.
+	ShippingAddress *Address `json:"shippingAddress,omitempty"`
 }
 
 const (
@@ -185,6 +311,12 @@ const (
 	// CustomerActionAmend is the action to amend a Fulfillment.
 	CustomerActionAmend = "amend"
 
+	// CustomerActionBackorder is the action to wait for unavailable items to be restocked, rather than cancel them.
+	CustomerActionBackorder = "backorder"
+
+	// CustomerActionUpdateAddress is the action to replace a shipping address which failed validation.
+	CustomerActionUpdateAddress = "updateAddress"
+
 	// CustomerActionTimedOut represents customer failing to take action in time.
 	CustomerActionTimedOut = "timedOut"
 )
@@ -211,6 +343,15 @@ func Router(client client.Client, db db.DB, logger *slog.Logger) http.Handler {
 	r.HandleFunc("GET /orders/{id}", h.handleGetOrder)
 	r.HandleFunc("POST /orders/{id}/status", h.handleUpdateOrderStatus)
 	r.HandleFunc("POST /orders/{id}/action", h.handleCustomerAction)
+	r.HandleFunc("POST /orders/{id}/items", h.handleUpdateItems)
+	r.HandleFunc("POST /orders/{id}/returns", h.handleCreateReturn)
+	r.HandleFunc("GET /orders/{id}/returns", h.handleListReturns)
+	r.HandleFunc("GET /orders/{id}/returns/{returnId}", h.handleGetReturn)
+	r.HandleFunc("POST /orders/{id}/returns/{returnId}/status", h.handleUpdateReturnStatus)
+	r.HandleFunc("POST /subscriptions", h.handleCreateSubscription)
+	r.HandleFunc("GET /subscriptions/{id}", h.handleGetSubscription)
+	r.HandleFunc("POST /subscriptions/{id}/action", h.handleSubscriptionAction)
+	r.HandleFunc("POST /subscriptions/{id}/orders", h.handleRecordSubscriptionOrder)
 
 	return r
 }
@@ -285,13 +426,27 @@ func (h *handlers) handleCreateOrder(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusCreated)
 }
 
-func (h *handlers) handleGetOrder(w http.ResponseWriter, r *http.Request) {
+// getOrderStatus queries the status of an Order workflow.
+func (h *handlers) getOrderStatus(r *http.Request, id string) (*OrderStatus, error) {
 	var status OrderStatus
 
 	q, err := h.temporal.QueryWorkflow(r.Context(),
-		OrderWorkflowID(r.PathValue("id")), "",
+		OrderWorkflowID(id), "",
 		StatusQuery,
 	)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := q.Get(&status); err != nil {
+		return nil, fmt.Errorf("failed to get order query result: %w", err)
+	}
+
+	return &status, nil
+}
+
+func (h *handlers) handleGetOrder(w http.ResponseWriter, r *http.Request) {
+	status, err := h.getOrderStatus(r, r.PathValue("id"))
 	if err != nil {
 		if _, ok := err.(*serviceerror.NotFound); ok {
 			http.Error(w, "Order not found", http.StatusNotFound)
@@ -302,8 +457,9 @@ func (h *handlers) handleGetOrder(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := q.Get(&status); err != nil {
-		h.logger.Error("Failed to get order query result", "error", err)
+	status.Returns, err = h.getReturns(r, status.ID)
+	if err != nil {
+		h.logger.Error("Failed to list returns", "error", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
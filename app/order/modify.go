@@ -0,0 +1,456 @@
+package order
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.temporal.io/api/serviceerror"
+	"go.temporal.io/sdk/client"
+	"go.temporal.io/sdk/temporal"
+	"go.temporal.io/sdk/workflow"
+)
+
+// UpdateItemsUpdateName is the name of the update used to change the items of an order.
+const UpdateItemsUpdateName = "UpdateItems"
+
+const (
+	// InvalidItemsUpdateErrorType is the error type for an items update which cannot be applied to any order,
+	// such as one with a negative quantity, or to this order, such as one removing a SKU the order does not have.
+	InvalidItemsUpdateErrorType = "InvalidItemsUpdate"
+
+	// ItemsLockedErrorType is the error type for an items update which arrives after the items it changes
+	// have started processing, or which adds items after the order has started processing.
+	ItemsLockedErrorType = "ItemsLocked"
+)
+
+// ItemsUpdate changes the items of an order before they are charged.
+// Each item sets the quantity of its SKU: SKUs which are not in the order are added, and a quantity
+// of 0 removes the SKU. Added items are shipped to the order's shipping address unless they have
+// their own ShippingAddress.
+type ItemsUpdate struct {
+	Items []*Item `json:"items"`
+}
+
+// setItemsUpdateHandler lets the customer change the order's items until they are reserved, and then while
+// the fulfillments shipping them are waiting to be processed.
+func (wf *orderImpl) setItemsUpdateHandler(ctx workflow.Context) error {
+	return workflow.SetUpdateHandlerWithOptions(ctx, UpdateItemsUpdateName,
+		func(ctx workflow.Context, update ItemsUpdate) (*OrderStatus, error) {
+			wf.pendingItemUpdates++
+			defer func() { wf.pendingItemUpdates-- }()
+
+			// Updates are applied one at a time, and the order is checked again as an earlier update, or the
+			// reservation of its items, may have changed it.
+			if err := workflow.Await(ctx, func() bool { return !wf.updatingItems && !wf.reservingItems }); err != nil {
+				return nil, err
+			}
+			if err := wf.validateItemsUpdate(update); err != nil {
+				return nil, err
+			}
+
+			wf.updatingItems = true
+			defer func() { wf.updatingItems = false }()
+
+			if err := wf.updateItems(ctx, update); err != nil {
+				return nil, err
+			}
+
+			wf.itemsUpdated.SendAsync(nil)
+
+			return wf.orderStatus(), nil
+		},
+		workflow.UpdateHandlerOptions{
+			Validator: wf.validateItemsUpdate,
+		},
+	)
+}
+
+// awaitItemsUpdated waits for the items updates which have been accepted to be applied.
+func (wf *orderImpl) awaitItemsUpdated(ctx workflow.Context) error {
+	return workflow.Await(ctx, func() bool { return wf.pendingItemUpdates == 0 })
+}
+
+// itemsCanBeAdded reports whether items can be added to the order, which they cannot once it is processing
+// as the fulfillments for them would not be processed.
+func (wf *orderImpl) itemsCanBeAdded() bool {
+	switch wf.status {
+	case OrderStatusProcessing, OrderStatusCompleted, OrderStatusFailed, OrderStatusCancelled, OrderStatusTimedOut:
+		return false
+	}
+	return true
+}
+
+// findUnreservedItem returns the order's item for a SKU before the items are reserved.
+// It returns an error if the order has the SKU more than once, as it is not clear which should change.
+func (wf *orderImpl) findUnreservedItem(sku string) (*Item, error) {
+	var line *Item
+
+	for _, item := range wf.items {
+		if item.SKU != sku {
+			continue
+		}
+		if line != nil {
+			return nil, temporal.NewApplicationError(fmt.Sprintf("%s is in the order more than once", sku), InvalidItemsUpdateErrorType)
+		}
+		line = item
+	}
+
+	return line, nil
+}
+
+// findItem returns the fulfillment which ships a SKU and the item for it, ignoring cancelled fulfillments.
+// It returns an error if the SKU is shipped by more than one fulfillment, as it is not clear which should change.
+func (wf *orderImpl) findItem(sku string) (*Fulfillment, *Item, error) {
+	var found *Fulfillment
+	var line *Item
+
+	for _, f := range wf.fulfillments {
+		if f.Status == FulfillmentStatusCancelled {
+			continue
+		}
+		for _, item := range f.Items {
+			if item.SKU != sku {
+				continue
+			}
+			if found != nil {
+				return nil, nil, temporal.NewApplicationError(fmt.Sprintf("%s is shipped in more than one fulfillment", sku), InvalidItemsUpdateErrorType)
+			}
+			found, line = f, item
+		}
+	}
+
+	return found, line, nil
+}
+
+func (wf *orderImpl) validateItemsUpdate(update ItemsUpdate) error {
+	if len(update.Items) == 0 {
+		return temporal.NewApplicationError("items are required", InvalidItemsUpdateErrorType)
+	}
+
+	seen := make(map[string]bool)
+	for _, item := range update.Items {
+		if item == nil || item.SKU == "" || item.Quantity < 0 {
+			return temporal.NewApplicationError("items must have a SKU and a quantity which is not negative", InvalidItemsUpdateErrorType)
+		}
+		if seen[item.SKU] {
+			return temporal.NewApplicationError(fmt.Sprintf("%s is listed more than once", item.SKU), InvalidItemsUpdateErrorType)
+		}
+		seen[item.SKU] = true
+	}
+
+	switch {
+	case wf.reservingItems:
+		// The update is checked against the fulfillments once the items have been reserved.
+		return nil
+	case wf.fulfillments == nil:
+		return wf.validateUnreservedItemsUpdate(update)
+	}
+
+	for _, item := range update.Items {
+		f, line, err := wf.findItem(item.SKU)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case f == nil && item.Quantity == 0:
+			return temporal.NewApplicationError(fmt.Sprintf("%s is not in the order", item.SKU), InvalidItemsUpdateErrorType)
+		case f != nil && f.Status != FulfillmentStatusPending && f.Status != FulfillmentStatusUnavailable:
+			return temporal.NewApplicationError(fmt.Sprintf("fulfillment %s is %s and can no longer be changed", f.ID, f.Status), ItemsLockedErrorType)
+		case !wf.itemsCanBeAdded() && (f == nil || (f.Status == FulfillmentStatusPending && item.Quantity > line.Quantity)):
+			return temporal.NewApplicationError("items can no longer be added once the order is processing", ItemsLockedErrorType)
+		}
+	}
+
+	return nil
+}
+
+// validateUnreservedItemsUpdate checks an items update against the order's items before they are reserved.
+func (wf *orderImpl) validateUnreservedItemsUpdate(update ItemsUpdate) error {
+	remaining := len(wf.items)
+
+	for _, item := range update.Items {
+		line, err := wf.findUnreservedItem(item.SKU)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case line == nil && item.Quantity == 0:
+			return temporal.NewApplicationError(fmt.Sprintf("%s is not in the order", item.SKU), InvalidItemsUpdateErrorType)
+		case line == nil:
+			remaining++
+		case item.Quantity == 0:
+			remaining--
+		}
+	}
+
+	if remaining == 0 {
+		return temporal.NewApplicationError("the order must keep at least one item", InvalidItemsUpdateErrorType)
+	}
+
+	return nil
+}
+
+// updateItems applies an items update. Added items, and the extra quantity of increased items, are reserved
+// and join a waiting fulfillment from the same warehouse to the same address if there is one. The stock of
+// reduced and removed items is returned. Fulfillments are charged for their items once they are processed,
+// so the changed items are priced then.
+func (wf *orderImpl) updateItems(ctx workflow.Context, update ItemsUpdate) error {
+	ctx = workflow.WithActivityOptions(ctx,
+		workflow.ActivityOptions{
+			StartToCloseTimeout: 30 * time.Second,
+		},
+	)
+
+	if wf.fulfillments == nil {
+		return wf.updateUnreservedItems(ctx, update)
+	}
+
+	wf.itemUpdates++
+	reference := fmt.Sprintf("%s:update:%d", wf.id, wf.itemUpdates)
+
+	var added []*Item
+	reduced := make(map[*Fulfillment][]*Item)
+
+	for _, item := range update.Items {
+		f, line, err := wf.findItem(item.SKU)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case f == nil:
+			address := item.ShippingAddress
+			if address == nil {
+				address = wf.shippingAddress
+			}
+			added = append(added, &Item{SKU: item.SKU, Quantity: item.Quantity, ShippingAddress: address})
+		case item.Quantity > line.Quantity && f.Status == FulfillmentStatusPending:
+			added = append(added, &Item{SKU: item.SKU, Quantity: item.Quantity - line.Quantity, ShippingAddress: line.ShippingAddress})
+		case item.Quantity < line.Quantity && f.Status == FulfillmentStatusPending:
+			reduced[f] = append(reduced[f], &Item{SKU: item.SKU, Quantity: line.Quantity - item.Quantity})
+		}
+	}
+
+	invalid, reason, err := wf.validateAddresses(ctx, added)
+	if err != nil {
+		return err
+	}
+	if len(invalid) > 0 {
+		return temporal.NewApplicationError(reason, InvalidItemsUpdateErrorType)
+	}
+
+	var result ReserveItemsResult
+	if len(added) > 0 {
+		err := workflow.ExecuteActivity(ctx,
+			a.ReserveItems,
+			ReserveItemsInput{
+				OrderID:      wf.id,
+				Reference:    reference,
+				Items:        added,
+				Policy:       wf.fulfillmentPolicy,
+				ShipComplete: wf.shipComplete,
+			},
+		).Get(ctx, &result)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Unavailable items have no stock reserved, so only their quantity changes.
+	for _, item := range update.Items {
+		f, line, _ := wf.findItem(item.SKU)
+		if f == nil {
+			continue
+		}
+		if f.Status == FulfillmentStatusUnavailable || item.Quantity < line.Quantity {
+			f.setQuantity(item.SKU, item.Quantity)
+		}
+	}
+
+	for _, f := range wf.fulfillments {
+		items, ok := reduced[f]
+		if !ok {
+			continue
+		}
+
+		err := workflow.ExecuteActivity(ctx,
+			a.RestockItems,
+			&RestockItemsInput{
+				Reference: fmt.Sprintf("%s:update:%d:released", f.ID, wf.itemUpdates),
+				Location:  f.Location,
+				Items:     items,
+			},
+		).Get(ctx, nil)
+		if err != nil {
+			f.logger.Error("Failed to release stock of reduced items", "error", err)
+		}
+	}
+
+	for _, r := range result.Reservations {
+		for _, items := range splitByAddress(r.Items) {
+			f := wf.waitingFulfillment(r, items[0].ShippingAddress)
+			if f == nil {
+				wf.addFulfillment(r, items)
+				continue
+			}
+			for _, item := range items {
+				f.addItem(item)
+			}
+		}
+	}
+
+	wf.logger.Info("Order items updated", "reference", reference, "added", len(added))
+
+	return nil
+}
+
+// updateUnreservedItems applies an items update to the order before its items are reserved, such as while
+// it is scheduled. The items are reserved as they are when the order is processed.
+func (wf *orderImpl) updateUnreservedItems(ctx workflow.Context, update ItemsUpdate) error {
+	var added []*Item
+	for _, item := range update.Items {
+		if line, _ := wf.findUnreservedItem(item.SKU); line != nil {
+			continue
+		}
+		address := item.ShippingAddress
+		if address == nil {
+			address = wf.shippingAddress
+		}
+		added = append(added, &Item{SKU: item.SKU, Quantity: item.Quantity, ShippingAddress: address})
+	}
+
+	invalid, reason, err := wf.validateAddresses(ctx, added)
+	if err != nil {
+		return err
+	}
+	if len(invalid) > 0 {
+		return temporal.NewApplicationError(reason, InvalidItemsUpdateErrorType)
+	}
+
+	for _, item := range update.Items {
+		if line, _ := wf.findUnreservedItem(item.SKU); line != nil {
+			line.Quantity = item.Quantity
+		}
+	}
+
+	var items []*Item
+	for _, item := range wf.items {
+		if item.Quantity > 0 {
+			items = append(items, item)
+		}
+	}
+	wf.items = append(items, added...)
+
+	wf.logger.Info("Order items updated before reservation", "added", len(added))
+
+	return nil
+}
+
+// waitingFulfillment returns the fulfillment which items of a reservation can join, if there is one:
+// one which has not been processed, with the same availability, warehouse, release date and shipping address.
+func (wf *orderImpl) waitingFulfillment(r *Reservation, address *Address) *Fulfillment {
+	status := FulfillmentStatusPending
+	switch {
+	case r.ReleasedAt != nil:
+		status = FulfillmentStatusPreordered
+	case !r.Available:
+		status = FulfillmentStatusUnavailable
+	}
+
+	for _, f := range wf.fulfillments {
+		if f.Status != status || f.Location != r.Location {
+			continue
+		}
+		if status == FulfillmentStatusPreordered && !f.ReleasedAt.Equal(*r.ReleasedAt) {
+			continue
+		}
+		if (f.ShippingAddress == nil) != (address == nil) || (address != nil && *f.ShippingAddress != *address) {
+			continue
+		}
+		return f
+	}
+
+	return nil
+}
+
+// addItem adds an item to a fulfillment, increasing the quantity of its SKU if the fulfillment already has it.
+func (f *Fulfillment) addItem(item *Item) {
+	for _, existing := range f.Items {
+		if existing.SKU == item.SKU {
+			existing.Quantity += item.Quantity
+			return
+		}
+	}
+
+	f.Items = append(f.Items, item)
+}
+
+// setQuantity sets the quantity of a SKU in a fulfillment, removing it at 0.
+// A fulfillment left with no items is cancelled.
+func (f *Fulfillment) setQuantity(sku string, quantity int32) {
+	var items []*Item
+	for _, item := range f.Items {
+		if item.SKU == sku {
+			if quantity == 0 {
+				continue
+			}
+			item.Quantity = quantity
+		}
+		items = append(items, item)
+	}
+
+	f.Items = items
+	if len(f.Items) == 0 {
+		f.Status = FulfillmentStatusCancelled
+	}
+}
+
+func (h *handlers) handleUpdateItems(w http.ResponseWriter, r *http.Request) {
+	var update ItemsUpdate
+
+	err := json.NewDecoder(r.Body).Decode(&update)
+	if err != nil {
+		h.logger.Error("Failed to decode items update", "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var status OrderStatus
+
+	handle, err := h.temporal.UpdateWorkflow(r.Context(), client.UpdateWorkflowOptions{
+		WorkflowID:   OrderWorkflowID(r.PathValue("id")),
+		UpdateName:   UpdateItemsUpdateName,
+		Args:         []interface{}{update},
+		WaitForStage: client.WorkflowUpdateStageCompleted,
+	})
+	if err == nil {
+		err = handle.Get(r.Context(), &status)
+	}
+	if err != nil {
+		var appErr *temporal.ApplicationError
+		switch {
+		case errors.As(err, new(*serviceerror.NotFound)):
+			http.Error(w, "Order not found", http.StatusNotFound)
+		case errors.As(err, &appErr) && appErr.Type() == InvalidItemsUpdateErrorType:
+			http.Error(w, appErr.Message(), http.StatusBadRequest)
+		case errors.As(err, &appErr) && appErr.Type() == ItemsLockedErrorType:
+			http.Error(w, appErr.Message(), http.StatusConflict)
+		default:
+			h.logger.Error("Failed to update order items", "error", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		h.logger.Error("Failed to encode order status", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
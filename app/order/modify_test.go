@@ -0,0 +1,380 @@
+package order_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/temporalio/reference-app-orders-go/app/billing"
+	"github.com/temporalio/reference-app-orders-go/app/order"
+	"github.com/temporalio/reference-app-orders-go/app/shipment"
+	"go.temporal.io/sdk/temporal"
+	"go.temporal.io/sdk/testsuite"
+	"go.temporal.io/sdk/workflow"
+)
+
+// updateCallbacks records the outcome of a workflow update.
+type updateCallbacks struct {
+	rejected  error
+	completed bool
+	result    interface{}
+	err       error
+}
+
+func (u *updateCallbacks) Accept() {}
+
+func (u *updateCallbacks) Reject(err error) {
+	u.rejected = err
+}
+
+func (u *updateCallbacks) Complete(result interface{}, err error) {
+	u.completed = true
+	u.result = result
+	u.err = err
+}
+
+// errorType returns the type of an application error, or an empty string for any other error.
+func errorType(err error) string {
+	var appErr *temporal.ApplicationError
+	if errors.As(err, &appErr) {
+		return appErr.Type()
+	}
+	return ""
+}
+
+func TestOrderUpdateItems(t *testing.T) {
+	s := testsuite.WorkflowTestSuite{}
+	env := s.NewTestWorkflowEnvironment()
+	var a *order.Activities
+
+	var restocks []*order.RestockItemsInput
+
+	env.OnActivity(a.ReserveItems, mock.Anything, mock.Anything).Return(reserveItems)
+	env.OnActivity(a.RestockItems, mock.Anything, mock.Anything).Return(func(ctx context.Context, input *order.RestockItemsInput) error {
+		restocks = append(restocks, input)
+		return nil
+	})
+	env.OnActivity(a.StartCharge, mock.Anything, mock.Anything).Return(func(ctx context.Context, input *order.ChargeInput) (*order.StartChargeResult, error) {
+		return &order.StartChargeResult{ID: input.IdempotencyKey}, nil
+	})
+	env.OnActivity(a.GetCharge, mock.Anything, mock.Anything).Return(func(ctx context.Context, input *order.GetChargeInput) (*order.ChargeResult, error) {
+		return &order.ChargeResult{Success: true}, nil
+	})
+	env.OnActivity(a.UpdateOrderStatus, mock.Anything, mock.Anything).Return(func(ctx context.Context, input *order.OrderStatusUpdate) error {
+		return nil
+	})
+	env.OnWorkflow(shipment.Shipment, mock.Anything, mock.Anything).Return(func(ctx workflow.Context, input *shipment.ShipmentInput) (*shipment.ShipmentResult, error) {
+		return &shipment.ShipmentResult{CourierReference: "test"}, nil
+	})
+
+	orderInput := order.OrderInput{
+		ID:         "1234",
+		CustomerID: "1234",
+		Items: []*order.Item{
+			{SKU: "Adidas", Quantity: 1},
+			{SKU: "test2", Quantity: 3},
+			{SKU: "test3", Quantity: 1},
+		},
+	}
+
+	uc := &updateCallbacks{}
+	env.RegisterDelayedCallback(func() {
+		env.UpdateWorkflow(order.UpdateItemsUpdateName, "update1", uc, order.ItemsUpdate{
+			Items: []*order.Item{
+				{SKU: "Adidas", Quantity: 0},
+				{SKU: "test2", Quantity: 1},
+				{SKU: "test3", Quantity: 0},
+				{SKU: "test4", Quantity: 2},
+			},
+		})
+	}, time.Second)
+
+	env.ExecuteWorkflow(
+		order.Order,
+		&orderInput,
+	)
+
+	var result order.OrderResult
+	require.NoError(t, env.GetWorkflowResult(&result))
+	assert.Equal(t, order.OrderStatusCompleted, result.Status)
+
+	require.NoError(t, uc.rejected)
+	require.True(t, uc.completed)
+	require.NoError(t, uc.err)
+	require.IsType(t, &order.OrderStatus{}, uc.result)
+
+	// Removing the unavailable item leaves nothing for the customer to decide, so the order is processed.
+	var status order.OrderStatus
+	v, err := env.QueryWorkflow(order.StatusQuery, nil)
+	require.NoError(t, err)
+	require.NoError(t, v.Get(&status))
+	require.Len(t, status.Fulfillments, 3)
+
+	assert.Equal(t, order.FulfillmentStatusCancelled, status.Fulfillments[0].Status)
+	assert.Empty(t, status.Fulfillments[0].Items)
+
+	// The added item was reserved at the same warehouse, so joins the existing fulfillment.
+	f := status.Fulfillments[1]
+	assert.Equal(t, order.FulfillmentStatusCompleted, f.Status)
+	assert.Equal(t, []*order.Item{{SKU: "test2", Quantity: 1}, {SKU: "test4", Quantity: 2}}, f.Items)
+	assert.Equal(t, order.PaymentStatusSuccess, f.Payment.Status)
+
+	assert.Equal(t, order.FulfillmentStatusCancelled, status.Fulfillments[2].Status)
+
+	assert.Equal(t, []*order.RestockItemsInput{
+		{Reference: "1234:2:update:1:released", Location: "Warehouse A", Items: []*order.Item{{SKU: "test2", Quantity: 2}}},
+		{Reference: "1234:3:update:1:released", Location: "Warehouse B", Items: []*order.Item{{SKU: "test3", Quantity: 1}}},
+	}, restocks)
+
+	env.AssertWorkflowNumberOfCalls(t, "Shipment", 1)
+}
+
+func TestOrderUpdateItemsWhileReserving(t *testing.T) {
+	s := testsuite.WorkflowTestSuite{}
+	env := s.NewTestWorkflowEnvironment()
+	var a *order.Activities
+
+	var restocks []*order.RestockItemsInput
+	var charged [][]billing.Item
+
+	// Reserving the order's items takes a while, so the order is updated before any fulfillment is processed.
+	env.OnActivity(a.ReserveItems, mock.Anything, mock.MatchedBy(func(input *order.ReserveItemsInput) bool {
+		return input.Reference == ""
+	})).After(time.Minute).Return(reserveItems)
+	env.OnActivity(a.ReserveItems, mock.Anything, mock.Anything).Return(reserveItems)
+	env.OnActivity(a.RestockItems, mock.Anything, mock.Anything).Return(func(ctx context.Context, input *order.RestockItemsInput) error {
+		restocks = append(restocks, input)
+		return nil
+	})
+	env.OnActivity(a.StartCharge, mock.Anything, mock.Anything).Return(func(ctx context.Context, input *order.ChargeInput) (*order.StartChargeResult, error) {
+		charged = append(charged, input.Items)
+		return &order.StartChargeResult{ID: input.IdempotencyKey}, nil
+	})
+	env.OnActivity(a.GetCharge, mock.Anything, mock.Anything).Return(func(ctx context.Context, input *order.GetChargeInput) (*order.ChargeResult, error) {
+		return &order.ChargeResult{Success: true}, nil
+	})
+	env.OnActivity(a.UpdateOrderStatus, mock.Anything, mock.Anything).Return(func(ctx context.Context, input *order.OrderStatusUpdate) error {
+		return nil
+	})
+	env.OnWorkflow(shipment.Shipment, mock.Anything, mock.Anything).Return(func(ctx workflow.Context, input *shipment.ShipmentInput) (*shipment.ShipmentResult, error) {
+		return &shipment.ShipmentResult{CourierReference: "test"}, nil
+	})
+
+	orderInput := order.OrderInput{
+		ID:         "1234",
+		CustomerID: "1234",
+		Items: []*order.Item{
+			{SKU: "test2", Quantity: 3},
+			{SKU: "test3", Quantity: 1},
+		},
+	}
+
+	uc := &updateCallbacks{}
+	env.RegisterDelayedCallback(func() {
+		env.UpdateWorkflow(order.UpdateItemsUpdateName, "update1", uc, order.ItemsUpdate{
+			Items: []*order.Item{
+				{SKU: "test2", Quantity: 1},
+				{SKU: "test4", Quantity: 2},
+			},
+		})
+	}, 30*time.Second)
+
+	env.ExecuteWorkflow(
+		order.Order,
+		&orderInput,
+	)
+
+	var result order.OrderResult
+	require.NoError(t, env.GetWorkflowResult(&result))
+	assert.Equal(t, order.OrderStatusCompleted, result.Status)
+
+	require.NoError(t, uc.rejected)
+	require.True(t, uc.completed)
+	require.NoError(t, uc.err)
+
+	// The update is applied to the fulfillments once the items are reserved, before they are charged.
+	var status order.OrderStatus
+	v, err := env.QueryWorkflow(order.StatusQuery, nil)
+	require.NoError(t, err)
+	require.NoError(t, v.Get(&status))
+	require.Len(t, status.Fulfillments, 2)
+
+	assert.Equal(t, []*order.Item{{SKU: "test2", Quantity: 1}, {SKU: "test4", Quantity: 2}}, status.Fulfillments[0].Items)
+	assert.Equal(t, order.FulfillmentStatusCompleted, status.Fulfillments[0].Status)
+	assert.Equal(t, order.FulfillmentStatusCompleted, status.Fulfillments[1].Status)
+
+	assert.ElementsMatch(t, [][]billing.Item{
+		{{SKU: "test2", Quantity: 1}, {SKU: "test4", Quantity: 2}},
+		{{SKU: "test3", Quantity: 1}},
+	}, charged)
+	assert.Equal(t, []*order.RestockItemsInput{
+		{Reference: "1234:1:update:1:released", Location: "Warehouse A", Items: []*order.Item{{SKU: "test2", Quantity: 2}}},
+	}, restocks)
+}
+
+func TestOrderUpdateItemsScheduled(t *testing.T) {
+	s := testsuite.WorkflowTestSuite{}
+	env := s.NewTestWorkflowEnvironment()
+	var a *order.Activities
+
+	start := time.Date(2024, time.March, 1, 9, 0, 0, 0, time.UTC)
+	notBefore := start.Add(48 * time.Hour)
+	env.SetStartTime(start)
+
+	var reserved []*order.ReserveItemsInput
+
+	env.OnActivity(a.ReserveItems, mock.Anything, mock.Anything).Return(func(ctx context.Context, input *order.ReserveItemsInput) (*order.ReserveItemsResult, error) {
+		assert.False(t, env.Now().Before(notBefore), "items are reserved once the order is due")
+		reserved = append(reserved, input)
+		return reserveItems(ctx, input)
+	})
+	env.OnActivity(a.StartCharge, mock.Anything, mock.Anything).Return(func(ctx context.Context, input *order.ChargeInput) (*order.StartChargeResult, error) {
+		return &order.StartChargeResult{ID: input.IdempotencyKey}, nil
+	})
+	env.OnActivity(a.GetCharge, mock.Anything, mock.Anything).Return(func(ctx context.Context, input *order.GetChargeInput) (*order.ChargeResult, error) {
+		return &order.ChargeResult{Success: true}, nil
+	})
+	env.OnActivity(a.UpdateOrderStatus, mock.Anything, mock.Anything).Return(func(ctx context.Context, input *order.OrderStatusUpdate) error {
+		return nil
+	})
+	env.OnWorkflow(shipment.Shipment, mock.Anything, mock.Anything).Return(func(ctx workflow.Context, input *shipment.ShipmentInput) (*shipment.ShipmentResult, error) {
+		return &shipment.ShipmentResult{CourierReference: "test"}, nil
+	})
+
+	orderInput := order.OrderInput{
+		ID:         "1234",
+		CustomerID: "1234",
+		Items: []*order.Item{
+			{SKU: "test1", Quantity: 1},
+			{SKU: "test2", Quantity: 2},
+		},
+		NotBefore: &notBefore,
+	}
+
+	update := func(items ...*order.Item) *updateCallbacks {
+		uc := &updateCallbacks{}
+		env.UpdateWorkflow(order.UpdateItemsUpdateName, "", uc, order.ItemsUpdate{Items: items})
+		return uc
+	}
+
+	var changed, missing, emptied *updateCallbacks
+
+	env.RegisterDelayedCallback(func() {
+		changed = update(
+			&order.Item{SKU: "test1", Quantity: 0},
+			&order.Item{SKU: "test2", Quantity: 5},
+			&order.Item{SKU: "test3", Quantity: 1},
+		)
+	}, time.Hour)
+
+	env.RegisterDelayedCallback(func() {
+		missing = update(&order.Item{SKU: "test1", Quantity: 0})
+		emptied = update(&order.Item{SKU: "test2", Quantity: 0}, &order.Item{SKU: "test3", Quantity: 0})
+	}, 2*time.Hour)
+
+	env.ExecuteWorkflow(
+		order.Order,
+		&orderInput,
+	)
+
+	var result order.OrderResult
+	require.NoError(t, env.GetWorkflowResult(&result))
+	assert.Equal(t, order.OrderStatusCompleted, result.Status)
+
+	require.NoError(t, changed.rejected)
+	require.True(t, changed.completed)
+	require.NoError(t, changed.err)
+
+	assert.Equal(t, order.InvalidItemsUpdateErrorType, errorType(missing.rejected))
+	assert.Equal(t, order.InvalidItemsUpdateErrorType, errorType(emptied.rejected))
+
+	// The items are reserved as they were changed while the order was scheduled.
+	require.Len(t, reserved, 1)
+	assert.Equal(t, []*order.Item{{SKU: "test2", Quantity: 5}, {SKU: "test3", Quantity: 1}}, reserved[0].Items)
+
+	env.AssertWorkflowNumberOfCalls(t, "Shipment", 2)
+}
+
+func TestOrderUpdateItemsRejected(t *testing.T) {
+	s := testsuite.WorkflowTestSuite{}
+	env := s.NewTestWorkflowEnvironment()
+	var a *order.Activities
+
+	env.OnActivity(a.ReserveItems, mock.Anything, mock.Anything).Return(reserveItems)
+	env.OnActivity(a.StartCharge, mock.Anything, mock.Anything).Return(func(ctx context.Context, input *order.ChargeInput) (*order.StartChargeResult, error) {
+		return &order.StartChargeResult{ID: input.IdempotencyKey}, nil
+	})
+	env.OnActivity(a.GetCharge, mock.Anything, mock.Anything).Return(func(ctx context.Context, input *order.GetChargeInput) (*order.ChargeResult, error) {
+		return &order.ChargeResult{Success: true}, nil
+	})
+	env.OnActivity(a.UpdateOrderStatus, mock.Anything, mock.Anything).Return(func(ctx context.Context, input *order.OrderStatusUpdate) error {
+		return nil
+	})
+	// The shipment takes a while, so the order is still processing when it is updated.
+	env.RegisterWorkflowWithOptions(func(ctx workflow.Context, input *shipment.ShipmentInput) (*shipment.ShipmentResult, error) {
+		if err := workflow.Sleep(ctx, time.Hour); err != nil {
+			return nil, err
+		}
+		return &shipment.ShipmentResult{CourierReference: "test"}, nil
+	}, workflow.RegisterOptions{Name: "Shipment"})
+
+	orderInput := order.OrderInput{
+		ID:         "1234",
+		CustomerID: "1234",
+		Items: []*order.Item{
+			{SKU: "Adidas", Quantity: 1},
+			{SKU: "test2", Quantity: 3},
+		},
+	}
+
+	update := func(items ...*order.Item) *updateCallbacks {
+		uc := &updateCallbacks{}
+		env.UpdateWorkflow(order.UpdateItemsUpdateName, "", uc, order.ItemsUpdate{Items: items})
+		return uc
+	}
+
+	var negative, missing, duplicated, charged *updateCallbacks
+
+	env.RegisterDelayedCallback(func() {
+		negative = update(&order.Item{SKU: "test2", Quantity: -1})
+		missing = update(&order.Item{SKU: "test9", Quantity: 0})
+		duplicated = update(&order.Item{SKU: "test2", Quantity: 1}, &order.Item{SKU: "test2", Quantity: 2})
+	}, time.Second)
+
+	env.RegisterDelayedCallback(func() {
+		env.SignalWorkflow(
+			order.CustomerActionSignalName,
+			order.CustomerActionSignal{
+				Action: order.CustomerActionAmend,
+			},
+		)
+	}, time.Second*2)
+
+	env.RegisterDelayedCallback(func() {
+		charged = update(&order.Item{SKU: "test2", Quantity: 1})
+	}, time.Second*3)
+
+	env.ExecuteWorkflow(
+		order.Order,
+		&orderInput,
+	)
+
+	var result order.OrderResult
+	require.NoError(t, env.GetWorkflowResult(&result))
+	assert.Equal(t, order.OrderStatusCompleted, result.Status)
+
+	assert.Equal(t, order.InvalidItemsUpdateErrorType, errorType(negative.rejected))
+	assert.Equal(t, order.InvalidItemsUpdateErrorType, errorType(missing.rejected))
+	assert.Equal(t, order.InvalidItemsUpdateErrorType, errorType(duplicated.rejected))
+	assert.Equal(t, order.ItemsLockedErrorType, errorType(charged.rejected))
+
+	var status order.OrderStatus
+	v, err := env.QueryWorkflow(order.StatusQuery, nil)
+	require.NoError(t, err)
+	require.NoError(t, v.Get(&status))
+	assert.Equal(t, []*order.Item{{SKU: "test2", Quantity: 3}}, status.Fulfillments[1].Items)
+}
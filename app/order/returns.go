@@ -0,0 +1,609 @@
+package order
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/temporalio/reference-app-orders-go/app/db"
+	"github.com/temporalio/reference-app-orders-go/app/shipment"
+	"go.temporal.io/api/enums/v1"
+	"go.temporal.io/api/serviceerror"
+	"go.temporal.io/sdk/client"
+	"go.temporal.io/sdk/log"
+	"go.temporal.io/sdk/workflow"
+)
+
+// ReturnWorkflowID returns the workflow ID for a Return.
+func ReturnWorkflowID(id string) string {
+	return "Return:" + id
+}
+
+// ReturnRequest is the body used to request the return of items from a completed fulfillment.
+type ReturnRequest struct {
+	FulfillmentID string  `json:"fulfillmentId"`
+	Items         []*Item `json:"items"`
+	Reason        string  `json:"reason,omitempty"`
+}
+
+// ReturnInput is the input for a Return workflow.
+type ReturnInput struct {
+	ID            string  `json:"id"`
+	OrderID       string  `json:"orderId"`
+	CustomerID    string  `json:"customerId"`
+	FulfillmentID string  `json:"fulfillmentId"`
+	Items         []*Item `json:"items"`
+	Reason        string  `json:"reason,omitempty"`
+
+	// Location is the warehouse the items were shipped from, and are returned to.
+	Location string `json:"location"`
+	// PickupAddress is the address the fulfillment was delivered to, where the items are collected from.
+	PickupAddress *Address `json:"pickupAddress,omitempty"`
+
+	// InvoiceReference is the invoice the returned items are refunded from.
+	InvoiceReference string `json:"invoiceReference"`
+}
+
+// ReturnStatus holds the status of a Return workflow.
+type ReturnStatus struct {
+	ID            string  `json:"id"`
+	OrderID       string  `json:"orderId"`
+	FulfillmentID string  `json:"fulfillmentId"`
+	Items         []*Item `json:"items"`
+	Reason        string  `json:"reason,omitempty"`
+
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+
+	// Shipment is the status of the shipment returning the items to the warehouse.
+	Shipment *ShipmentStatus `json:"shipment,omitempty"`
+
+	// Refund is set once the returned items have been refunded.
+	Refund *RefundResult `json:"refund,omitempty"`
+}
+
+// ReturnStatusUpdate is used to update a Return's status.
+type ReturnStatusUpdate struct {
+	ID      string `json:"id"`
+	OrderID string `json:"orderId"`
+	Status  string `json:"status"`
+}
+
+// ReturnSummary is an entry in the list of an Order's Returns.
+type ReturnSummary struct {
+	ID            string    `json:"id"`
+	FulfillmentID string    `json:"fulfillmentId"`
+	Items         []*Item   `json:"items"`
+	Status        string    `json:"status"`
+	CreatedAt     time.Time `json:"createdAt"`
+}
+
+// ReturnResult is the result of a Return workflow.
+type ReturnResult struct {
+	Status string `json:"status"`
+}
+
+const (
+	// ReturnStatusPending is the status of a Return which has been requested.
+	ReturnStatusPending = "pending"
+
+	// ReturnStatusShipping is the status of a Return whose items are being shipped back to the warehouse.
+	ReturnStatusShipping = "shipping"
+
+	// ReturnStatusReceived is the status of a Return whose items have been received by the warehouse.
+	ReturnStatusReceived = "received"
+
+	// ReturnStatusCompleted is the status of a Return whose items have been restocked and refunded.
+	ReturnStatusCompleted = "completed"
+
+	// ReturnStatusFailed is the status of a Return which could not be completed.
+	ReturnStatusFailed = "failed"
+)
+
+type returnImpl struct {
+	id               string
+	orderID          string
+	customerID       string
+	fulfillmentID    string
+	items            []*Item
+	reason           string
+	location         string
+	pickupAddress    *Address
+	invoiceReference string
+
+	status   string
+	error    string
+	shipment *ShipmentStatus
+	refund   *RefundResult
+
+	logger log.Logger
+}
+
+// Return Workflow returns items from a completed fulfillment to the warehouse, restocks them
+// and refunds the customer.
+func Return(ctx workflow.Context, input *ReturnInput) (*ReturnResult, error) {
+	wf := new(returnImpl)
+
+	if err := wf.setup(ctx, input); err != nil {
+		return nil, err
+	}
+
+	return wf.run(ctx)
+}
+
+func (wf *returnImpl) setup(ctx workflow.Context, input *ReturnInput) error {
+	if input.ID == "" || input.OrderID == "" || input.FulfillmentID == "" {
+		return fmt.Errorf("ID, OrderID and FulfillmentID are required")
+	}
+
+	if len(input.Items) == 0 {
+		return fmt.Errorf("return must contain items")
+	}
+
+	if input.InvoiceReference == "" {
+		return fmt.Errorf("InvoiceReference is required")
+	}
+
+	wf.id = input.ID
+	wf.orderID = input.OrderID
+	wf.customerID = input.CustomerID
+	wf.fulfillmentID = input.FulfillmentID
+	wf.items = input.Items
+	wf.reason = input.Reason
+	wf.location = input.Location
+	wf.pickupAddress = input.PickupAddress
+	wf.invoiceReference = input.InvoiceReference
+
+	wf.logger = log.With(
+		workflow.GetLogger(ctx),
+		"returnId", wf.id,
+		"orderId", wf.orderID,
+		"customerId", wf.customerID,
+		"fulfillment", wf.fulfillmentID,
+	)
+
+	return workflow.SetQueryHandler(ctx, StatusQuery, func() (*ReturnStatus, error) {
+		return &ReturnStatus{
+			ID:            wf.id,
+			OrderID:       wf.orderID,
+			FulfillmentID: wf.fulfillmentID,
+			Items:         wf.items,
+			Reason:        wf.reason,
+			Status:        wf.status,
+			Error:         wf.error,
+			Shipment:      wf.shipment,
+			Refund:        wf.refund,
+		}, nil
+	})
+}
+
+func (wf *returnImpl) run(ctx workflow.Context) (*ReturnResult, error) {
+	if err := wf.updateStatus(ctx, ReturnStatusPending); err != nil {
+		return nil, err
+	}
+
+	workflow.Go(ctx, wf.handleShipmentStatusUpdates)
+
+	if err := wf.updateStatus(ctx, ReturnStatusShipping); err != nil {
+		return nil, err
+	}
+
+	if err := wf.processShipment(ctx); err != nil {
+		return wf.fail(ctx, "return shipment failed", err)
+	}
+
+	if err := wf.updateStatus(ctx, ReturnStatusReceived); err != nil {
+		return nil, err
+	}
+
+	if err := wf.restock(ctx); err != nil {
+		return wf.fail(ctx, "restock failed", err)
+	}
+
+	if err := wf.processRefund(ctx); err != nil {
+		return wf.fail(ctx, "refund failed", err)
+	}
+
+	if err := wf.updateStatus(ctx, ReturnStatusCompleted); err != nil {
+		return nil, err
+	}
+
+	return &ReturnResult{Status: wf.status}, nil
+}
+
+// fail records that the return could not be completed.
+func (wf *returnImpl) fail(ctx workflow.Context, reason string, err error) (*ReturnResult, error) {
+	wf.logger.Error("Return failed", "reason", reason, "error", err)
+
+	wf.error = fmt.Sprintf("%s: %v", reason, err)
+	if err := wf.updateStatus(ctx, ReturnStatusFailed); err != nil {
+		return nil, err
+	}
+
+	return &ReturnResult{Status: wf.status}, nil
+}
+
+func (wf *returnImpl) updateStatus(ctx workflow.Context, status string) error {
+	wf.status = status
+
+	update := &ReturnStatusUpdate{
+		ID:      wf.id,
+		OrderID: wf.orderID,
+		Status:  wf.status,
+	}
+
+	ctx = workflow.WithLocalActivityOptions(ctx, workflow.LocalActivityOptions{
+		ScheduleToCloseTimeout: 5 * time.Second,
+	})
+	return workflow.ExecuteLocalActivity(ctx, a.UpdateReturnStatus, update).Get(ctx, nil)
+}
+
+func (wf *returnImpl) handleShipmentStatusUpdates(ctx workflow.Context) {
+	ch := workflow.GetSignalChannel(ctx, shipment.ShipmentStatusUpdatedSignalName)
+
+	for {
+		var signal shipment.ShipmentStatusUpdatedSignal
+		_ = ch.Receive(ctx, &signal)
+
+		if wf.shipment == nil || signal.ShipmentID != wf.shipment.ID {
+			continue
+		}
+		wf.shipment.update(signal)
+
+		wf.logger.Info("Return shipment status updated", "status", signal.Status)
+	}
+}
+
+// processShipment has the items collected from the customer and shipped back to the warehouse they were
+// sent from, waiting for them to be delivered.
+func (wf *returnImpl) processShipment(ctx workflow.Context) error {
+	ctx = workflow.WithChildOptions(ctx,
+		workflow.ChildWorkflowOptions{
+			TaskQueue:  shipment.TaskQueue,
+			WorkflowID: shipment.ShipmentWorkflowID(wf.id),
+		},
+	)
+
+	var shippingItems []shipment.Item
+	for _, i := range wf.items {
+		shippingItems = append(shippingItems, shipment.Item{SKU: i.SKU, Quantity: i.Quantity})
+	}
+
+	wf.shipment = &ShipmentStatus{
+		ID:        wf.id,
+		Status:    shipment.ShipmentStatusPending,
+		UpdatedAt: workflow.Now(ctx),
+	}
+
+	err := workflow.ExecuteChildWorkflow(ctx,
+		shipment.Shipment,
+		shipment.ShipmentInput{
+			RequestorWID: workflow.GetInfo(ctx).WorkflowExecution.ID,
+
+			ID:       wf.id,
+			Items:    shippingItems,
+			Location: wf.location,
+			Origin:   wf.pickupAddress,
+		},
+	).Get(ctx, nil)
+
+	wf.logger.Info("Return shipment processed", "status", wf.shipment.Status)
+
+	return err
+}
+
+func (wf *returnImpl) restock(ctx workflow.Context) error {
+	ctx = workflow.WithActivityOptions(ctx,
+		workflow.ActivityOptions{
+			StartToCloseTimeout: 30 * time.Second,
+		},
+	)
+
+	return workflow.ExecuteActivity(ctx,
+		a.RestockItems,
+		&RestockItemsInput{
+			Reference: wf.id,
+			Location:  wf.location,
+			Items:     wf.items,
+		},
+	).Get(ctx, nil)
+}
+
+func (wf *returnImpl) processRefund(ctx workflow.Context) error {
+	ctx = workflow.WithActivityOptions(ctx,
+		workflow.ActivityOptions{
+			StartToCloseTimeout: 10 * time.Second,
+		},
+	)
+
+	var refund RefundResult
+
+	err := workflow.ExecuteActivity(ctx,
+		a.RefundItems,
+		&RefundItemsInput{
+			InvoiceReference: wf.invoiceReference,
+			Reference:        wf.id,
+			Items:            wf.items,
+		},
+	).Get(ctx, &refund)
+	if err != nil {
+		return err
+	}
+
+	wf.refund = &refund
+
+	wf.logger.Info("Refund processed", "total", refund.Total)
+
+	return nil
+}
+
+// returnable returns the quantity of each SKU in a fulfillment which has not already been returned.
+// Failed returns do not count against the fulfillment.
+func returnable(f *Fulfillment, returns []ReturnSummary) map[string]int32 {
+	quantities := make(map[string]int32)
+	for _, i := range f.Items {
+		quantities[i.SKU] += i.Quantity
+	}
+
+	for _, r := range returns {
+		if r.FulfillmentID != f.ID || r.Status == ReturnStatusFailed {
+			continue
+		}
+		for _, i := range r.Items {
+			quantities[i.SKU] -= i.Quantity
+		}
+	}
+
+	return quantities
+}
+
+// getReturns returns the Returns requested for an Order, oldest first.
+func (h *handlers) getReturns(r *http.Request, orderID string) ([]ReturnSummary, error) {
+	var records []db.Return
+
+	if err := h.db.GetReturns(r.Context(), orderID, &records); err != nil {
+		return nil, err
+	}
+
+	return returnSummaries(records)
+}
+
+// returnSummaries converts the records of an Order's Returns to summaries.
+func returnSummaries(records []db.Return) ([]ReturnSummary, error) {
+	returns := make([]ReturnSummary, len(records))
+	for i, rec := range records {
+		returns[i] = ReturnSummary{
+			ID:            rec.ID,
+			FulfillmentID: rec.FulfillmentID,
+			Status:        rec.Status,
+			CreatedAt:     rec.CreatedAt,
+		}
+		if err := json.Unmarshal([]byte(rec.Items), &returns[i].Items); err != nil {
+			return nil, err
+		}
+	}
+
+	return returns, nil
+}
+
+func (h *handlers) handleCreateReturn(w http.ResponseWriter, r *http.Request) {
+	var req ReturnRequest
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		h.logger.Error("Failed to decode return request", "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.FulfillmentID == "" || len(req.Items) == 0 {
+		http.Error(w, "fulfillmentId and items are required", http.StatusBadRequest)
+		return
+	}
+	for _, i := range req.Items {
+		if i == nil || i.SKU == "" || i.Quantity <= 0 {
+			http.Error(w, "items must have a SKU and a positive quantity", http.StatusBadRequest)
+			return
+		}
+	}
+
+	orderID := r.PathValue("id")
+
+	status, err := h.getOrderStatus(r, orderID)
+	if err != nil {
+		if errors.As(err, new(*serviceerror.NotFound)) {
+			http.Error(w, "Order not found", http.StatusNotFound)
+		} else {
+			h.logger.Error("Failed to query order workflow", "error", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	var f *Fulfillment
+	for _, candidate := range status.Fulfillments {
+		if candidate.ID == req.FulfillmentID {
+			f = candidate
+		}
+	}
+	if f == nil {
+		http.Error(w, "Fulfillment not found", http.StatusBadRequest)
+		return
+	}
+	if f.Status != FulfillmentStatusCompleted || f.Payment == nil || f.Payment.InvoiceReference == "" {
+		http.Error(w, "Only completed fulfillments can be returned", http.StatusConflict)
+		return
+	}
+
+	input := ReturnInput{
+		ID:               uuid.NewString(),
+		OrderID:          orderID,
+		CustomerID:       status.CustomerID,
+		FulfillmentID:    f.ID,
+		Items:            req.Items,
+		Reason:           req.Reason,
+		Location:         f.Location,
+		PickupAddress:    f.ShippingAddress,
+		InvoiceReference: f.Payment.InvoiceReference,
+	}
+
+	items, err := json.Marshal(input.Items)
+	if err != nil {
+		h.logger.Error("Failed to encode return items", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// The items are checked against the fulfillment's other returns as the return is recorded,
+	// so that concurrent requests cannot return the same items twice.
+	var conflict string
+	check := func(records []db.Return) (bool, error) {
+		returns, err := returnSummaries(records)
+		if err != nil {
+			return false, err
+		}
+
+		remaining := returnable(f, returns)
+		for _, i := range req.Items {
+			if i.Quantity > remaining[i.SKU] {
+				conflict = fmt.Sprintf("Only %d of %s can be returned", max(remaining[i.SKU], 0), i.SKU)
+				return false, nil
+			}
+			remaining[i.SKU] -= i.Quantity
+		}
+
+		return true, nil
+	}
+
+	// Record the return before starting it so that it counts against the fulfillment straight away.
+	recorded, err := h.db.InsertReturn(r.Context(), &db.Return{
+		ID:            input.ID,
+		OrderID:       input.OrderID,
+		FulfillmentID: input.FulfillmentID,
+		Status:        ReturnStatusPending,
+		Items:         string(items),
+		CreatedAt:     time.Now().UTC(),
+	}, check)
+	if err != nil {
+		h.logger.Error("Failed to record return", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !recorded {
+		http.Error(w, conflict, http.StatusConflict)
+		return
+	}
+
+	_, err = h.temporal.ExecuteWorkflow(r.Context(),
+		client.StartWorkflowOptions{
+			TaskQueue:             TaskQueue,
+			ID:                    ReturnWorkflowID(input.ID),
+			WorkflowIDReusePolicy: enums.WORKFLOW_ID_REUSE_POLICY_REJECT_DUPLICATE,
+		},
+		Return,
+		&input,
+	)
+	if err != nil {
+		h.logger.Error("Failed to start return workflow", "error", err)
+		if err := h.db.UpdateReturnStatus(r.Context(), input.ID, ReturnStatusFailed); err != nil {
+			h.logger.Error("Failed to record return status", "error", err)
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Location", "/orders/"+orderID+"/returns/"+input.ID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+
+	err = json.NewEncoder(w).Encode(ReturnStatus{
+		ID:            input.ID,
+		OrderID:       input.OrderID,
+		FulfillmentID: input.FulfillmentID,
+		Items:         input.Items,
+		Reason:        input.Reason,
+		Status:        ReturnStatusPending,
+	})
+	if err != nil {
+		h.logger.Error("Failed to encode return status", "error", err)
+	}
+}
+
+func (h *handlers) handleListReturns(w http.ResponseWriter, r *http.Request) {
+	returns, err := h.getReturns(r, r.PathValue("id"))
+	if err != nil {
+		h.logger.Error("Failed to list returns", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(returns); err != nil {
+		h.logger.Error("Failed to encode returns", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (h *handlers) handleGetReturn(w http.ResponseWriter, r *http.Request) {
+	var status ReturnStatus
+
+	q, err := h.temporal.QueryWorkflow(r.Context(),
+		ReturnWorkflowID(r.PathValue("returnId")), "",
+		StatusQuery,
+	)
+	if err != nil {
+		if errors.As(err, new(*serviceerror.NotFound)) {
+			http.Error(w, "Return not found", http.StatusNotFound)
+		} else {
+			h.logger.Error("Failed to query return workflow", "error", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if err := q.Get(&status); err != nil {
+		h.logger.Error("Failed to get return query result", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if status.OrderID != r.PathValue("id") {
+		http.Error(w, "Return not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		h.logger.Error("Failed to encode return status", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (h *handlers) handleUpdateReturnStatus(w http.ResponseWriter, r *http.Request) {
+	var status ReturnStatusUpdate
+
+	err := json.NewDecoder(r.Body).Decode(&status)
+	if err != nil {
+		h.logger.Error("Failed to decode return status", "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = h.db.UpdateReturnStatus(r.Context(), r.PathValue("returnId"), status.Status)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			http.Error(w, "Return not found", http.StatusNotFound)
+		} else {
+			h.logger.Error("Failed to update return status", "error", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
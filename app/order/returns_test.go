@@ -0,0 +1,174 @@
+package order_test
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/temporalio/reference-app-orders-go/app/config"
+	"github.com/temporalio/reference-app-orders-go/app/db"
+	"github.com/temporalio/reference-app-orders-go/app/order"
+	"github.com/temporalio/reference-app-orders-go/app/shipment"
+	"go.temporal.io/sdk/mocks"
+	"go.temporal.io/sdk/temporal"
+	"go.temporal.io/sdk/testsuite"
+	"go.temporal.io/sdk/workflow"
+)
+
+func testReturnInput() *order.ReturnInput {
+	return &order.ReturnInput{
+		ID:               "return1",
+		OrderID:          "1234",
+		CustomerID:       "1234",
+		FulfillmentID:    "1234:1",
+		Items:            []*order.Item{{SKU: "test1", Quantity: 1}},
+		Reason:           "Too small",
+		Location:         "Warehouse A",
+		PickupAddress:    &order.Address{Line1: "1 High Street", City: "Leeds", PostalCode: "LS1 1AA", Country: "GB"},
+		InvoiceReference: "1234:1",
+	}
+}
+
+func TestReturnWorkflow(t *testing.T) {
+	s := testsuite.WorkflowTestSuite{}
+	env := s.NewTestWorkflowEnvironment()
+	var a *order.Activities
+
+	var statuses []string
+	env.OnActivity(a.UpdateReturnStatus, mock.Anything, mock.Anything).Return(func(ctx context.Context, input *order.ReturnStatusUpdate) error {
+		statuses = append(statuses, input.Status)
+		return nil
+	})
+	env.OnActivity(a.RestockItems, mock.Anything, mock.Anything).Return(func(ctx context.Context, input *order.RestockItemsInput) error {
+		assert.Equal(t, "Warehouse A", input.Location)
+		return nil
+	}).Once()
+	env.OnActivity(a.RefundItems, mock.Anything, mock.Anything).Return(func(ctx context.Context, input *order.RefundItemsInput) (*order.RefundResult, error) {
+		assert.Equal(t, "1234:1", input.InvoiceReference)
+		assert.Equal(t, "return1", input.Reference)
+		return &order.RefundResult{Reference: input.Reference, Total: 1200}, nil
+	}).Once()
+	env.OnWorkflow(shipment.Shipment, mock.Anything, mock.Anything).Return(func(ctx workflow.Context, input *shipment.ShipmentInput) (*shipment.ShipmentResult, error) {
+		// The items are collected from the customer and delivered to the warehouse.
+		assert.Equal(t, "Warehouse A", input.Location)
+		assert.Equal(t, "Leeds", input.Origin.City)
+		assert.Nil(t, input.Destination)
+		env.SignalWorkflow(
+			shipment.ShipmentStatusUpdatedSignalName,
+			shipment.ShipmentStatusUpdatedSignal{
+				ShipmentID:       input.ID,
+				Status:           shipment.ShipmentStatusDelivered,
+				UpdatedAt:        env.Now(),
+				CourierReference: "test",
+			},
+		)
+		return &shipment.ShipmentResult{CourierReference: "test"}, nil
+	}).Once()
+
+	env.ExecuteWorkflow(order.Return, testReturnInput())
+
+	var result order.ReturnResult
+	require.NoError(t, env.GetWorkflowResult(&result))
+	assert.Equal(t, order.ReturnStatusCompleted, result.Status)
+	assert.Equal(t, []string{
+		order.ReturnStatusPending,
+		order.ReturnStatusShipping,
+		order.ReturnStatusReceived,
+		order.ReturnStatusCompleted,
+	}, statuses)
+
+	v, err := env.QueryWorkflow(order.StatusQuery)
+	require.NoError(t, err)
+
+	var status order.ReturnStatus
+	require.NoError(t, v.Get(&status))
+	assert.Equal(t, shipment.ShipmentStatusDelivered, status.Shipment.Status)
+	assert.Equal(t, "test", status.Shipment.CourierReference)
+	require.NotNil(t, status.Refund)
+	assert.Equal(t, int32(1200), status.Refund.Total)
+}
+
+func TestReturnWorkflowShipmentFailed(t *testing.T) {
+	s := testsuite.WorkflowTestSuite{}
+	env := s.NewTestWorkflowEnvironment()
+	var a *order.Activities
+
+	env.OnActivity(a.UpdateReturnStatus, mock.Anything, mock.Anything).Return(nil)
+	env.OnWorkflow(shipment.Shipment, mock.Anything, mock.Anything).Return(
+		nil, temporal.NewNonRetryableApplicationError("shipment lost", shipment.ShipmentFailedErrorType, nil),
+	).Once()
+
+	env.ExecuteWorkflow(order.Return, testReturnInput())
+
+	var result order.ReturnResult
+	require.NoError(t, env.GetWorkflowResult(&result))
+	assert.Equal(t, order.ReturnStatusFailed, result.Status)
+
+	v, err := env.QueryWorkflow(order.StatusQuery)
+	require.NoError(t, err)
+
+	var status order.ReturnStatus
+	require.NoError(t, v.Get(&status))
+	assert.Contains(t, status.Error, "return shipment failed")
+
+	env.AssertNotCalled(t, "RefundItems", mock.Anything, mock.Anything)
+}
+
+func TestCreateReturnConcurrently(t *testing.T) {
+	store := db.CreateDB(config.AppConfig{SQLitePath: filepath.Join(t.TempDir(), "test.db")})
+	require.NoError(t, store.Connect(context.Background()))
+	require.NoError(t, store.Setup())
+	t.Cleanup(func() { store.Close() })
+
+	c := mocks.NewClient(t)
+	v := mocks.NewEncodedValue(t)
+
+	v.On("Get", mock.Anything).Return(func(ptr interface{}) error {
+		*ptr.(*order.OrderStatus) = order.OrderStatus{
+			ID:         "1234",
+			CustomerID: "customer1",
+			Fulfillments: []*order.Fulfillment{{
+				ID:       "1234:1",
+				Items:    []*order.Item{{SKU: "test1", Quantity: 1}},
+				Location: "Warehouse A",
+				Status:   order.FulfillmentStatusCompleted,
+				Payment:  &order.PaymentStatus{InvoiceReference: "1234:1"},
+			}},
+		}
+		return nil
+	})
+	c.On("QueryWorkflow", mock.Anything, order.OrderWorkflowID("1234"), "", order.StatusQuery).Return(v, nil)
+	c.On("ExecuteWorkflow", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(&mocks.WorkflowRun{}, nil).Once()
+
+	r := order.Router(c, store, slog.Default())
+
+	// Only one of the requests to return the fulfillment's only item is accepted.
+	codes := make([]int, 5)
+	var wg sync.WaitGroup
+	for i := range codes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			req := httptest.NewRequest(http.MethodPost, "/orders/1234/returns", strings.NewReader(`{"fulfillmentId":"1234:1","items":[{"sku":"test1","quantity":1}]}`))
+			rr := httptest.NewRecorder()
+			r.ServeHTTP(rr, req)
+			codes[i] = rr.Code
+		}()
+	}
+	wg.Wait()
+
+	assert.ElementsMatch(t, []int{http.StatusCreated, http.StatusConflict, http.StatusConflict, http.StatusConflict, http.StatusConflict}, codes)
+
+	var returns []db.Return
+	require.NoError(t, store.GetReturns(context.Background(), "1234", &returns))
+	assert.Len(t, returns, 1)
+}
@@ -0,0 +1,642 @@
+package order
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/robfig/cron"
+	"github.com/temporalio/reference-app-orders-go/app/db"
+	"go.temporal.io/api/enums/v1"
+	"go.temporal.io/api/serviceerror"
+	"go.temporal.io/sdk/client"
+	"go.temporal.io/sdk/log"
+	"go.temporal.io/sdk/temporal"
+	"go.temporal.io/sdk/workflow"
+)
+
+// SubscriptionWorkflowID returns the workflow ID for a Subscription.
+func SubscriptionWorkflowID(id string) string {
+	return "Subscription:" + id
+}
+
+// SubscriptionOrderID returns the ID of the nth order placed by a Subscription.
+func SubscriptionOrderID(id string, n int) string {
+	return fmt.Sprintf("%s-%d", id, n)
+}
+
+// SubscriptionActionUpdateName is the name of the update used to pause, resume, skip or cancel a Subscription.
+const SubscriptionActionUpdateName = "SubscriptionAction"
+
+const (
+	// InvalidSubscriptionActionErrorType is the error type for a subscription action which is not recognised.
+	InvalidSubscriptionActionErrorType = "InvalidSubscriptionAction"
+
+	// SubscriptionActionNotAllowedErrorType is the error type for a subscription action which does not apply
+	// to the subscription's current status, such as resuming a subscription which is not paused.
+	SubscriptionActionNotAllowedErrorType = "SubscriptionActionNotAllowed"
+)
+
+// maxSubscriptionOrdersPerRun is the number of orders after which the workflow continues
+// as new, to bound the size of its history.
+const maxSubscriptionOrdersPerRun = 50
+
+// maxSubscriptionHistory is the number of recent orders kept in a Subscription's status.
+const maxSubscriptionHistory = 100
+
+// SubscriptionInput is the input for a Subscription workflow.
+type SubscriptionInput struct {
+	ID         string  `json:"id"`
+	CustomerID string  `json:"customerId"`
+	Items      []*Item `json:"items"`
+
+	// Schedule is a cron expression, interpreted in UTC, for when orders are placed,
+	// such as "0 9 * * 1" for 9am every Monday. Descriptors such as "@monthly" are also accepted.
+	Schedule string `json:"schedule"`
+
+	// PaymentMethodID, ShippingPolicy, ShippingAddress and FulfillmentPolicy are passed to each order.
+	PaymentMethodID   string   `json:"paymentMethodId,omitempty"`
+	ShippingPolicy    string   `json:"shippingPolicy,omitempty"`
+	ShippingAddress   *Address `json:"shippingAddress,omitempty"`
+	FulfillmentPolicy string   `json:"fulfillmentPolicy,omitempty"`
+
+	// State is set when the workflow continues as new, to resume the subscription where it left off.
+	State *SubscriptionState `json:"state,omitempty"`
+}
+
+// SubscriptionState is the state of a Subscription, carried over when the workflow continues as new.
+type SubscriptionState struct {
+	Status      string              `json:"status"`
+	NextOrderAt *time.Time          `json:"nextOrderAt,omitempty"`
+	OrderCount  int                 `json:"orderCount"`
+	Orders      []SubscriptionOrder `json:"orders,omitempty"`
+}
+
+// SubscriptionOrder is an entry in a Subscription's history of orders.
+type SubscriptionOrder struct {
+	// ID is the ID of the order placed, empty if the order was skipped.
+	ID           string    `json:"id,omitempty"`
+	ScheduledFor time.Time `json:"scheduledFor"`
+	Status       string    `json:"status"`
+	Error        string    `json:"error,omitempty"`
+}
+
+// SubscriptionStatus holds the status of a Subscription workflow.
+type SubscriptionStatus struct {
+	ID         string  `json:"id"`
+	CustomerID string  `json:"customerId"`
+	Items      []*Item `json:"items"`
+	Schedule   string  `json:"schedule"`
+
+	Status string `json:"status"`
+	// NextOrderAt is when the next order is placed, unless the subscription is paused or cancelled.
+	NextOrderAt *time.Time `json:"nextOrderAt,omitempty"`
+
+	// OrderCount is the number of orders placed since the subscription started.
+	OrderCount int `json:"orderCount"`
+	// Orders lists the subscription's most recent orders, including skipped ones, oldest first.
+	Orders []SubscriptionOrder `json:"orders"`
+}
+
+// SubscriptionAction is the body of the update used to pause, resume, skip or cancel a Subscription.
+type SubscriptionAction struct {
+	Action string `json:"action"`
+}
+
+// SubscriptionOrderRecord is used to record an order placed by a Subscription.
+type SubscriptionOrderRecord struct {
+	SubscriptionID string    `json:"subscriptionId"`
+	ID             string    `json:"id"`
+	CustomerID     string    `json:"customerId"`
+	ReceivedAt     time.Time `json:"receivedAt"`
+}
+
+// SubscriptionResult is the result of a Subscription workflow.
+type SubscriptionResult struct {
+	Status     string `json:"status"`
+	OrderCount int    `json:"orderCount"`
+}
+
+const (
+	// SubscriptionStatusActive is the status of a Subscription which is placing orders.
+	SubscriptionStatusActive = "active"
+
+	// SubscriptionStatusPaused is the status of a Subscription which is not placing orders until it is resumed.
+	SubscriptionStatusPaused = "paused"
+
+	// SubscriptionStatusCancelled is the status of a cancelled Subscription.
+	SubscriptionStatusCancelled = "cancelled"
+)
+
+const (
+	// SubscriptionActionPause stops a Subscription placing orders until it is resumed.
+	SubscriptionActionPause = "pause"
+
+	// SubscriptionActionResume restarts a paused Subscription from its next scheduled time.
+	// Orders which would have been placed while it was paused are not placed.
+	SubscriptionActionResume = "resume"
+
+	// SubscriptionActionSkip skips a Subscription's next order.
+	SubscriptionActionSkip = "skip"
+
+	// SubscriptionActionCancel cancels a Subscription. Orders it has already placed are not affected.
+	SubscriptionActionCancel = "cancel"
+)
+
+const (
+	// SubscriptionOrderStatusPlaced is the status of a subscription order which has been placed.
+	SubscriptionOrderStatusPlaced = "placed"
+
+	// SubscriptionOrderStatusSkipped is the status of a subscription order which the customer skipped.
+	SubscriptionOrderStatusSkipped = "skipped"
+
+	// SubscriptionOrderStatusFailed is the status of a subscription order which could not be placed.
+	SubscriptionOrderStatusFailed = "failed"
+)
+
+type subscriptionImpl struct {
+	id         string
+	customerID string
+	items      []*Item
+	schedule   cron.Schedule
+
+	status      string
+	nextOrderAt *time.Time
+	orderCount  int
+	orders      []SubscriptionOrder
+
+	// runOrders counts the orders placed during this run of the workflow.
+	runOrders int
+	// changes counts the actions applied, so that waits can be interrupted by them.
+	changes int
+
+	logger log.Logger
+}
+
+// Subscription Workflow places an Order for the subscription's items on a schedule, until it is cancelled.
+// It continues as new periodically, so a subscription may run for years.
+func Subscription(ctx workflow.Context, input *SubscriptionInput) (*SubscriptionResult, error) {
+	wf := new(subscriptionImpl)
+
+	if err := wf.setup(ctx, input); err != nil {
+		return nil, err
+	}
+
+	return wf.run(ctx, input)
+}
+
+func (wf *subscriptionImpl) setup(ctx workflow.Context, input *SubscriptionInput) error {
+	if input.ID == "" {
+		return fmt.Errorf("ID is required")
+	}
+
+	if input.CustomerID == "" {
+		return fmt.Errorf("CustomerID is required")
+	}
+
+	if len(input.Items) == 0 {
+		return fmt.Errorf("subscription must contain items")
+	}
+
+	schedule, err := cron.ParseStandard(input.Schedule)
+	if err != nil {
+		return fmt.Errorf("invalid schedule %q: %w", input.Schedule, err)
+	}
+
+	wf.id = input.ID
+	wf.customerID = input.CustomerID
+	wf.items = input.Items
+	wf.schedule = schedule
+
+	if input.State != nil {
+		wf.status = input.State.Status
+		wf.nextOrderAt = input.State.NextOrderAt
+		wf.orderCount = input.State.OrderCount
+		wf.orders = input.State.Orders
+	} else {
+		wf.status = SubscriptionStatusActive
+	}
+	if wf.status == SubscriptionStatusActive && wf.nextOrderAt == nil {
+		wf.nextOrderAt = wf.next(workflow.Now(ctx))
+	}
+
+	wf.logger = log.With(
+		workflow.GetLogger(ctx),
+		"subscriptionId", wf.id,
+		"customerId", wf.customerID,
+	)
+
+	err = workflow.SetQueryHandler(ctx, StatusQuery, func() (*SubscriptionStatus, error) {
+		return wf.subscriptionStatus(input.Schedule), nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return workflow.SetUpdateHandlerWithOptions(ctx, SubscriptionActionUpdateName,
+		func(ctx workflow.Context, action SubscriptionAction) (*SubscriptionStatus, error) {
+			wf.apply(ctx, action)
+			return wf.subscriptionStatus(input.Schedule), nil
+		},
+		workflow.UpdateHandlerOptions{
+			Validator: wf.validateAction,
+		},
+	)
+}
+
+func (wf *subscriptionImpl) subscriptionStatus(schedule string) *SubscriptionStatus {
+	orders := wf.orders
+	if orders == nil {
+		orders = []SubscriptionOrder{}
+	}
+
+	return &SubscriptionStatus{
+		ID:          wf.id,
+		CustomerID:  wf.customerID,
+		Items:       wf.items,
+		Schedule:    schedule,
+		Status:      wf.status,
+		NextOrderAt: wf.nextOrderAt,
+		OrderCount:  wf.orderCount,
+		Orders:      orders,
+	}
+}
+
+// next returns the first scheduled time after t.
+func (wf *subscriptionImpl) next(t time.Time) *time.Time {
+	next := wf.schedule.Next(t.UTC())
+	return &next
+}
+
+func (wf *subscriptionImpl) validateAction(action SubscriptionAction) error {
+	switch action.Action {
+	case SubscriptionActionPause, SubscriptionActionResume, SubscriptionActionSkip, SubscriptionActionCancel:
+	default:
+		return temporal.NewApplicationError(fmt.Sprintf("invalid action %q", action.Action), InvalidSubscriptionActionErrorType)
+	}
+
+	allowed := false
+	switch wf.status {
+	case SubscriptionStatusActive:
+		allowed = action.Action != SubscriptionActionResume
+	case SubscriptionStatusPaused:
+		allowed = action.Action == SubscriptionActionResume || action.Action == SubscriptionActionCancel
+	}
+	if !allowed {
+		return temporal.NewApplicationError(fmt.Sprintf("cannot %s a subscription which is %s", action.Action, wf.status), SubscriptionActionNotAllowedErrorType)
+	}
+
+	return nil
+}
+
+// apply applies a validated action to the subscription.
+func (wf *subscriptionImpl) apply(ctx workflow.Context, action SubscriptionAction) {
+	switch action.Action {
+	case SubscriptionActionPause:
+		wf.status = SubscriptionStatusPaused
+		wf.nextOrderAt = nil
+	case SubscriptionActionResume:
+		wf.status = SubscriptionStatusActive
+		wf.nextOrderAt = wf.next(workflow.Now(ctx))
+	case SubscriptionActionSkip:
+		wf.record(SubscriptionOrder{ScheduledFor: *wf.nextOrderAt, Status: SubscriptionOrderStatusSkipped})
+		wf.nextOrderAt = wf.next(*wf.nextOrderAt)
+	case SubscriptionActionCancel:
+		wf.status = SubscriptionStatusCancelled
+		wf.nextOrderAt = nil
+	}
+
+	wf.changes++
+
+	wf.logger.Info("Subscription action applied", "action", action.Action, "status", wf.status)
+}
+
+// record adds an order to the subscription's history, dropping the oldest once it is full.
+func (wf *subscriptionImpl) record(order SubscriptionOrder) {
+	wf.orders = append(wf.orders, order)
+	if len(wf.orders) > maxSubscriptionHistory {
+		wf.orders = wf.orders[len(wf.orders)-maxSubscriptionHistory:]
+	}
+}
+
+func (wf *subscriptionImpl) run(ctx workflow.Context, input *SubscriptionInput) (*SubscriptionResult, error) {
+	for wf.status != SubscriptionStatusCancelled {
+		if wf.shouldContinueAsNew(ctx) {
+			return nil, wf.continueAsNew(ctx, input)
+		}
+
+		changes := wf.changes
+		changed := func() bool { return wf.changes != changes }
+
+		if wf.status == SubscriptionStatusPaused {
+			if err := workflow.Await(ctx, changed); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if wait := wf.nextOrderAt.Sub(workflow.Now(ctx)); wait > 0 {
+			ok, err := workflow.AwaitWithTimeout(ctx, wait, changed)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				continue
+			}
+		}
+
+		// Actions taken while the order is placed apply to the orders after it, so a skip does not
+		// skip the order being placed.
+		scheduledFor := *wf.nextOrderAt
+		wf.nextOrderAt = wf.next(scheduledFor)
+		changes = wf.changes
+
+		wf.placeOrder(ctx, input, scheduledFor)
+
+		// Orders are placed from the next scheduled time, rather than catching up on any missed
+		// while the workflow could not run, unless an action has already set when the next order is placed.
+		if !changed() {
+			wf.nextOrderAt = wf.next(workflow.Now(ctx))
+		}
+	}
+
+	return &SubscriptionResult{Status: wf.status, OrderCount: wf.orderCount}, nil
+}
+
+// placeOrder records the subscription's order scheduled for a time and starts it as a child workflow.
+// The order is not waited for, and carries on if the subscription is cancelled. An order which cannot
+// be recorded or started is added to the subscription's history as failed, and the subscription carries on.
+func (wf *subscriptionImpl) placeOrder(ctx workflow.Context, input *SubscriptionInput, scheduledFor time.Time) {
+	wf.orderCount++
+	wf.runOrders++
+
+	entry := SubscriptionOrder{
+		ID:           SubscriptionOrderID(wf.id, wf.orderCount),
+		ScheduledFor: scheduledFor,
+		Status:       SubscriptionOrderStatusPlaced,
+	}
+
+	// The order is only placed once it is recorded, so the Order API is given a while to recover.
+	lctx := workflow.WithLocalActivityOptions(ctx, workflow.LocalActivityOptions{
+		ScheduleToCloseTimeout: 5 * time.Minute,
+		RetryPolicy: &temporal.RetryPolicy{
+			InitialInterval:    time.Second,
+			BackoffCoefficient: 2,
+			MaximumInterval:    30 * time.Second,
+		},
+	})
+	err := workflow.ExecuteLocalActivity(lctx,
+		a.RecordSubscriptionOrder,
+		&SubscriptionOrderRecord{
+			SubscriptionID: wf.id,
+			ID:             entry.ID,
+			CustomerID:     wf.customerID,
+			ReceivedAt:     workflow.Now(ctx),
+		},
+	).Get(ctx, nil)
+	if err != nil {
+		wf.logger.Error("Failed to record subscription order", "orderId", entry.ID, "error", err)
+		entry.Status = SubscriptionOrderStatusFailed
+		entry.Error = err.Error()
+		wf.record(entry)
+		return
+	}
+
+	cctx := workflow.WithChildOptions(ctx,
+		workflow.ChildWorkflowOptions{
+			TaskQueue:             TaskQueue,
+			WorkflowID:            OrderWorkflowID(entry.ID),
+			WorkflowIDReusePolicy: enums.WORKFLOW_ID_REUSE_POLICY_REJECT_DUPLICATE,
+			ParentClosePolicy:     enums.PARENT_CLOSE_POLICY_ABANDON,
+		},
+	)
+
+	err = workflow.ExecuteChildWorkflow(cctx,
+		Order,
+		&OrderInput{
+			ID:                entry.ID,
+			CustomerID:        wf.customerID,
+			Items:             wf.items,
+			PaymentMethodID:   input.PaymentMethodID,
+			ShippingPolicy:    input.ShippingPolicy,
+			ShippingAddress:   input.ShippingAddress,
+			FulfillmentPolicy: input.FulfillmentPolicy,
+		},
+	).GetChildWorkflowExecution().Get(ctx, nil)
+	if err != nil {
+		wf.logger.Error("Failed to place subscription order", "orderId", entry.ID, "error", err)
+		entry.Status = SubscriptionOrderStatusFailed
+		entry.Error = err.Error()
+	} else {
+		wf.logger.Info("Subscription order placed", "orderId", entry.ID)
+	}
+
+	wf.record(entry)
+}
+
+func (wf *subscriptionImpl) shouldContinueAsNew(ctx workflow.Context) bool {
+	return wf.runOrders >= maxSubscriptionOrdersPerRun || workflow.GetInfo(ctx).GetContinueAsNewSuggested()
+}
+
+// continueAsNew carries the subscription's schedule and history into a new run, once any actions
+// in progress have been applied.
+func (wf *subscriptionImpl) continueAsNew(ctx workflow.Context, input *SubscriptionInput) error {
+	if err := workflow.Await(ctx, func() bool { return workflow.AllHandlersFinished(ctx) }); err != nil {
+		return err
+	}
+
+	wf.logger.Info("Continuing as new", "orders", wf.orderCount)
+
+	next := *input
+	next.State = &SubscriptionState{
+		Status:      wf.status,
+		NextOrderAt: wf.nextOrderAt,
+		OrderCount:  wf.orderCount,
+		Orders:      wf.orders,
+	}
+
+	return workflow.NewContinueAsNewError(ctx, Subscription, &next)
+}
+
+// RecordSubscriptionOrder stores an order placed by a Subscription to the database, so that it is listed with other orders.
+func (a *Activities) RecordSubscriptionOrder(ctx context.Context, record *SubscriptionOrderRecord) error {
+	jsonInput, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("unable to encode order: %w", err)
+	}
+
+	u := a.OrderURL + "/subscriptions/" + url.PathEscape(record.SubscriptionID) + "/orders"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(jsonInput))
+	if err != nil {
+		return fmt.Errorf("unable to build request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		body, _ := io.ReadAll(res.Body)
+		return fmt.Errorf("%s: %s", http.StatusText(res.StatusCode), body)
+	}
+
+	return nil
+}
+
+func (h *handlers) handleCreateSubscription(w http.ResponseWriter, r *http.Request) {
+	var input SubscriptionInput
+
+	err := json.NewDecoder(r.Body).Decode(&input)
+	if err != nil {
+		h.logger.Error("Failed to decode subscription input", "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if input.ID == "" || input.CustomerID == "" || len(input.Items) == 0 {
+		http.Error(w, "id, customerId and items are required", http.StatusBadRequest)
+		return
+	}
+	if _, err := cron.ParseStandard(input.Schedule); err != nil {
+		http.Error(w, fmt.Sprintf("invalid schedule: %v", err), http.StatusBadRequest)
+		return
+	}
+	// The policies are passed to each order, which would fail if it did not accept them.
+	if err := validatePolicies(input.ShippingPolicy, input.FulfillmentPolicy); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	input.State = nil
+
+	_, err = h.temporal.ExecuteWorkflow(r.Context(),
+		client.StartWorkflowOptions{
+			TaskQueue:             TaskQueue,
+			ID:                    SubscriptionWorkflowID(input.ID),
+			WorkflowIDReusePolicy: enums.WORKFLOW_ID_REUSE_POLICY_REJECT_DUPLICATE,
+		},
+		Subscription,
+		&input,
+	)
+	if err != nil {
+		if errors.As(err, new(*serviceerror.WorkflowExecutionAlreadyStarted)) {
+			http.Error(w, "Subscription already exists", http.StatusConflict)
+			return
+		}
+		h.logger.Error("Failed to start subscription workflow", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Location", "/subscriptions/"+input.ID)
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (h *handlers) handleGetSubscription(w http.ResponseWriter, r *http.Request) {
+	var status SubscriptionStatus
+
+	q, err := h.temporal.QueryWorkflow(r.Context(),
+		SubscriptionWorkflowID(r.PathValue("id")), "",
+		StatusQuery,
+	)
+	if err == nil {
+		err = q.Get(&status)
+	}
+	if err != nil {
+		if errors.As(err, new(*serviceerror.NotFound)) {
+			http.Error(w, "Subscription not found", http.StatusNotFound)
+		} else {
+			h.logger.Error("Failed to query subscription workflow", "error", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		h.logger.Error("Failed to encode subscription status", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (h *handlers) handleSubscriptionAction(w http.ResponseWriter, r *http.Request) {
+	var action SubscriptionAction
+
+	err := json.NewDecoder(r.Body).Decode(&action)
+	if err != nil {
+		h.logger.Error("Failed to decode subscription action", "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var status SubscriptionStatus
+
+	handle, err := h.temporal.UpdateWorkflow(r.Context(), client.UpdateWorkflowOptions{
+		WorkflowID:   SubscriptionWorkflowID(r.PathValue("id")),
+		UpdateName:   SubscriptionActionUpdateName,
+		Args:         []interface{}{action},
+		WaitForStage: client.WorkflowUpdateStageCompleted,
+	})
+	if err == nil {
+		err = handle.Get(r.Context(), &status)
+	}
+	if err != nil {
+		var appErr *temporal.ApplicationError
+		switch {
+		case errors.As(err, new(*serviceerror.NotFound)):
+			http.Error(w, "Subscription not found", http.StatusNotFound)
+		case errors.As(err, &appErr) && appErr.Type() == InvalidSubscriptionActionErrorType:
+			http.Error(w, appErr.Message(), http.StatusBadRequest)
+		case errors.As(err, &appErr) && appErr.Type() == SubscriptionActionNotAllowedErrorType:
+			http.Error(w, appErr.Message(), http.StatusConflict)
+		default:
+			h.logger.Error("Failed to update subscription", "error", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		h.logger.Error("Failed to encode subscription status", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (h *handlers) handleRecordSubscriptionOrder(w http.ResponseWriter, r *http.Request) {
+	var record SubscriptionOrderRecord
+
+	err := json.NewDecoder(r.Body).Decode(&record)
+	if err != nil {
+		h.logger.Error("Failed to decode subscription order", "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	status := &db.OrderStatus{
+		ID:         record.ID,
+		CustomerID: record.CustomerID,
+		ReceivedAt: record.ReceivedAt.UTC(),
+		Status:     OrderStatusPending,
+	}
+
+	err = h.db.InsertOrder(r.Context(), status)
+	if err != nil {
+		h.logger.Error("Failed to record subscription order", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,310 @@
+package order_test
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/temporalio/reference-app-orders-go/app/order"
+	"go.temporal.io/sdk/converter"
+	"go.temporal.io/sdk/mocks"
+	"go.temporal.io/sdk/temporal"
+	"go.temporal.io/sdk/testsuite"
+	"go.temporal.io/sdk/workflow"
+)
+
+func TestSubscriptionPlacesOrders(t *testing.T) {
+	s := testsuite.WorkflowTestSuite{}
+	env := s.NewTestWorkflowEnvironment()
+	var a *order.Activities
+
+	start := time.Date(2026, 1, 1, 8, 0, 0, 0, time.UTC)
+	env.SetStartTime(start)
+
+	var records []*order.SubscriptionOrderRecord
+	env.OnActivity(a.RecordSubscriptionOrder, mock.Anything, mock.Anything).Return(func(ctx context.Context, record *order.SubscriptionOrderRecord) error {
+		records = append(records, record)
+		return nil
+	})
+
+	var placed []*order.OrderInput
+	env.RegisterWorkflowWithOptions(func(ctx workflow.Context, input *order.OrderInput) (*order.OrderResult, error) {
+		placed = append(placed, input)
+		return &order.OrderResult{Status: order.OrderStatusCompleted}, nil
+	}, workflow.RegisterOptions{Name: "Order"})
+
+	action := func(at time.Duration, name string, u *updateCallbacks) {
+		env.RegisterDelayedCallback(func() {
+			env.UpdateWorkflow(order.SubscriptionActionUpdateName, name, u, order.SubscriptionAction{Action: name})
+		}, at)
+	}
+
+	// Skip the order due at 9am on the 1st, pause after the order on the 2nd, then resume on the afternoon
+	// of the 4th so that the next order is on the 5th.
+	skip, pause, resume, cancel := &updateCallbacks{}, &updateCallbacks{}, &updateCallbacks{}, &updateCallbacks{}
+	action(time.Hour/2, order.SubscriptionActionSkip, skip)
+	action(30*time.Hour, order.SubscriptionActionPause, pause)
+	action(80*time.Hour, order.SubscriptionActionResume, resume)
+	action(98*time.Hour, order.SubscriptionActionCancel, cancel)
+
+	env.ExecuteWorkflow(
+		order.Subscription,
+		&order.SubscriptionInput{
+			ID:         "sub1",
+			CustomerID: "customer1",
+			Items:      []*order.Item{{SKU: "coffee", Quantity: 2}},
+			Schedule:   "0 9 * * *",
+		},
+	)
+
+	require.True(t, env.IsWorkflowCompleted())
+	require.NoError(t, env.GetWorkflowError())
+
+	var result order.SubscriptionResult
+	require.NoError(t, env.GetWorkflowResult(&result))
+	assert.Equal(t, order.SubscriptionStatusCancelled, result.Status)
+	assert.Equal(t, 2, result.OrderCount)
+
+	for _, u := range []*updateCallbacks{skip, pause, resume, cancel} {
+		require.NoError(t, u.rejected)
+		require.True(t, u.completed)
+		require.NoError(t, u.err)
+	}
+
+	require.Len(t, placed, 2)
+	assert.Equal(t, "sub1-1", placed[0].ID)
+	assert.Equal(t, "customer1", placed[0].CustomerID)
+	assert.Equal(t, "coffee", placed[0].Items[0].SKU)
+	assert.Equal(t, "sub1-2", placed[1].ID)
+
+	require.Len(t, records, 2)
+	assert.Equal(t, "sub1", records[0].SubscriptionID)
+	assert.Equal(t, "sub1-1", records[0].ID)
+
+	status := cancel.result.(*order.SubscriptionStatus)
+	assert.Nil(t, status.NextOrderAt)
+	assert.Equal(t, []order.SubscriptionOrder{
+		{ScheduledFor: start.Add(time.Hour), Status: order.SubscriptionOrderStatusSkipped},
+		{ID: "sub1-1", ScheduledFor: start.Add(25 * time.Hour), Status: order.SubscriptionOrderStatusPlaced},
+		{ID: "sub1-2", ScheduledFor: start.Add(97 * time.Hour), Status: order.SubscriptionOrderStatusPlaced},
+	}, status.Orders)
+}
+
+func TestSubscriptionActionsWhilePlacingOrder(t *testing.T) {
+	s := testsuite.WorkflowTestSuite{}
+	env := s.NewTestWorkflowEnvironment()
+	var a *order.Activities
+
+	start := time.Date(2026, 1, 1, 8, 0, 0, 0, time.UTC)
+	env.SetStartTime(start)
+
+	// Recording the order takes a while, so the customer acts while it is being placed.
+	env.OnActivity(a.RecordSubscriptionOrder, mock.Anything, mock.Anything).After(time.Minute).Return(nil)
+	env.RegisterWorkflowWithOptions(func(ctx workflow.Context, input *order.OrderInput) (*order.OrderResult, error) {
+		return &order.OrderResult{Status: order.OrderStatusCompleted}, nil
+	}, workflow.RegisterOptions{Name: "Order"})
+
+	skip, pause, cancel := &updateCallbacks{}, &updateCallbacks{}, &updateCallbacks{}
+	env.RegisterDelayedCallback(func() {
+		env.UpdateWorkflow(order.SubscriptionActionUpdateName, "skip", skip, order.SubscriptionAction{Action: order.SubscriptionActionSkip})
+	}, time.Hour+20*time.Second)
+	env.RegisterDelayedCallback(func() {
+		env.UpdateWorkflow(order.SubscriptionActionUpdateName, "pause", pause, order.SubscriptionAction{Action: order.SubscriptionActionPause})
+	}, time.Hour+40*time.Second)
+	env.RegisterDelayedCallback(func() {
+		env.UpdateWorkflow(order.SubscriptionActionUpdateName, "cancel", cancel, order.SubscriptionAction{Action: order.SubscriptionActionCancel})
+	}, 2*time.Hour)
+
+	env.ExecuteWorkflow(
+		order.Subscription,
+		&order.SubscriptionInput{
+			ID:         "sub1",
+			CustomerID: "customer1",
+			Items:      []*order.Item{{SKU: "coffee", Quantity: 1}},
+			Schedule:   "0 9 * * *",
+		},
+	)
+
+	require.True(t, env.IsWorkflowCompleted())
+	require.NoError(t, env.GetWorkflowError())
+
+	for _, u := range []*updateCallbacks{skip, pause, cancel} {
+		require.NoError(t, u.rejected)
+		require.True(t, u.completed)
+	}
+
+	// The skip applies to the order after the one being placed, and the pause is not undone once it is placed.
+	paused := pause.result.(*order.SubscriptionStatus)
+	assert.Equal(t, order.SubscriptionStatusPaused, paused.Status)
+	assert.Nil(t, paused.NextOrderAt)
+
+	status := cancel.result.(*order.SubscriptionStatus)
+	assert.Equal(t, []order.SubscriptionOrder{
+		{ScheduledFor: start.Add(25 * time.Hour), Status: order.SubscriptionOrderStatusSkipped},
+		{ID: "sub1-1", ScheduledFor: start.Add(time.Hour), Status: order.SubscriptionOrderStatusPlaced},
+	}, status.Orders)
+	assert.Equal(t, 1, status.OrderCount)
+}
+
+func TestSubscriptionRecordOrderFails(t *testing.T) {
+	s := testsuite.WorkflowTestSuite{}
+	env := s.NewTestWorkflowEnvironment()
+	var a *order.Activities
+
+	start := time.Date(2026, 1, 1, 8, 0, 0, 0, time.UTC)
+	env.SetStartTime(start)
+
+	env.OnActivity(a.RecordSubscriptionOrder, mock.Anything, mock.Anything).Return(temporal.NewNonRetryableApplicationError("unavailable", "test", nil)).Once()
+	env.OnActivity(a.RecordSubscriptionOrder, mock.Anything, mock.Anything).Return(nil)
+
+	var placed []*order.OrderInput
+	env.RegisterWorkflowWithOptions(func(ctx workflow.Context, input *order.OrderInput) (*order.OrderResult, error) {
+		placed = append(placed, input)
+		return &order.OrderResult{Status: order.OrderStatusCompleted}, nil
+	}, workflow.RegisterOptions{Name: "Order"})
+
+	cancel := &updateCallbacks{}
+	env.RegisterDelayedCallback(func() {
+		env.UpdateWorkflow(order.SubscriptionActionUpdateName, "cancel", cancel, order.SubscriptionAction{Action: order.SubscriptionActionCancel})
+	}, 26*time.Hour)
+
+	env.ExecuteWorkflow(
+		order.Subscription,
+		&order.SubscriptionInput{
+			ID:         "sub1",
+			CustomerID: "customer1",
+			Items:      []*order.Item{{SKU: "coffee", Quantity: 1}},
+			Schedule:   "0 9 * * *",
+		},
+	)
+
+	require.True(t, env.IsWorkflowCompleted())
+	require.NoError(t, env.GetWorkflowError())
+
+	// The order which could not be recorded is not placed, and the subscription carries on.
+	require.Len(t, placed, 1)
+	assert.Equal(t, "sub1-2", placed[0].ID)
+
+	status := cancel.result.(*order.SubscriptionStatus)
+	require.Len(t, status.Orders, 2)
+	assert.Equal(t, "sub1-1", status.Orders[0].ID)
+	assert.Equal(t, order.SubscriptionOrderStatusFailed, status.Orders[0].Status)
+	assert.Contains(t, status.Orders[0].Error, "unavailable")
+	assert.Equal(t, order.SubscriptionOrderStatusPlaced, status.Orders[1].Status)
+}
+
+func TestSubscriptionActionRejected(t *testing.T) {
+	s := testsuite.WorkflowTestSuite{}
+	env := s.NewTestWorkflowEnvironment()
+
+	env.SetStartTime(time.Date(2026, 1, 1, 8, 0, 0, 0, time.UTC))
+
+	resume, invalid, cancel := &updateCallbacks{}, &updateCallbacks{}, &updateCallbacks{}
+	env.RegisterDelayedCallback(func() {
+		env.UpdateWorkflow(order.SubscriptionActionUpdateName, "resume", resume, order.SubscriptionAction{Action: order.SubscriptionActionResume})
+		env.UpdateWorkflow(order.SubscriptionActionUpdateName, "invalid", invalid, order.SubscriptionAction{Action: "double"})
+		env.UpdateWorkflow(order.SubscriptionActionUpdateName, "cancel", cancel, order.SubscriptionAction{Action: order.SubscriptionActionCancel})
+	}, time.Minute)
+
+	env.ExecuteWorkflow(
+		order.Subscription,
+		&order.SubscriptionInput{
+			ID:         "sub1",
+			CustomerID: "customer1",
+			Items:      []*order.Item{{SKU: "coffee", Quantity: 1}},
+			Schedule:   "@weekly",
+		},
+	)
+
+	require.True(t, env.IsWorkflowCompleted())
+	require.NoError(t, env.GetWorkflowError())
+
+	assert.Equal(t, order.SubscriptionActionNotAllowedErrorType, errorType(resume.rejected))
+	assert.Equal(t, order.InvalidSubscriptionActionErrorType, errorType(invalid.rejected))
+	require.NoError(t, cancel.rejected)
+	require.True(t, cancel.completed)
+}
+
+func TestSubscriptionContinuesAsNew(t *testing.T) {
+	s := testsuite.WorkflowTestSuite{}
+	env := s.NewTestWorkflowEnvironment()
+	var a *order.Activities
+
+	start := time.Date(2026, 1, 1, 0, 30, 0, 0, time.UTC)
+	env.SetStartTime(start)
+	next := start.Add(30 * time.Minute)
+
+	env.OnActivity(a.RecordSubscriptionOrder, mock.Anything, mock.Anything).Return(nil)
+
+	placed := 0
+	env.RegisterWorkflowWithOptions(func(ctx workflow.Context, input *order.OrderInput) (*order.OrderResult, error) {
+		placed++
+		return &order.OrderResult{Status: order.OrderStatusCompleted}, nil
+	}, workflow.RegisterOptions{Name: "Order"})
+
+	env.ExecuteWorkflow(
+		order.Subscription,
+		&order.SubscriptionInput{
+			ID:         "sub1",
+			CustomerID: "customer1",
+			Items:      []*order.Item{{SKU: "coffee", Quantity: 1}},
+			Schedule:   "@hourly",
+			State: &order.SubscriptionState{
+				Status:      order.SubscriptionStatusActive,
+				NextOrderAt: &next,
+				OrderCount:  7,
+				Orders:      []order.SubscriptionOrder{{ID: "sub1-7", ScheduledFor: start.Add(-time.Hour), Status: order.SubscriptionOrderStatusPlaced}},
+			},
+		},
+	)
+
+	require.True(t, env.IsWorkflowCompleted())
+
+	var canErr *workflow.ContinueAsNewError
+	require.ErrorAs(t, env.GetWorkflowError(), &canErr)
+
+	var input order.SubscriptionInput
+	require.NoError(t, converter.GetDefaultDataConverter().FromPayloads(canErr.Input, &input))
+
+	require.NotNil(t, input.State)
+	assert.Equal(t, order.SubscriptionStatusActive, input.State.Status)
+	// The run continues as new after 50 orders, carrying on the sequence of order IDs.
+	assert.Equal(t, 50, placed)
+	assert.Equal(t, 57, input.State.OrderCount)
+	assert.Equal(t, "sub1-8", input.State.Orders[1].ID)
+	assert.Equal(t, order.SubscriptionOrderID("sub1", input.State.OrderCount), input.State.Orders[len(input.State.Orders)-1].ID)
+	require.NotNil(t, input.State.NextOrderAt)
+	assert.True(t, input.State.NextOrderAt.After(input.State.Orders[len(input.State.Orders)-1].ScheduledFor))
+}
+
+func TestCreateSubscriptionValidatesPolicies(t *testing.T) {
+	c := mocks.NewClient(t)
+	c.On("ExecuteWorkflow", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(&mocks.WorkflowRun{}, nil).Once()
+
+	r := order.Router(c, nil, slog.Default())
+
+	create := func(policies string) *httptest.ResponseRecorder {
+		body := `{"id":"sub1","customerId":"customer1","items":[{"sku":"test1","quantity":1}],"schedule":"@weekly"` + policies + `}`
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/subscriptions", strings.NewReader(body)))
+		return rr
+	}
+
+	rr := create(`,"shippingPolicy":"overnight"`)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Contains(t, rr.Body.String(), "invalid shipping policy")
+
+	rr = create(`,"fulfillmentPolicy":"cheapest"`)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Contains(t, rr.Body.String(), "invalid fulfillment policy")
+
+	rr = create(`,"shippingPolicy":"express","fulfillmentPolicy":"fastest"`)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+}
@@ -14,7 +14,9 @@ func RunWorker(ctx context.Context, config config.AppConfig, client client.Clien
 	w := worker.New(client, TaskQueue, worker.Options{})
 
 	w.RegisterWorkflow(Order)
-	w.RegisterActivity(&Activities{BillingURL: config.BillingURL, OrderURL: config.OrderURL})
+	w.RegisterWorkflow(Return)
+	w.RegisterWorkflow(Subscription)
+	w.RegisterActivity(&Activities{BillingURL: config.BillingURL, OrderURL: config.OrderURL, InventoryURL: config.InventoryURL})
 
 	return w.Run(temporalutil.WorkerInterruptFromContext(ctx))
 }
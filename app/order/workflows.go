@@ -2,26 +2,80 @@ package order
 
 import (
 	"fmt"
+	"slices"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/temporalio/reference-app-orders-go/app/billing"
+	"github.com/temporalio/reference-app-orders-go/app/inventory"
 	"github.com/temporalio/reference-app-orders-go/app/shipment"
+	"go.temporal.io/api/enums/v1"
 	"go.temporal.io/sdk/log"
+	"go.temporal.io/sdk/temporal"
 	"go.temporal.io/sdk/workflow"
 )
 
 type orderImpl struct {
-	id           string
-	customerID   string
-	status       string
-	fulfillments []*Fulfillment
-	logger       log.Logger
+	id              string
+	customerID      string
+	paymentMethodID string
+	shippingPolicy  string
+	shippingAddress *Address
+	status          string
+	reason          string
+	fulfillments    []*Fulfillment
+	logger          log.Logger
+
+	// items are the order's items until they are reserved, when they are planned into fulfillments.
+	items []*Item
+
+	// releasesStock is set if the stock reserved for fulfillments which are not shipped is returned.
+	releasesStock bool
+
+	// fulfillmentPolicy and shipComplete are how the order's items are planned into fulfillments.
+	fulfillmentPolicy string
+	shipComplete      bool
+	plan              *FulfillmentPlan
+
+	// scheduledFor is when the order's items are reserved and charged, if it is scheduled.
+	scheduledFor *time.Time
+
+	// cancelRequested is set if the order is cancelled while its fulfillments are processing.
+	cancelRequested bool
+
+	// updatingItems is set while an items update is being applied, and itemsUpdated is sent to once it has been.
+	// itemUpdates counts the updates applied, to give each its own reservation, and pendingItemUpdates the
+	// updates accepted but not yet applied. reservingItems is set while the order's items are reserved, so
+	// that an update waits for the fulfillments.
+	updatingItems      bool
+	reservingItems     bool
+	itemsUpdated       workflow.Channel
+	itemUpdates        int
+	pendingItemUpdates int
 }
 
 // Aggressively low for demo purposes.
 const customerActionTimeout = 30 * time.Second
 
+// backorderTimeout is how long a backordered fulfillment waits for its items to be restocked before it is cancelled.
+const backorderTimeout = 7 * 24 * time.Hour
+
+// confirmAddressesChangeID versions the Order workflow from when it validated shipping addresses
+// before reserving items.
+const confirmAddressesChangeID = "ConfirmAddresses"
+
+// releaseStockChangeID versions the Order workflow from when it returned the stock reserved for
+// fulfillments which were not shipped. Orders reserved before then had no stock deducted.
+const releaseStockChangeID = "ReleaseStock"
+
+// asyncChargeChangeID versions the Order workflow from when it started charges and polled for their
+// result, rather than waiting on a single Charge activity.
+const asyncChargeChangeID = "AsyncCharge"
+
+// chargeTimeout is how long to wait for the Billing system to process a charge.
+// Charges held for fraud review may take some time to be decided.
+const chargeTimeout = 24 * time.Hour
+
 // Order Workflow process an order from a customer.
 func Order(ctx workflow.Context, input *OrderInput) (*OrderResult, error) {
 	wf := new(orderImpl)
@@ -33,6 +87,24 @@ func Order(ctx workflow.Context, input *OrderInput) (*OrderResult, error) {
 	return wf.run(ctx, input)
 }
 
+// validatePolicies checks that an order accepts its shipping and fulfillment policies.
+// Empty policies are accepted, and the defaults apply.
+func validatePolicies(shippingPolicy string, fulfillmentPolicy string) error {
+	switch shippingPolicy {
+	case "", shipment.ShippingPolicyEconomy, shipment.ShippingPolicyExpress:
+	default:
+		return fmt.Errorf("invalid shipping policy %q", shippingPolicy)
+	}
+
+	switch fulfillmentPolicy {
+	case "", inventory.PolicyFewestShipments, inventory.PolicyFastest:
+	default:
+		return fmt.Errorf("invalid fulfillment policy %q", fulfillmentPolicy)
+	}
+
+	return nil
+}
+
 func (wf *orderImpl) setup(ctx workflow.Context, input *OrderInput) error {
 	if input.ID == "" {
 		return fmt.Errorf("ID is required")
@@ -46,8 +118,25 @@ func (wf *orderImpl) setup(ctx workflow.Context, input *OrderInput) error {
 		return fmt.Errorf("order must contain items")
 	}
 
+	if err := validatePolicies(input.ShippingPolicy, input.FulfillmentPolicy); err != nil {
+		return err
+	}
+
 	wf.id = input.ID
 	wf.customerID = input.CustomerID
+	wf.paymentMethodID = input.PaymentMethodID
+	wf.shippingPolicy = input.ShippingPolicy
+	wf.shippingAddress = input.ShippingAddress
+	wf.fulfillmentPolicy = input.FulfillmentPolicy
+	wf.shipComplete = input.ShipComplete
+	wf.scheduledFor = input.NotBefore
+	wf.items = input.Items
+
+	for _, item := range input.Items {
+		if item.ShippingAddress == nil {
+			item.ShippingAddress = input.ShippingAddress
+		}
+	}
 
 	wf.logger = log.With(
 		workflow.GetLogger(ctx),
@@ -55,67 +144,147 @@ func (wf *orderImpl) setup(ctx workflow.Context, input *OrderInput) error {
 		"customerId", wf.customerID,
 	)
 
+	wf.itemsUpdated = workflow.NewBufferedChannel(ctx, 1)
+	if err := wf.setItemsUpdateHandler(ctx); err != nil {
+		return err
+	}
+
 	return workflow.SetQueryHandler(ctx, StatusQuery, func() (*OrderStatus, error) {
-		return &OrderStatus{
-			ID:           wf.id,
-			Status:       wf.status,
-			CustomerID:   wf.customerID,
-			Fulfillments: wf.fulfillments,
-		}, nil
+		return wf.orderStatus(), nil
 	})
 }
 
+func (wf *orderImpl) orderStatus() *OrderStatus {
+	return &OrderStatus{
+		ID:           wf.id,
+		Status:       wf.status,
+		Reason:       wf.reason,
+		ScheduledFor: wf.scheduledFor,
+		CustomerID:   wf.customerID,
+		Fulfillments: wf.fulfillments,
+		Plan:         wf.plan,
+	}
+}
+
 func (wf *orderImpl) run(ctx workflow.Context, order *OrderInput) (*OrderResult, error) {
-	err := wf.buildFulfillments(ctx, order.Items)
+	// Orders started before shipping addresses were validated go straight on to reserve their items.
+	if workflow.GetVersion(ctx, confirmAddressesChangeID, workflow.DefaultVersion, 1) != workflow.DefaultVersion {
+		action, err := wf.confirmAddresses(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		switch action {
+		case CustomerActionCancel:
+			err := wf.updateStatus(ctx, OrderStatusCancelled)
+			return &OrderResult{Status: wf.status}, err
+		case CustomerActionTimedOut:
+			err := wf.updateStatus(ctx, OrderStatusTimedOut)
+			return &OrderResult{Status: wf.status}, err
+		}
+	}
+
+	if wf.scheduledFor != nil && wf.scheduledFor.After(workflow.Now(ctx)) {
+		if err := wf.updateStatus(ctx, OrderStatusScheduled); err != nil {
+			return nil, err
+		}
+
+		action, err := wf.waitUntilScheduled(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if action == CustomerActionCancel {
+			err := wf.updateStatus(ctx, OrderStatusCancelled)
+			return &OrderResult{Status: wf.status}, err
+		}
+	}
+
+	err := wf.buildFulfillments(ctx)
 	if err != nil {
 		return nil, err
 	}
 
+	// An order which ships complete is held until a warehouse can ship all of it, rather than
+	// asking the customer whether to ship part of it.
+	if wf.shipComplete && wf.customerActionRequired() {
+		wf.backorderUnavailableFulfillments(ctx)
+	}
+
 	if wf.customerActionRequired() {
 		err = wf.updateStatus(ctx, OrderStatusCustomerActionRequired)
 		if err != nil {
 			return nil, err
 		}
 
-		action, err := wf.waitForCustomer(ctx)
+		signal, err := wf.waitForCustomer(ctx, CustomerActionAmend, CustomerActionBackorder, CustomerActionCancel)
 		if err != nil {
 			return nil, err
 		}
 
-		switch action {
+		// The customer's action applies to the items as they are once any update in progress is applied.
+		if err := wf.awaitItemsUpdated(ctx); err != nil {
+			return nil, err
+		}
+
+		switch action := signal.Action; action {
 		case CustomerActionCancel:
+			wf.cancelAllFulfillments(ctx)
 			err := wf.updateStatus(ctx, OrderStatusCancelled)
 			return &OrderResult{Status: wf.status}, err
 		case CustomerActionTimedOut:
+			wf.cancelAllFulfillments(ctx)
 			err := wf.updateStatus(ctx, OrderStatusTimedOut)
-			wf.cancelAllFulfillments()
 			return &OrderResult{Status: wf.status}, err
 		case CustomerActionAmend:
 			wf.cancelUnavailableFulfillments()
+		case CustomerActionBackorder:
+			wf.backorderUnavailableFulfillments(ctx)
 		default:
 			return nil, fmt.Errorf("unhandled customer action %q", action)
 		}
 	}
 
+	// Items can no longer be added once the order is processing, so any update in progress is applied first.
+	if err := wf.awaitItemsUpdated(ctx); err != nil {
+		return nil, err
+	}
 	if err := wf.updateStatus(ctx, OrderStatusProcessing); err != nil {
 		return nil, err
 	}
 
 	workflow.Go(ctx, wf.handleShipmentStatusUpdates)
+	workflow.Go(ctx, wf.handleRestocks)
+
+	// Cancelling the order cancels its fulfillments, which see through any payment in progress
+	// and then refund it, and cancel their shipment if it has not yet been dispatched.
+	fctx, cancelFulfillments := workflow.WithCancel(ctx)
+	workflow.Go(ctx, func(ctx workflow.Context) {
+		wf.handleCancellation(ctx, cancelFulfillments)
+	})
 
 	completed := 0
 	for _, f := range wf.fulfillments {
 		f := f
-		workflow.Go(ctx, func(ctx workflow.Context) {
+		workflow.Go(fctx, func(ctx workflow.Context) {
+			// A pending fulfillment is processed once any update changing its items is applied. A cancelled
+			// context is left to process to handle.
+			_ = wf.awaitItemsUpdated(ctx)
 			f.process(ctx)
 			completed++
 		})
 	}
 
+	// Fulfillments are seen through to the end even if the workflow itself is cancelled.
+	ctx, _ = workflow.NewDisconnectedContext(ctx)
 	workflow.Await(ctx, func() bool { return completed == len(wf.fulfillments) })
 
 	status := OrderStatusCompleted
-	if wf.allFulfillmentsFailed() {
+	switch {
+	case wf.cancelRequested && !wf.anyFulfillmentCompleted():
+		status = OrderStatusCancelled
+	case wf.allFulfillmentsCancelled():
+		status = OrderStatusCancelled
+	case wf.allFulfillmentsFailed():
 		status = OrderStatusFailed
 	}
 	if err := wf.updateStatus(ctx, status); err != nil {
@@ -139,7 +308,16 @@ func (wf *orderImpl) updateStatus(ctx workflow.Context, status string) error {
 	return workflow.ExecuteLocalActivity(ctx, a.UpdateOrderStatus, update).Get(ctx, nil)
 }
 
-func (wf *orderImpl) buildFulfillments(ctx workflow.Context, items []*Item) error {
+func (wf *orderImpl) buildFulfillments(ctx workflow.Context) error {
+	if err := wf.awaitItemsUpdated(ctx); err != nil {
+		return err
+	}
+
+	wf.reservingItems = true
+	defer func() { wf.reservingItems = false }()
+
+	wf.releasesStock = workflow.GetVersion(ctx, releaseStockChangeID, workflow.DefaultVersion, 1) != workflow.DefaultVersion
+
 	ctx = workflow.WithActivityOptions(ctx,
 		workflow.ActivityOptions{
 			StartToCloseTimeout: 30 * time.Second,
@@ -151,36 +329,59 @@ func (wf *orderImpl) buildFulfillments(ctx workflow.Context, items []*Item) erro
 	err := workflow.ExecuteActivity(ctx,
 		a.ReserveItems,
 		ReserveItemsInput{
-			OrderID: wf.id,
-			Items:   items,
+			OrderID:      wf.id,
+			Items:        wf.items,
+			Policy:       wf.fulfillmentPolicy,
+			ShipComplete: wf.shipComplete,
 		},
 	).Get(ctx, &result)
 	if err != nil {
 		return err
 	}
 
-	for i, r := range result.Reservations {
-		id := fmt.Sprintf("%s:%d", wf.id, i+1)
-		logger := log.With(wf.logger, "fulfillment", id)
-		f := &Fulfillment{
-			orderID:    wf.id,
-			customerID: wf.customerID,
-			logger:     logger,
+	wf.plan = result.Plan
+	if wf.plan != nil {
+		wf.logger.Info("Fulfillment planned", "plan", wf.plan.Summary)
+	}
 
-			ID:       id,
-			Items:    r.Items,
-			Location: r.Location,
-			Status:   FulfillmentStatusPending,
-		}
-		if !r.Available {
-			f.Status = FulfillmentStatusUnavailable
+	// Items reserved together are shipped separately if they are going to different addresses.
+	for _, r := range result.Reservations {
+		for _, items := range splitByAddress(r.Items) {
+			wf.addFulfillment(r, items)
 		}
-		wf.fulfillments = append(wf.fulfillments, f)
 	}
 
 	return nil
 }
 
+// addFulfillment adds a fulfillment for items of a reservation which are shipped to the same address.
+func (wf *orderImpl) addFulfillment(r *Reservation, items []*Item) {
+	id := fmt.Sprintf("%s:%d", wf.id, len(wf.fulfillments)+1)
+	logger := log.With(wf.logger, "fulfillment", id)
+	f := &Fulfillment{
+		orderID:         wf.id,
+		customerID:      wf.customerID,
+		paymentMethodID: wf.paymentMethodID,
+		shippingPolicy:  wf.shippingPolicy,
+		releasesStock:   wf.releasesStock,
+		logger:          logger,
+
+		ID:              id,
+		Items:           items,
+		Location:        r.Location,
+		ShippingAddress: items[0].ShippingAddress,
+		Status:          FulfillmentStatusPending,
+	}
+	switch {
+	case r.ReleasedAt != nil:
+		f.Status = FulfillmentStatusPreordered
+		f.ReleasedAt = r.ReleasedAt
+	case !r.Available:
+		f.Status = FulfillmentStatusUnavailable
+	}
+	wf.fulfillments = append(wf.fulfillments, f)
+}
+
 func (wf *orderImpl) customerActionRequired() bool {
 	for _, f := range wf.fulfillments {
 		if f.Status == FulfillmentStatusUnavailable {
@@ -201,14 +402,51 @@ func (wf *orderImpl) cancelUnavailableFulfillments() {
 	}
 }
 
-func (wf *orderImpl) cancelAllFulfillments() {
+// backorderUnavailableFulfillments has unavailable fulfillments wait for their items to be restocked.
+func (wf *orderImpl) backorderUnavailableFulfillments(ctx workflow.Context) {
+	wf.logger.Info("Backordering unavailable fulfillments", "timeout", backorderTimeout)
+
+	for _, f := range wf.fulfillments {
+		if f.Status == FulfillmentStatusUnavailable {
+			f.Status = FulfillmentStatusBackordered
+			f.Backorder = &BackorderStatus{ExpiresAt: workflow.Now(ctx).Add(backorderTimeout)}
+		}
+	}
+}
+
+// cancelAllFulfillments cancels the order's fulfillments before they are processed,
+// returning the stock reserved for them.
+func (wf *orderImpl) cancelAllFulfillments(ctx workflow.Context) {
 	wf.logger.Info("Cancelling all fulfillments")
 
 	for _, f := range wf.fulfillments {
+		if f.Status == FulfillmentStatusPending {
+			f.releaseStock(ctx)
+		}
 		f.Status = FulfillmentStatusCancelled
 	}
 }
 
+func (wf *orderImpl) anyFulfillmentCompleted() bool {
+	for _, f := range wf.fulfillments {
+		if f.Status == FulfillmentStatusCompleted {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (wf *orderImpl) allFulfillmentsCancelled() bool {
+	for _, f := range wf.fulfillments {
+		if f.Status != FulfillmentStatusCancelled {
+			return false
+		}
+	}
+
+	return len(wf.fulfillments) > 0
+}
+
 func (wf *orderImpl) allFulfillmentsFailed() bool {
 	failures := 0
 	for _, f := range wf.fulfillments {
@@ -220,7 +458,9 @@ func (wf *orderImpl) allFulfillmentsFailed() bool {
 	return failures >= 1 && failures == len(wf.fulfillments)
 }
 
-func (wf *orderImpl) waitForCustomer(ctx workflow.Context) (string, error) {
+// waitForCustomer waits for the customer to take one of the given actions, returning CustomerActionTimedOut
+// if they do not respond in time. Other actions do not apply to what the customer is being asked, so are ignored.
+func (wf *orderImpl) waitForCustomer(ctx workflow.Context, actions ...string) (*CustomerActionSignal, error) {
 	var signal CustomerActionSignal
 
 	s := workflow.NewSelector(ctx)
@@ -229,43 +469,141 @@ func (wf *orderImpl) waitForCustomer(ctx workflow.Context) (string, error) {
 	t := workflow.NewTimer(timerCtx, customerActionTimeout)
 
 	var err error
+	done := false
 
 	s.AddFuture(t, func(f workflow.Future) {
 		if err = f.Get(timerCtx, nil); err != nil {
+			done = true
 			return
 		}
 
 		wf.logger.Info("Timed out waiting for customer action", "timeout", customerActionTimeout)
 
 		signal.Action = CustomerActionTimedOut
+		done = true
 	})
 
 	ch := workflow.GetSignalChannel(ctx, CustomerActionSignalName)
 	s.AddReceive(ch, func(c workflow.ReceiveChannel, _ bool) {
-		c.Receive(ctx, &signal)
+		var received CustomerActionSignal
+		c.Receive(ctx, &received)
 
-		wf.logger.Info("Received customer action", "action", signal.Action)
+		if !slices.Contains(actions, received.Action) {
+			wf.logger.Warn("Ignoring customer action which does not apply", "action", received.Action)
+			return
+		}
+
+		wf.logger.Info("Received customer action", "action", received.Action)
+
+		signal = received
+		cancelTimer()
+		done = true
+	})
+
+	// Changing the order's items may leave nothing for the customer to act on.
+	s.AddReceive(wf.itemsUpdated, func(c workflow.ReceiveChannel, _ bool) {
+		c.Receive(ctx, nil)
 
+		if wf.fulfillments == nil || wf.customerActionRequired() {
+			return
+		}
+
+		wf.logger.Info("Customer action no longer required after items were updated")
+
+		signal.Action = CustomerActionAmend
 		cancelTimer()
+		done = true
 	})
 
 	wf.logger.Info("Waiting for customer action")
 
-	s.Select(ctx)
+	for !done {
+		s.Select(ctx)
+	}
 
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	switch signal.Action {
-	case CustomerActionAmend:
-	case CustomerActionCancel:
-	case CustomerActionTimedOut:
-	default:
-		return "", fmt.Errorf("invalid customer action %q", signal.Action)
+	return &signal, nil
+}
+
+// waitUntilScheduled waits for the time the order is scheduled for. It returns CustomerActionCancel if the
+// customer cancels the order first. Other customer actions do not apply to a scheduled order and are ignored.
+func (wf *orderImpl) waitUntilScheduled(ctx workflow.Context) (string, error) {
+	s := workflow.NewSelector(ctx)
+
+	timerCtx, cancelTimer := workflow.WithCancel(ctx)
+	t := workflow.NewTimer(timerCtx, wf.scheduledFor.Sub(workflow.Now(ctx)))
+
+	var action string
+	var err error
+	done := false
+
+	s.AddFuture(t, func(f workflow.Future) {
+		err = f.Get(timerCtx, nil)
+		done = true
+	})
+
+	ch := workflow.GetSignalChannel(ctx, CustomerActionSignalName)
+	s.AddReceive(ch, func(c workflow.ReceiveChannel, _ bool) {
+		var signal CustomerActionSignal
+		c.Receive(ctx, &signal)
+
+		if signal.Action != CustomerActionCancel {
+			wf.logger.Warn("Ignoring customer action while scheduled", "action", signal.Action)
+			return
+		}
+
+		wf.logger.Info("Received customer action", "action", signal.Action)
+
+		action = signal.Action
+		cancelTimer()
+		done = true
+	})
+
+	wf.logger.Info("Waiting until scheduled", "scheduledFor", wf.scheduledFor)
+
+	for !done {
+		s.Select(ctx)
 	}
 
-	return signal.Action, nil
+	return action, err
+}
+
+// handleCancellation cancels the order's fulfillments if the customer cancels the order, or the workflow is
+// cancelled, while they are processing. Other customer actions no longer apply and are ignored.
+func (wf *orderImpl) handleCancellation(ctx workflow.Context, cancelFulfillments workflow.CancelFunc) {
+	s := workflow.NewSelector(ctx)
+
+	s.AddReceive(ctx.Done(), func(c workflow.ReceiveChannel, _ bool) {
+		c.Receive(ctx, nil)
+
+		wf.logger.Info("Order workflow cancelled")
+
+		wf.cancelRequested = true
+	})
+
+	ch := workflow.GetSignalChannel(ctx, CustomerActionSignalName)
+	s.AddReceive(ch, func(c workflow.ReceiveChannel, _ bool) {
+		var signal CustomerActionSignal
+		c.Receive(ctx, &signal)
+
+		if signal.Action != CustomerActionCancel {
+			wf.logger.Warn("Ignoring customer action while processing", "action", signal.Action)
+			return
+		}
+
+		wf.logger.Info("Received customer action", "action", signal.Action)
+
+		wf.cancelRequested = true
+	})
+
+	for !wf.cancelRequested {
+		s.Select(ctx)
+	}
+
+	cancelFulfillments()
 }
 
 func (wf *orderImpl) handleShipmentStatusUpdates(ctx workflow.Context) {
@@ -276,8 +614,10 @@ func (wf *orderImpl) handleShipmentStatusUpdates(ctx workflow.Context) {
 		_ = ch.Receive(ctx, &signal)
 		for _, f := range wf.fulfillments {
 			if f.ID == signal.ShipmentID {
-				f.Shipment.Status = signal.Status
-				f.Shipment.UpdatedAt = signal.UpdatedAt
+				f.Shipment.update(signal)
+				if signal.Escalation != nil {
+					wf.logger.Warn("Shipment escalated", "shipmentID", signal.ShipmentID, "status", signal.Escalation.Status)
+				}
 
 				wf.logger.Info("Shipment status updated", "shipmentID", signal.ShipmentID, "status", signal.Status)
 
@@ -287,24 +627,72 @@ func (wf *orderImpl) handleShipmentStatusUpdates(ctx workflow.Context) {
 	}
 }
 
+// handleRestocks wakes backordered fulfillments when the Inventory system signals that their items were restocked.
+func (wf *orderImpl) handleRestocks(ctx workflow.Context) {
+	ch := workflow.GetSignalChannel(ctx, inventory.RestockSignalName)
+
+	for {
+		var signal inventory.RestockSignal
+		_ = ch.Receive(ctx, &signal)
+		for _, f := range wf.fulfillments {
+			if f.ID == signal.Reference {
+				f.restocked = true
+
+				wf.logger.Info("Backordered items restocked", "fulfillment", f.ID, "skus", signal.SKUs)
+
+				break
+			}
+		}
+	}
+}
+
 func (f *Fulfillment) process(ctx workflow.Context) error {
 	defer func() {
 		f.logger.Info("Fulfillment processed", "status", f.Status)
 	}()
 
+	if f.Status == FulfillmentStatusPreordered {
+		f.awaitRelease(ctx)
+	}
+
+	if f.Status == FulfillmentStatusBackordered {
+		if err := f.awaitRestock(ctx); err != nil {
+			f.Status = FulfillmentStatusFailed
+			return err
+		}
+	}
+
 	if f.Status == FulfillmentStatusCancelled {
 		return nil
 	}
 
+	// A charge which has been started is seen through, so that it can be refunded if the order is cancelled.
+	// Reserved stock is returned if the fulfillment is not shipped.
+	dctx, _ := workflow.NewDisconnectedContext(ctx)
+
+	if ctx.Err() != nil {
+		f.Status = FulfillmentStatusCancelled
+		f.releaseStock(dctx)
+		return nil
+	}
+
 	f.Status = FulfillmentStatusProcessing
 
-	err := f.processPayment(ctx)
+	err := f.processPayment(dctx)
 	if err != nil || f.Payment.Status != PaymentStatusSuccess {
 		f.Status = FulfillmentStatusFailed
+		f.releaseStock(dctx)
 		return err
 	}
 
+	if ctx.Err() != nil {
+		return f.cancel(dctx)
+	}
+
 	if err := f.processShipment(ctx); err != nil {
+		if temporal.IsCanceledError(err) {
+			return f.cancel(dctx)
+		}
 		f.Status = FulfillmentStatusFailed
 		return err
 	}
@@ -314,6 +702,195 @@ func (f *Fulfillment) process(ctx workflow.Context) error {
 	return nil
 }
 
+// awaitRelease waits until a pre-ordered fulfillment's items are released, and then backorders them until they
+// are in stock. The fulfillment is cancelled if the order is cancelled first.
+func (f *Fulfillment) awaitRelease(ctx workflow.Context) {
+	f.logger.Info("Waiting for pre-ordered items to be released", "releasedAt", f.ReleasedAt)
+
+	if d := f.ReleasedAt.Sub(workflow.Now(ctx)); d > 0 {
+		if err := workflow.Sleep(ctx, d); err != nil {
+			f.Status = FulfillmentStatusCancelled
+			return
+		}
+	}
+
+	f.Status = FulfillmentStatusBackordered
+	f.Backorder = &BackorderStatus{ExpiresAt: workflow.Now(ctx).Add(backorderTimeout)}
+}
+
+// awaitRestock waits for a backordered fulfillment's items to be restocked and reserves them, leaving the
+// fulfillment pending. The fulfillment is cancelled if the order is cancelled or the backorder expires first.
+func (f *Fulfillment) awaitRestock(ctx workflow.Context) error {
+	dctx, _ := workflow.NewDisconnectedContext(ctx)
+	dctx = workflow.WithActivityOptions(dctx,
+		workflow.ActivityOptions{
+			StartToCloseTimeout: 10 * time.Second,
+		},
+	)
+
+	err := workflow.ExecuteActivity(dctx,
+		a.BackorderItems,
+		&BackorderItemsInput{
+			Reference:  f.ID,
+			WorkflowID: workflow.GetInfo(ctx).WorkflowExecution.ID,
+			Items:      f.Items,
+		},
+	).Get(dctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err := workflow.ExecuteActivity(dctx, a.RemoveBackorder, f.ID).Get(dctx, nil); err != nil {
+			f.logger.Error("Failed to remove backorder", "error", err)
+		}
+	}()
+
+	for {
+		// Restocks signalled while reserving are picked up by the next attempt.
+		f.restocked = false
+
+		reserved, err := f.reserveBackorder(dctx)
+		if err != nil {
+			return err
+		}
+		if reserved {
+			f.logger.Info("Backordered items reserved", "location", f.Location, "attempts", f.Backorder.Attempts)
+			f.Status = FulfillmentStatusPending
+			return nil
+		}
+
+		remaining := f.Backorder.ExpiresAt.Sub(workflow.Now(ctx))
+		restocked := false
+		if remaining > 0 {
+			restocked, err = workflow.AwaitWithTimeout(ctx, remaining, func() bool { return f.restocked })
+		}
+		if err != nil {
+			f.Status = FulfillmentStatusCancelled
+			return nil
+		}
+		if !restocked {
+			f.logger.Info("Backorder expired", "expiresAt", f.Backorder.ExpiresAt)
+			f.Status = FulfillmentStatusCancelled
+			return nil
+		}
+	}
+}
+
+// reserveBackorder tries to reserve all of a backordered fulfillment's items from a single warehouse, as they
+// ship together. Any items reserved are returned to stock if the others are still unavailable.
+func (f *Fulfillment) reserveBackorder(ctx workflow.Context) (bool, error) {
+	f.Backorder.Attempts++
+	reference := fmt.Sprintf("%s:backorder:%d", f.ID, f.Backorder.Attempts)
+
+	var result ReserveItemsResult
+
+	err := workflow.ExecuteActivity(ctx,
+		a.ReserveItems,
+		ReserveItemsInput{
+			OrderID:      f.orderID,
+			Reference:    reference,
+			Items:        f.Items,
+			ShipComplete: true,
+		},
+	).Get(ctx, &result)
+	if err != nil {
+		return false, err
+	}
+
+	var reserved *Reservation
+	complete := true
+	for _, r := range result.Reservations {
+		if r.Available {
+			reserved = r
+		} else {
+			complete = false
+		}
+	}
+
+	if reserved == nil {
+		return false, nil
+	}
+	if complete {
+		f.Location = reserved.Location
+		return true, nil
+	}
+
+	err = workflow.ExecuteActivity(ctx,
+		a.RestockItems,
+		&RestockItemsInput{
+			Reference: reference + ":released",
+			Location:  reserved.Location,
+			Items:     reserved.Items,
+		},
+	).Get(ctx, nil)
+	if err != nil {
+		f.logger.Error("Failed to release partially reserved stock", "error", err)
+	}
+
+	return false, nil
+}
+
+// releaseStock returns the stock reserved for a fulfillment which will not be shipped.
+// Failures are logged rather than failing the order. Orders reserved before stock was deducted have none to return.
+func (f *Fulfillment) releaseStock(ctx workflow.Context) {
+	if !f.releasesStock {
+		return
+	}
+
+	ctx = workflow.WithActivityOptions(ctx,
+		workflow.ActivityOptions{
+			StartToCloseTimeout: 10 * time.Second,
+		},
+	)
+
+	err := workflow.ExecuteActivity(ctx,
+		a.RestockItems,
+		&RestockItemsInput{
+			Reference: f.ID + ":released",
+			Location:  f.Location,
+			Items:     f.Items,
+		},
+	).Get(ctx, nil)
+	if err != nil {
+		f.logger.Error("Failed to release reserved stock", "error", err)
+		return
+	}
+
+	f.logger.Info("Reserved stock released", "location", f.Location)
+}
+
+// cancel cancels a fulfillment which has been paid for, refunding its items and returning them to stock.
+// Shipping is not refunded.
+func (f *Fulfillment) cancel(ctx workflow.Context) error {
+	f.Status = FulfillmentStatusCancelled
+
+	f.releaseStock(ctx)
+
+	ctx = workflow.WithActivityOptions(ctx,
+		workflow.ActivityOptions{
+			StartToCloseTimeout: 10 * time.Second,
+		},
+	)
+
+	err := workflow.ExecuteActivity(ctx,
+		a.RefundItems,
+		&RefundItemsInput{
+			InvoiceReference: f.Payment.InvoiceReference,
+			Reference:        f.ID + ":cancelled",
+			Items:            f.Items,
+		},
+	).Get(ctx, &f.Refund)
+	if err != nil {
+		f.logger.Error("Failed to refund cancelled fulfillment", "error", err)
+		return err
+	}
+
+	f.logger.Info("Cancelled fulfillment refunded", "total", f.Refund.Total)
+
+	return nil
+}
+
 func (f *Fulfillment) processPayment(ctx workflow.Context) error {
 	var billingItems []billing.Item
 	for _, i := range f.Items {
@@ -324,7 +901,7 @@ func (f *Fulfillment) processPayment(ctx workflow.Context) error {
 
 	ctx = workflow.WithActivityOptions(ctx,
 		workflow.ActivityOptions{
-			StartToCloseTimeout: 30 * time.Second,
+			StartToCloseTimeout: 10 * time.Second,
 		},
 	)
 
@@ -339,35 +916,90 @@ func (f *Fulfillment) processPayment(ctx workflow.Context) error {
 		return err
 	}
 
-	c := workflow.ExecuteActivity(ctx,
-		a.Charge,
-		&ChargeInput{
-			CustomerID:     f.customerID,
-			Reference:      f.ID,
-			Items:          billingItems,
-			IdempotencyKey: chargeKey,
+	input := &ChargeInput{
+		CustomerID:      f.customerID,
+		PaymentMethodID: f.paymentMethodID,
+		Reference:       f.ID,
+		Items:           billingItems,
+		IdempotencyKey:  chargeKey,
+	}
+
+	// Orders which requested their charges before the Billing API processed them asynchronously
+	// replay the single Charge activity they scheduled.
+	if workflow.GetVersion(ctx, asyncChargeChangeID, workflow.DefaultVersion, 1) == workflow.DefaultVersion {
+		ctx = workflow.WithActivityOptions(ctx,
+			workflow.ActivityOptions{
+				StartToCloseTimeout: 30 * time.Second,
+			},
+		)
+		if err := workflow.ExecuteActivity(ctx, a.Charge, input).Get(ctx, &charge); err != nil {
+			f.Payment.Status = PaymentStatusFailed
+			return err
+		}
+		f.applyCharge(&charge)
+		return nil
+	}
+
+	var started StartChargeResult
+
+	err := workflow.ExecuteActivity(ctx,
+		a.StartCharge,
+		input,
+	).Get(ctx, &started)
+	if err != nil {
+		f.Payment.Status = PaymentStatusFailed
+		return err
+	}
+
+	// The Billing API processes the charge asynchronously. Poll for the result
+	// using the activity's retry policy, which durably backs off between attempts.
+	pollCtx := workflow.WithActivityOptions(ctx,
+		workflow.ActivityOptions{
+			StartToCloseTimeout:    10 * time.Second,
+			ScheduleToCloseTimeout: chargeTimeout,
+			RetryPolicy: &temporal.RetryPolicy{
+				InitialInterval:    time.Second,
+				BackoffCoefficient: 2,
+				MaximumInterval:    30 * time.Second,
+			},
 		},
 	)
-	if err := c.Get(ctx, &charge); err != nil {
+
+	err = workflow.ExecuteActivity(pollCtx,
+		a.GetCharge,
+		&GetChargeInput{ChargeID: started.ID},
+	).Get(ctx, &charge)
+	if err != nil {
 		f.Payment.Status = PaymentStatusFailed
 		return err
 	}
 
+	f.applyCharge(&charge)
+
+	return nil
+}
+
+// applyCharge records the result of a fulfillment's charge.
+func (f *Fulfillment) applyCharge(charge *ChargeResult) {
 	p := f.Payment
 
 	p.SubTotal = charge.SubTotal
 	p.Tax = charge.Tax
 	p.Shipping = charge.Shipping
 	p.Total = charge.Total
-	if charge.Success {
+	p.InvoiceReference = charge.InvoiceReference
+	p.InvoiceURL = charge.InvoiceURL
+	switch {
+	case charge.Success:
 		p.Status = PaymentStatusSuccess
-	} else {
+	case charge.Outcome == billing.ChargeOutcomeDeclined:
+		p.Status = PaymentStatusDeclined
+	default:
 		p.Status = PaymentStatusFailed
+		p.Error = charge.PaymentError
 	}
 
 	f.logger.Info("Payment processed", "total", p.Total, "status", p.Status)
-
-	return nil
 }
 
 func (f *Fulfillment) processShipment(ctx workflow.Context) error {
@@ -375,6 +1007,9 @@ func (f *Fulfillment) processShipment(ctx workflow.Context) error {
 		workflow.ChildWorkflowOptions{
 			TaskQueue:  shipment.TaskQueue,
 			WorkflowID: shipment.ShipmentWorkflowID(f.ID),
+			// The shipment is asked to cancel if the order is, and reports whether it could be.
+			ParentClosePolicy:   enums.PARENT_CLOSE_POLICY_REQUEST_CANCEL,
+			WaitForCancellation: true,
 		},
 	)
 
@@ -394,8 +1029,11 @@ func (f *Fulfillment) processShipment(ctx workflow.Context) error {
 		shipment.ShipmentInput{
 			RequestorWID: workflow.GetInfo(ctx).WorkflowExecution.ID,
 
-			ID:    f.ID,
-			Items: shippingItems,
+			ID:          f.ID,
+			Items:       shippingItems,
+			Location:    f.Location,
+			Destination: f.ShippingAddress,
+			Policy:      f.shippingPolicy,
 		},
 	).Get(ctx, nil)
 
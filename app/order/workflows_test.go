@@ -2,24 +2,59 @@ package order_test
 
 import (
 	"context"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/temporalio/reference-app-orders-go/app/inventory"
 	"github.com/temporalio/reference-app-orders-go/app/order"
 	"github.com/temporalio/reference-app-orders-go/app/shipment"
+	"go.temporal.io/sdk/temporal"
 	"go.temporal.io/sdk/testsuite"
 	"go.temporal.io/sdk/workflow"
 )
 
+// reserveItems stands in for the Inventory API, reserving the first available item from Warehouse A
+// and the rest from Warehouse B. Adidas items are unavailable.
+func reserveItems(_ context.Context, input *order.ReserveItemsInput) (*order.ReserveItemsResult, error) {
+	var result order.ReserveItemsResult
+	var available []*order.Item
+	var unavailable []*order.Item
+
+	for _, item := range input.Items {
+		if strings.Contains(item.SKU, "Adidas") {
+			unavailable = append(unavailable, item)
+		} else {
+			available = append(available, item)
+		}
+	}
+
+	if len(unavailable) > 0 {
+		result.Reservations = append(result.Reservations, &order.Reservation{Available: false, Items: unavailable})
+	}
+	if len(available) > 0 {
+		result.Reservations = append(result.Reservations, &order.Reservation{Available: true, Location: "Warehouse A", Items: available[:1]})
+	}
+	if len(available) > 1 {
+		result.Reservations = append(result.Reservations, &order.Reservation{Available: true, Location: "Warehouse B", Items: available[1:]})
+	}
+
+	return &result, nil
+}
+
 func TestOrderWorkflow(t *testing.T) {
 	s := testsuite.WorkflowTestSuite{}
 	env := s.NewTestWorkflowEnvironment()
 	var a *order.Activities
 
-	env.RegisterActivity(a.ReserveItems)
-	env.OnActivity(a.Charge, mock.Anything, mock.Anything).Return(func(ctx context.Context, input *order.ChargeInput) (*order.ChargeResult, error) {
+	env.OnActivity(a.ReserveItems, mock.Anything, mock.Anything).Return(reserveItems)
+	env.OnActivity(a.StartCharge, mock.Anything, mock.Anything).Return(func(ctx context.Context, input *order.ChargeInput) (*order.StartChargeResult, error) {
+		return &order.StartChargeResult{ID: input.IdempotencyKey}, nil
+	})
+	env.OnActivity(a.GetCharge, mock.Anything, mock.Anything).Return(func(ctx context.Context, input *order.GetChargeInput) (*order.ChargeResult, error) {
 		return &order.ChargeResult{Success: true}, nil
 	})
 	env.OnActivity(a.UpdateOrderStatus, mock.Anything, mock.Anything).Return(func(ctx context.Context, input *order.OrderStatusUpdate) error {
@@ -50,25 +85,75 @@ func TestOrderWorkflow(t *testing.T) {
 	env.AssertWorkflowNumberOfCalls(t, "Shipment", 2)
 }
 
+func TestOrderSynchronousChargeVersion(t *testing.T) {
+	s := testsuite.WorkflowTestSuite{}
+	env := s.NewTestWorkflowEnvironment()
+	var a *order.Activities
+
+	// An order which requested its charges before they were processed asynchronously replays the Charge activity.
+	env.OnGetVersion("AsyncCharge", workflow.DefaultVersion, 1).Return(workflow.DefaultVersion)
+	env.OnActivity(a.ReserveItems, mock.Anything, mock.Anything).Return(reserveItems)
+	env.OnActivity(a.Charge, mock.Anything, mock.Anything).Return(&order.ChargeResult{Success: true, Total: 100}, nil)
+	env.OnActivity(a.UpdateOrderStatus, mock.Anything, mock.Anything).Return(nil)
+	env.OnWorkflow(shipment.Shipment, mock.Anything, mock.Anything).Return(&shipment.ShipmentResult{CourierReference: "test"}, nil)
+
+	env.ExecuteWorkflow(
+		order.Order,
+		&order.OrderInput{
+			ID:         "1234",
+			CustomerID: "1234",
+			Items:      []*order.Item{{SKU: "test1", Quantity: 1}},
+		},
+	)
+
+	var result order.OrderResult
+	require.NoError(t, env.GetWorkflowResult(&result))
+	assert.Equal(t, order.OrderStatusCompleted, result.Status)
+
+	env.AssertNotCalled(t, "StartCharge", mock.Anything, mock.Anything)
+	env.AssertNotCalled(t, "GetCharge", mock.Anything, mock.Anything)
+}
+
 func TestOrderShipmentStatus(t *testing.T) {
 	s := testsuite.WorkflowTestSuite{}
 	env := s.NewTestWorkflowEnvironment()
 	var a *order.Activities
 
-	env.RegisterActivity(a.ReserveItems)
-	env.OnActivity(a.Charge, mock.Anything, mock.Anything).Return(func(ctx context.Context, input *order.ChargeInput) (*order.ChargeResult, error) {
+	env.OnActivity(a.ReserveItems, mock.Anything, mock.Anything).Return(reserveItems)
+	env.OnActivity(a.StartCharge, mock.Anything, mock.Anything).Return(func(ctx context.Context, input *order.ChargeInput) (*order.StartChargeResult, error) {
+		return &order.StartChargeResult{ID: input.IdempotencyKey}, nil
+	})
+	env.OnActivity(a.GetCharge, mock.Anything, mock.Anything).Return(func(ctx context.Context, input *order.GetChargeInput) (*order.ChargeResult, error) {
 		return &order.ChargeResult{Success: true}, nil
 	})
 	env.OnActivity(a.UpdateOrderStatus, mock.Anything, mock.Anything).Return(func(ctx context.Context, input *order.OrderStatusUpdate) error {
 		return nil
 	})
 	env.OnWorkflow(shipment.Shipment, mock.Anything, mock.Anything).Return(func(ctx workflow.Context, input *shipment.ShipmentInput) (*shipment.ShipmentResult, error) {
+		env.SignalWorkflow(
+			shipment.ShipmentStatusUpdatedSignalName,
+			shipment.ShipmentStatusUpdatedSignal{
+				ShipmentID: input.ID,
+				Status:     shipment.ShipmentStatusBooked,
+				UpdatedAt:  env.Now(),
+				Escalation: &shipment.Escalation{
+					Status:   shipment.ShipmentStatusBooked,
+					DueAt:    env.Now(),
+					RaisedAt: env.Now(),
+				},
+			},
+		)
 		env.SignalWorkflow(
 			shipment.ShipmentStatusUpdatedSignalName,
 			shipment.ShipmentStatusUpdatedSignal{
 				ShipmentID: input.ID,
 				Status:     shipment.ShipmentStatusDelivered,
 				UpdatedAt:  env.Now(),
+				Event: &shipment.TrackingEvent{
+					Status:    shipment.ShipmentStatusDelivered,
+					Timestamp: env.Now(),
+					Location:  "Front door",
+				},
 			},
 		)
 
@@ -101,6 +186,10 @@ func TestOrderShipmentStatus(t *testing.T) {
 
 	f := status.Fulfillments[0]
 	assert.Equal(t, shipment.ShipmentStatusDelivered, f.Shipment.Status)
+	require.NotNil(t, f.Shipment.LatestEvent)
+	assert.Equal(t, "Front door", f.Shipment.LatestEvent.Location)
+	require.Len(t, f.Shipment.Escalations, 1)
+	assert.Equal(t, shipment.ShipmentStatusBooked, f.Shipment.Escalations[0].Status)
 }
 
 func TestOrderAmendWithUnavailableItems(t *testing.T) {
@@ -108,8 +197,11 @@ func TestOrderAmendWithUnavailableItems(t *testing.T) {
 	env := s.NewTestWorkflowEnvironment()
 	var a *order.Activities
 
-	env.RegisterActivity(a.ReserveItems)
-	env.OnActivity(a.Charge, mock.Anything, mock.Anything).Return(func(ctx context.Context, input *order.ChargeInput) (*order.ChargeResult, error) {
+	env.OnActivity(a.ReserveItems, mock.Anything, mock.Anything).Return(reserveItems)
+	env.OnActivity(a.StartCharge, mock.Anything, mock.Anything).Return(func(ctx context.Context, input *order.ChargeInput) (*order.StartChargeResult, error) {
+		return &order.StartChargeResult{ID: input.IdempotencyKey}, nil
+	})
+	env.OnActivity(a.GetCharge, mock.Anything, mock.Anything).Return(func(ctx context.Context, input *order.GetChargeInput) (*order.ChargeResult, error) {
 		return &order.ChargeResult{Success: true}, nil
 	})
 	env.OnActivity(a.UpdateOrderStatus, mock.Anything, mock.Anything).Return(func(ctx context.Context, input *order.OrderStatusUpdate) error {
@@ -199,10 +291,17 @@ func TestOrderCancelWithUnavailableItems(t *testing.T) {
 	env := s.NewTestWorkflowEnvironment()
 	var a *order.Activities
 
-	env.RegisterActivity(a.ReserveItems)
+	env.OnActivity(a.ReserveItems, mock.Anything, mock.Anything).Return(reserveItems)
 	env.OnActivity(a.UpdateOrderStatus, mock.Anything, mock.Anything).Return(func(ctx context.Context, input *order.OrderStatusUpdate) error {
 		return nil
 	})
+	// Only the available items were reserved, so only they are released.
+	env.OnActivity(a.RestockItems, mock.Anything, mock.Anything).Return(func(ctx context.Context, input *order.RestockItemsInput) error {
+		assert.Equal(t, "1234:2:released", input.Reference)
+		assert.Equal(t, "Warehouse A", input.Location)
+		assert.Equal(t, "test2", input.Items[0].SKU)
+		return nil
+	}).Once()
 
 	orderInput := order.OrderInput{
 		ID:         "1234",
@@ -230,6 +329,49 @@ func TestOrderCancelWithUnavailableItems(t *testing.T) {
 	var result order.OrderResult
 	err := env.GetWorkflowResult(&result)
 	assert.NoError(t, err)
+
+	assert.Equal(t, order.OrderStatusCancelled, result.Status)
+	env.AssertExpectations(t)
+}
+
+func TestOrderCancelReleaseStockVersion(t *testing.T) {
+	s := testsuite.WorkflowTestSuite{}
+	env := s.NewTestWorkflowEnvironment()
+	var a *order.Activities
+
+	// Orders reserved before stock was deducted have none to return when they are cancelled.
+	env.OnGetVersion("ReleaseStock", workflow.DefaultVersion, 1).Return(workflow.DefaultVersion)
+
+	env.OnActivity(a.ReserveItems, mock.Anything, mock.Anything).Return(reserveItems)
+	env.OnActivity(a.UpdateOrderStatus, mock.Anything, mock.Anything).Return(nil)
+	env.OnActivity(a.RestockItems, mock.Anything, mock.Anything).Return(nil)
+
+	env.RegisterDelayedCallback(func() {
+		env.SignalWorkflow(
+			order.CustomerActionSignalName,
+			order.CustomerActionSignal{
+				Action: order.CustomerActionCancel,
+			},
+		)
+	}, 1)
+
+	env.ExecuteWorkflow(
+		order.Order,
+		&order.OrderInput{
+			ID:         "1234",
+			CustomerID: "1234",
+			Items: []*order.Item{
+				{SKU: "Adidas", Quantity: 1},
+				{SKU: "test2", Quantity: 3},
+			},
+		},
+	)
+
+	var result order.OrderResult
+	require.NoError(t, env.GetWorkflowResult(&result))
+	assert.Equal(t, order.OrderStatusCancelled, result.Status)
+
+	env.AssertNumberOfCalls(t, "RestockItems", 0)
 }
 
 func TestOrderCancelAfterTimeout(t *testing.T) {
@@ -237,10 +379,17 @@ func TestOrderCancelAfterTimeout(t *testing.T) {
 	env := s.NewTestWorkflowEnvironment()
 	var a *order.Activities
 
-	env.RegisterActivity(a.ReserveItems)
+	env.OnActivity(a.ReserveItems, mock.Anything, mock.Anything).Return(reserveItems)
 	env.OnActivity(a.UpdateOrderStatus, mock.Anything, mock.Anything).Return(func(ctx context.Context, input *order.OrderStatusUpdate) error {
 		return nil
 	})
+	// Only the available items were reserved, so only they are released.
+	env.OnActivity(a.RestockItems, mock.Anything, mock.Anything).Return(func(ctx context.Context, input *order.RestockItemsInput) error {
+		assert.Equal(t, "1234:2:released", input.Reference)
+		assert.Equal(t, "Warehouse A", input.Location)
+		assert.Equal(t, "test2", input.Items[0].SKU)
+		return nil
+	}).Once()
 
 	orderInput := order.OrderInput{
 		ID:         "1234",
@@ -261,4 +410,511 @@ func TestOrderCancelAfterTimeout(t *testing.T) {
 	assert.NoError(t, err)
 
 	assert.Equal(t, order.OrderStatusTimedOut, result.Status)
+	env.AssertExpectations(t)
+}
+
+func TestOrderCancelWhileShipping(t *testing.T) {
+	s := testsuite.WorkflowTestSuite{}
+	env := s.NewTestWorkflowEnvironment()
+	var a *order.Activities
+
+	env.OnActivity(a.ReserveItems, mock.Anything, mock.Anything).Return(reserveItems)
+	env.OnActivity(a.StartCharge, mock.Anything, mock.Anything).Return(func(ctx context.Context, input *order.ChargeInput) (*order.StartChargeResult, error) {
+		return &order.StartChargeResult{ID: input.IdempotencyKey}, nil
+	})
+	env.OnActivity(a.GetCharge, mock.Anything, mock.Anything).Return(func(ctx context.Context, input *order.GetChargeInput) (*order.ChargeResult, error) {
+		return &order.ChargeResult{Success: true, InvoiceReference: input.ChargeID}, nil
+	})
+	env.OnActivity(a.UpdateOrderStatus, mock.Anything, mock.Anything).Return(func(ctx context.Context, input *order.OrderStatusUpdate) error {
+		return nil
+	})
+	env.OnActivity(a.RefundItems, mock.Anything, mock.Anything).Return(func(ctx context.Context, input *order.RefundItemsInput) (*order.RefundResult, error) {
+		assert.Equal(t, "1234:1:cancelled", input.Reference)
+		return &order.RefundResult{Reference: input.Reference, Total: 1200}, nil
+	}).Once()
+	env.OnActivity(a.RestockItems, mock.Anything, mock.Anything).Return(func(ctx context.Context, input *order.RestockItemsInput) error {
+		assert.Equal(t, "1234:1:released", input.Reference)
+		return nil
+	}).Once()
+	// Mocked child workflows are not delivered cancellation requests, so a fake Shipment workflow
+	// stands in which is cancelled before dispatch.
+	env.RegisterWorkflowWithOptions(func(ctx workflow.Context, input *shipment.ShipmentInput) (*shipment.ShipmentResult, error) {
+		ctx.Done().Receive(ctx, nil)
+
+		ctx, _ = workflow.NewDisconnectedContext(ctx)
+		err := workflow.SignalExternalWorkflow(ctx, input.RequestorWID, "",
+			shipment.ShipmentStatusUpdatedSignalName,
+			shipment.ShipmentStatusUpdatedSignal{
+				ShipmentID:   input.ID,
+				Status:       shipment.ShipmentStatusCancelled,
+				UpdatedAt:    workflow.Now(ctx),
+				Cancellation: &shipment.Cancellation{RequestedAt: workflow.Now(ctx), Cancelled: true},
+			},
+		).Get(ctx, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		return nil, temporal.NewCanceledError()
+	}, workflow.RegisterOptions{Name: "Shipment"})
+
+	env.RegisterDelayedCallback(func() {
+		env.SignalWorkflow(order.CustomerActionSignalName, order.CustomerActionSignal{Action: order.CustomerActionCancel})
+	}, time.Minute)
+
+	env.ExecuteWorkflow(order.Order, &order.OrderInput{
+		ID:         "1234",
+		CustomerID: "1234",
+		Items:      []*order.Item{{SKU: "test1", Quantity: 1}},
+	})
+
+	var result order.OrderResult
+	require.NoError(t, env.GetWorkflowResult(&result))
+	assert.Equal(t, order.OrderStatusCancelled, result.Status)
+
+	var status order.OrderStatus
+	v, err := env.QueryWorkflow(order.StatusQuery, nil)
+	require.NoError(t, err)
+	require.NoError(t, v.Get(&status))
+
+	f := status.Fulfillments[0]
+	assert.Equal(t, order.FulfillmentStatusCancelled, f.Status)
+	assert.Equal(t, shipment.ShipmentStatusCancelled, f.Shipment.Status)
+	require.NotNil(t, f.Shipment.Cancellation)
+	assert.True(t, f.Shipment.Cancellation.Cancelled)
+	require.NotNil(t, f.Refund)
+	assert.Equal(t, int32(1200), f.Refund.Total)
+}
+
+func TestOrderBackorderRestocked(t *testing.T) {
+	s := testsuite.WorkflowTestSuite{}
+	env := s.NewTestWorkflowEnvironment()
+	var a *order.Activities
+
+	restocked := false
+
+	env.OnActivity(a.ReserveItems, mock.Anything, mock.Anything).Return(func(ctx context.Context, input *order.ReserveItemsInput) (*order.ReserveItemsResult, error) {
+		if input.Reference == "" || !restocked {
+			return reserveItems(ctx, input)
+		}
+
+		assert.Equal(t, "1234:1:backorder:2", input.Reference)
+		assert.True(t, input.ShipComplete)
+		return &order.ReserveItemsResult{
+			Reservations: []*order.Reservation{{Available: true, Location: "Warehouse B", Items: input.Items}},
+		}, nil
+	})
+	env.OnActivity(a.BackorderItems, mock.Anything, mock.Anything).Return(func(ctx context.Context, input *order.BackorderItemsInput) error {
+		assert.Equal(t, "1234:1", input.Reference)
+		assert.NotEmpty(t, input.WorkflowID)
+		assert.Equal(t, "Adidas", input.Items[0].SKU)
+		return nil
+	}).Once()
+	env.OnActivity(a.RemoveBackorder, mock.Anything, "1234:1").Return(nil).Once()
+	env.OnActivity(a.StartCharge, mock.Anything, mock.Anything).Return(func(ctx context.Context, input *order.ChargeInput) (*order.StartChargeResult, error) {
+		return &order.StartChargeResult{ID: input.IdempotencyKey}, nil
+	})
+	env.OnActivity(a.GetCharge, mock.Anything, mock.Anything).Return(func(ctx context.Context, input *order.GetChargeInput) (*order.ChargeResult, error) {
+		return &order.ChargeResult{Success: true}, nil
+	})
+	env.OnActivity(a.UpdateOrderStatus, mock.Anything, mock.Anything).Return(func(ctx context.Context, input *order.OrderStatusUpdate) error {
+		return nil
+	})
+	env.OnWorkflow(shipment.Shipment, mock.Anything, mock.Anything).Return(func(ctx workflow.Context, input *shipment.ShipmentInput) (*shipment.ShipmentResult, error) {
+		return &shipment.ShipmentResult{CourierReference: "test"}, nil
+	})
+
+	orderInput := order.OrderInput{
+		ID:         "1234",
+		CustomerID: "1234",
+		Items: []*order.Item{
+			{SKU: "Adidas", Quantity: 1},
+			{SKU: "test2", Quantity: 3},
+		},
+	}
+
+	env.RegisterDelayedCallback(func() {
+		env.SignalWorkflow(
+			order.CustomerActionSignalName,
+			order.CustomerActionSignal{
+				Action: order.CustomerActionBackorder,
+			},
+		)
+	}, time.Second*1)
+
+	env.RegisterDelayedCallback(func() {
+		var status order.OrderStatus
+		v, err := env.QueryWorkflow(order.StatusQuery, nil)
+		require.NoError(t, err)
+		require.NoError(t, v.Get(&status))
+
+		f := status.Fulfillments[0]
+		assert.Equal(t, order.FulfillmentStatusBackordered, f.Status)
+		assert.Equal(t, 1, f.Backorder.Attempts)
+
+		restocked = true
+		env.SignalWorkflow(
+			inventory.RestockSignalName,
+			inventory.RestockSignal{Reference: "1234:1", SKUs: []string{"Adidas"}},
+		)
+	}, time.Hour*24)
+
+	env.ExecuteWorkflow(
+		order.Order,
+		&orderInput,
+	)
+
+	var result order.OrderResult
+	err := env.GetWorkflowResult(&result)
+	assert.NoError(t, err)
+	assert.Equal(t, order.OrderStatusCompleted, result.Status)
+
+	var status order.OrderStatus
+	v, err := env.QueryWorkflow(order.StatusQuery, nil)
+	require.NoError(t, err)
+	require.NoError(t, v.Get(&status))
+
+	f := status.Fulfillments[0]
+	assert.Equal(t, order.FulfillmentStatusCompleted, f.Status)
+	assert.Equal(t, "Warehouse B", f.Location)
+	assert.Equal(t, 2, f.Backorder.Attempts)
+
+	env.AssertWorkflowNumberOfCalls(t, "Shipment", 2)
+	env.AssertExpectations(t)
+}
+
+func TestOrderShipCompleteHeld(t *testing.T) {
+	s := testsuite.WorkflowTestSuite{}
+	env := s.NewTestWorkflowEnvironment()
+	var a *order.Activities
+
+	restocked := false
+
+	env.OnActivity(a.ReserveItems, mock.Anything, mock.Anything).Return(func(ctx context.Context, input *order.ReserveItemsInput) (*order.ReserveItemsResult, error) {
+		assert.True(t, input.ShipComplete)
+		// No warehouse stocks every item until the unavailable item is restocked, so none are reserved.
+		available := input.Reference != "" && restocked
+		location := ""
+		if available {
+			location = "Warehouse B"
+		}
+		return &order.ReserveItemsResult{
+			Reservations: []*order.Reservation{{Available: available, Location: location, Items: input.Items}},
+		}, nil
+	})
+	env.OnActivity(a.BackorderItems, mock.Anything, mock.Anything).Return(nil).Once()
+	env.OnActivity(a.RemoveBackorder, mock.Anything, "1234:1").Return(nil).Once()
+	env.OnActivity(a.StartCharge, mock.Anything, mock.Anything).Return(func(ctx context.Context, input *order.ChargeInput) (*order.StartChargeResult, error) {
+		return &order.StartChargeResult{ID: input.IdempotencyKey}, nil
+	})
+	env.OnActivity(a.GetCharge, mock.Anything, mock.Anything).Return(&order.ChargeResult{Success: true}, nil)
+
+	var statuses []string
+	env.OnActivity(a.UpdateOrderStatus, mock.Anything, mock.Anything).Return(func(ctx context.Context, input *order.OrderStatusUpdate) error {
+		statuses = append(statuses, input.Status)
+		return nil
+	})
+
+	var shipped [][]shipment.Item
+	env.OnWorkflow(shipment.Shipment, mock.Anything, mock.Anything).Return(func(ctx workflow.Context, input *shipment.ShipmentInput) (*shipment.ShipmentResult, error) {
+		shipped = append(shipped, input.Items)
+		return &shipment.ShipmentResult{CourierReference: "test"}, nil
+	})
+
+	env.RegisterDelayedCallback(func() {
+		var status order.OrderStatus
+		v, err := env.QueryWorkflow(order.StatusQuery, nil)
+		require.NoError(t, err)
+		require.NoError(t, v.Get(&status))
+
+		// The whole order is held, without asking the customer whether to ship part of it.
+		require.Len(t, status.Fulfillments, 1)
+		assert.Equal(t, order.FulfillmentStatusBackordered, status.Fulfillments[0].Status)
+		assert.Len(t, status.Fulfillments[0].Items, 2)
+
+		restocked = true
+		env.SignalWorkflow(
+			inventory.RestockSignalName,
+			inventory.RestockSignal{Reference: "1234:1", SKUs: []string{"Adidas"}},
+		)
+	}, time.Hour*24)
+
+	env.ExecuteWorkflow(
+		order.Order,
+		&order.OrderInput{
+			ID:           "1234",
+			CustomerID:   "1234",
+			ShipComplete: true,
+			Items: []*order.Item{
+				{SKU: "Adidas", Quantity: 1},
+				{SKU: "test2", Quantity: 3},
+			},
+		},
+	)
+
+	var result order.OrderResult
+	require.NoError(t, env.GetWorkflowResult(&result))
+	assert.Equal(t, order.OrderStatusCompleted, result.Status)
+
+	assert.NotContains(t, statuses, order.OrderStatusCustomerActionRequired)
+	require.Len(t, shipped, 1)
+	assert.Len(t, shipped[0], 2)
+
+	env.AssertExpectations(t)
+}
+
+func TestOrderBackorderExpires(t *testing.T) {
+	s := testsuite.WorkflowTestSuite{}
+	env := s.NewTestWorkflowEnvironment()
+	var a *order.Activities
+
+	env.OnActivity(a.ReserveItems, mock.Anything, mock.Anything).Return(reserveItems)
+	env.OnActivity(a.BackorderItems, mock.Anything, mock.Anything).Return(nil).Once()
+	env.OnActivity(a.RemoveBackorder, mock.Anything, "1234:1").Return(nil).Once()
+	env.OnActivity(a.UpdateOrderStatus, mock.Anything, mock.Anything).Return(func(ctx context.Context, input *order.OrderStatusUpdate) error {
+		return nil
+	})
+
+	orderInput := order.OrderInput{
+		ID:         "1234",
+		CustomerID: "1234",
+		Items: []*order.Item{
+			{SKU: "Adidas", Quantity: 1},
+		},
+	}
+
+	env.RegisterDelayedCallback(func() {
+		env.SignalWorkflow(
+			order.CustomerActionSignalName,
+			order.CustomerActionSignal{
+				Action: order.CustomerActionBackorder,
+			},
+		)
+	}, time.Second*1)
+
+	// A restock which still leaves too little stock does not satisfy the backorder.
+	env.RegisterDelayedCallback(func() {
+		env.SignalWorkflow(
+			inventory.RestockSignalName,
+			inventory.RestockSignal{Reference: "1234:1", SKUs: []string{"Adidas"}},
+		)
+	}, time.Hour*24)
+
+	env.ExecuteWorkflow(
+		order.Order,
+		&orderInput,
+	)
+
+	var result order.OrderResult
+	err := env.GetWorkflowResult(&result)
+	assert.NoError(t, err)
+	assert.Equal(t, order.OrderStatusCancelled, result.Status)
+
+	var status order.OrderStatus
+	v, err := env.QueryWorkflow(order.StatusQuery, nil)
+	require.NoError(t, err)
+	require.NoError(t, v.Get(&status))
+
+	f := status.Fulfillments[0]
+	assert.Equal(t, order.FulfillmentStatusCancelled, f.Status)
+	assert.Equal(t, 2, f.Backorder.Attempts)
+
+	env.AssertExpectations(t)
+}
+
+func TestOrderScheduled(t *testing.T) {
+	s := testsuite.WorkflowTestSuite{}
+	env := s.NewTestWorkflowEnvironment()
+	var a *order.Activities
+
+	start := time.Date(2024, time.March, 1, 9, 0, 0, 0, time.UTC)
+	notBefore := start.Add(48 * time.Hour)
+	env.SetStartTime(start)
+
+	var reservedAt, chargedAt time.Time
+
+	env.OnActivity(a.ReserveItems, mock.Anything, mock.Anything).Return(func(ctx context.Context, input *order.ReserveItemsInput) (*order.ReserveItemsResult, error) {
+		reservedAt = env.Now()
+		return reserveItems(ctx, input)
+	})
+	env.OnActivity(a.StartCharge, mock.Anything, mock.Anything).Return(func(ctx context.Context, input *order.ChargeInput) (*order.StartChargeResult, error) {
+		chargedAt = env.Now()
+		return &order.StartChargeResult{ID: input.IdempotencyKey}, nil
+	})
+	env.OnActivity(a.GetCharge, mock.Anything, mock.Anything).Return(func(ctx context.Context, input *order.GetChargeInput) (*order.ChargeResult, error) {
+		return &order.ChargeResult{Success: true}, nil
+	})
+	env.OnActivity(a.UpdateOrderStatus, mock.Anything, mock.Anything).Return(func(ctx context.Context, input *order.OrderStatusUpdate) error {
+		return nil
+	})
+	env.OnWorkflow(shipment.Shipment, mock.Anything, mock.Anything).Return(func(ctx workflow.Context, input *shipment.ShipmentInput) (*shipment.ShipmentResult, error) {
+		return &shipment.ShipmentResult{CourierReference: "test"}, nil
+	})
+
+	orderInput := order.OrderInput{
+		ID:         "1234",
+		CustomerID: "1234",
+		Items: []*order.Item{
+			{SKU: "test1", Quantity: 1},
+		},
+		NotBefore: &notBefore,
+	}
+
+	env.RegisterDelayedCallback(func() {
+		var status order.OrderStatus
+		v, err := env.QueryWorkflow(order.StatusQuery, nil)
+		require.NoError(t, err)
+		require.NoError(t, v.Get(&status))
+
+		assert.Equal(t, order.OrderStatusScheduled, status.Status)
+		assert.True(t, notBefore.Equal(*status.ScheduledFor))
+		assert.Empty(t, status.Fulfillments)
+
+		// Only cancellation applies to a scheduled order.
+		env.SignalWorkflow(
+			order.CustomerActionSignalName,
+			order.CustomerActionSignal{
+				Action: order.CustomerActionAmend,
+			},
+		)
+	}, time.Hour)
+
+	env.ExecuteWorkflow(
+		order.Order,
+		&orderInput,
+	)
+
+	var result order.OrderResult
+	require.NoError(t, env.GetWorkflowResult(&result))
+	assert.Equal(t, order.OrderStatusCompleted, result.Status)
+
+	assert.False(t, reservedAt.Before(notBefore), "items are reserved once the order is due")
+	assert.False(t, chargedAt.Before(notBefore), "items are charged once the order is due")
+
+	env.AssertWorkflowNumberOfCalls(t, "Shipment", 1)
+}
+
+func TestOrderCancelWhileScheduled(t *testing.T) {
+	s := testsuite.WorkflowTestSuite{}
+	env := s.NewTestWorkflowEnvironment()
+	var a *order.Activities
+
+	notBefore := env.Now().Add(48 * time.Hour)
+
+	env.OnActivity(a.ReserveItems, mock.Anything, mock.Anything).Return(reserveItems).Never()
+	env.OnActivity(a.UpdateOrderStatus, mock.Anything, mock.Anything).Return(func(ctx context.Context, input *order.OrderStatusUpdate) error {
+		return nil
+	})
+
+	orderInput := order.OrderInput{
+		ID:         "1234",
+		CustomerID: "1234",
+		Items: []*order.Item{
+			{SKU: "test1", Quantity: 1},
+		},
+		NotBefore: &notBefore,
+	}
+
+	env.RegisterDelayedCallback(func() {
+		env.SignalWorkflow(
+			order.CustomerActionSignalName,
+			order.CustomerActionSignal{
+				Action: order.CustomerActionCancel,
+			},
+		)
+	}, time.Hour)
+
+	env.ExecuteWorkflow(
+		order.Order,
+		&orderInput,
+	)
+
+	var result order.OrderResult
+	require.NoError(t, env.GetWorkflowResult(&result))
+	assert.Equal(t, order.OrderStatusCancelled, result.Status)
+
+	env.AssertExpectations(t)
+}
+
+func TestOrderPreorder(t *testing.T) {
+	s := testsuite.WorkflowTestSuite{}
+	env := s.NewTestWorkflowEnvironment()
+	var a *order.Activities
+
+	start := time.Date(2024, time.March, 1, 9, 0, 0, 0, time.UTC)
+	releasedAt := start.Add(72 * time.Hour)
+	env.SetStartTime(start)
+
+	chargedAt := make(map[string]time.Time)
+
+	env.OnActivity(a.ReserveItems, mock.Anything, mock.Anything).Return(func(ctx context.Context, input *order.ReserveItemsInput) (*order.ReserveItemsResult, error) {
+		if input.Reference != "" {
+			// The console has been released and is in stock.
+			assert.Equal(t, "1234:2:backorder:1", input.Reference)
+			assert.False(t, env.Now().Before(releasedAt))
+			return &order.ReserveItemsResult{
+				Reservations: []*order.Reservation{{Available: true, Location: "Warehouse B", Items: input.Items}},
+			}, nil
+		}
+
+		return &order.ReserveItemsResult{
+			Reservations: []*order.Reservation{
+				{Available: true, Location: "Warehouse A", Items: input.Items[:1]},
+				{Available: false, Items: input.Items[1:], ReleasedAt: &releasedAt},
+			},
+		}, nil
+	})
+	env.OnActivity(a.BackorderItems, mock.Anything, mock.Anything).Return(nil).Once()
+	env.OnActivity(a.RemoveBackorder, mock.Anything, "1234:2").Return(nil).Once()
+	env.OnActivity(a.StartCharge, mock.Anything, mock.Anything).Return(func(ctx context.Context, input *order.ChargeInput) (*order.StartChargeResult, error) {
+		chargedAt[input.Reference] = env.Now()
+		return &order.StartChargeResult{ID: input.IdempotencyKey}, nil
+	})
+	env.OnActivity(a.GetCharge, mock.Anything, mock.Anything).Return(func(ctx context.Context, input *order.GetChargeInput) (*order.ChargeResult, error) {
+		return &order.ChargeResult{Success: true}, nil
+	})
+	env.OnActivity(a.UpdateOrderStatus, mock.Anything, mock.Anything).Return(func(ctx context.Context, input *order.OrderStatusUpdate) error {
+		return nil
+	})
+	env.OnWorkflow(shipment.Shipment, mock.Anything, mock.Anything).Return(func(ctx workflow.Context, input *shipment.ShipmentInput) (*shipment.ShipmentResult, error) {
+		return &shipment.ShipmentResult{CourierReference: "test"}, nil
+	})
+
+	orderInput := order.OrderInput{
+		ID:         "1234",
+		CustomerID: "1234",
+		Items: []*order.Item{
+			{SKU: "test1", Quantity: 1},
+			{SKU: "console", Quantity: 1},
+		},
+	}
+
+	env.RegisterDelayedCallback(func() {
+		var status order.OrderStatus
+		v, err := env.QueryWorkflow(order.StatusQuery, nil)
+		require.NoError(t, err)
+		require.NoError(t, v.Get(&status))
+
+		assert.Equal(t, order.OrderStatusProcessing, status.Status)
+		assert.Equal(t, order.FulfillmentStatusCompleted, status.Fulfillments[0].Status)
+
+		f := status.Fulfillments[1]
+		assert.Equal(t, order.FulfillmentStatusPreordered, f.Status)
+		assert.True(t, releasedAt.Equal(*f.ReleasedAt))
+	}, time.Hour)
+
+	env.ExecuteWorkflow(
+		order.Order,
+		&orderInput,
+	)
+
+	var result order.OrderResult
+	require.NoError(t, env.GetWorkflowResult(&result))
+	assert.Equal(t, order.OrderStatusCompleted, result.Status)
+
+	assert.True(t, chargedAt["1234:1"].Before(releasedAt))
+	assert.False(t, chargedAt["1234:2"].Before(releasedAt))
+
+	env.AssertWorkflowNumberOfCalls(t, "Shipment", 2)
+	env.AssertExpectations(t)
 }
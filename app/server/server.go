@@ -14,6 +14,7 @@ import (
 	"github.com/temporalio/reference-app-orders-go/app/config"
 	"github.com/temporalio/reference-app-orders-go/app/db"
 	"github.com/temporalio/reference-app-orders-go/app/fraud"
+	"github.com/temporalio/reference-app-orders-go/app/inventory"
 	"github.com/temporalio/reference-app-orders-go/app/order"
 	"github.com/temporalio/reference-app-orders-go/app/shipment"
 	"go.temporal.io/sdk/client"
@@ -163,7 +164,7 @@ func RunAPIServers(ctx context.Context, config config.AppConfig, client client.C
 
 	db := db.CreateDB(config)
 
-	if slices.Contains(services, "orders") || slices.Contains(services, "shipment") {
+	if slices.Contains(services, "billing") || slices.Contains(services, "fraud") || slices.Contains(services, "inventory") || slices.Contains(services, "order") || slices.Contains(services, "shipment") {
 		err := db.Connect(context.TODO())
 		if err != nil {
 			return fmt.Errorf("failed to connect to database: %w", err)
@@ -184,11 +185,15 @@ func RunAPIServers(ctx context.Context, config config.AppConfig, client client.C
 		switch service {
 		case "billing":
 			g.Go(func() error {
-				return runAPIServer(ctx, port, billing.Router(client, logger), logger)
+				return runAPIServer(ctx, port, billing.Router(client, db, logger), logger)
 			})
 		case "fraud":
 			g.Go(func() error {
-				return runAPIServer(ctx, port, fraud.Router(logger), logger)
+				return runAPIServer(ctx, port, fraud.Router(db, logger), logger)
+			})
+		case "inventory":
+			g.Go(func() error {
+				return runAPIServer(ctx, port, inventory.Router(client, db, logger), logger)
 			})
 		case "order":
 			g.Go(func() error {
@@ -196,7 +201,7 @@ func RunAPIServers(ctx context.Context, config config.AppConfig, client client.C
 			})
 		case "shipment":
 			g.Go(func() error {
-				return runAPIServer(ctx, port, shipment.Router(client, db, logger), logger)
+				return runAPIServer(ctx, port, shipment.Router(client, db, logger, config.CarrierWebhookSecrets), logger)
 			})
 		default:
 			return fmt.Errorf("unknown service: %s", service)
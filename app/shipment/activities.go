@@ -4,39 +4,243 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"go.temporal.io/sdk/activity"
+	"go.temporal.io/sdk/temporal"
 )
 
 // Activities implements the shipment package's Activities.
 // Any state shared by the worker among the activities is stored here.
 type Activities struct {
 	ShipmentURL string
+
+	// Carriers are the carriers shipments may be booked with, by name.
+	// If no carriers are configured the simulator is used.
+	Carriers map[string]Carrier
+	// WarehouseCarriers maps a warehouse location to the names of the carriers which collect from it.
+	// Warehouses with no carriers configured may use any carrier.
+	WarehouseCarriers map[string][]string
+
+	// SLAs is the longest a shipment may remain in each status before being escalated.
+	// If not set DefaultShipmentSLAs is used.
+	SLAs map[string]time.Duration
+
+	simulatorOnce sync.Once
+	simulator     Carrier
 }
 
 var a Activities
 
+const (
+	// CarrierUnavailableErrorType is the error type returned when a carrier request fails temporarily.
+	// Errors of this type are retried.
+	CarrierUnavailableErrorType = "CarrierUnavailable"
+
+	// CarrierRejectedErrorType is the error type returned when a carrier refuses a request.
+	// Errors of this type are not retried.
+	CarrierRejectedErrorType = "CarrierRejected"
+
+	// CarrierNotConfiguredErrorType is the error type returned when a warehouse's carrier is not available.
+	// Errors of this type are not retried.
+	CarrierNotConfiguredErrorType = "CarrierNotConfigured"
+)
+
+// QuoteShipmentInput is the input for the QuoteShipment operation.
+// All fields except Location, Destination and Origin are required.
+type QuoteShipmentInput struct {
+	Carrier     string
+	Reference   string
+	Location    string
+	Destination *Address
+	Origin      *Address
+	Items       []Item
+}
+
 // BookShipmentInput is the input for the BookShipment operation.
-// All fields are required.
+// Location is the warehouse the carrier collects from. If Carrier is not set the
+// warehouse's first carrier is used, and if Service is not set its standard service.
+// Destination is the customer's address, if known. Origin is set instead for shipments collected
+// from the customer and delivered to the warehouse. All other fields are required.
 type BookShipmentInput struct {
-	Reference string
-	Items     []Item
+	Reference   string
+	Location    string
+	Destination *Address
+	Origin      *Address
+	Items       []Item
+
+	Carrier string
+	Service string
 }
 
 // BookShipmentResult is the result for the BookShipment operation.
 // CourierReference is recorded where available, to allow tracking enquiries.
 type BookShipmentResult struct {
+	Carrier          string
 	CourierReference string
+	TrackingURL      string
+}
+
+// carriers returns the names of the carriers which collect from a warehouse.
+func (a *Activities) carriers(location string) []string {
+	if names := a.WarehouseCarriers[location]; len(names) > 0 {
+		return names
+	}
+
+	if len(a.Carriers) == 0 {
+		return []string{SimulatorCarrierName}
+	}
+
+	names := make([]string, 0, len(a.Carriers))
+	for name := range a.Carriers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// carrier returns a carrier by name.
+func (a *Activities) carrier(name string) (Carrier, error) {
+	if c, ok := a.Carriers[name]; ok {
+		return c, nil
+	}
+
+	if name == SimulatorCarrierName && len(a.Carriers) == 0 {
+		a.simulatorOnce.Do(func() { a.simulator = NewSimulatorCarrier() })
+		return a.simulator, nil
+	}
+
+	return nil, temporal.NewNonRetryableApplicationError(
+		fmt.Sprintf("carrier %q is not configured", name),
+		CarrierNotConfiguredErrorType, nil,
+	)
+}
+
+// carrierActivityError converts an error from a carrier into an activity error,
+// so that only temporary failures are retried.
+func carrierActivityError(err error) error {
+	var ce *CarrierError
+	if !errors.As(err, &ce) {
+		// Unexpected errors, such as network failures, are retried.
+		return err
+	}
+
+	if ce.Temporary {
+		return temporal.NewApplicationError(ce.Error(), CarrierUnavailableErrorType, ce.Code)
+	}
+	return temporal.NewNonRetryableApplicationError(ce.Error(), CarrierRejectedErrorType, nil, ce.Code)
+}
+
+// ShipmentCarriers returns the names of the carriers which collect from a warehouse.
+func (a *Activities) ShipmentCarriers(_ context.Context, location string) ([]string, error) {
+	return a.carriers(location), nil
+}
+
+// ShipmentSLAs returns the longest a shipment may remain in each status before being escalated.
+func (a *Activities) ShipmentSLAs(_ context.Context) (map[string]time.Duration, error) {
+	if len(a.SLAs) > 0 {
+		return a.SLAs, nil
+	}
+	return DefaultShipmentSLAs, nil
+}
+
+// QuoteShipment asks a carrier for its prices to deliver the shipment to the customer.
+func (a *Activities) QuoteShipment(ctx context.Context, input *QuoteShipmentInput) ([]CarrierQuote, error) {
+	carrier, err := a.carrier(input.Carrier)
+	if err != nil {
+		return nil, err
+	}
+
+	quotes, err := carrier.Quote(ctx, &CarrierRequest{
+		Reference:   input.Reference,
+		Location:    input.Location,
+		Destination: input.Destination,
+		Origin:      input.Origin,
+		Items:       input.Items,
+	})
+	if err != nil {
+		return nil, carrierActivityError(err)
+	}
+
+	return quotes, nil
 }
 
 // BookShipment engages a courier who can deliver the shipment to the customer
-func (a *Activities) BookShipment(_ context.Context, input *BookShipmentInput) (*BookShipmentResult, error) {
+func (a *Activities) BookShipment(ctx context.Context, input *BookShipmentInput) (*BookShipmentResult, error) {
+	name := input.Carrier
+	if name == "" {
+		name = a.carriers(input.Location)[0]
+	}
+
+	carrier, err := a.carrier(name)
+	if err != nil {
+		return nil, err
+	}
+
+	booking, err := carrier.Book(ctx, &CarrierBookingRequest{
+		CarrierRequest: CarrierRequest{
+			Reference:   input.Reference,
+			Location:    input.Location,
+			Destination: input.Destination,
+			Origin:      input.Origin,
+			Items:       input.Items,
+		},
+		Service: input.Service,
+	})
+	if err != nil {
+		return nil, carrierActivityError(err)
+	}
+
+	activity.GetLogger(ctx).Info("Shipment booked", "carrier", booking.Carrier, "courierReference", booking.CourierReference)
+
 	return &BookShipmentResult{
-		CourierReference: input.Reference + ":1234",
+		Carrier:          booking.Carrier,
+		CourierReference: booking.CourierReference,
+		TrackingURL:      booking.TrackingURL,
 	}, nil
 }
 
+// CancelBookingInput is the input for the CancelBooking operation.
+type CancelBookingInput struct {
+	Carrier          string
+	CourierReference string
+}
+
+// CancelBookingResult is the result for the CancelBooking operation.
+// Cancelled is false if the carrier has already collected the shipment.
+type CancelBookingResult struct {
+	Cancelled bool
+}
+
+// CancelBooking asks a carrier to cancel a booking which it has not yet collected.
+// A booking the carrier no longer knows of is treated as already cancelled.
+func (a *Activities) CancelBooking(ctx context.Context, input *CancelBookingInput) (*CancelBookingResult, error) {
+	carrier, err := a.carrier(input.Carrier)
+	if err != nil {
+		return nil, err
+	}
+
+	err = carrier.Cancel(ctx, input.CourierReference)
+
+	var ce *CarrierError
+	switch {
+	case err == nil, errors.As(err, &ce) && ce.Code == CarrierErrorCodeNotFound:
+		activity.GetLogger(ctx).Info("Booking cancelled", "carrier", input.Carrier, "courierReference", input.CourierReference)
+		return &CancelBookingResult{Cancelled: true}, nil
+	case errors.As(err, &ce) && ce.Code == CarrierErrorCodeCollected:
+		return &CancelBookingResult{Cancelled: false}, nil
+	default:
+		return nil, carrierActivityError(err)
+	}
+}
+
 // UpdateShipmentStatus stores the Order status to the database.
 func (a *Activities) UpdateShipmentStatus(ctx context.Context, status *ShipmentStatusUpdate) error {
 	jsonInput, err := json.Marshal(status)
@@ -0,0 +1,111 @@
+package shipment_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/temporalio/reference-app-orders-go/app/shipment"
+	"go.temporal.io/sdk/temporal"
+	"go.temporal.io/sdk/testsuite"
+)
+
+// failingCarrier is a carrier whose bookings fail with the given error.
+type failingCarrier struct {
+	shipment.SimulatorCarrier
+	err error
+}
+
+func (c *failingCarrier) Name() string {
+	return "failing"
+}
+
+func (c *failingCarrier) Book(context.Context, *shipment.CarrierBookingRequest) (*shipment.CarrierBooking, error) {
+	return nil, c.err
+}
+
+func TestBookShipment(t *testing.T) {
+	testSuite := testsuite.WorkflowTestSuite{}
+	env := testSuite.NewTestActivityEnvironment()
+
+	a := &shipment.Activities{}
+	env.RegisterActivity(a.BookShipment)
+
+	input := shipment.BookShipmentInput{
+		Reference: "order1:1",
+		Location:  "Warehouse A",
+		Items:     []shipment.Item{{SKU: "test1", Quantity: 1}},
+	}
+
+	future, err := env.ExecuteActivity(a.BookShipment, &input)
+	require.NoError(t, err)
+
+	var result shipment.BookShipmentResult
+	require.NoError(t, future.Get(&result))
+	require.Equal(t, shipment.SimulatorCarrierName, result.Carrier)
+	require.NotEmpty(t, result.CourierReference)
+	require.Contains(t, result.TrackingURL, result.CourierReference)
+
+	// Booking again returns the same courier reference.
+	future, err = env.ExecuteActivity(a.BookShipment, &input)
+	require.NoError(t, err)
+
+	var again shipment.BookShipmentResult
+	require.NoError(t, future.Get(&again))
+	require.Equal(t, result, again)
+}
+
+func TestBookShipmentCarrierErrors(t *testing.T) {
+	tests := []struct {
+		name         string
+		warehouse    string
+		err          error
+		errorType    string
+		nonRetryable bool
+	}{
+		{
+			name:      "temporary carrier error",
+			warehouse: "Warehouse A",
+			err:       &shipment.CarrierError{Carrier: "failing", Code: shipment.CarrierErrorCodeUnavailable, Message: "try later", Temporary: true},
+			errorType: shipment.CarrierUnavailableErrorType,
+		},
+		{
+			name:         "rejected by carrier",
+			warehouse:    "Warehouse A",
+			err:          &shipment.CarrierError{Carrier: "failing", Code: shipment.CarrierErrorCodeInvalidRequest, Message: "no pickup from this address"},
+			errorType:    shipment.CarrierRejectedErrorType,
+			nonRetryable: true,
+		},
+		{
+			name:         "carrier not configured",
+			warehouse:    "Warehouse B",
+			errorType:    shipment.CarrierNotConfiguredErrorType,
+			nonRetryable: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			testSuite := testsuite.WorkflowTestSuite{}
+			env := testSuite.NewTestActivityEnvironment()
+
+			a := &shipment.Activities{
+				Carriers:          map[string]shipment.Carrier{"failing": &failingCarrier{err: tc.err}},
+				WarehouseCarriers: map[string][]string{"Warehouse A": {"failing"}, "Warehouse B": {"missing"}},
+			}
+			env.RegisterActivity(a.BookShipment)
+
+			_, err := env.ExecuteActivity(a.BookShipment, &shipment.BookShipmentInput{
+				Reference: "order1:1",
+				Location:  tc.warehouse,
+				Items:     []shipment.Item{{SKU: "test1", Quantity: 1}},
+			})
+
+			var appErr *temporal.ApplicationError
+			require.True(t, errors.As(err, &appErr))
+			require.Equal(t, tc.errorType, appErr.Type())
+			require.Equal(t, tc.nonRetryable, appErr.NonRetryable())
+		})
+	}
+}
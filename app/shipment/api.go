@@ -3,6 +3,7 @@ package shipment
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"log/slog"
 	"net/http"
 	"strings"
@@ -11,6 +12,7 @@ import (
 	"github.com/temporalio/reference-app-orders-go/app/db"
 	"go.temporal.io/api/serviceerror"
 	"go.temporal.io/sdk/client"
+	"go.temporal.io/sdk/temporal"
 )
 
 // TaskQueue is the default task queue for the Shipment system.
@@ -33,20 +35,53 @@ type handlers struct {
 	temporal client.Client
 	db       db.DB
 	logger   *slog.Logger
+
+	// webhookSecrets holds the key each carrier signs its webhook requests with.
+	webhookSecrets map[string]string
 }
 
 // ShipmentStatus holds the status of a Shipment.
+// The carrier fields are set once the shipment has been booked.
 type ShipmentStatus struct {
 	ID        string    `json:"id"`
 	Status    string    `json:"status"`
 	UpdatedAt time.Time `json:"updatedAt"`
 	Items     []Item    `json:"items"`
+
+	// Destination is the address the shipment is delivered to.
+	Destination *Address `json:"destination,omitempty"`
+	// Origin is the address the shipment is collected from, if it is not collected from a warehouse.
+	Origin *Address `json:"origin,omitempty"`
+
+	Carrier          string `json:"carrier,omitempty"`
+	CourierReference string `json:"courierReference,omitempty"`
+	TrackingURL      string `json:"trackingUrl,omitempty"`
+
+	// Location is where the carrier last reported the shipment to be.
+	Location string `json:"location,omitempty"`
+
+	// Events is the shipment's tracking timeline, oldest first.
+	Events []TrackingEvent `json:"events"`
+
+	// DueAt is when the shipment breaches the SLA for its status, if the status has one.
+	DueAt *time.Time `json:"dueAt,omitempty"`
+	// Escalations lists the SLAs the shipment has breached.
+	Escalations []Escalation `json:"escalations,omitempty"`
+	// Cancellation is set once the shipment has been asked to cancel, with the outcome.
+	Cancellation *Cancellation `json:"cancellation,omitempty"`
+
+	// Quote is the carrier quote chosen for the shipment.
+	Quote *CarrierQuote `json:"quote,omitempty"`
 }
 
 // ShipmentStatusUpdate is used to update the status of a Shipment.
+// DueAt and EscalatedAt are zero if the status has no SLA, or has not been escalated.
 type ShipmentStatusUpdate struct {
 	ID     string `json:"id"`
 	Status string `json:"status"`
+
+	DueAt       time.Time `json:"dueAt"`
+	EscalatedAt time.Time `json:"escalatedAt"`
 }
 
 // ListShipmentEntry is an entry in the Shipment list.
@@ -55,16 +90,30 @@ type ListShipmentEntry struct {
 	Status string `json:"status" db:"status" bson:"status"`
 }
 
-// Router implements the http.Handler interface for the Shipment API
-func Router(client client.Client, db db.DB, logger *slog.Logger) http.Handler {
+// AtRiskShipment is a shipment which has breached, or is soon due to breach, the SLA for its status.
+type AtRiskShipment struct {
+	ID          string     `json:"id"`
+	Status      string     `json:"status"`
+	DueAt       time.Time  `json:"dueAt"`
+	EscalatedAt *time.Time `json:"escalatedAt,omitempty"`
+}
+
+// defaultAtRiskWindow is how far ahead shipments due to breach their SLA are listed if no window is given.
+const defaultAtRiskWindow = 24 * time.Hour
+
+// Router implements the http.Handler interface for the Shipment API.
+// Webhooks are accepted from the carriers with a secret in webhookSecrets.
+func Router(client client.Client, db db.DB, logger *slog.Logger, webhookSecrets map[string]string) http.Handler {
 	r := http.NewServeMux()
 
-	h := handlers{temporal: client, db: db, logger: logger}
+	h := handlers{temporal: client, db: db, logger: logger, webhookSecrets: webhookSecrets}
 
 	r.HandleFunc("GET /shipments", h.handleListShipments)
+	r.HandleFunc("GET /shipments/at-risk", h.handleListAtRiskShipments)
 	r.HandleFunc("GET /shipments/{id}", h.handleGetShipment)
 	r.HandleFunc("POST /shipments/{id}", h.handleUpdateShipmentStatus)
 	r.HandleFunc("POST /shipments/{id}/status", h.handleUpdateShipmentCarrierStatus)
+	r.HandleFunc("POST /carriers/{carrier}/webhook", h.handleCarrierWebhook)
 
 	return r
 }
@@ -95,6 +144,45 @@ func (h *handlers) handleListShipments(w http.ResponseWriter, _ *http.Request) {
 	}
 }
 
+func (h *handlers) handleListAtRiskShipments(w http.ResponseWriter, r *http.Request) {
+	within := defaultAtRiskWindow
+	if v := r.URL.Query().Get("within"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			http.Error(w, "within must be a duration, such as 24h", http.StatusBadRequest)
+			return
+		}
+		within = d
+	}
+
+	var shipments []db.ShipmentStatus
+
+	if err := h.db.GetShipmentsDueBy(r.Context(), time.Now().Add(within), &shipments); err != nil {
+		h.logger.Error("Failed to list at-risk shipments", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	result := make([]AtRiskShipment, len(shipments))
+	for i, s := range shipments {
+		result[i] = AtRiskShipment{
+			ID:     s.ID,
+			Status: s.Status,
+			DueAt:  s.DueAt,
+		}
+		if !s.EscalatedAt.IsZero() {
+			result[i].EscalatedAt = &s.EscalatedAt
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		h.logger.Error("Failed to encode at-risk shipments", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
 func (h *handlers) handleGetShipment(w http.ResponseWriter, r *http.Request) {
 	var status ShipmentStatus
 
@@ -144,6 +232,13 @@ func (h *handlers) handleUpdateShipmentStatus(w http.ResponseWriter, r *http.Req
 		return
 	}
 
+	err = h.db.UpdateShipmentSLA(context.Background(), status.ID, status.DueAt, status.EscalatedAt)
+	if err != nil {
+		h.logger.Error("Failed to update shipment SLA: %v", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	w.WriteHeader(http.StatusOK)
 }
 
@@ -157,19 +252,44 @@ func (h *handlers) handleUpdateShipmentCarrierStatus(w http.ResponseWriter, r *h
 		return
 	}
 
-	err = h.temporal.SignalWorkflow(context.Background(),
+	handle, err := h.temporal.UpdateWorkflow(r.Context(), client.UpdateWorkflowOptions{
+		WorkflowID:   ShipmentWorkflowID(r.PathValue("id")),
+		UpdateName:   ShipmentCarrierStatusUpdateName,
+		Args:         []interface{}{signal},
+		WaitForStage: client.WorkflowUpdateStageCompleted,
+	})
+	if err == nil {
+		err = handle.Get(r.Context(), nil)
+	}
+	if err != nil {
+		var appErr *temporal.ApplicationError
+		switch {
+		case errors.As(err, new(*serviceerror.NotFound)):
+			http.Error(w, "Shipment not found", http.StatusNotFound)
+		case errors.As(err, &appErr) && appErr.Type() == InvalidShipmentStatusErrorType:
+			http.Error(w, appErr.Message(), http.StatusBadRequest)
+		case errors.As(err, &appErr) && appErr.Type() == InvalidShipmentTransitionErrorType:
+			http.Error(w, appErr.Message(), http.StatusConflict)
+		case errors.As(err, &appErr) && appErr.Type() == CarrierStatusUpdateUnsupportedErrorType:
+			// Shipments started before updates were validated still take carrier updates as signals.
+			h.signalShipmentCarrierStatus(w, r, signal)
+		default:
+			h.logger.Error("Failed to update shipment workflow: %v", "error", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+}
+
+func (h *handlers) signalShipmentCarrierStatus(w http.ResponseWriter, r *http.Request, signal ShipmentCarrierUpdateSignal) {
+	err := h.temporal.SignalWorkflow(r.Context(),
 		ShipmentWorkflowID(r.PathValue("id")), "",
 		ShipmentCarrierUpdateSignalName,
 		signal,
 	)
 	if err != nil {
-		if _, ok := err.(*serviceerror.NotFound); ok {
-			h.logger.Error("Failed to signal shipment workflow: %v", "error", err)
-			http.Error(w, "Shipment not found", http.StatusNotFound)
-		} else {
-			h.logger.Error("Failed to signal shipment workflow: %v", "error", err)
-			http.Error(w, err.Error(), http.StatusBadRequest)
-		}
+		h.logger.Error("Failed to signal shipment workflow: %v", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 }
@@ -18,14 +18,19 @@ import (
 	"github.com/temporalio/reference-app-orders-go/app/db"
 	"github.com/temporalio/reference-app-orders-go/app/shipment"
 	"github.com/testcontainers/testcontainers-go/modules/mongodb"
+	"go.temporal.io/sdk/client"
 	"go.temporal.io/sdk/mocks"
+	"go.temporal.io/sdk/temporal"
 )
 
 func TestShipmentUpdate(t *testing.T) {
 	ctx := context.Background()
 	c := mocks.NewClient(t)
 
-	c.On("SignalWorkflow", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	handle := mocks.NewWorkflowUpdateHandle(t)
+	handle.On("Get", mock.Anything, mock.Anything).Return(nil)
+
+	c.On("UpdateWorkflow", mock.Anything, mock.Anything).Return(handle, nil)
 
 	mongoDBContainer, err := mongodb.Run(ctx, "mongo:6")
 	require.NoError(t, err)
@@ -44,7 +49,7 @@ func TestShipmentUpdate(t *testing.T) {
 
 	logger := slog.Default()
 
-	r := shipment.Router(c, db, logger)
+	r := shipment.Router(c, db, logger, nil)
 	req, err := http.NewRequest("POST", "/shipments/test/status", strings.NewReader(`{"status":"dispatched"}`))
 	assert.NoError(t, err)
 
@@ -56,12 +61,52 @@ func TestShipmentUpdate(t *testing.T) {
 	assert.Equal(t, rr.Body.String(), "")
 
 	c.AssertCalled(t,
-		"SignalWorkflow",
+		"UpdateWorkflow",
 		mock.Anything,
-		shipment.ShipmentWorkflowID("test"), "",
-		"ShipmentCarrierUpdate",
-		shipment.ShipmentCarrierUpdateSignal{
-			Status: shipment.ShipmentStatusDispatched,
+		client.UpdateWorkflowOptions{
+			WorkflowID: shipment.ShipmentWorkflowID("test"),
+			UpdateName: shipment.ShipmentCarrierStatusUpdateName,
+			Args: []interface{}{shipment.ShipmentCarrierUpdateSignal{
+				Status: shipment.ShipmentStatusDispatched,
+			}},
+			WaitForStage: client.WorkflowUpdateStageCompleted,
 		},
 	)
 }
+
+func TestShipmentUpdateSignalsUnquotedShipment(t *testing.T) {
+	ctx := context.Background()
+	c := mocks.NewClient(t)
+
+	// Shipments started before carrier updates were validated reject the update, so it is sent as a signal.
+	handle := mocks.NewWorkflowUpdateHandle(t)
+	handle.On("Get", mock.Anything, mock.Anything).Return(
+		temporal.NewApplicationError("shipment only accepts carrier updates as signals", shipment.CarrierStatusUpdateUnsupportedErrorType),
+	)
+
+	c.On("UpdateWorkflow", mock.Anything, mock.Anything).Return(handle, nil)
+	c.On("SignalWorkflow", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(nil)
+
+	db := db.CreateDB(config.AppConfig{SQLitePath: t.TempDir() + "/test.db"})
+	require.NoError(t, db.Connect(ctx))
+	require.NoError(t, db.Setup())
+
+	r := shipment.Router(c, db, slog.Default(), nil)
+	req, err := http.NewRequest("POST", "/shipments/test/status", strings.NewReader(`{"status":"dispatched"}`))
+	require.NoError(t, err)
+
+	rr := httptest.NewRecorder()
+
+	r.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	c.AssertCalled(t,
+		"SignalWorkflow",
+		mock.Anything,
+		shipment.ShipmentWorkflowID("test"),
+		"",
+		shipment.ShipmentCarrierUpdateSignalName,
+		shipment.ShipmentCarrierUpdateSignal{Status: shipment.ShipmentStatusDispatched},
+	)
+}
@@ -0,0 +1,68 @@
+package shipment
+
+import (
+	"fmt"
+	"time"
+
+	"go.temporal.io/sdk/workflow"
+)
+
+// Cancellation records a request to cancel a shipment, and its outcome.
+// Shipments can only be cancelled before the carrier collects them.
+type Cancellation struct {
+	RequestedAt time.Time `json:"requestedAt"`
+	Cancelled   bool      `json:"cancelled"`
+	// Reason explains why the shipment could not be cancelled.
+	Reason string `json:"reason,omitempty"`
+}
+
+// watchCancellation flags that the workflow has been asked to cancel, so that the request can be
+// handled once the shipment reaches a point where it can be.
+func (s *shipmentImpl) watchCancellation(ctx workflow.Context) {
+	ctx.Done().Receive(ctx, nil)
+	s.cancelRequested = true
+}
+
+// cancel handles a request to cancel the shipment, cancelling its booking with the carrier if it has
+// not yet been collected. The requestor is notified of the outcome. It reports whether the shipment was cancelled.
+func (s *shipmentImpl) cancel(ctx workflow.Context) bool {
+	s.cancelRequested = false
+	s.cancellation = &Cancellation{RequestedAt: workflow.Now(ctx)}
+
+	switch s.status {
+	case ShipmentStatusPending, ShipmentStatusBooked:
+		var result CancelBookingResult
+		err := workflow.ExecuteActivity(ctx,
+			a.CancelBooking,
+			CancelBookingInput{
+				Carrier:          s.booking.Carrier,
+				CourierReference: s.booking.CourierReference,
+			},
+		).Get(ctx, &result)
+		switch {
+		case err != nil:
+			s.cancellation.Reason = fmt.Sprintf("carrier could not cancel the booking: %v", err)
+		case !result.Cancelled:
+			s.cancellation.Reason = "shipment has been collected by the carrier"
+		}
+	default:
+		s.cancellation.Reason = fmt.Sprintf("shipment has been %s", s.status)
+	}
+
+	if s.cancellation.Reason != "" {
+		s.logger.Info("Shipment cancellation refused", "reason", s.cancellation.Reason)
+
+		if err := s.notifyRequestor(ctx, nil, nil); err != nil {
+			s.logger.Warn("Failed to notify requestor of refused cancellation", "error", err)
+		}
+		return false
+	}
+
+	s.cancellation.Cancelled = true
+
+	s.logger.Info("Shipment cancelled")
+
+	s.updateStatus(ctx, TrackingEvent{Status: ShipmentStatusCancelled, Timestamp: workflow.Now(ctx), Note: "Cancelled before collection"})
+
+	return true
+}
@@ -0,0 +1,114 @@
+package shipment_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/temporalio/reference-app-orders-go/app/shipment"
+	"go.temporal.io/sdk/temporal"
+	"go.temporal.io/sdk/testsuite"
+)
+
+func TestShipmentWorkflowCancelledBeforeDispatch(t *testing.T) {
+	s := testsuite.WorkflowTestSuite{}
+	env := s.NewTestWorkflowEnvironment()
+	a := &shipment.Activities{}
+
+	env.RegisterActivity(a.QuoteShipment)
+	env.RegisterActivity(a.BookShipment)
+
+	env.OnActivity(a.CancelBooking, mock.Anything, mock.Anything).Return(
+		func(_ context.Context, input *shipment.CancelBookingInput) (*shipment.CancelBookingResult, error) {
+			assert.Equal(t, shipment.SimulatorCarrierName, input.Carrier)
+			assert.NotEmpty(t, input.CourierReference)
+			return &shipment.CancelBookingResult{Cancelled: true}, nil
+		},
+	).Once()
+
+	var signals []shipment.ShipmentStatusUpdatedSignal
+	env.OnSignalExternalWorkflow(mock.Anything, "parentwid", "", shipment.ShipmentStatusUpdatedSignalName, mock.Anything).Return(
+		func(_ string, _ string, _ string, _ string, arg interface{}) error {
+			signals = append(signals, arg.(shipment.ShipmentStatusUpdatedSignal))
+			return nil
+		},
+	)
+
+	env.RegisterDelayedCallback(env.CancelWorkflow, time.Minute)
+
+	env.ExecuteWorkflow(shipment.Shipment, &shipment.ShipmentInput{
+		RequestorWID: "parentwid",
+		ID:           "test",
+		Items:        []shipment.Item{{SKU: "test1", Quantity: 1}},
+	})
+
+	require.True(t, env.IsWorkflowCompleted())
+	assert.True(t, temporal.IsCanceledError(env.GetWorkflowError()))
+
+	require.Len(t, signals, 2)
+	last := signals[1]
+	assert.Equal(t, shipment.ShipmentStatusCancelled, last.Status)
+	require.NotNil(t, last.Cancellation)
+	assert.True(t, last.Cancellation.Cancelled)
+	assert.Empty(t, last.Cancellation.Reason)
+}
+
+func TestShipmentWorkflowCancelledAfterDispatch(t *testing.T) {
+	s := testsuite.WorkflowTestSuite{}
+	env := s.NewTestWorkflowEnvironment()
+	a := &shipment.Activities{}
+
+	env.RegisterActivity(a.QuoteShipment)
+	env.RegisterActivity(a.BookShipment)
+	env.RegisterActivity(a.CancelBooking)
+
+	var signals []shipment.ShipmentStatusUpdatedSignal
+	env.OnSignalExternalWorkflow(mock.Anything, "parentwid", "", shipment.ShipmentStatusUpdatedSignalName, mock.Anything).Return(
+		func(_ string, _ string, _ string, _ string, arg interface{}) error {
+			signals = append(signals, arg.(shipment.ShipmentStatusUpdatedSignal))
+			return nil
+		},
+	)
+
+	env.RegisterDelayedCallback(func() {
+		env.SignalWorkflow(shipment.ShipmentCarrierUpdateSignalName, shipment.ShipmentCarrierUpdateSignal{Status: shipment.ShipmentStatusDispatched})
+	}, time.Minute)
+
+	env.RegisterDelayedCallback(env.CancelWorkflow, 2*time.Minute)
+
+	env.RegisterDelayedCallback(func() {
+		env.SignalWorkflow(shipment.ShipmentCarrierUpdateSignalName, shipment.ShipmentCarrierUpdateSignal{Status: shipment.ShipmentStatusDelivered})
+	}, time.Hour)
+
+	env.ExecuteWorkflow(shipment.Shipment, &shipment.ShipmentInput{
+		RequestorWID: "parentwid",
+		ID:           "test",
+		Items:        []shipment.Item{{SKU: "test1", Quantity: 1}},
+	})
+
+	require.True(t, env.IsWorkflowCompleted())
+	require.NoError(t, env.GetWorkflowError(), "dispatched shipments are delivered")
+
+	env.AssertNotCalled(t, "CancelBooking", mock.Anything, mock.Anything)
+
+	var statuses []string
+	for _, signal := range signals {
+		statuses = append(statuses, signal.Status)
+	}
+	// The refusal is reported without changing the shipment's status.
+	assert.Equal(t, []string{
+		shipment.ShipmentStatusBooked,
+		shipment.ShipmentStatusDispatched,
+		shipment.ShipmentStatusDispatched,
+		shipment.ShipmentStatusDelivered,
+	}, statuses)
+
+	refusal := signals[2].Cancellation
+	require.NotNil(t, refusal)
+	assert.False(t, refusal.Cancelled)
+	assert.Equal(t, "shipment has been dispatched", refusal.Reason)
+	assert.Equal(t, refusal, signals[3].Cancellation)
+}
@@ -0,0 +1,282 @@
+package shipment
+
+import (
+	"context"
+	"fmt"
+	"hash/crc32"
+	"sync"
+	"time"
+)
+
+// Carrier is a courier which collects shipments from a warehouse and delivers them to the customer.
+type Carrier interface {
+	// Name returns the name the carrier is configured by.
+	Name() string
+	// Quote returns the carrier's prices for delivering a shipment, one for each service offered.
+	Quote(ctx context.Context, request *CarrierRequest) ([]CarrierQuote, error)
+	// Book engages the carrier to deliver a shipment. Booking the same reference again
+	// returns the existing booking.
+	Book(ctx context.Context, request *CarrierBookingRequest) (*CarrierBooking, error)
+	// Cancel cancels a booking which has not yet been collected.
+	Cancel(ctx context.Context, courierReference string) error
+	// Track returns the carrier's current status for a booking.
+	Track(ctx context.Context, courierReference string) (*CarrierTracking, error)
+}
+
+// CarrierRequest describes a shipment to a carrier. The carrier collects from the warehouse at
+// Location and delivers to Destination or, if Origin is set, collects from Origin and delivers
+// to the warehouse.
+type CarrierRequest struct {
+	Reference   string
+	Location    string
+	Destination *Address
+	Origin      *Address
+	Items       []Item
+}
+
+// CarrierBookingRequest is a request to book a shipment using one of the carrier's services.
+// If Service is empty the carrier's standard service is used.
+type CarrierBookingRequest struct {
+	CarrierRequest
+	Service string
+}
+
+// CarrierQuote is a carrier's price for delivering a shipment using one of its services.
+type CarrierQuote struct {
+	Carrier       string `json:"carrier"`
+	Service       string `json:"service"`
+	Price         int32  `json:"price"`
+	EstimatedDays int32  `json:"estimatedDays"`
+}
+
+// CarrierBooking is a carrier's confirmation that it will deliver a shipment.
+type CarrierBooking struct {
+	Carrier          string `json:"carrier"`
+	Service          string `json:"service"`
+	CourierReference string `json:"courierReference"`
+	TrackingURL      string `json:"trackingUrl"`
+}
+
+// CarrierTracking is a carrier's current status for a booking.
+type CarrierTracking struct {
+	Status    string    `json:"status"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// CarrierError is returned by a Carrier when a request fails.
+// Temporary errors may succeed if the request is repeated.
+type CarrierError struct {
+	Carrier   string
+	Code      string
+	Message   string
+	Temporary bool
+}
+
+// Error implements the error interface.
+func (e *CarrierError) Error() string {
+	return fmt.Sprintf("%s: %s: %s", e.Carrier, e.Code, e.Message)
+}
+
+const (
+	// CarrierServiceStandard is the service used when none is requested.
+	CarrierServiceStandard = "standard"
+
+	// CarrierServiceExpress is a faster, more expensive, service.
+	CarrierServiceExpress = "express"
+)
+
+const (
+	// CarrierErrorCodeUnavailable is the code for a carrier which cannot currently accept requests.
+	CarrierErrorCodeUnavailable = "unavailable"
+
+	// CarrierErrorCodeInvalidRequest is the code for a request the carrier will not accept.
+	CarrierErrorCodeInvalidRequest = "invalid_request"
+
+	// CarrierErrorCodeNotFound is the code for a booking the carrier does not know of.
+	CarrierErrorCodeNotFound = "not_found"
+
+	// CarrierErrorCodeCollected is the code for a booking which can no longer be cancelled.
+	CarrierErrorCodeCollected = "collected"
+)
+
+// SimulatorCarrierName is the name of the simulated carrier, used for warehouses with no carrier configured.
+const SimulatorCarrierName = "simulator"
+
+// EconomyCarrierName is the name of a second simulated carrier, which is cheaper but slower than the simulator.
+const EconomyCarrierName = "economy"
+
+// simulatorTrackingURL is the base URL for the simulated carriers' tracking links.
+const simulatorTrackingURL = "https://tracking.example.com/"
+
+// SimulatorService is the pricing of a service offered by a simulated carrier.
+// A shipment is quoted BasePrice plus UnitPrice for each unit shipped.
+type SimulatorService struct {
+	Name          string
+	BasePrice     int32
+	UnitPrice     int32
+	EstimatedDays int32
+}
+
+// SimulatorProfile configures a simulated carrier. The first service is used for
+// bookings which do not request one. ReferencePrefix starts each courier reference.
+type SimulatorProfile struct {
+	Name            string
+	ReferencePrefix string
+	Services        []SimulatorService
+}
+
+// SimulatorProfiles are the simulated carriers the Shipment worker registers.
+var SimulatorProfiles = []SimulatorProfile{
+	{
+		Name:            SimulatorCarrierName,
+		ReferencePrefix: "SIM",
+		Services: []SimulatorService{
+			{Name: CarrierServiceStandard, BasePrice: 500, UnitPrice: 100, EstimatedDays: 3},
+			{Name: CarrierServiceExpress, BasePrice: 1500, UnitPrice: 200, EstimatedDays: 1},
+		},
+	},
+	{
+		Name:            EconomyCarrierName,
+		ReferencePrefix: "ECO",
+		Services: []SimulatorService{
+			{Name: CarrierServiceStandard, BasePrice: 300, UnitPrice: 80, EstimatedDays: 5},
+			{Name: CarrierServiceExpress, BasePrice: 1200, UnitPrice: 150, EstimatedDays: 2},
+		},
+	},
+}
+
+// SimulatorCarrier is a carrier which accepts every shipment without contacting a courier.
+type SimulatorCarrier struct {
+	profile SimulatorProfile
+
+	mu       sync.Mutex
+	bookings map[string]*simulatedBooking
+}
+
+type simulatedBooking struct {
+	booking  CarrierBooking
+	tracking CarrierTracking
+}
+
+// NewSimulatorCarrier returns the default simulated carrier.
+func NewSimulatorCarrier() *SimulatorCarrier {
+	return NewSimulatorCarrierWithProfile(SimulatorProfiles[0])
+}
+
+// NewSimulatorCarrierWithProfile returns a simulated carrier with the name and services in profile.
+func NewSimulatorCarrierWithProfile(profile SimulatorProfile) *SimulatorCarrier {
+	return &SimulatorCarrier{
+		profile:  profile,
+		bookings: make(map[string]*simulatedBooking),
+	}
+}
+
+// Name implements Carrier.
+func (c *SimulatorCarrier) Name() string {
+	return c.profile.Name
+}
+
+// Quote implements Carrier. Prices are calculated from the number of units shipped.
+func (c *SimulatorCarrier) Quote(_ context.Context, request *CarrierRequest) ([]CarrierQuote, error) {
+	if err := c.validate(request); err != nil {
+		return nil, err
+	}
+
+	var units int32
+	for _, item := range request.Items {
+		units += item.Quantity
+	}
+
+	quotes := make([]CarrierQuote, len(c.profile.Services))
+	for i, s := range c.profile.Services {
+		quotes[i] = CarrierQuote{Carrier: c.Name(), Service: s.Name, Price: s.BasePrice + s.UnitPrice*units, EstimatedDays: s.EstimatedDays}
+	}
+
+	return quotes, nil
+}
+
+// Book implements Carrier. The courier reference is derived from the shipment reference,
+// so that repeated bookings for the same shipment are given the same reference.
+func (c *SimulatorCarrier) Book(_ context.Context, request *CarrierBookingRequest) (*CarrierBooking, error) {
+	if err := c.validate(&request.CarrierRequest); err != nil {
+		return nil, err
+	}
+
+	service := request.Service
+	if service == "" && len(c.profile.Services) > 0 {
+		service = c.profile.Services[0].Name
+	}
+	if !c.offers(service) {
+		return nil, &CarrierError{Carrier: c.Name(), Code: CarrierErrorCodeInvalidRequest, Message: fmt.Sprintf("unknown service %q", service)}
+	}
+
+	ref := fmt.Sprintf("%s%08X", c.profile.ReferencePrefix, crc32.ChecksumIEEE([]byte(request.Reference)))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if b, ok := c.bookings[ref]; ok {
+		return &b.booking, nil
+	}
+
+	b := &simulatedBooking{
+		booking: CarrierBooking{
+			Carrier:          c.Name(),
+			Service:          service,
+			CourierReference: ref,
+			TrackingURL:      simulatorTrackingURL + c.Name() + "/" + ref,
+		},
+		tracking: CarrierTracking{Status: ShipmentStatusBooked, UpdatedAt: time.Now().UTC()},
+	}
+	c.bookings[ref] = b
+
+	return &b.booking, nil
+}
+
+// Cancel implements Carrier.
+func (c *SimulatorCarrier) Cancel(_ context.Context, courierReference string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	b, ok := c.bookings[courierReference]
+	if !ok {
+		return &CarrierError{Carrier: c.Name(), Code: CarrierErrorCodeNotFound, Message: "no booking " + courierReference}
+	}
+	if b.tracking.Status != ShipmentStatusBooked {
+		return &CarrierError{Carrier: c.Name(), Code: CarrierErrorCodeCollected, Message: "shipment has been collected"}
+	}
+
+	delete(c.bookings, courierReference)
+
+	return nil
+}
+
+// Track implements Carrier.
+func (c *SimulatorCarrier) Track(_ context.Context, courierReference string) (*CarrierTracking, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	b, ok := c.bookings[courierReference]
+	if !ok {
+		return nil, &CarrierError{Carrier: c.Name(), Code: CarrierErrorCodeNotFound, Message: "no booking " + courierReference}
+	}
+
+	tracking := b.tracking
+	return &tracking, nil
+}
+
+func (c *SimulatorCarrier) offers(service string) bool {
+	for _, s := range c.profile.Services {
+		if s.Name == service {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *SimulatorCarrier) validate(request *CarrierRequest) error {
+	if request.Reference == "" || len(request.Items) == 0 {
+		return &CarrierError{Carrier: c.Name(), Code: CarrierErrorCodeInvalidRequest, Message: "reference and items are required"}
+	}
+	return nil
+}
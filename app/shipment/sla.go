@@ -0,0 +1,109 @@
+package shipment
+
+import (
+	"time"
+
+	"go.temporal.io/sdk/workflow"
+)
+
+// DefaultShipmentSLAs is the longest a shipment may remain in each status before being escalated,
+// used if no SLAs are configured.
+var DefaultShipmentSLAs = map[string]time.Duration{
+	ShipmentStatusBooked:     48 * time.Hour,
+	ShipmentStatusDispatched: 7 * 24 * time.Hour,
+}
+
+// Escalation is raised when a shipment remains in a status for longer than the status's SLA.
+type Escalation struct {
+	Status   string    `json:"status"`
+	Since    time.Time `json:"since"`
+	DueAt    time.Time `json:"dueAt"`
+	RaisedAt time.Time `json:"raisedAt"`
+}
+
+// slaDueAt returns when the shipment breaches the SLA for its current status.
+// It returns false if the status has no SLA.
+func (s *shipmentImpl) slaDueAt() (time.Time, bool) {
+	sla, ok := s.slas[s.status]
+	if !ok || sla <= 0 || s.statusSince.IsZero() {
+		return time.Time{}, false
+	}
+	return s.statusSince.Add(sla), true
+}
+
+// dueAt returns when the shipment breaches the SLA for its current status, or nil if the status has no SLA.
+func (s *shipmentImpl) dueAt() *time.Time {
+	if dueAt, ok := s.slaDueAt(); ok {
+		return &dueAt
+	}
+	return nil
+}
+
+// escalated reports whether an escalation has been raised for the shipment's current status.
+func (s *shipmentImpl) escalated() bool {
+	if len(s.escalations) == 0 {
+		return false
+	}
+	last := s.escalations[len(s.escalations)-1]
+	return last.Status == s.status && last.Since.Equal(s.statusSince)
+}
+
+// awaitCompletion waits for the shipment to reach a terminal status, to have added enough events
+// to its history to continue as new, or to be asked to cancel, and for all updates to it to be applied.
+// An escalation is raised if the shipment remains in a status for longer than the status's SLA.
+func (s *shipmentImpl) awaitCompletion(ctx workflow.Context) error {
+	done := func() bool {
+		return (isTerminal(s.status) || s.shouldContinueAsNew(ctx) || s.cancelRequested) && s.updating == 0
+	}
+
+	for !done() {
+		status, since := s.status, s.statusSince
+		changed := func() bool {
+			return done() || s.status != status || !s.statusSince.Equal(since)
+		}
+
+		dueAt, ok := s.slaDueAt()
+		if !ok || s.escalated() {
+			if err := workflow.Await(ctx, changed); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if remaining := dueAt.Sub(workflow.Now(ctx)); remaining > 0 {
+			ok, err := workflow.AwaitWithTimeout(ctx, remaining, changed)
+			if err != nil {
+				return err
+			}
+			if ok {
+				continue
+			}
+		}
+
+		s.escalate(ctx, dueAt)
+	}
+
+	return nil
+}
+
+// escalate records that the shipment has breached the SLA for its status and notifies the requestor.
+// The escalation stands even if it could not be recorded.
+func (s *shipmentImpl) escalate(ctx workflow.Context, dueAt time.Time) {
+	escalation := Escalation{
+		Status:   s.status,
+		Since:    s.statusSince,
+		DueAt:    dueAt,
+		RaisedAt: workflow.Now(ctx),
+	}
+	s.escalations = append(s.escalations, escalation)
+
+	s.logger.Warn("Shipment SLA breached", "status", s.status, "since", s.statusSince, "dueAt", dueAt)
+
+	if err := s.notifyRequestor(ctx, nil, &escalation); err != nil {
+		s.logger.Warn("Failed to notify requestor of escalation", "error", err)
+	}
+
+	if err := s.recordStatus(ctx); err != nil {
+		s.logger.Warn("Failed to record escalation", "error", err)
+	}
+}
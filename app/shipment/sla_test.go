@@ -0,0 +1,85 @@
+package shipment_test
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/temporalio/reference-app-orders-go/app/config"
+	"github.com/temporalio/reference-app-orders-go/app/db"
+	"github.com/temporalio/reference-app-orders-go/app/shipment"
+)
+
+func testStore(t *testing.T) db.DB {
+	store := db.CreateDB(config.AppConfig{SQLitePath: filepath.Join(t.TempDir(), "test.db")})
+	require.NoError(t, store.Connect(context.Background()))
+	require.NoError(t, store.Setup())
+	t.Cleanup(func() { store.Close() })
+
+	return store
+}
+
+func TestAtRiskShipments(t *testing.T) {
+	r := shipment.Router(nil, testStore(t), slog.Default(), nil)
+
+	now := time.Now().UTC().Truncate(time.Second)
+
+	record := func(update shipment.ShipmentStatusUpdate) {
+		body, err := json.Marshal(update)
+		require.NoError(t, err)
+
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/shipments/"+update.ID, strings.NewReader(string(body))))
+		require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	}
+
+	record(shipment.ShipmentStatusUpdate{ID: "overdue", Status: shipment.ShipmentStatusBooked, DueAt: now.Add(-time.Hour), EscalatedAt: now.Add(-time.Minute)})
+	record(shipment.ShipmentStatusUpdate{ID: "soon", Status: shipment.ShipmentStatusDispatched, DueAt: now.Add(2 * time.Hour)})
+	record(shipment.ShipmentStatusUpdate{ID: "later", Status: shipment.ShipmentStatusDispatched, DueAt: now.Add(72 * time.Hour)})
+	record(shipment.ShipmentStatusUpdate{ID: "delivered", Status: shipment.ShipmentStatusDelivered})
+
+	list := func(query string) (int, []shipment.AtRiskShipment) {
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/shipments/at-risk"+query, nil))
+
+		var result []shipment.AtRiskShipment
+		if rr.Code == http.StatusOK {
+			require.NoError(t, json.NewDecoder(rr.Body).Decode(&result))
+		}
+		return rr.Code, result
+	}
+
+	code, result := list("")
+	require.Equal(t, http.StatusOK, code)
+	require.Len(t, result, 2)
+	assert.Equal(t, "overdue", result[0].ID)
+	require.NotNil(t, result[0].EscalatedAt)
+	assert.True(t, now.Add(-time.Minute).Equal(*result[0].EscalatedAt))
+	assert.Equal(t, "soon", result[1].ID)
+	assert.Nil(t, result[1].EscalatedAt)
+
+	_, result = list("?within=0s")
+	require.Len(t, result, 1)
+	assert.Equal(t, "overdue", result[0].ID)
+
+	_, result = list("?within=96h")
+	assert.Len(t, result, 3)
+
+	code, _ = list("?within=soon")
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	// A shipment which moves to a status without an SLA is no longer at risk.
+	record(shipment.ShipmentStatusUpdate{ID: "soon", Status: shipment.ShipmentStatusDelivered})
+
+	_, result = list("")
+	require.Len(t, result, 1)
+	assert.Equal(t, "overdue", result[0].ID)
+}
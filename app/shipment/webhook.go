@@ -0,0 +1,171 @@
+package shipment
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"go.temporal.io/api/serviceerror"
+)
+
+// CarrierSignatureHeader is the header carrying the signature of a carrier webhook request,
+// as "sha256=" followed by the hex encoded HMAC-SHA256 of the request body.
+const CarrierSignatureHeader = "X-Carrier-Signature"
+
+// maxWebhookBodySize is the largest carrier webhook request accepted.
+const maxWebhookBodySize = 1 << 20
+
+// carrierEvent is a tracking event received from a carrier, for the shipment with ShipmentID.
+type carrierEvent struct {
+	ShipmentID string
+	Code       string
+	Update     ShipmentCarrierUpdateSignal
+}
+
+// carrierWebhookParsers decodes each carrier's webhook payload into tracking events.
+// Events with a code the carrier does not map to a shipment status have an empty Update.Status.
+var carrierWebhookParsers = map[string]func(body []byte) ([]carrierEvent, error){
+	SimulatorCarrierName: simulatorWebhookParser(SimulatorCarrierName),
+	EconomyCarrierName:   simulatorWebhookParser(EconomyCarrierName),
+}
+
+// SimulatorWebhook is the webhook payload sent by the simulated carriers.
+type SimulatorWebhook struct {
+	Events []SimulatorWebhookEvent `json:"events"`
+}
+
+// SimulatorWebhookEvent is a tracking event sent by the simulated carrier.
+// Reference is the shipment reference the carrier was booked with.
+type SimulatorWebhookEvent struct {
+	ID               string    `json:"id"`
+	Reference        string    `json:"reference"`
+	CourierReference string    `json:"courierReference"`
+	Code             string    `json:"code"`
+	Timestamp        time.Time `json:"timestamp"`
+	Location         string    `json:"location"`
+	Description      string    `json:"description"`
+}
+
+// simulatorEventStatuses maps the simulated carrier's event codes to shipment statuses.
+var simulatorEventStatuses = map[string]string{
+	"PICKED_UP":        ShipmentStatusDispatched,
+	"IN_TRANSIT":       ShipmentStatusDispatched,
+	"OUT_FOR_DELIVERY": ShipmentStatusDispatched,
+	"DELIVERED":        ShipmentStatusDelivered,
+	"DELIVERY_FAILED":  ShipmentStatusDeliveryFailed,
+	"RETURNED":         ShipmentStatusReturned,
+	"LOST":             ShipmentStatusLost,
+}
+
+// simulatorWebhookParser returns a parser for the webhooks of the simulated carrier with name,
+// whose event IDs are qualified with the carrier's name.
+func simulatorWebhookParser(name string) func(body []byte) ([]carrierEvent, error) {
+	return func(body []byte) ([]carrierEvent, error) {
+		return parseSimulatorWebhook(name, body)
+	}
+}
+
+func parseSimulatorWebhook(name string, body []byte) ([]carrierEvent, error) {
+	var payload SimulatorWebhook
+
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, err
+	}
+
+	events := make([]carrierEvent, len(payload.Events))
+	for i, e := range payload.Events {
+		if e.ID == "" || e.Reference == "" || e.Code == "" {
+			return nil, fmt.Errorf("event %d: id, reference and code are required", i)
+		}
+
+		events[i] = carrierEvent{
+			ShipmentID: e.Reference,
+			Code:       e.Code,
+			Update: ShipmentCarrierUpdateSignal{
+				Status:    simulatorEventStatuses[e.Code],
+				EventID:   name + ":" + e.ID,
+				Timestamp: e.Timestamp.UTC(),
+				Location:  e.Location,
+				Note:      e.Description,
+			},
+		}
+	}
+
+	return events, nil
+}
+
+// SignCarrierWebhook returns the signature header value for a webhook body signed with secret.
+func SignCarrierWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func verifyCarrierWebhook(secret string, body []byte, signature string) bool {
+	return hmac.Equal([]byte(SignCarrierWebhook(secret, body)), []byte(signature))
+}
+
+// handleCarrierWebhook signals the shipments named in a carrier's tracking events.
+// Events for unknown shipments, or with codes which do not map to a status, are skipped so that
+// the carrier does not retry them. Other failures are reported so that the carrier retries the
+// request, which is safe as shipments ignore events they have already received.
+func (h *handlers) handleCarrierWebhook(w http.ResponseWriter, r *http.Request) {
+	carrier := r.PathValue("carrier")
+
+	parse, ok := carrierWebhookParsers[carrier]
+	secret := h.webhookSecrets[carrier]
+	if !ok || secret == "" {
+		http.Error(w, "Carrier not found", http.StatusNotFound)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookBodySize))
+	if err != nil {
+		h.logger.Error("Failed to read carrier webhook", "carrier", carrier, "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !verifyCarrierWebhook(secret, body, r.Header.Get(CarrierSignatureHeader)) {
+		h.logger.Warn("Rejected carrier webhook with invalid signature", "carrier", carrier)
+		http.Error(w, "Invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	events, err := parse(body)
+	if err != nil {
+		h.logger.Error("Failed to decode carrier webhook", "carrier", carrier, "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	for _, e := range events {
+		if e.Update.Status == "" {
+			h.logger.Info("Ignoring carrier event", "carrier", carrier, "code", e.Code, "eventId", e.Update.EventID)
+			continue
+		}
+
+		err := h.temporal.SignalWorkflow(r.Context(),
+			ShipmentWorkflowID(e.ShipmentID), "",
+			ShipmentCarrierUpdateSignalName,
+			e.Update,
+		)
+		if errors.As(err, new(*serviceerror.NotFound)) {
+			h.logger.Warn("Ignoring carrier event for unknown shipment", "carrier", carrier, "shipmentId", e.ShipmentID, "eventId", e.Update.EventID)
+			continue
+		}
+		if err != nil {
+			h.logger.Error("Failed to signal shipment workflow", "carrier", carrier, "shipmentId", e.ShipmentID, "error", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,64 @@
+package shipment_test
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/temporalio/reference-app-orders-go/app/shipment"
+	"go.temporal.io/api/serviceerror"
+	"go.temporal.io/sdk/mocks"
+)
+
+func TestCarrierWebhook(t *testing.T) {
+	c := mocks.NewClient(t)
+
+	c.On("SignalWorkflow", mock.Anything, "Shipment:test", "", shipment.ShipmentCarrierUpdateSignalName,
+		shipment.ShipmentCarrierUpdateSignal{
+			Status:    shipment.ShipmentStatusDispatched,
+			EventID:   "simulator:evt-1",
+			Timestamp: time.Date(2024, 6, 1, 9, 30, 0, 0, time.UTC),
+			Location:  "Leeds",
+		},
+	).Return(nil).Once()
+	c.On("SignalWorkflow", mock.Anything, "Shipment:missing", "", shipment.ShipmentCarrierUpdateSignalName, mock.Anything).
+		Return(serviceerror.NewNotFound("workflow not found")).Once()
+
+	r := shipment.Router(c, nil, slog.Default(), map[string]string{shipment.SimulatorCarrierName: "s3cret"})
+
+	post := func(carrier string, body string, signature string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/carriers/"+carrier+"/webhook", strings.NewReader(body))
+		req.Header.Set(shipment.CarrierSignatureHeader, signature)
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		return rr
+	}
+
+	body := `{"events":[
+		{"id":"evt-1","reference":"test","code":"PICKED_UP","timestamp":"2024-06-01T10:30:00+01:00","location":"Leeds"},
+		{"id":"evt-2","reference":"test","code":"WEIGHED"},
+		{"id":"evt-3","reference":"missing","code":"DELIVERED"}
+	]}`
+
+	rr := post("acme", body, shipment.SignCarrierWebhook("s3cret", []byte(body)))
+	assert.Equal(t, http.StatusNotFound, rr.Code, "carriers without a secret are not accepted")
+
+	rr = post(shipment.SimulatorCarrierName, body, shipment.SignCarrierWebhook("wrong", []byte(body)))
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	rr = post(shipment.SimulatorCarrierName, body, "")
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	invalid := `{"events":[{"reference":"test","code":"PICKED_UP"}]}`
+	rr = post(shipment.SimulatorCarrierName, invalid, shipment.SignCarrierWebhook("s3cret", []byte(invalid)))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	// Unmapped codes and unknown shipments are skipped rather than failing the request.
+	rr = post(shipment.SimulatorCarrierName, body, shipment.SignCarrierWebhook("s3cret", []byte(body)))
+	assert.Equal(t, http.StatusNoContent, rr.Code, rr.Body.String())
+}
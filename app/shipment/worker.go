@@ -2,6 +2,7 @@ package shipment
 
 import (
 	"context"
+	"fmt"
 
 	"github.com/temporalio/reference-app-orders-go/app/config"
 	"github.com/temporalio/reference-app-orders-go/app/temporalutil"
@@ -18,8 +19,31 @@ type Config struct {
 func RunWorker(ctx context.Context, config config.AppConfig, client client.Client) error {
 	w := worker.New(client, TaskQueue, worker.Options{})
 
+	carriers := make(map[string]Carrier, len(SimulatorProfiles))
+	for _, profile := range SimulatorProfiles {
+		carriers[profile.Name] = NewSimulatorCarrierWithProfile(profile)
+	}
+	for warehouse, names := range config.WarehouseCarriers {
+		for _, name := range names {
+			if _, ok := carriers[name]; !ok {
+				return fmt.Errorf("unknown carrier %q for warehouse %q", name, warehouse)
+			}
+		}
+	}
+
+	for status := range config.ShipmentSLAs {
+		if _, ok := shipmentTransitions[status]; !ok || isTerminal(status) || status == ShipmentStatusPending {
+			return fmt.Errorf("invalid shipment SLA status %q", status)
+		}
+	}
+
 	w.RegisterWorkflow(Shipment)
-	w.RegisterActivity(&Activities{ShipmentURL: config.ShipmentURL})
+	w.RegisterActivity(&Activities{
+		ShipmentURL:       config.ShipmentURL,
+		Carriers:          carriers,
+		WarehouseCarriers: config.WarehouseCarriers,
+		SLAs:              config.ShipmentSLAs,
+	})
 
 	return w.Run(temporalutil.WorkerInterruptFromContext(ctx))
 }
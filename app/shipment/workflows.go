@@ -2,9 +2,11 @@ package shipment
 
 import (
 	"fmt"
+	"slices"
 	"time"
 
 	"go.temporal.io/sdk/log"
+	"go.temporal.io/sdk/temporal"
 	"go.temporal.io/sdk/workflow"
 )
 
@@ -14,17 +16,84 @@ type Item struct {
 	Quantity int32  `json:"quantity"`
 }
 
+// Address is a postal address a shipment is delivered to.
+type Address struct {
+	Name       string `json:"name,omitempty"`
+	Line1      string `json:"line1"`
+	Line2      string `json:"line2,omitempty"`
+	City       string `json:"city"`
+	Region     string `json:"region,omitempty"`
+	PostalCode string `json:"postalCode"`
+	// Country is an ISO 3166-1 alpha-2 country code.
+	Country string `json:"country"`
+}
+
 // ShipmentInput is the input for a Shipment workflow.
 type ShipmentInput struct {
 	RequestorWID string
 
 	ID    string
 	Items []Item
+
+	// Location is the warehouse the shipment is collected from, which determines the carriers available.
+	Location string
+	// Destination is the address the shipment is delivered to.
+	Destination *Address `json:"destination,omitempty"`
+	// Origin is set for shipments collected from a customer, such as returns, which are delivered
+	// to the warehouse at Location rather than to Destination.
+	Origin *Address `json:"origin,omitempty"`
+
+	// Policy is how the carrier is chosen, ShippingPolicyEconomy if not set.
+	Policy string `json:"policy,omitempty"`
+
+	// State is set when the workflow continues as new, to resume tracking a booked shipment.
+	State *ShipmentState `json:"state,omitempty"`
+}
+
+// ShipmentState is the state of a booked shipment, carried over when the workflow continues as new.
+type ShipmentState struct {
+	Quote   *CarrierQuote      `json:"quote,omitempty"`
+	Booking BookShipmentResult `json:"booking"`
+	Events  []TrackingEvent    `json:"events"`
+
+	StatusSince time.Time    `json:"statusSince"`
+	Escalations []Escalation `json:"escalations,omitempty"`
+
+	Cancellation *Cancellation `json:"cancellation,omitempty"`
+
+	// Pending holds carrier updates which were received but not yet applied.
+	Pending []ShipmentCarrierUpdateSignal `json:"pending,omitempty"`
+}
+
+// TrackingEvent is an entry in a shipment's tracking timeline.
+type TrackingEvent struct {
+	Status    string    `json:"status"`
+	Timestamp time.Time `json:"timestamp"`
+	Location  string    `json:"location,omitempty"`
+	Note      string    `json:"note,omitempty"`
+	EventID   string    `json:"eventId,omitempty"`
 }
 
+// maxTrackingEventsPerRun is the number of tracking events after which the workflow continues
+// as new, to bound the size of its history.
+const maxTrackingEventsPerRun = 100
+
+const (
+	// ShippingPolicyEconomy chooses the cheapest quote.
+	ShippingPolicyEconomy = "economy"
+
+	// ShippingPolicyExpress chooses the quote with the earliest delivery.
+	ShippingPolicyExpress = "express"
+)
+
 // ShipmentCarrierUpdateSignalName is the name for a signal to update a shipment's status from the carrier.
+// Signals with invalid statuses are ignored, use ShipmentCarrierStatusUpdateName to have them rejected.
 const ShipmentCarrierUpdateSignalName = "ShipmentCarrierUpdate"
 
+// ShipmentCarrierStatusUpdateName is the name for an update to a shipment's status from the carrier.
+// The update is rejected if the status is unknown or does not follow from the shipment's current status.
+const ShipmentCarrierStatusUpdateName = "ShipmentCarrierStatus"
+
 // ShipmentStatusUpdatedSignalName is the name for a signal to notify of an update to a shipment's status.
 const ShipmentStatusUpdatedSignalName = "ShipmentStatusUpdated"
 
@@ -37,23 +106,102 @@ const (
 	ShipmentStatusDispatched = "dispatched"
 	// ShipmentStatusDelivered represents a shipment that has been delivered to the customer
 	ShipmentStatusDelivered = "delivered"
+	// ShipmentStatusLost represents a shipment the carrier has lost
+	ShipmentStatusLost = "lost"
+	// ShipmentStatusReturned represents a shipment the carrier has returned to the warehouse
+	ShipmentStatusReturned = "returned"
+	// ShipmentStatusDeliveryFailed represents a shipment the carrier was unable to deliver
+	ShipmentStatusDeliveryFailed = "deliveryFailed"
+	// ShipmentStatusCancelled represents a shipment cancelled before the carrier collected it
+	ShipmentStatusCancelled = "cancelled"
 )
 
+// shipmentTransitions lists the statuses a carrier may move a shipment to from each status.
+// Statuses with no transitions are terminal. Carriers do not always report collection, so a
+// booked shipment may move straight to any of the statuses which follow dispatch.
+var shipmentTransitions = map[string][]string{
+	ShipmentStatusPending:        {},
+	ShipmentStatusBooked:         {ShipmentStatusDispatched, ShipmentStatusDelivered, ShipmentStatusLost, ShipmentStatusReturned, ShipmentStatusDeliveryFailed},
+	ShipmentStatusDispatched:     {ShipmentStatusDelivered, ShipmentStatusLost, ShipmentStatusReturned, ShipmentStatusDeliveryFailed},
+	ShipmentStatusDelivered:      {},
+	ShipmentStatusLost:           {},
+	ShipmentStatusReturned:       {},
+	ShipmentStatusDeliveryFailed: {},
+	ShipmentStatusCancelled:      {},
+}
+
+const (
+	// InvalidShipmentStatusErrorType is the error type for a carrier update with an unknown status.
+	InvalidShipmentStatusErrorType = "InvalidShipmentStatus"
+
+	// InvalidShipmentTransitionErrorType is the error type for a carrier update with a status
+	// which does not follow from the shipment's current status.
+	InvalidShipmentTransitionErrorType = "InvalidShipmentTransition"
+
+	// CarrierStatusUpdateUnsupportedErrorType is the error type for a carrier status update sent to a
+	// shipment started before carriers were quoted, which only takes carrier updates as signals.
+	CarrierStatusUpdateUnsupportedErrorType = "CarrierStatusUpdateUnsupported"
+
+	// ShipmentFailedErrorType is the error type returned by a Shipment workflow which ended
+	// without the shipment being delivered.
+	ShipmentFailedErrorType = "ShipmentFailed"
+)
+
+// validateTransition checks that a carrier may move a shipment from one status to another.
+// Repeating the current status is allowed, and has no effect.
+func validateTransition(from string, to string) error {
+	if _, ok := shipmentTransitions[to]; !ok {
+		return temporal.NewApplicationError(fmt.Sprintf("unknown shipment status %q", to), InvalidShipmentStatusErrorType)
+	}
+
+	if from == to || slices.Contains(shipmentTransitions[from], to) {
+		return nil
+	}
+
+	return temporal.NewApplicationError(fmt.Sprintf("shipment cannot move from %s to %s", from, to), InvalidShipmentTransitionErrorType)
+}
+
+// isTerminal reports whether a shipment with a status will not change again.
+func isTerminal(status string) bool {
+	return status != ShipmentStatusPending && len(shipmentTransitions[status]) == 0
+}
+
 // ShipmentCarrierUpdateSignal is used by a carrier to update a shipment's status.
+// Updates carrying an EventID already seen by the shipment are ignored, so that carriers
+// may safely deliver the same event more than once.
 type ShipmentCarrierUpdateSignal struct {
 	Status string `json:"status"`
+
+	EventID   string    `json:"eventId,omitempty"`
+	Timestamp time.Time `json:"timestamp,omitempty"`
+	Location  string    `json:"location,omitempty"`
+	Note      string    `json:"note,omitempty"`
 }
 
 // ShipmentStatusUpdatedSignal is used to notify the requestor of an update to a shipment's status.
+// The carrier fields are set once the shipment has been booked.
 type ShipmentStatusUpdatedSignal struct {
 	ShipmentID string    `json:"shipmentID"`
 	Status     string    `json:"status"`
 	UpdatedAt  time.Time `json:"updatedAt"`
+
+	Carrier          string `json:"carrier,omitempty"`
+	CourierReference string `json:"courierReference,omitempty"`
+	TrackingURL      string `json:"trackingUrl,omitempty"`
+
+	// Event is the tracking event which caused the update.
+	Event *TrackingEvent `json:"event,omitempty"`
+	// Escalation is set if the update was caused by the shipment breaching an SLA.
+	Escalation *Escalation `json:"escalation,omitempty"`
+	// Cancellation is set once the shipment has been asked to cancel, with the outcome.
+	Cancellation *Cancellation `json:"cancellation,omitempty"`
 }
 
 // ShipmentResult is the result of a Shipment workflow.
 type ShipmentResult struct {
+	Carrier          string
 	CourierReference string
+	TrackingURL      string
 }
 
 type shipmentImpl struct {
@@ -62,18 +210,59 @@ type shipmentImpl struct {
 	id        string
 	status    string
 	updatedAt time.Time
+	location  string
+
+	// events is the shipment's tracking timeline, oldest first.
+	events []TrackingEvent
+	// runEvents counts the events added during this run of the workflow.
+	runEvents int
+	// seen holds the IDs of the carrier events already received.
+	seen map[string]bool
+
+	// statusSince is when the shipment moved to its current status, by the workflow's clock.
+	statusSince time.Time
+	slas        map[string]time.Duration
+	escalations []Escalation
+
+	// cancelRequested is set when the workflow is asked to cancel, until the request is handled.
+	cancelRequested bool
+	cancellation    *Cancellation
+
+	quote   *CarrierQuote
+	booking BookShipmentResult
+
+	// updating counts the carrier updates still being applied.
+	updating int
+
+	// unquoted is set for shipments started before carriers were quoted.
+	unquoted bool
 
 	logger log.Logger
 }
 
+// carrierQuotesChangeID versions the Shipment workflow from when it quoted the warehouse's carriers
+// before booking, rather than booking with the default carrier and waiting for carrier signals.
+const carrierQuotesChangeID = "CarrierQuotes"
+
+// shipmentSLAsChangeID versions the Shipment workflow from when it loaded the per-status SLAs and
+// escalated shipments which breached them.
+const shipmentSLAsChangeID = "ShipmentSLAs"
+
 // Shipment implements the Shipment workflow.
 func Shipment(ctx workflow.Context, input *ShipmentInput) (*ShipmentResult, error) {
 	wf := new(shipmentImpl)
 
+	// Shipments started before carriers were quoted replay the original booking and carrier signals.
+	wf.unquoted = workflow.GetVersion(ctx, carrierQuotesChangeID, workflow.DefaultVersion, 1) == workflow.DefaultVersion
+
 	if err := wf.setup(ctx, input); err != nil {
 		return nil, err
 	}
 
+	if wf.unquoted {
+		return wf.runUnquoted(ctx, input)
+	}
+
 	return wf.run(ctx, input)
 }
 
@@ -81,30 +270,140 @@ func (s *shipmentImpl) setup(ctx workflow.Context, input *ShipmentInput) error {
 	s.requestorWID = input.RequestorWID
 	s.id = input.ID
 	s.status = ShipmentStatusPending
+	s.seen = make(map[string]bool)
+
+	if input.State != nil {
+		s.quote = input.State.Quote
+		s.booking = input.State.Booking
+		for _, e := range input.State.Events {
+			s.addEvent(e)
+		}
+		s.runEvents = 0
+		s.statusSince = input.State.StatusSince
+		s.escalations = input.State.Escalations
+		s.cancellation = input.State.Cancellation
+	}
 
 	s.logger = log.With(
 		workflow.GetLogger(ctx),
 		"shipmentId", s.id,
 	)
 
+	err := workflow.SetUpdateHandlerWithOptions(ctx, ShipmentCarrierStatusUpdateName,
+		func(ctx workflow.Context, update ShipmentCarrierUpdateSignal) error {
+			if s.duplicateEvent(update.EventID) {
+				return nil
+			}
+			// Updates are still applied once cancellation of the shipment has been refused.
+			ctx, _ = workflow.NewDisconnectedContext(ctx)
+			return s.applyCarrierUpdate(ctx, update)
+		},
+		workflow.UpdateHandlerOptions{
+			Validator: func(update ShipmentCarrierUpdateSignal) error {
+				if s.unquoted {
+					return temporal.NewApplicationError("shipment only accepts carrier updates as signals", CarrierStatusUpdateUnsupportedErrorType)
+				}
+				if s.duplicateEvent(update.EventID) {
+					return nil
+				}
+				return validateTransition(s.status, update.Status)
+			},
+		},
+	)
+	if err != nil {
+		return err
+	}
+
 	return workflow.SetQueryHandler(ctx, StatusQuery, func() (*ShipmentStatus, error) {
 		return &ShipmentStatus{
-			ID:        s.id,
-			Status:    s.status,
-			UpdatedAt: s.updatedAt,
-			Items:     input.Items,
+			ID:               s.id,
+			Status:           s.status,
+			UpdatedAt:        s.updatedAt,
+			Location:         s.location,
+			Events:           s.events,
+			DueAt:            s.dueAt(),
+			Escalations:      s.escalations,
+			Cancellation:     s.cancellation,
+			Items:            input.Items,
+			Destination:      input.Destination,
+			Origin:           input.Origin,
+			Carrier:          s.booking.Carrier,
+			CourierReference: s.booking.CourierReference,
+			TrackingURL:      s.booking.TrackingURL,
+			Quote:            s.quote,
 		}, nil
 	})
 }
 
 func (s *shipmentImpl) run(ctx workflow.Context, input *ShipmentInput) (*ShipmentResult, error) {
+	// Cancellation is only honoured before the shipment is dispatched, so the shipment carries on
+	// in a context which is not cancelled, and handles the request once it has been booked.
+	workflow.Go(ctx, s.watchCancellation)
+	ctx, _ = workflow.NewDisconnectedContext(ctx)
+
 	ctx = workflow.WithActivityOptions(ctx,
 		workflow.ActivityOptions{
 			StartToCloseTimeout: 5 * time.Second,
 		},
 	)
 
-	var result BookShipmentResult
+	// Shipments started before SLAs were kept have none, so are never escalated.
+	if workflow.GetVersion(ctx, shipmentSLAsChangeID, workflow.DefaultVersion, 1) != workflow.DefaultVersion {
+		lctx := workflow.WithLocalActivityOptions(ctx, workflow.LocalActivityOptions{
+			ScheduleToCloseTimeout: 5 * time.Second,
+		})
+		if err := workflow.ExecuteLocalActivity(lctx, a.ShipmentSLAs).Get(ctx, &s.slas); err != nil {
+			return nil, err
+		}
+	}
+
+	if input.State == nil {
+		if err := s.book(ctx, input); err != nil {
+			return nil, err
+		}
+	} else {
+		for _, signal := range input.State.Pending {
+			s.handleCarrierSignal(ctx, signal)
+		}
+	}
+
+	workflow.Go(ctx, s.handleCarrierSignals)
+
+	for {
+		if err := s.awaitCompletion(ctx); err != nil {
+			return nil, err
+		}
+		if !s.cancelRequested {
+			break
+		}
+		if s.cancel(ctx) {
+			return nil, temporal.NewCanceledError()
+		}
+	}
+
+	if !isTerminal(s.status) {
+		return nil, s.continueAsNew(ctx, input)
+	}
+
+	if s.status != ShipmentStatusDelivered {
+		return nil, temporal.NewNonRetryableApplicationError(fmt.Sprintf("shipment %s", s.status), ShipmentFailedErrorType, nil)
+	}
+
+	return &ShipmentResult{
+		Carrier:          s.booking.Carrier,
+		CourierReference: s.booking.CourierReference,
+		TrackingURL:      s.booking.TrackingURL,
+	}, nil
+}
+
+// runUnquoted is the Shipment workflow as it was before carriers were quoted. It is kept for shipments
+// started by an earlier version of the workflow, and may be removed once none are running.
+func (s *shipmentImpl) runUnquoted(ctx workflow.Context, input *ShipmentInput) (*ShipmentResult, error) {
+	ctx = workflow.WithActivityOptions(ctx,
+		workflow.ActivityOptions{
+			StartToCloseTimeout: 5 * time.Second,
+		},
+	)
 
 	err := workflow.ExecuteActivity(ctx,
 		a.BookShipment,
@@ -112,48 +411,325 @@ func (s *shipmentImpl) run(ctx workflow.Context, input *ShipmentInput) (*Shipmen
 			Reference: s.id,
 			Items:     input.Items,
 		},
-	).Get(ctx, &result)
+	).Get(ctx, &s.booking)
 	if err != nil {
 		return nil, err
 	}
 
-	s.updateStatus(ctx, ShipmentStatusBooked)
+	s.updateStatusUnquoted(ctx, ShipmentStatusBooked)
 
-	err = s.handleCarrierUpdates(ctx)
+	ch := workflow.GetSignalChannel(ctx, ShipmentCarrierUpdateSignalName)
+
+	for s.status != ShipmentStatusDelivered {
+		var signal ShipmentCarrierUpdateSignal
+		ch.Receive(ctx, &signal)
+
+		s.logger.Info("Received carrier update", "status", signal.Status)
+
+		s.updateStatusUnquoted(ctx, signal.Status)
+	}
 
 	return &ShipmentResult{
-		CourierReference: result.CourierReference,
-	}, err
+		Carrier:          s.booking.Carrier,
+		CourierReference: s.booking.CourierReference,
+		TrackingURL:      s.booking.TrackingURL,
+	}, nil
+}
+
+// updateStatusUnquoted moves a shipment started before carriers were quoted to a status, notifying the
+// requestor and recording the status even if it has not changed, as the workflow did then.
+func (s *shipmentImpl) updateStatusUnquoted(ctx workflow.Context, status string) error {
+	event := TrackingEvent{Status: status, Timestamp: workflow.Now(ctx)}
+	s.addEvent(event)
+
+	if err := s.notifyRequestor(ctx, &event, nil); err != nil {
+		return fmt.Errorf("failed to notify requestor of status: %w", err)
+	}
+
+	return s.recordStatus(ctx)
+}
+
+// book chooses a carrier for the shipment and books it.
+func (s *shipmentImpl) book(ctx workflow.Context, input *ShipmentInput) error {
+	quote, err := s.chooseCarrier(ctx, input)
+	if err != nil {
+		return err
+	}
+	s.quote = quote
+
+	err = workflow.ExecuteActivity(ctx,
+		a.BookShipment,
+		BookShipmentInput{
+			Reference:   s.id,
+			Location:    input.Location,
+			Destination: input.Destination,
+			Origin:      input.Origin,
+			Items:       input.Items,
+			Carrier:     quote.Carrier,
+			Service:     quote.Service,
+		},
+	).Get(ctx, &s.booking)
+	if err != nil {
+		return err
+	}
+
+	s.logger.Info("Shipment booked", "carrier", s.booking.Carrier, "courierReference", s.booking.CourierReference)
+
+	s.updateStatus(ctx, TrackingEvent{Status: ShipmentStatusBooked, Timestamp: workflow.Now(ctx)})
+
+	return nil
+}
+
+func (s *shipmentImpl) shouldContinueAsNew(ctx workflow.Context) bool {
+	return s.runEvents >= maxTrackingEventsPerRun || workflow.GetInfo(ctx).GetContinueAsNewSuggested()
 }
 
-func (s *shipmentImpl) handleCarrierUpdates(ctx workflow.Context) error {
+// continueAsNew carries the shipment's timeline, and any carrier signals not yet received, into a new run.
+func (s *shipmentImpl) continueAsNew(ctx workflow.Context, input *ShipmentInput) error {
+	state := &ShipmentState{
+		Quote:   s.quote,
+		Booking: s.booking,
+		Events:  s.events,
+
+		StatusSince: s.statusSince,
+		Escalations: s.escalations,
+
+		Cancellation: s.cancellation,
+	}
+
 	ch := workflow.GetSignalChannel(ctx, ShipmentCarrierUpdateSignalName)
+	for {
+		var signal ShipmentCarrierUpdateSignal
+		if !ch.ReceiveAsync(&signal) {
+			break
+		}
+		state.Pending = append(state.Pending, signal)
+	}
 
-	var signal ShipmentCarrierUpdateSignal
+	s.logger.Info("Continuing as new", "events", len(s.events), "pending", len(state.Pending))
 
-	for s.status != ShipmentStatusDelivered {
+	next := *input
+	next.State = state
+
+	return workflow.NewContinueAsNewError(ctx, Shipment, &next)
+}
+
+// chooseCarrier requests quotes from each of the warehouse's carriers in parallel and chooses one by policy.
+// Carriers which fail to quote are not considered.
+func (s *shipmentImpl) chooseCarrier(ctx workflow.Context, input *ShipmentInput) (*CarrierQuote, error) {
+	var carriers []string
+
+	lctx := workflow.WithLocalActivityOptions(ctx, workflow.LocalActivityOptions{
+		ScheduleToCloseTimeout: 5 * time.Second,
+	})
+	if err := workflow.ExecuteLocalActivity(lctx, a.ShipmentCarriers, input.Location).Get(ctx, &carriers); err != nil {
+		return nil, err
+	}
+
+	futures := make([]workflow.Future, len(carriers))
+	for i, carrier := range carriers {
+		futures[i] = workflow.ExecuteActivity(ctx,
+			a.QuoteShipment,
+			QuoteShipmentInput{
+				Carrier:     carrier,
+				Reference:   s.id,
+				Location:    input.Location,
+				Destination: input.Destination,
+				Origin:      input.Origin,
+				Items:       input.Items,
+			},
+		)
+	}
+
+	var quotes []CarrierQuote
+	var lastErr error
+	for i, f := range futures {
+		var q []CarrierQuote
+		if err := f.Get(ctx, &q); err != nil {
+			s.logger.Warn("Carrier failed to quote", "carrier", carriers[i], "error", err)
+			lastErr = err
+			continue
+		}
+		quotes = append(quotes, q...)
+	}
+
+	quote := chooseQuote(quotes, input.Policy)
+	if quote == nil {
+		if lastErr != nil {
+			return nil, fmt.Errorf("no carrier quoted for shipment: %w", lastErr)
+		}
+		return nil, fmt.Errorf("no carrier quoted for shipment from %q", input.Location)
+	}
+
+	s.logger.Info("Carrier chosen", "policy", input.Policy, "carrier", quote.Carrier, "service", quote.Service, "price", quote.Price)
+
+	return quote, nil
+}
+
+// chooseQuote returns the cheapest quote, or for the express policy the quote with the earliest delivery.
+// Ties are broken by the other measure, then by carrier and service so that the choice is deterministic.
+func chooseQuote(quotes []CarrierQuote, policy string) *CarrierQuote {
+	better := func(x, y *CarrierQuote) bool {
+		if policy == ShippingPolicyExpress {
+			if x.EstimatedDays != y.EstimatedDays {
+				return x.EstimatedDays < y.EstimatedDays
+			}
+			if x.Price != y.Price {
+				return x.Price < y.Price
+			}
+		} else {
+			if x.Price != y.Price {
+				return x.Price < y.Price
+			}
+			if x.EstimatedDays != y.EstimatedDays {
+				return x.EstimatedDays < y.EstimatedDays
+			}
+		}
+		if x.Carrier != y.Carrier {
+			return x.Carrier < y.Carrier
+		}
+		return x.Service < y.Service
+	}
+
+	var best *CarrierQuote
+	for i := range quotes {
+		if best == nil || better(&quotes[i], best) {
+			best = &quotes[i]
+		}
+	}
+
+	return best
+}
+
+// handleCarrierSignals applies carrier updates sent as signals, which cannot be rejected so
+// are ignored if they are invalid.
+func (s *shipmentImpl) handleCarrierSignals(ctx workflow.Context) {
+	ch := workflow.GetSignalChannel(ctx, ShipmentCarrierUpdateSignalName)
+
+	for {
+		var signal ShipmentCarrierUpdateSignal
 		ch.Receive(ctx, &signal)
 
-		s.logger.Info("Received carrier update", "status", signal.Status)
+		s.handleCarrierSignal(ctx, signal)
+	}
+}
+
+func (s *shipmentImpl) handleCarrierSignal(ctx workflow.Context, signal ShipmentCarrierUpdateSignal) {
+	if s.duplicateEvent(signal.EventID) {
+		s.logger.Info("Ignoring duplicate carrier event", "eventId", signal.EventID)
+		return
+	}
+
+	if err := validateTransition(s.status, signal.Status); err != nil {
+		// The event is not recorded as received, so that a corrected redelivery is still applied.
+		s.logger.Warn("Ignoring invalid carrier update", "status", signal.Status, "eventId", signal.EventID, "error", err)
+		return
+	}
+
+	_ = s.applyCarrierUpdate(ctx, signal)
+}
+
+// duplicateEvent reports whether a carrier event has already been received.
+// Updates without an event ID are never duplicates.
+func (s *shipmentImpl) duplicateEvent(eventID string) bool {
+	return eventID != "" && s.seen[eventID]
+}
+
+// applyCarrierUpdate adds a validated carrier update to the shipment's timeline.
+// Updates which repeat the current status with nothing else to report are ignored.
+func (s *shipmentImpl) applyCarrierUpdate(ctx workflow.Context, update ShipmentCarrierUpdateSignal) error {
+	if update.Status == s.status && update.EventID == "" && update.Location == "" && update.Note == "" {
+		return nil
+	}
+
+	s.logger.Info("Received carrier update", "status", update.Status, "eventId", update.EventID, "location", update.Location)
+
+	s.updating++
+	defer func() { s.updating-- }()
+
+	// Carriers report when an event happened, which may be some time before it is received.
+	event := TrackingEvent{
+		Status:    update.Status,
+		Timestamp: update.Timestamp,
+		Location:  update.Location,
+		Note:      update.Note,
+		EventID:   update.EventID,
+	}
+	if event.Timestamp.IsZero() {
+		event.Timestamp = workflow.Now(ctx)
+	}
 
-		s.updateStatus(ctx, signal.Status)
+	// The update has been accepted even if it could not be recorded.
+	if err := s.updateStatus(ctx, event); err != nil {
+		s.logger.Warn("Failed to record carrier update", "status", update.Status, "error", err)
 	}
 
 	return nil
 }
 
-func (s *shipmentImpl) updateStatus(ctx workflow.Context, status string) error {
-	s.status = status
-	s.updatedAt = workflow.Now(ctx)
+// addEvent adds an event to the shipment's timeline, moving the shipment to the event's status.
+// An event for the current status which is older than the latest has arrived out of order, so is
+// placed in the timeline by its timestamp and does not change where the shipment is.
+func (s *shipmentImpl) addEvent(event TrackingEvent) {
+	if event.Status == s.status && event.Timestamp.Before(s.updatedAt) {
+		i := len(s.events)
+		for i > 0 && s.events[i-1].Status == event.Status && s.events[i-1].Timestamp.After(event.Timestamp) {
+			i--
+		}
+		s.events = slices.Insert(s.events, i, event)
+		s.runEvents++
+		if event.EventID != "" {
+			s.seen[event.EventID] = true
+		}
+		return
+	}
+
+	s.events = append(s.events, event)
+	s.runEvents++
 
-	if err := s.notifyRequestorOfStatus(ctx); err != nil {
+	s.status = event.Status
+	s.updatedAt = event.Timestamp
+	if event.Location != "" {
+		s.location = event.Location
+	}
+	if event.EventID != "" {
+		s.seen[event.EventID] = true
+	}
+}
+
+// updateStatus adds an event to the shipment's timeline, notifying the requestor and recording
+// any change of status in the database.
+func (s *shipmentImpl) updateStatus(ctx workflow.Context, event TrackingEvent) error {
+	changed := event.Status != s.status
+
+	s.addEvent(event)
+	if changed {
+		s.statusSince = workflow.Now(ctx)
+	}
+
+	if err := s.notifyRequestor(ctx, &event, nil); err != nil {
 		return fmt.Errorf("failed to notify requestor of status: %w", err)
 	}
 
+	if !changed {
+		return nil
+	}
+
+	return s.recordStatus(ctx)
+}
+
+// recordStatus records the shipment's status, and its SLA, in the database.
+func (s *shipmentImpl) recordStatus(ctx workflow.Context) error {
 	update := &ShipmentStatusUpdate{
 		ID:     s.id,
 		Status: s.status,
 	}
+	if dueAt, ok := s.slaDueAt(); ok {
+		update.DueAt = dueAt
+	}
+	if s.escalated() {
+		update.EscalatedAt = s.escalations[len(s.escalations)-1].RaisedAt
+	}
 
 	ctx = workflow.WithLocalActivityOptions(ctx, workflow.LocalActivityOptions{
 		ScheduleToCloseTimeout: 5 * time.Second,
@@ -161,14 +737,20 @@ func (s *shipmentImpl) updateStatus(ctx workflow.Context, status string) error {
 	return workflow.ExecuteLocalActivity(ctx, a.UpdateShipmentStatus, update).Get(ctx, nil)
 }
 
-func (s *shipmentImpl) notifyRequestorOfStatus(ctx workflow.Context) error {
+func (s *shipmentImpl) notifyRequestor(ctx workflow.Context, event *TrackingEvent, escalation *Escalation) error {
 	return workflow.SignalExternalWorkflow(ctx,
 		s.requestorWID, "",
 		ShipmentStatusUpdatedSignalName,
 		ShipmentStatusUpdatedSignal{
-			ShipmentID: s.id,
-			Status:     s.status,
-			UpdatedAt:  s.updatedAt,
+			ShipmentID:       s.id,
+			Status:           s.status,
+			UpdatedAt:        s.updatedAt,
+			Carrier:          s.booking.Carrier,
+			CourierReference: s.booking.CourierReference,
+			TrackingURL:      s.booking.TrackingURL,
+			Event:            event,
+			Escalation:       escalation,
+			Cancellation:     s.cancellation,
 		},
 	).Get(ctx, nil)
 }
@@ -1,13 +1,19 @@
 package shipment_test
 
 import (
+	"context"
+	"fmt"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
 	"github.com/temporalio/reference-app-orders-go/app/shipment"
+	"go.temporal.io/sdk/converter"
+	"go.temporal.io/sdk/temporal"
 	"go.temporal.io/sdk/testsuite"
+	"go.temporal.io/sdk/workflow"
 )
 
 func TestShipmentWorkflow(t *testing.T) {
@@ -24,6 +30,7 @@ func TestShipmentWorkflow(t *testing.T) {
 		},
 	}
 
+	env.RegisterActivity(a.QuoteShipment)
 	env.RegisterActivity(a.BookShipment)
 
 	env.RegisterDelayedCallback(func() {
@@ -76,4 +83,602 @@ func TestShipmentWorkflow(t *testing.T) {
 	var result shipment.ShipmentResult
 	err := env.GetWorkflowResult(&result)
 	assert.NoError(t, err)
+	assert.Equal(t, shipment.SimulatorCarrierName, result.Carrier)
+	assert.NotEmpty(t, result.CourierReference)
+	assert.NotEmpty(t, result.TrackingURL)
+}
+
+// quotingCarrier is a carrier which offers fixed quotes.
+type quotingCarrier struct {
+	shipment.SimulatorCarrier
+	name   string
+	quotes []shipment.CarrierQuote
+	err    error
+}
+
+func (c *quotingCarrier) Name() string {
+	return c.name
+}
+
+func (c *quotingCarrier) Quote(context.Context, *shipment.CarrierRequest) ([]shipment.CarrierQuote, error) {
+	return c.quotes, c.err
+}
+
+func (c *quotingCarrier) Book(_ context.Context, request *shipment.CarrierBookingRequest) (*shipment.CarrierBooking, error) {
+	return &shipment.CarrierBooking{
+		Carrier:          c.name,
+		Service:          request.Service,
+		CourierReference: c.name + ":" + request.Reference,
+		TrackingURL:      "https://tracking.example.com/" + c.name,
+	}, nil
+}
+
+func TestShipmentWorkflowUnquoted(t *testing.T) {
+	s := testsuite.WorkflowTestSuite{}
+	env := s.NewTestWorkflowEnvironment()
+	var a *shipment.Activities
+
+	env.OnGetVersion("CarrierQuotes", workflow.DefaultVersion, 1).Return(workflow.DefaultVersion)
+
+	// Shipments started before carriers were quoted book straight away with the default carrier.
+	var booked *shipment.BookShipmentInput
+	env.OnActivity(a.BookShipment, mock.Anything, mock.Anything).Return(func(ctx context.Context, input *shipment.BookShipmentInput) (*shipment.BookShipmentResult, error) {
+		booked = input
+		return &shipment.BookShipmentResult{Carrier: shipment.SimulatorCarrierName, CourierReference: "SIM-1"}, nil
+	}).Once()
+	env.OnActivity(a.UpdateShipmentStatus, mock.Anything, mock.Anything).Return(nil)
+
+	var statuses []string
+	env.OnSignalExternalWorkflow(mock.Anything, "parentwid", "", shipment.ShipmentStatusUpdatedSignalName, mock.Anything).Return(
+		func(_ string, _ string, _ string, _ string, arg interface{}) error {
+			statuses = append(statuses, arg.(shipment.ShipmentStatusUpdatedSignal).Status)
+			return nil
+		},
+	)
+
+	env.RegisterDelayedCallback(func() {
+		env.SignalWorkflow(shipment.ShipmentCarrierUpdateSignalName, shipment.ShipmentCarrierUpdateSignal{Status: shipment.ShipmentStatusDispatched})
+		env.SignalWorkflow(shipment.ShipmentCarrierUpdateSignalName, shipment.ShipmentCarrierUpdateSignal{Status: shipment.ShipmentStatusDispatched})
+	}, time.Second)
+
+	// Carrier status updates are rejected, so that they are sent as signals instead.
+	unsupported := &updateCallbacks{}
+	env.RegisterDelayedCallback(func() {
+		env.UpdateWorkflow(shipment.ShipmentCarrierStatusUpdateName, "update", unsupported, shipment.ShipmentCarrierUpdateSignal{Status: shipment.ShipmentStatusDelivered})
+	}, time.Second+time.Millisecond)
+
+	env.RegisterDelayedCallback(func() {
+		env.SignalWorkflow(shipment.ShipmentCarrierUpdateSignalName, shipment.ShipmentCarrierUpdateSignal{Status: shipment.ShipmentStatusDelivered})
+	}, 2*time.Second)
+
+	env.ExecuteWorkflow(shipment.Shipment, &shipment.ShipmentInput{
+		RequestorWID: "parentwid",
+		ID:           "test",
+		Items:        []shipment.Item{{SKU: "test1", Quantity: 1}},
+		Location:     "Warehouse A",
+	})
+
+	var appErr *temporal.ApplicationError
+	require.ErrorAs(t, unsupported.rejected, &appErr)
+	assert.Equal(t, shipment.CarrierStatusUpdateUnsupportedErrorType, appErr.Type())
+
+	require.True(t, env.IsWorkflowCompleted())
+	require.NoError(t, env.GetWorkflowError())
+
+	var result shipment.ShipmentResult
+	require.NoError(t, env.GetWorkflowResult(&result))
+	assert.Equal(t, "SIM-1", result.CourierReference)
+
+	require.NotNil(t, booked)
+	assert.Empty(t, booked.Carrier)
+	assert.Empty(t, booked.Location)
+
+	// Every carrier signal is applied and recorded, as it was before updates were validated.
+	assert.Equal(t, []string{
+		shipment.ShipmentStatusBooked,
+		shipment.ShipmentStatusDispatched,
+		shipment.ShipmentStatusDispatched,
+		shipment.ShipmentStatusDelivered,
+	}, statuses)
+	env.AssertNumberOfCalls(t, "UpdateShipmentStatus", 4)
+	env.AssertExpectations(t)
+}
+
+func TestShipmentWorkflowChoosesCarrier(t *testing.T) {
+	tests := []struct {
+		policy  string
+		carrier string
+		service string
+	}{
+		{policy: "", carrier: "cheap", service: shipment.CarrierServiceStandard},
+		{policy: shipment.ShippingPolicyEconomy, carrier: "cheap", service: shipment.CarrierServiceStandard},
+		{policy: shipment.ShippingPolicyExpress, carrier: "fast", service: shipment.CarrierServiceExpress},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.policy, func(t *testing.T) {
+			s := testsuite.WorkflowTestSuite{}
+			env := s.NewTestWorkflowEnvironment()
+
+			a := &shipment.Activities{
+				Carriers: map[string]shipment.Carrier{
+					"cheap": &quotingCarrier{name: "cheap", quotes: []shipment.CarrierQuote{
+						{Carrier: "cheap", Service: shipment.CarrierServiceStandard, Price: 400, EstimatedDays: 5},
+					}},
+					"fast": &quotingCarrier{name: "fast", quotes: []shipment.CarrierQuote{
+						{Carrier: "fast", Service: shipment.CarrierServiceStandard, Price: 600, EstimatedDays: 2},
+						{Carrier: "fast", Service: shipment.CarrierServiceExpress, Price: 1200, EstimatedDays: 1},
+					}},
+					"broken": &quotingCarrier{name: "broken", err: &shipment.CarrierError{
+						Carrier: "broken", Code: shipment.CarrierErrorCodeInvalidRequest, Message: "no service",
+					}},
+				},
+			}
+
+			env.RegisterActivity(a)
+
+			env.OnSignalExternalWorkflow(mock.Anything, "parentwid", "", shipment.ShipmentStatusUpdatedSignalName, mock.Anything).Return(nil)
+
+			env.RegisterDelayedCallback(func() {
+				env.SignalWorkflow(
+					shipment.ShipmentCarrierUpdateSignalName,
+					shipment.ShipmentCarrierUpdateSignal{Status: shipment.ShipmentStatusDispatched},
+				)
+				env.SignalWorkflow(
+					shipment.ShipmentCarrierUpdateSignalName,
+					shipment.ShipmentCarrierUpdateSignal{Status: shipment.ShipmentStatusDelivered},
+				)
+			}, time.Second)
+
+			env.ExecuteWorkflow(shipment.Shipment, &shipment.ShipmentInput{
+				RequestorWID: "parentwid",
+				ID:           "test",
+				Items:        []shipment.Item{{SKU: "test1", Quantity: 1}},
+				Location:     "Warehouse A",
+				Policy:       tc.policy,
+			})
+
+			var result shipment.ShipmentResult
+			require.NoError(t, env.GetWorkflowResult(&result))
+			assert.Equal(t, tc.carrier, result.Carrier)
+			assert.Equal(t, tc.carrier+":test", result.CourierReference)
+
+			q, err := env.QueryWorkflow(shipment.StatusQuery)
+			require.NoError(t, err)
+
+			var status shipment.ShipmentStatus
+			require.NoError(t, q.Get(&status))
+			require.NotNil(t, status.Quote)
+			assert.Equal(t, tc.carrier, status.Quote.Carrier)
+			assert.Equal(t, tc.service, status.Quote.Service)
+		})
+	}
+}
+
+// updateCallbacks records the outcome of a workflow update.
+type updateCallbacks struct {
+	rejected  error
+	completed bool
+	err       error
+}
+
+func (u *updateCallbacks) Accept() {}
+
+func (u *updateCallbacks) Reject(err error) {
+	u.rejected = err
+}
+
+func (u *updateCallbacks) Complete(_ interface{}, err error) {
+	u.completed = true
+	u.err = err
+}
+
+func TestShipmentWorkflowCarrierUpdates(t *testing.T) {
+	s := testsuite.WorkflowTestSuite{}
+	env := s.NewTestWorkflowEnvironment()
+	a := &shipment.Activities{}
+
+	env.RegisterActivity(a.QuoteShipment)
+	env.RegisterActivity(a.BookShipment)
+
+	var statuses []string
+	env.OnSignalExternalWorkflow(mock.Anything, "parentwid", "", shipment.ShipmentStatusUpdatedSignalName, mock.Anything).Return(
+		func(_ string, _ string, _ string, _ string, arg interface{}) error {
+			statuses = append(statuses, arg.(shipment.ShipmentStatusUpdatedSignal).Status)
+			return nil
+		},
+	)
+
+	update := func(status string) *updateCallbacks {
+		uc := &updateCallbacks{}
+		env.UpdateWorkflow(shipment.ShipmentCarrierStatusUpdateName, status, uc, shipment.ShipmentCarrierUpdateSignal{Status: status})
+		return uc
+	}
+
+	var unknown, backwards, dispatched, repeated *updateCallbacks
+
+	env.RegisterDelayedCallback(func() {
+		unknown = update("teleported")
+		backwards = update(shipment.ShipmentStatusPending)
+		dispatched = update(shipment.ShipmentStatusDispatched)
+		repeated = update(shipment.ShipmentStatusDispatched)
+	}, time.Second)
+
+	env.RegisterDelayedCallback(func() {
+		// Signals cannot be rejected, so invalid statuses are ignored.
+		env.SignalWorkflow(shipment.ShipmentCarrierUpdateSignalName, shipment.ShipmentCarrierUpdateSignal{Status: shipment.ShipmentStatusBooked})
+		env.SignalWorkflow(shipment.ShipmentCarrierUpdateSignalName, shipment.ShipmentCarrierUpdateSignal{Status: shipment.ShipmentStatusLost})
+	}, 2*time.Second)
+
+	env.ExecuteWorkflow(shipment.Shipment, &shipment.ShipmentInput{
+		RequestorWID: "parentwid",
+		ID:           "test",
+		Items:        []shipment.Item{{SKU: "test1", Quantity: 1}},
+	})
+
+	var appErr *temporal.ApplicationError
+
+	require.ErrorAs(t, unknown.rejected, &appErr)
+	assert.Equal(t, shipment.InvalidShipmentStatusErrorType, appErr.Type())
+
+	require.ErrorAs(t, backwards.rejected, &appErr)
+	assert.Equal(t, shipment.InvalidShipmentTransitionErrorType, appErr.Type())
+
+	assert.NoError(t, dispatched.rejected)
+	assert.True(t, dispatched.completed)
+	assert.NoError(t, dispatched.err)
+
+	assert.NoError(t, repeated.rejected, "repeating the current status is allowed")
+
+	err := env.GetWorkflowError()
+	require.ErrorAs(t, err, &appErr)
+	assert.Equal(t, shipment.ShipmentFailedErrorType, appErr.Type())
+
+	assert.Equal(t, []string{shipment.ShipmentStatusBooked, shipment.ShipmentStatusDispatched, shipment.ShipmentStatusLost}, statuses)
+}
+
+func TestShipmentWorkflowDeliveredWithoutDispatch(t *testing.T) {
+	s := testsuite.WorkflowTestSuite{}
+	env := s.NewTestWorkflowEnvironment()
+	a := &shipment.Activities{}
+
+	env.RegisterActivity(a.QuoteShipment)
+	env.RegisterActivity(a.BookShipment)
+
+	var statuses []string
+	env.OnSignalExternalWorkflow(mock.Anything, "parentwid", "", shipment.ShipmentStatusUpdatedSignalName, mock.Anything).Return(
+		func(_ string, _ string, _ string, _ string, arg interface{}) error {
+			statuses = append(statuses, arg.(shipment.ShipmentStatusUpdatedSignal).Status)
+			return nil
+		},
+	)
+
+	delivered := &updateCallbacks{}
+	env.RegisterDelayedCallback(func() {
+		// The carrier did not report collecting the shipment.
+		env.UpdateWorkflow(shipment.ShipmentCarrierStatusUpdateName, "delivered", delivered, shipment.ShipmentCarrierUpdateSignal{Status: shipment.ShipmentStatusDelivered})
+	}, time.Second)
+
+	env.ExecuteWorkflow(shipment.Shipment, &shipment.ShipmentInput{
+		RequestorWID: "parentwid",
+		ID:           "test",
+		Items:        []shipment.Item{{SKU: "test1", Quantity: 1}},
+	})
+
+	require.NoError(t, delivered.rejected)
+	require.True(t, delivered.completed)
+	require.NoError(t, env.GetWorkflowError())
+
+	assert.Equal(t, []string{shipment.ShipmentStatusBooked, shipment.ShipmentStatusDelivered}, statuses)
+}
+
+func TestShipmentWorkflowCarrierEvents(t *testing.T) {
+	s := testsuite.WorkflowTestSuite{}
+	env := s.NewTestWorkflowEnvironment()
+	a := &shipment.Activities{}
+
+	env.RegisterActivity(a.QuoteShipment)
+	env.RegisterActivity(a.BookShipment)
+
+	var updates []shipment.ShipmentStatusUpdatedSignal
+	env.OnSignalExternalWorkflow(mock.Anything, "parentwid", "", shipment.ShipmentStatusUpdatedSignalName, mock.Anything).Return(
+		func(_ string, _ string, _ string, _ string, arg interface{}) error {
+			updates = append(updates, arg.(shipment.ShipmentStatusUpdatedSignal))
+			return nil
+		},
+	)
+
+	pickedUp := time.Date(2024, 6, 1, 9, 30, 0, 0, time.UTC)
+
+	event := func(id string, status string, location string) shipment.ShipmentCarrierUpdateSignal {
+		return shipment.ShipmentCarrierUpdateSignal{Status: status, EventID: id, Timestamp: pickedUp, Location: location}
+	}
+
+	var status shipment.ShipmentStatus
+
+	env.RegisterDelayedCallback(func() {
+		env.SignalWorkflow(shipment.ShipmentCarrierUpdateSignalName, event("evt-1", shipment.ShipmentStatusDispatched, "Leeds"))
+		env.SignalWorkflow(shipment.ShipmentCarrierUpdateSignalName, event("evt-2", shipment.ShipmentStatusDispatched, "York"))
+		// A redelivered event is ignored, so does not move the shipment back to Leeds.
+		env.SignalWorkflow(shipment.ShipmentCarrierUpdateSignalName, event("evt-1", shipment.ShipmentStatusDispatched, "Leeds"))
+	}, time.Second)
+
+	env.RegisterDelayedCallback(func() {
+		v, err := env.QueryWorkflow(shipment.StatusQuery)
+		require.NoError(t, err)
+		require.NoError(t, v.Get(&status))
+
+		env.SignalWorkflow(shipment.ShipmentCarrierUpdateSignalName, event("evt-3", shipment.ShipmentStatusDelivered, "York"))
+		// A duplicate which is no longer a valid transition is ignored rather than logged as invalid.
+		env.SignalWorkflow(shipment.ShipmentCarrierUpdateSignalName, event("evt-2", shipment.ShipmentStatusDispatched, "York"))
+	}, time.Minute)
+
+	env.ExecuteWorkflow(shipment.Shipment, &shipment.ShipmentInput{
+		RequestorWID: "parentwid",
+		ID:           "test",
+		Items:        []shipment.Item{{SKU: "test1", Quantity: 1}},
+	})
+
+	require.True(t, env.IsWorkflowCompleted())
+	require.NoError(t, env.GetWorkflowError())
+
+	assert.Equal(t, shipment.ShipmentStatusDispatched, status.Status)
+	assert.Equal(t, "York", status.Location)
+	assert.Equal(t, pickedUp, status.UpdatedAt, "the status is dated by the carrier event")
+
+	require.Len(t, status.Events, 3)
+	assert.Equal(t, shipment.ShipmentStatusBooked, status.Events[0].Status)
+	assert.Equal(t, shipment.TrackingEvent{Status: shipment.ShipmentStatusDispatched, Timestamp: pickedUp, Location: "Leeds", EventID: "evt-1"}, status.Events[1])
+	assert.Equal(t, "York", status.Events[2].Location, "events which do not change the status are added to the timeline")
+
+	// The requestor is notified of every event, so that it can show the latest.
+	require.Len(t, updates, 4)
+	assert.Equal(t, shipment.ShipmentStatusDispatched, updates[1].Status)
+	assert.Equal(t, pickedUp, updates[1].UpdatedAt)
+	require.NotNil(t, updates[2].Event)
+	assert.Equal(t, "York", updates[2].Event.Location)
+	assert.Equal(t, shipment.ShipmentStatusDelivered, updates[3].Status)
+}
+
+func TestShipmentWorkflowCarrierEventsOutOfOrder(t *testing.T) {
+	s := testsuite.WorkflowTestSuite{}
+	env := s.NewTestWorkflowEnvironment()
+	a := &shipment.Activities{}
+
+	env.RegisterActivity(a.QuoteShipment)
+	env.RegisterActivity(a.BookShipment)
+
+	env.OnSignalExternalWorkflow(mock.Anything, "parentwid", "", shipment.ShipmentStatusUpdatedSignalName, mock.Anything).Return(nil)
+
+	pickedUp := env.Now().Add(time.Hour)
+
+	event := func(id string, status string, location string, at time.Duration) shipment.ShipmentCarrierUpdateSignal {
+		return shipment.ShipmentCarrierUpdateSignal{Status: status, EventID: id, Timestamp: pickedUp.Add(at), Location: location}
+	}
+
+	var status shipment.ShipmentStatus
+
+	env.RegisterDelayedCallback(func() {
+		// The carrier's events arrive in the reverse of the order they happened.
+		env.SignalWorkflow(shipment.ShipmentCarrierUpdateSignalName, event("evt-3", shipment.ShipmentStatusDispatched, "Darlington", 2*time.Hour))
+		env.SignalWorkflow(shipment.ShipmentCarrierUpdateSignalName, event("evt-2", shipment.ShipmentStatusDispatched, "York", time.Hour))
+		env.SignalWorkflow(shipment.ShipmentCarrierUpdateSignalName, event("evt-1", shipment.ShipmentStatusDispatched, "Leeds", 0))
+		// A rejected event is not recorded as received, so a corrected redelivery is applied.
+		env.SignalWorkflow(shipment.ShipmentCarrierUpdateSignalName, event("evt-4", shipment.ShipmentStatusPending, "Durham", 3*time.Hour))
+		env.SignalWorkflow(shipment.ShipmentCarrierUpdateSignalName, event("evt-4", shipment.ShipmentStatusDispatched, "Durham", 3*time.Hour))
+	}, time.Second)
+
+	env.RegisterDelayedCallback(func() {
+		v, err := env.QueryWorkflow(shipment.StatusQuery)
+		require.NoError(t, err)
+		require.NoError(t, v.Get(&status))
+
+		env.SignalWorkflow(shipment.ShipmentCarrierUpdateSignalName, event("evt-5", shipment.ShipmentStatusDelivered, "Newcastle", 4*time.Hour))
+	}, time.Minute)
+
+	env.ExecuteWorkflow(shipment.Shipment, &shipment.ShipmentInput{
+		RequestorWID: "parentwid",
+		ID:           "test",
+		Items:        []shipment.Item{{SKU: "test1", Quantity: 1}},
+	})
+
+	require.True(t, env.IsWorkflowCompleted())
+	require.NoError(t, env.GetWorkflowError())
+
+	assert.Equal(t, shipment.ShipmentStatusDispatched, status.Status)
+	assert.Equal(t, "Durham", status.Location)
+	assert.True(t, pickedUp.Add(3*time.Hour).Equal(status.UpdatedAt), "the shipment is dated by its latest event")
+
+	var locations []string
+	for _, e := range status.Events[1:] {
+		locations = append(locations, e.Location)
+	}
+	assert.Equal(t, []string{"Leeds", "York", "Darlington", "Durham"}, locations, "events are kept in the order they happened")
+}
+
+func TestShipmentWorkflowContinuesAsNew(t *testing.T) {
+	s := testsuite.WorkflowTestSuite{}
+	env := s.NewTestWorkflowEnvironment()
+	a := &shipment.Activities{}
+
+	env.RegisterActivity(a.QuoteShipment)
+	env.RegisterActivity(a.BookShipment)
+
+	env.OnSignalExternalWorkflow(mock.Anything, "parentwid", "", shipment.ShipmentStatusUpdatedSignalName, mock.Anything).Return(nil)
+
+	env.RegisterDelayedCallback(func() {
+		for i := 0; i < 100; i++ {
+			env.SignalWorkflow(shipment.ShipmentCarrierUpdateSignalName, shipment.ShipmentCarrierUpdateSignal{
+				Status:   shipment.ShipmentStatusDispatched,
+				EventID:  fmt.Sprintf("evt-%d", i),
+				Location: fmt.Sprintf("Depot %d", i),
+			})
+		}
+	}, time.Second)
+
+	input := &shipment.ShipmentInput{
+		RequestorWID: "parentwid",
+		ID:           "test",
+		Items:        []shipment.Item{{SKU: "test1", Quantity: 1}},
+	}
+
+	env.ExecuteWorkflow(shipment.Shipment, input)
+
+	var canErr *workflow.ContinueAsNewError
+	require.ErrorAs(t, env.GetWorkflowError(), &canErr)
+
+	var next shipment.ShipmentInput
+	require.NoError(t, converter.GetDefaultDataConverter().FromPayloads(canErr.Input, &next))
+
+	require.NotNil(t, next.State)
+	assert.Equal(t, input.ID, next.ID)
+	assert.Equal(t, shipment.SimulatorCarrierName, next.State.Booking.Carrier)
+	assert.Equal(t, shipment.ShipmentStatusBooked, next.State.Events[0].Status)
+	// Signals received but not applied before continuing are carried over.
+	assert.Equal(t, 101, len(next.State.Events)+len(next.State.Pending))
+
+	env = s.NewTestWorkflowEnvironment()
+	env.OnSignalExternalWorkflow(mock.Anything, "parentwid", "", shipment.ShipmentStatusUpdatedSignalName, mock.Anything).Return(nil)
+
+	env.RegisterDelayedCallback(func() {
+		// Events from the previous run are still recognised as duplicates.
+		env.SignalWorkflow(shipment.ShipmentCarrierUpdateSignalName, shipment.ShipmentCarrierUpdateSignal{
+			Status:  shipment.ShipmentStatusDispatched,
+			EventID: "evt-0",
+		})
+		env.SignalWorkflow(shipment.ShipmentCarrierUpdateSignalName, shipment.ShipmentCarrierUpdateSignal{
+			Status:  shipment.ShipmentStatusDelivered,
+			EventID: "evt-100",
+		})
+	}, time.Second)
+
+	env.ExecuteWorkflow(shipment.Shipment, &next)
+
+	require.True(t, env.IsWorkflowCompleted())
+	require.NoError(t, env.GetWorkflowError())
+
+	v, err := env.QueryWorkflow(shipment.StatusQuery)
+	require.NoError(t, err)
+
+	var status shipment.ShipmentStatus
+	require.NoError(t, v.Get(&status))
+
+	assert.Equal(t, shipment.ShipmentStatusDelivered, status.Status)
+	assert.Equal(t, "Depot 99", status.Location)
+	assert.Len(t, status.Events, 102)
+	assert.Equal(t, shipment.SimulatorCarrierName, status.Carrier)
+}
+
+func TestShipmentWorkflowWithoutSLAs(t *testing.T) {
+	s := testsuite.WorkflowTestSuite{}
+	env := s.NewTestWorkflowEnvironment()
+	a := &shipment.Activities{
+		SLAs: map[string]time.Duration{shipment.ShipmentStatusBooked: time.Hour},
+	}
+
+	env.OnGetVersion("ShipmentSLAs", workflow.DefaultVersion, 1).Return(workflow.DefaultVersion)
+
+	env.RegisterActivity(a.ShipmentSLAs)
+	env.RegisterActivity(a.QuoteShipment)
+	env.RegisterActivity(a.BookShipment)
+
+	var escalations []shipment.Escalation
+	env.OnSignalExternalWorkflow(mock.Anything, "parentwid", "", shipment.ShipmentStatusUpdatedSignalName, mock.Anything).Return(
+		func(_ string, _ string, _ string, _ string, arg interface{}) error {
+			if e := arg.(shipment.ShipmentStatusUpdatedSignal).Escalation; e != nil {
+				escalations = append(escalations, *e)
+			}
+			return nil
+		},
+	)
+
+	var booked shipment.ShipmentStatus
+	env.RegisterDelayedCallback(func() {
+		v, err := env.QueryWorkflow(shipment.StatusQuery)
+		require.NoError(t, err)
+		require.NoError(t, v.Get(&booked))
+
+		env.SignalWorkflow(shipment.ShipmentCarrierUpdateSignalName, shipment.ShipmentCarrierUpdateSignal{Status: shipment.ShipmentStatusDelivered})
+	}, 3*time.Hour)
+
+	env.ExecuteWorkflow(shipment.Shipment, &shipment.ShipmentInput{
+		RequestorWID: "parentwid",
+		ID:           "test",
+		Items:        []shipment.Item{{SKU: "test1", Quantity: 1}},
+	})
+
+	require.True(t, env.IsWorkflowCompleted())
+	require.NoError(t, env.GetWorkflowError())
+
+	// Shipments started before SLAs were kept do not load them, so are never escalated.
+	assert.Equal(t, shipment.ShipmentStatusBooked, booked.Status)
+	assert.Nil(t, booked.DueAt)
+	assert.Empty(t, escalations)
+}
+
+func TestShipmentWorkflowEscalatesBreachedSLA(t *testing.T) {
+	s := testsuite.WorkflowTestSuite{}
+	env := s.NewTestWorkflowEnvironment()
+	a := &shipment.Activities{
+		SLAs: map[string]time.Duration{shipment.ShipmentStatusBooked: time.Hour},
+	}
+
+	env.RegisterActivity(a.ShipmentSLAs)
+	env.RegisterActivity(a.QuoteShipment)
+	env.RegisterActivity(a.BookShipment)
+
+	var escalations []shipment.Escalation
+	env.OnSignalExternalWorkflow(mock.Anything, "parentwid", "", shipment.ShipmentStatusUpdatedSignalName, mock.Anything).Return(
+		func(_ string, _ string, _ string, _ string, arg interface{}) error {
+			if e := arg.(shipment.ShipmentStatusUpdatedSignal).Escalation; e != nil {
+				escalations = append(escalations, *e)
+			}
+			return nil
+		},
+	)
+
+	var booked, dispatched shipment.ShipmentStatus
+
+	query := func(status *shipment.ShipmentStatus) {
+		v, err := env.QueryWorkflow(shipment.StatusQuery)
+		require.NoError(t, err)
+		require.NoError(t, v.Get(status))
+	}
+
+	env.RegisterDelayedCallback(func() {
+		query(&booked)
+	}, time.Minute)
+
+	env.RegisterDelayedCallback(func() {
+		env.SignalWorkflow(shipment.ShipmentCarrierUpdateSignalName, shipment.ShipmentCarrierUpdateSignal{Status: shipment.ShipmentStatusDispatched})
+	}, 3*time.Hour)
+
+	env.RegisterDelayedCallback(func() {
+		query(&dispatched)
+		env.SignalWorkflow(shipment.ShipmentCarrierUpdateSignalName, shipment.ShipmentCarrierUpdateSignal{Status: shipment.ShipmentStatusDelivered})
+	}, 200*time.Hour)
+
+	start := env.Now()
+
+	env.ExecuteWorkflow(shipment.Shipment, &shipment.ShipmentInput{
+		RequestorWID: "parentwid",
+		ID:           "test",
+		Items:        []shipment.Item{{SKU: "test1", Quantity: 1}},
+	})
+
+	require.True(t, env.IsWorkflowCompleted())
+	require.NoError(t, env.GetWorkflowError())
+
+	require.NotNil(t, booked.DueAt)
+	assert.WithinDuration(t, start.Add(time.Hour), *booked.DueAt, time.Minute)
+	assert.Empty(t, booked.Escalations)
+
+	// The booked SLA was breached once, the dispatched status has no SLA.
+	require.Len(t, escalations, 1)
+	assert.Equal(t, shipment.ShipmentStatusBooked, escalations[0].Status)
+	assert.Equal(t, *booked.DueAt, escalations[0].DueAt)
+	assert.False(t, escalations[0].RaisedAt.Before(escalations[0].DueAt))
+
+	assert.Nil(t, dispatched.DueAt)
+	assert.Equal(t, escalations, dispatched.Escalations)
 }
@@ -20,6 +20,7 @@ import (
 	"github.com/temporalio/reference-app-orders-go/app/config"
 	"github.com/temporalio/reference-app-orders-go/app/db"
 	"github.com/temporalio/reference-app-orders-go/app/fraud"
+	"github.com/temporalio/reference-app-orders-go/app/inventory"
 	"github.com/temporalio/reference-app-orders-go/app/order"
 	"github.com/temporalio/reference-app-orders-go/app/shipment"
 	"github.com/testcontainers/testcontainers-go/modules/mongodb"
@@ -94,11 +95,6 @@ func Test_Order(t *testing.T) {
 
 	logger := slog.Default()
 
-	fraudAPI := httptest.NewServer(fraud.Router(logger))
-	defer fraudAPI.Close()
-	billingAPI := httptest.NewServer(billing.Router(c, logger))
-	defer billingAPI.Close()
-
 	mongoDBContainer, err := mongodb.Run(ctx, "mongo:6")
 	require.NoError(t, err)
 	defer mongoDBContainer.Terminate(ctx)
@@ -109,18 +105,31 @@ func Test_Order(t *testing.T) {
 	uri := fmt.Sprintf("mongodb://localhost:%s", port.Port())
 
 	config := config.AppConfig{
-		MongoURL:   uri,
-		BillingURL: billingAPI.URL,
-		FraudURL:   fraudAPI.URL,
+		MongoURL: uri,
 	}
 
 	db := db.CreateDB(config)
 	require.NoError(t, db.Connect(ctx))
 	require.NoError(t, db.Setup())
 
+	fraudAPI := httptest.NewServer(fraud.Router(db, logger))
+	defer fraudAPI.Close()
+
+	config.FraudURL = fraudAPI.URL
+
+	inventoryAPI := httptest.NewServer(inventory.Router(c, db, logger))
+	defer inventoryAPI.Close()
+
+	config.InventoryURL = inventoryAPI.URL
+
+	billingAPI := httptest.NewServer(billing.Router(c, db, logger))
+	defer billingAPI.Close()
+
+	config.BillingURL = billingAPI.URL
+
 	orderAPI := httptest.NewServer(order.Router(c, db, logger))
 	defer orderAPI.Close()
-	shipmentAPI := httptest.NewServer(shipment.Router(c, db, logger))
+	shipmentAPI := httptest.NewServer(shipment.Router(c, db, logger, nil))
 	defer shipmentAPI.Close()
 
 	config.OrderURL = orderAPI.URL
@@ -179,9 +188,29 @@ func Test_Order(t *testing.T) {
 		if f.Shipment == nil {
 			continue
 		}
-		res, err := postJSON(shipmentAPI.URL+"/shipments/"+f.Shipment.ID+"/status", &shipment.ShipmentCarrierUpdateSignal{Status: "delivered"})
-		require.Equal(t, http.StatusOK, res.StatusCode)
+
+		// Carrier updates are only accepted once the shipment has been booked.
+		assert.EventuallyWithT(t, func(c *assert.CollectT) {
+			var s shipment.ShipmentStatus
+			res, err := getJSON(shipmentAPI.URL+"/shipments/"+f.Shipment.ID, &s)
+			require.NoError(c, err)
+
+			require.Equal(c, http.StatusOK, res.StatusCode)
+			assert.Equal(c, shipment.ShipmentStatusBooked, s.Status)
+			// The order has the default economy shipping policy, so the cheaper of the two
+			// carriers is chosen.
+			assert.Equal(c, shipment.EconomyCarrierName, s.Carrier)
+		}, 3*time.Second, 100*time.Millisecond)
+
+		res, err := postJSON(shipmentAPI.URL+"/shipments/"+f.Shipment.ID+"/status", &shipment.ShipmentCarrierUpdateSignal{Status: "pending"})
 		require.NoError(t, err)
+		require.Equal(t, http.StatusConflict, res.StatusCode, "a booked shipment cannot return to pending")
+
+		for _, status := range []string{shipment.ShipmentStatusDispatched, shipment.ShipmentStatusDelivered} {
+			res, err := postJSON(shipmentAPI.URL+"/shipments/"+f.Shipment.ID+"/status", &shipment.ShipmentCarrierUpdateSignal{Status: status})
+			require.NoError(t, err)
+			require.Equal(t, http.StatusOK, res.StatusCode)
+		}
 	}
 
 	assert.EventuallyWithT(t, func(c *assert.CollectT) {